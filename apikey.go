@@ -0,0 +1,416 @@
+package mnms
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Service accounts are users that can not log in with a password.
+	They call the API with API keys sent as bearer tokens,
+
+		Authorization: Bearer mnms_<id>_<secret>
+
+	A key belongs to a service account and acts with the permissions of
+	its role, narrowed to the scopes of the key when it has any. Only the
+	sha256 hash of the secret is kept, the key is shown once when it is
+	created.
+*/
+
+// APIKeyPrefix starts every API key.
+const APIKeyPrefix = "mnms_"
+
+// apiKeyLastUsedInterval limits how often the last used time of a key is
+// written to the mnms config.
+const apiKeyLastUsedInterval = time.Minute
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// APIKey is a named, scoped key of a service account.
+type APIKey struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	User     string   `json:"user"`
+	Hash     string   `json:"hash,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	Created  int64    `json:"created"`
+	Expires  int64    `json:"expires,omitempty"`
+	LastUsed int64    `json:"lastUsed,omitempty"`
+	Revoked  int64    `json:"revoked,omitempty"`
+}
+
+// Allows reports whether the scopes of the key grant perm.
+func (k *APIKey) Allows(perm string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	scopes := RoleConfig{Permissions: k.Scopes}
+	return scopes.Allows(perm)
+}
+
+func (k *APIKey) active(now time.Time) bool {
+	return k.Revoked == 0 && (k.Expires == 0 || now.Unix() < k.Expires)
+}
+
+func apiKeyHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// AddServiceAccount adds a service account with role.
+func AddServiceAccount(name, role string) error {
+	if name == "" {
+		return fmt.Errorf("name required")
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		_, err := findRole(c, role)
+		if err != nil {
+			return err
+		}
+		for _, u := range c.Users {
+			if u.Name == name {
+				return fmt.Errorf("user %s already exist", name)
+			}
+		}
+		c.Users = append(c.Users, UserConfig{Name: name, Role: role, Service: true})
+		return nil
+	})
+}
+
+// GetServiceAccounts returns the service accounts.
+func GetServiceAccounts() ([]UserConfig, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ret := []UserConfig{}
+	for _, u := range c.Users {
+		if u.Service {
+			ret = append(ret, u)
+		}
+	}
+	return ret, nil
+}
+
+// DeleteServiceAccount deletes service account name and revokes its keys.
+func DeleteServiceAccount(name string) error {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return err
+	}
+	for _, u := range c.Users {
+		if u.Name == name {
+			if !u.Service {
+				return fmt.Errorf("user %s is not a service account", name)
+			}
+			return DeleteUserConfig(name)
+		}
+	}
+	return fmt.Errorf("service account %s not exist", name)
+}
+
+// CreateAPIKey creates a key for service account user, valid for
+// expires when it is not zero. It returns the key and its secret form.
+func CreateAPIKey(user, name string, scopes []string, expires time.Duration) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("key name required")
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	key := APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Created: now.Unix(),
+	}
+	if expires > 0 {
+		key.Expires = now.Add(expires).Unix()
+	}
+	secretString := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = apiKeyHash(secretString)
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		found := false
+		for _, u := range c.Users {
+			if u.Name == user {
+				if !u.Service {
+					return fmt.Errorf("user %s is not a service account", user)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("service account %s not exist", user)
+		}
+		for _, k := range c.APIKeys {
+			if k.User == user && k.Name == name && k.Revoked == 0 {
+				return fmt.Errorf("key %s of %s already exist", name, user)
+			}
+		}
+		c.APIKeys = append(c.APIKeys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	key.Hash = ""
+	return &key, APIKeyPrefix + key.ID + "_" + secretString, nil
+}
+
+// GetAPIKeys returns the keys of user, of all service accounts when
+// user is empty, without their hashes.
+func GetAPIKeys(user string) ([]APIKey, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	ret := []APIKey{}
+	for _, k := range c.APIKeys {
+		if user == "" || k.User == user {
+			k.Hash = ""
+			ret = append(ret, k)
+		}
+	}
+	return ret, nil
+}
+
+// RevokeAPIKey revokes the key with id.
+func RevokeAPIKey(id string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i := range c.APIKeys {
+			if c.APIKeys[i].ID == id {
+				if c.APIKeys[i].Revoked != 0 {
+					return fmt.Errorf("key %s already revoked", id)
+				}
+				c.APIKeys[i].Revoked = time.Now().Unix()
+				return nil
+			}
+		}
+		return fmt.Errorf("key %s not exist", id)
+	})
+}
+
+// activeAPIKey returns the key with id unless it is revoked or expired.
+func activeAPIKey(id string) (*APIKey, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range c.APIKeys {
+		if k.ID == id {
+			if !k.active(time.Now()) {
+				return nil, fmt.Errorf("key %s is revoked or expired", id)
+			}
+			k.Hash = ""
+			return &k, nil
+		}
+	}
+	return nil, fmt.Errorf("key %s not exist", id)
+}
+
+// authenticateAPIKey returns the service account and key of an API key.
+func authenticateAPIKey(key string) (*UserConfig, *APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	for i := range c.APIKeys {
+		k := &c.APIKeys[i]
+		if k.ID != id {
+			continue
+		}
+		hash := apiKeyHash(secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) != 1 || !k.active(now) {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		var user *UserConfig
+		for j := range c.Users {
+			if c.Users[j].Name == k.User && c.Users[j].Service {
+				u := c.Users[j]
+				user = &u
+			}
+		}
+		if user == nil {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		if now.Unix()-k.LastUsed >= int64(apiKeyLastUsedInterval/time.Second) {
+			k.LastUsed = now.Unix()
+			err = touchAPIKey(id, now)
+			if err != nil {
+				q.Q(err)
+			}
+		}
+		ret := *k
+		ret.Hash = ""
+		return user, &ret, nil
+	}
+	return nil, nil, ErrInvalidAPIKey
+}
+
+// touchAPIKey sets the last use of the key with id to now. Only the key
+// is changed, the config read to authenticate may be stale by now.
+func touchAPIKey(id string, now time.Time) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i := range c.APIKeys {
+			if c.APIKeys[i].ID == id {
+				if c.APIKeys[i].LastUsed >= now.Unix() {
+					return errMNMSConfigUnchanged
+				}
+				c.APIKeys[i].LastUsed = now.Unix()
+				return nil
+			}
+		}
+		return errMNMSConfigUnchanged
+	})
+}
+
+// apiKeyFromRequest returns the API key bearer token of r, if any.
+func apiKeyFromRequest(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// HandleServiceAccounts handles service account requests
+//
+// GET /api/v1/serviceaccounts
+//
+//	returns the service accounts
+//
+// POST /api/v1/serviceaccounts
+//
+//	Example parameter: {"name": "ci", "role": "superuser"}
+//
+// DELETE /api/v1/serviceaccounts
+//
+//	Example parameter: {"name": "ci"}, the keys of the account are revoked
+func HandleServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	var body usersBody
+	if r.Method == "POST" || r.Method == "DELETE" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		setAuditDetail(r, "service account %s", body.Name)
+	}
+	var err error
+	switch r.Method {
+	case "POST":
+		err = AddServiceAccount(body.Name, body.Role)
+	case "DELETE":
+		err = DeleteServiceAccount(body.Name)
+	}
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	accounts, err := GetServiceAccounts()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(accounts)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleAPIKeys handles API key requests
+//
+// GET /api/v1/apikeys?user=[service account]
+//
+//	returns the keys, without their secrets
+//
+// POST /api/v1/apikeys
+//
+//	Example parameter: {"user": "ci", "name": "nightly", "scopes": ["devices:read", "commands:*"], "expiresDays": 90}
+//	Example return: {"key": "mnms_3f2a...", "apikey": {"id": "3f2a...", "name": "nightly", ...}}
+//
+//	The key is returned only once.
+//
+// DELETE /api/v1/apikeys
+//
+//	Example parameter: {"id": "3f2a..."}
+func HandleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var body struct {
+			User        string   `json:"user"`
+			Name        string   `json:"name"`
+			Scopes      []string `json:"scopes"`
+			ExpiresDays int      `json:"expiresDays"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		setAuditDetail(r, "create key %s of %s", body.Name, body.User)
+		key, secret, err := CreateAPIKey(body.User, body.Name, body.Scopes,
+			time.Duration(body.ExpiresDays)*24*time.Hour)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		err = json.NewEncoder(w).Encode(map[string]any{"key": secret, "apikey": key})
+		if err != nil {
+			q.Q(err)
+		}
+		return
+	case "DELETE":
+		var body struct {
+			ID string `json:"id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		setAuditDetail(r, "revoke key %s", body.ID)
+		err = RevokeAPIKey(body.ID)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	keys, err := GetAPIKeys(r.URL.Query().Get("user"))
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(keys)
+	if err != nil {
+		q.Q(err)
+	}
+}
@@ -0,0 +1,94 @@
+package mnms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAPIKey tests service accounts and scoped API keys
+func TestAPIKey(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+
+	err = AddServiceAccount("ci", MNMSSuperUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = authenticateUser("ci", ""); err == nil {
+		t.Fatal("expect service account password login to fail")
+	}
+	if _, _, err = CreateAPIKey("admin", "k", nil, 0); err == nil {
+		t.Fatal("expect keys only for service accounts")
+	}
+	if err = DeleteServiceAccount("admin"); err == nil {
+		t.Fatal("expect only service accounts to be deleted")
+	}
+	key, secret, err := CreateAPIKey("ci", "nightly", []string{PermDevicesRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Hash != "" {
+		t.Fatal("expect hash to be hidden")
+	}
+
+	handler := requirePermission(PermDevicesRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := userFromContext(r.Context()); u == nil || u.Name != "ci" {
+			t.Error("expect service account in context", u)
+		}
+	}))
+	call := func(h http.Handler, token string) int {
+		req := httptest.NewRequest("GET", "/api/v1/devices", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := call(handler, secret); code != http.StatusOK {
+		t.Fatal("expect key to be accepted, got", code)
+	}
+	if code := call(handler, secret+"x"); code != http.StatusUnauthorized {
+		t.Fatal("expect wrong secret to be rejected, got", code)
+	}
+	// the role allows devices:write, the key scopes do not
+	write := requirePermission(PermDevicesWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if code := call(write, secret); code != http.StatusForbidden {
+		t.Fatal("expect scope to be enforced, got", code)
+	}
+
+	keys, err := GetAPIKeys("ci")
+	if err != nil || len(keys) != 1 || keys[0].LastUsed == 0 {
+		t.Fatal("expect last used key", keys, err)
+	}
+	err = RevokeAPIKey(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := call(handler, secret); code != http.StatusUnauthorized {
+		t.Fatal("expect revoked key to be rejected, got", code)
+	}
+	// a late last use update keeps the key revoked
+	err = touchAPIKey(key.ID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := call(handler, secret); code != http.StatusUnauthorized {
+		t.Fatal("expect key to stay revoked, got", code)
+	}
+
+	_, secret, err = CreateAPIKey("ci", "short", nil, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if _, _, err = authenticateAPIKey(secret); err == nil {
+		t.Fatal("expect expired key to be rejected")
+	}
+}
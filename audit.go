@@ -0,0 +1,497 @@
+package mnms
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/qeof/q"
+)
+
+/*
+	The audit log records who did what from where: logins, user, role
+	and 2FA changes, posted commands and config imports.
+
+	Records are appended to audit.log in the mnms folder as JSON lines.
+	Each record carries the hash of the previous record and its own
+	hash over both, so removing or editing a record breaks the chain
+	and is reported by VerifyAuditLog.
+
+	Secrets in commands, device passwords and snmp communities, are
+	redacted before they are recorded.
+*/
+
+// PermAuditRead allows reading and exporting the audit log.
+const PermAuditRead = "audit:read"
+
+// AuditRecord is an entry of the audit log.
+type AuditRecord struct {
+	Seq       int64  `json:"seq"`
+	Timestamp string `json:"timestamp"`
+	User      string `json:"user"`
+	Source    string `json:"source"`
+	Method    string `json:"method"`
+	Endpoint  string `json:"endpoint"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail,omitempty"`
+	Outcome   string `json:"outcome"`
+	Prev      string `json:"prev"`
+	Hash      string `json:"hash"`
+}
+
+// AuditQuery selects audit records.
+type AuditQuery struct {
+	User   string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+type auditContextKey struct{}
+
+// auditEntry is filled in by handlers of audited requests.
+type auditEntry struct {
+	user   string
+	detail string
+	skip   bool
+}
+
+var auditMutex sync.Mutex
+
+// auditTailSize bounds how much of the end of the log is read to find
+// the last record.
+const auditTailSize = 64 * 1024
+
+// auditSecretArgs are the positions of secret arguments of commands,
+// by leading command words.
+var auditSecretArgs = map[string][]int{
+	"mtderase":              {4},
+	"reset":                 {4},
+	"config mtderase":       {5},
+	"config switch save":    {5},
+	"config snmp enable":    {5},
+	"config snmp disable":   {5},
+	"switch":                {3},
+	"snmp communities":      {3},
+	"snmp update community": {4, 5},
+	"snmp options":          {3},
+}
+
+// auditSecretOptions are the option=value arguments of commands with
+// secret values, by leading command words.
+var auditSecretOptions = map[string][]string{
+	"mqtt connect": {"password"},
+}
+
+func auditLogPath() (string, error) {
+	mnmsDir, err := CheckMNMSFolder()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mnmsDir, "audit.log"), nil
+}
+
+// RedactCommand replaces the secret arguments of cmd with ***.
+func RedactCommand(cmd string) string {
+	prefix := ""
+	body := cmd
+	if strings.HasPrefix(cmd, "@") {
+		client, rest, _ := strings.Cut(cmd, " ")
+		prefix = client + " "
+		body = rest
+	}
+	ws := strings.Split(body, " ")
+	for k, options := range auditSecretOptions {
+		if !strings.HasPrefix(body, k+" ") {
+			continue
+		}
+		for i, w := range ws {
+			for _, o := range options {
+				if strings.HasPrefix(w, o+"=") {
+					ws[i] = o + "=***"
+				}
+			}
+		}
+		return prefix + strings.Join(ws, " ")
+	}
+	match := ""
+	for k := range auditSecretArgs {
+		if (body == k || strings.HasPrefix(body, k+" ")) && len(k) > len(match) {
+			match = k
+		}
+	}
+	if match == "" {
+		return cmd
+	}
+	for _, i := range auditSecretArgs[match] {
+		// a credential reference takes the place of username and password
+		if i > 0 && i-1 < len(ws) && isCredentialRef(ws[i-1]) {
+			continue
+		}
+		if i < len(ws) && ws[i] != "" {
+			ws[i] = "***"
+		}
+	}
+	return prefix + strings.Join(ws, " ")
+}
+
+func (rec *AuditRecord) sum() string {
+	c := *rec
+	c.Hash = ""
+	b, _ := json.Marshal(c)
+	h := sha256.Sum256(append([]byte(rec.Prev), b...))
+	return hex.EncodeToString(h[:])
+}
+
+// lastAuditRecord reads the last record of the audit log at p, the log
+// may have been appended to by another mnms process.
+func lastAuditRecord(p string) (*AuditRecord, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return &AuditRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size() - auditTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	b := make([]byte, fi.Size()-offset)
+	_, err = f.ReadAt(b, offset)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	last := lines[len(lines)-1]
+	if last == "" {
+		return &AuditRecord{}, nil
+	}
+	var rec AuditRecord
+	err = json.Unmarshal([]byte(last), &rec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last audit record: %v", err)
+	}
+	return &rec, nil
+}
+
+// WriteAuditRecord chains rec to the audit log and appends it.
+func WriteAuditRecord(rec AuditRecord) error {
+	p, err := auditLogPath()
+	if err != nil {
+		return err
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	last, err := lastAuditRecord(p)
+	if err != nil {
+		return err
+	}
+	if rec.Timestamp == "" {
+		rec.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	rec.Seq = last.Seq + 1
+	rec.Prev = last.Hash
+	rec.Hash = rec.sum()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// readAuditLog calls fn for each record of the audit log until fn
+// returns false.
+func readAuditLog(fn func(rec *AuditRecord) bool) error {
+	p, err := auditLogPath()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec AuditRecord
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return fmt.Errorf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		if !fn(&rec) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// VerifyAuditLog checks the hash chain of the audit log and returns the
+// number of records.
+func VerifyAuditLog() (int64, error) {
+	var n int64
+	prev := ""
+	var verr error
+	err := readAuditLog(func(rec *AuditRecord) bool {
+		n++
+		if rec.Seq != n {
+			verr = fmt.Errorf("audit record %d: expect sequence %d", rec.Seq, n)
+			return false
+		}
+		if rec.Prev != prev || rec.sum() != rec.Hash {
+			verr = fmt.Errorf("audit record %d: hash chain broken", rec.Seq)
+			return false
+		}
+		prev = rec.Hash
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, verr
+}
+
+// QueryAuditLog returns the records matching query, the latest limit
+// records when a limit is set.
+func QueryAuditLog(query AuditQuery) ([]AuditRecord, error) {
+	ret := []AuditRecord{}
+	err := readAuditLog(func(rec *AuditRecord) bool {
+		if query.User != "" && rec.User != query.User {
+			return true
+		}
+		if query.Action != "" && !strings.HasPrefix(rec.Action, query.Action) {
+			return true
+		}
+		if !query.Since.IsZero() || !query.Until.IsZero() {
+			t, err := time.Parse(time.RFC3339, rec.Timestamp)
+			if err != nil {
+				return true
+			}
+			if !query.Since.IsZero() && t.Before(query.Since) {
+				return true
+			}
+			if !query.Until.IsZero() && t.After(query.Until) {
+				return true
+			}
+		}
+		ret = append(ret, *rec)
+		return true
+	})
+	if query.Limit > 0 && len(ret) > query.Limit {
+		ret = ret[len(ret)-query.Limit:]
+	}
+	return ret, err
+}
+
+// AuditLocal records an action taken on this host outside the API.
+func AuditLocal(action, detail string, err error) {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("USERNAME")
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error: " + err.Error()
+	}
+	err = WriteAuditRecord(AuditRecord{User: user, Source: "local", Action: action,
+		Detail: detail, Outcome: outcome})
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// auditRequest records action of user in request r.
+func auditRequest(r *http.Request, action, user, detail, outcome string) {
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+	err = WriteAuditRecord(AuditRecord{
+		User:     user,
+		Source:   source,
+		Method:   r.Method,
+		Endpoint: r.URL.Path,
+		Action:   action,
+		Detail:   detail,
+		Outcome:  outcome,
+	})
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+func auditFromContext(r *http.Request) *auditEntry {
+	e, _ := r.Context().Value(auditContextKey{}).(*auditEntry)
+	return e
+}
+
+// setAuditUser sets the user of an audited request that has no token,
+// e.g. a login.
+func setAuditUser(r *http.Request, user string) {
+	if e := auditFromContext(r); e != nil {
+		e.user = user
+	}
+}
+
+// setAuditDetail sets the detail of an audited request.
+func setAuditDetail(r *http.Request, format string, args ...any) {
+	if e := auditFromContext(r); e != nil {
+		e.detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// skipAudit leaves an audited request out of the audit log.
+func skipAudit(r *http.Request) {
+	if e := auditFromContext(r); e != nil {
+		e.skip = true
+	}
+}
+
+// audit returns middleware recording requests other than GET as action.
+func audit(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			e := &auditEntry{}
+			token, _, err := jwtauth.FromContext(r.Context())
+			if err == nil && token != nil {
+				if user, ok := token.Get("user"); ok {
+					e.user, _ = user.(string)
+				}
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, e)))
+			if e.skip {
+				return
+			}
+			outcome := "ok"
+			if status := ww.Status(); status >= 400 {
+				outcome = fmt.Sprintf("error: %d %s", status, http.StatusText(status))
+			}
+			auditRequest(r, action, e.user, e.detail, outcome)
+		})
+	}
+}
+
+// HandleAudit handles audit log requests
+//
+// GET /api/v1/audit?user=[user]&action=[action]&since=[RFC3339]&until=[RFC3339]&limit=[n]&format=[json|ndjson|csv]
+//
+//	returns the matching audit records, ndjson returns the records as
+//	stored so the export can be verified
+//
+// GET /api/v1/audit/verify
+//
+//	Example return: {"valid": true, "records": 42}
+func HandleAudit(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := AuditQuery{User: values.Get("user"), Action: values.Get("action")}
+	var err error
+	if s := values.Get("since"); s != "" {
+		query.Since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	if s := values.Get("until"); s != "" {
+		query.Until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		query.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	recs, err := QueryAuditLog(query)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	switch values.Get("format") {
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit.ndjson")
+		enc := json.NewEncoder(w)
+		for _, rec := range recs {
+			err = enc.Encode(rec)
+			if err != nil {
+				q.Q(err)
+				return
+			}
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"seq", "timestamp", "user", "source", "method", "endpoint",
+			"action", "detail", "outcome", "prev", "hash"})
+		for _, rec := range recs {
+			_ = cw.Write([]string{strconv.FormatInt(rec.Seq, 10), rec.Timestamp, rec.User,
+				rec.Source, rec.Method, rec.Endpoint, rec.Action, rec.Detail, rec.Outcome,
+				rec.Prev, rec.Hash})
+		}
+		cw.Flush()
+		if err = cw.Error(); err != nil {
+			q.Q(err)
+		}
+	default:
+		err = json.NewEncoder(w).Encode(recs)
+		if err != nil {
+			q.Q(err)
+		}
+	}
+}
+
+// HandleAuditVerify verifies the hash chain of the audit log.
+func HandleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	res := make(map[string]any)
+	n, err := VerifyAuditLog()
+	res["valid"] = err == nil
+	res["records"] = n
+	if err != nil {
+		res["error"] = err.Error()
+	}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		q.Q(err)
+	}
+}
@@ -0,0 +1,112 @@
+package mnms
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func cleanAuditLog(t *testing.T) {
+	p, err := auditLogPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(p)
+}
+
+// TestRedactCommand tests redaction of secrets in commands
+func TestRedactCommand(t *testing.T) {
+	tests := map[string]string{
+		"reset 00-60-E9-18-3C-3C 10.0.50.1 admin secret":           "reset 00-60-E9-18-3C-3C 10.0.50.1 admin ***",
+		"@client1 switch 00-60-E9-18-3C-3C admin secret show ip":   "@client1 switch 00-60-E9-18-3C-3C admin *** show ip",
+		"config switch save 00-60-E9-18-3C-3C admin secret":        "config switch save 00-60-E9-18-3C-3C admin ***",
+		"snmp update community 00-60-E9-18-3C-3C public private":   "snmp update community 00-60-E9-18-3C-3C *** ***",
+		"beep 00-60-E9-18-3C-3C 10.0.50.1":                         "beep 00-60-E9-18-3C-3C 10.0.50.1",
+		"config mtderase 00-60-E9-18-3C-3C 10.0.50.1 admin secret": "config mtderase 00-60-E9-18-3C-3C 10.0.50.1 admin ***",
+		"mtderase 00-60-E9-18-3C-3C 10.0.50.1 admin":               "mtderase 00-60-E9-18-3C-3C 10.0.50.1 admin",
+		"config local syslog path /var/log/mnms.log":               "config local syslog path /var/log/mnms.log",
+	}
+	for cmd, expect := range tests {
+		if got := RedactCommand(cmd); got != expect {
+			t.Errorf("redact %q: expect %q, got %q", cmd, expect, got)
+		}
+	}
+}
+
+// TestAuditLogChain tests appending, querying and verifying the audit log
+func TestAuditLogChain(t *testing.T) {
+	cleanAuditLog(t)
+	defer cleanAuditLog(t)
+
+	for _, user := range []string{"admin", "user1", "admin"} {
+		err := WriteAuditRecord(AuditRecord{User: user, Action: "user add", Outcome: "ok"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := VerifyAuditLog()
+	if err != nil || n != 3 {
+		t.Fatal("expect valid audit log of 3 records", n, err)
+	}
+	recs, err := QueryAuditLog(AuditQuery{User: "admin", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Seq != 3 {
+		t.Fatal("expect latest admin record", recs)
+	}
+
+	// tamper with the second record
+	p, _ := auditLogPath()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(p, bytes.Replace(b, []byte(`"user":"user1"`), []byte(`"user":"user2"`), 1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyAuditLog()
+	if err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Fatal("expect broken chain at record 2", err)
+	}
+}
+
+// TestAuditMiddleware tests recording of api requests
+func TestAuditMiddleware(t *testing.T) {
+	cleanAuditLog(t)
+	defer cleanAuditLog(t)
+
+	handler := audit("login")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditUser(r, "user1")
+		setAuditDetail(r, "from test")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	req := httptest.NewRequest("POST", "/api/v1/login", strings.NewReader("{}"))
+	req.RemoteAddr = "10.0.0.7:4242"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	// GET requests are not recorded
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/login", nil))
+
+	recs, err := QueryAuditLog(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatal("expect one audit record", recs)
+	}
+	rec := recs[0]
+	if rec.User != "user1" || rec.Source != "10.0.0.7" || rec.Endpoint != "/api/v1/login" ||
+		rec.Action != "login" || rec.Detail != "from test" || rec.Outcome != "error: 401 Unauthorized" {
+		t.Fatal("unexpected audit record", rec)
+	}
+
+	rec2 := httptest.NewRecorder()
+	HandleAudit(rec2, httptest.NewRequest("GET", "/api/v1/audit?format=csv", nil))
+	if !strings.Contains(rec2.Body.String(), "10.0.0.7") {
+		t.Fatal("expect csv export", rec2.Body.String())
+	}
+}
@@ -56,6 +56,7 @@ type CmdInfo struct {
 	Client      string `json:"client"`
 	DevId       string `json:"devid"`
 	Tag         string `json:"tag"`
+	User        string `json:"user,omitempty"`
 }
 
 const telnet_timeout = 10 * time.Second // XXX
@@ -110,6 +111,25 @@ func InsertCmd(cmd string, cmdinfo CmdInfo) {
 	QC.CmdMutex.Lock()
 	QC.CmdData[cmd] = cmdinfo
 	QC.CmdMutex.Unlock()
+	publishCmd(cmd, cmdinfo)
+}
+
+// publishCmd sends command changes to websocket and mqtt clients.
+func publishCmd(cmd string, cmdinfo CmdInfo) {
+	publishMqttCmd(cmd, cmdinfo)
+	level := LOG_INFO
+	if strings.HasPrefix(cmdinfo.Status, "error") {
+		level = LOG_ERR
+	}
+	// commands may carry device passwords
+	cmdinfo.Command = RedactCommand(cmdinfo.Command)
+	PublishWebSocketMessage(WebSocketMessage{
+		Kind:    "command",
+		Topic:   WebSocketTopicCommands,
+		Level:   level,
+		Message: RedactCommand(cmd),
+		Data:    cmdinfo,
+	})
 }
 
 // InsertDownCmds puts downloaded command data into local CmdData[].
@@ -168,6 +188,11 @@ func UpdateCmds(cmddata *map[string]CmdInfo) {
 				continue
 			}
 		}
+		// a status update keeps the command and user it was posted with
+		if ok {
+			v.Command = found.Command
+			v.User = found.User
+		}
 		// fill in missing timestamp
 		if v.Timestamp == "" {
 			v.Timestamp = time.Now().Format(time.RFC3339)
@@ -176,6 +201,7 @@ func UpdateCmds(cmddata *map[string]CmdInfo) {
 		QC.CmdData[k] = v
 		QC.CmdMutex.Unlock()
 		q.Q("cmd updated", found, v)
+		publishCmd(k, v)
 	}
 }
 
@@ -218,6 +244,7 @@ func CheckCmds() error {
 		// cannot use goroutine because of ordering
 		res := RunCmd(&v)
 		QC.CmdData[k] = v
+		publishMqttCmd(k, v)
 		q.Q(res)
 	}
 	QC.CmdMutex.Unlock()
@@ -248,7 +275,10 @@ func CheckCmds() error {
 func RunCmd(cmdinfo *CmdInfo) *CmdInfo {
 	defer func() {
 		if cmdinfo.Status != "" && !cmdinfo.NoSyslog {
-			jsonBytes, err := json.Marshal(cmdinfo)
+			// device logins given in the command text stay out of syslog
+			logged := *cmdinfo
+			logged.Command = RedactCommand(logged.Command)
+			jsonBytes, err := json.Marshal(logged)
 			if err != nil {
 				q.Q(err)
 			}
@@ -341,12 +371,26 @@ func RunCmd(cmdinfo *CmdInfo) *CmdInfo {
 			return OpcuaReadCmd(cmdinfo)
 		case "browse":
 			return OpcuaBrowseReferenceCmd(cmdinfo)
+		case "export":
+			return OpcuaExportCmd(cmdinfo)
+		case "write":
+			return OpcuaWriteCmd(cmdinfo)
+		case "call":
+			return OpcuaCallCmd(cmdinfo)
+		case "historyread":
+			return OpcuaHistoryReadCmd(cmdinfo)
 		case "sub":
 			return OpcuaSubscribeCmd(cmdinfo)
 		case "deletesub":
 			return OpcuDeleteSubscribeCmd(cmdinfo)
-		case "close":
+		case "unsub":
+			return OpcuaUnsubscribeCmd(cmdinfo)
+		case "list":
+			return OpcuaListCmd(cmdinfo)
+		case "close", "disconnect":
 			return OpcuCloseCmd(cmdinfo)
+		case "cert":
+			return OpcuaCertCmd(cmdinfo)
 		}
 	}
 
@@ -406,18 +450,23 @@ func BeepCmd(cmdinfo *CmdInfo) *CmdInfo {
 //	[username]    : target device login user name
 //	[password]    : target device login passwaord
 //
+// Usage : reset [mac address] [ip address] @cred:[credential]
+//
+//	[credential]  : name of the device credential in the credential vault
+//
 // Example :
 //
 //	reset AA-BB-CC-DD-EE-FF 10.0.50.1 admin default
+//	reset AA-BB-CC-DD-EE-FF 10.0.50.1 @cred:plant1
 func ResetCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 5 {
+	if len(ws) < 3+loginArgs(ws, 3) {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	var macaddr, ipaddr, username, password string
-	Unpack(ws[1:], &macaddr, &ipaddr, &username, &password)
+	var macaddr, ipaddr string
+	Unpack(ws[1:], &macaddr, &ipaddr)
 	cmdinfo.DevId = macaddr
 	dev, err := FindDev(macaddr)
 	if err != nil || dev.IPAddress != ipaddr {
@@ -439,6 +488,11 @@ func ResetCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = fmt.Sprintf("error:%v", err)
 		return cmdinfo
 	}
+	username, password, _, err := deviceLogin(ws[3:], macaddr)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
 	err = GwdReset(ipaddr, macaddr, username, password)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
@@ -457,19 +511,24 @@ func ResetCmd(cmdinfo *CmdInfo) *CmdInfo {
 //	[username]    : target device login user name
 //	[password]    : target device login passwaord
 //
+// Usage : mtderase [mac address] [ip address] @cred:[credential]
+//
+//	[credential]  : name of the device credential in the credential vault
+//
 // Example :
 //
 //	mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 admin default
+//	mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 @cred:plant1
 func MtdEraseCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 5 {
+	if len(ws) < 3+loginArgs(ws, 3) {
 		q.Q("error", len(ws))
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	var macaddr, ipaddr, username, password string
-	Unpack(ws[1:], &macaddr, &ipaddr, &username, &password)
+	var macaddr, ipaddr string
+	Unpack(ws[1:], &macaddr, &ipaddr)
 	cmdinfo.DevId = macaddr
 	dev, err := FindDev(macaddr)
 	if err != nil || dev.IPAddress != ipaddr {
@@ -492,6 +551,11 @@ func MtdEraseCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = fmt.Sprintf("error:%v", err)
 		return cmdinfo
 	}
+	username, password, _, err := deviceLogin(ws[3:], macaddr)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
 	err = GwdMtdErase(ipaddr, macaddr, username, password)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
@@ -573,13 +637,18 @@ func deleteExtraSnmpCmd(cmd []string) []string {
 //	[password]    : target device login passwaord
 //	[cli cmd...]  : target device cli command
 //
+// Usage : switch [mac address] @cred:[credential] [cli cmd...]
+//
+//	[credential]  : name of the device credential in the credential vault
+//
 // Example :
 //
 //	switch AA-BB-CC-DD-EE-FF admin default show ip
+//	switch AA-BB-CC-DD-EE-FF @cred:plant1 show ip
 func SwitchCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 5 {
+	if len(ws) < 3+loginArgs(ws, 2) {
 		q.Q("error", len(ws))
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
@@ -599,10 +668,13 @@ func SwitchCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = "error: switch cli not available"
 		return cmdinfo
 	}
-	wcmd := ConvertSwitchCmd(dev.ModelName, ws[4:])
+	username, password, n, err := deviceLogin(ws[2:], devId)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	wcmd := ConvertSwitchCmd(dev.ModelName, ws[2+n:])
 
-	username := ws[2]
-	password := ws[3]
 	err = SendSwitch(cmdinfo, dev, username, password, strings.Join(wcmd, " "))
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
@@ -718,12 +790,18 @@ func SendSwitchWithoutConfig(cmdinfo *CmdInfo, dev *DevInfo, username, password,
 //	[username]    : target device login user name
 //	[password]    : target device login passwaord
 //
+// Usage :config switch save [mac address] @cred:[credential]
+//
+//	[credential]  : name of the device credential in the credential vault
+//
 // Example :
 //
+//	config switch save AA-BB-CC-DD-EE-FF admin default
+//	config switch save AA-BB-CC-DD-EE-FF @cred:plant1
 func ConfigSwitchSaveCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 6 {
+	if len(ws) < 4+loginArgs(ws, 4) {
 		q.Q("error", len(ws))
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
@@ -743,8 +821,11 @@ func ConfigSwitchSaveCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = "error: switch cli not available"
 		return cmdinfo
 	}
-	username := ws[4]
-	password := ws[5]
+	username, password, _, err := deviceLogin(ws[4:], devId)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
 	err = SwitchConfigSave(cmdinfo, dev, username, password)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
@@ -800,21 +881,38 @@ func ScanCmd(cmdinfo *CmdInfo) *CmdInfo {
 	return cmdinfo
 }
 
-// Use mqtt to publish/subscribe/unsubscribe/list topic.
+// Use mqtt to connect/publish/subscribe/unsubscribe/list topic.
+//
+// Usage : mqtt connect [name] [broker url] [@cred:name] [option=value...]
+//
+//	[name]        : connection name
+//	[broker url]  : tcp://, ssl://, ws:// or wss:// host:port
+//	[@cred:name]  : username and password of the broker from the credential vault
+//	[option]      : user, password, clientid, clean, qos, retain,
+//	                will, willmsg, willqos, willretain, ca, cert, key, insecure
+//
+// Usage : mqtt disconnect [name]
 //
-// Usage : mqtt [mqttcmd] [tcp address] [topic] [data...]
+// Usage : mqtt [mqttcmd] [name|tcp address] [topic] [data...]
 //
 //		[mqttcmd]     : pub/sub/unsub/list
-//	                 list is show all subscribe topic
+//	                 list is show all connections and subscribe topic
+//		[name]        : connection name
 //		[tcp address] : would pub/sub/unsub broker tcp address
 //		[topic]       : topic name
-//		[data...]     : data is messages, only publish use it.
+//		[data...]     : data is messages, only publish use it,
+//		                subscribe can give the qos.
 //
 // Example :
 //
+//	mqtt connect plant1 ssl://192.168.12.1:8883 @cred:broker clientid=mnms1 clean=false qos=1 ca=ca.pem
+//	mqtt connect plant2 192.168.12.2:1883 user=mnms password=secret will=mnms/status willmsg=offline willretain=true
+//	mqtt sub plant1 factory/# 2
+//	mqtt pub plant1 topictest "this is messages."
 //	mqtt pub 192.168.12.1:1883 topictest "this is messages."
 //	mqtt sub 192.168.12.1:1883 topictest
 //	mqtt unsub 192.168.12.1:1883 topictest
+//	mqtt disconnect plant1
 //	mqtt list
 func RunMqttCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
@@ -826,24 +924,55 @@ func RunMqttCmd(cmdinfo *CmdInfo) *CmdInfo {
 	}
 	selectOption := ws[1]
 	if strings.HasPrefix(selectOption, "list") {
-		result := DisplayAllSubscribeTopic()
-		if result == "" {
-			result = "not subscribe topic"
+		b, err := json.Marshal(GetMqttClients())
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
 		}
-		cmdinfo.Result = result
+		cmdinfo.Result = string(b)
 		cmdinfo.Status = "ok"
 		return cmdinfo
 	}
+	if selectOption == "connect" {
+		p, err := ParseMqttConnect(ws[2:])
+		if err == nil {
+			err = MqttConnect(p)
+		}
+		if err != nil {
+			q.Q(err)
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Status = "ok"
+		return cmdinfo
+	}
+	if len(ws) < 3 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
 	tcpaddr := ws[2]
+	if selectOption == "disconnect" {
+		err := MqttDisconnect(tcpaddr)
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Status = "ok"
+		return cmdinfo
+	}
 	checkIP := strings.Split(ws[2], ":")
 	// pass ":11883" local address
-	if checkIP[0] != "" {
+	if len(checkIP) > 1 && checkIP[0] != "" {
 		err := CheckIPAddress(checkIP[0])
 		if err != nil {
 			cmdinfo.Status = "error: tcp address invalid"
 			return cmdinfo
 		}
 	}
+	if len(ws) < 4 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
 	topicname := ws[3]
 	data := strings.Join(ws[4:], " ")
 	if strings.HasPrefix(selectOption, "pub") {
@@ -861,7 +990,16 @@ func RunMqttCmd(cmdinfo *CmdInfo) *CmdInfo {
 		return cmdinfo
 	}
 	if strings.HasPrefix(selectOption, "sub") {
-		err := RunMqttSubscribe(tcpaddr, topicname)
+		var qos []byte
+		if data != "" {
+			n, err := parseMqttQoS(data)
+			if err != nil {
+				cmdinfo.Status = "error: " + err.Error()
+				return cmdinfo
+			}
+			qos = append(qos, n)
+		}
+		err := RunMqttSubscribe(tcpaddr, topicname, qos...)
 		if err != nil {
 			q.Q(err)
 			cmdinfo.Status = "error: " + err.Error()
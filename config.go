@@ -440,7 +440,18 @@ func ConfigCmd(cmdinfo *CmdInfo) *CmdInfo {
 		return ConfigSwitchSaveCmd(cmdinfo)
 	}
 
-	if strings.HasPrefix(cmd, "config local syslog ") && QC.IsRoot {
+	// every node reloads its own settings file
+	if cmd == "config reload" {
+		return ConfigReloadCmd(cmdinfo)
+	}
+	// settings profile pushed by root
+	if strings.HasPrefix(cmd, "config profile ") {
+		return ConfigProfileCmd(cmdinfo)
+	}
+
+	// forwarding targets and retention are configured on every node,
+	// the other syslog commands on root
+	if strings.HasPrefix(cmd, "config local syslog ") {
 		return configOfLocalSyslogCmd(cmdinfo)
 	}
 
@@ -452,23 +463,23 @@ func ConfigCmd(cmdinfo *CmdInfo) *CmdInfo {
 // ConvertSnmpCmd convert snmp cmd by telnet
 func ConvertSnmpCmd(cmds string) (string, error) {
 	ws := strings.Split(cmds, " ")
-	if len(ws) < 6 {
+	n := loginArgs(ws, 4)
+	if len(ws) < 4+n {
 		return "", errors.New("error: invalid command")
 	}
-	extra := []string{}
-	if len(ws) > 6 {
-		extra = ws[6:]
-	}
+	// the login is a username and password or a credential reference
+	login := strings.Join(ws[4:4+n], " ")
+	extra := ws[4+n:]
 
 	//example,input: config snmp enable AA-BB-CC-DD-EE-FF admin default
 	//return:switch AA-BB-CC-DD-EE-FF admin default snmp enable
 	if strings.HasPrefix(cmds, "config snmp enable ") {
-		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s %s %s", "switch", ws[3], ws[4], ws[5], "snmp", "enable", strings.Join(extra, " "))), nil
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s %s", "switch", ws[3], login, "snmp", "enable", strings.Join(extra, " "))), nil
 	}
 	//example,input: config snmp enable AA-BB-CC-DD-EE-FF admin default
 	//return:switch AA-BB-CC-DD-EE-FF admin default no snmp enable
 	if strings.HasPrefix(cmds, "config snmp disable ") {
-		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s %s %s %s", "switch", ws[3], ws[4], ws[5], "no", "snmp", "enable", strings.Join(extra, " "))), nil
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s %s %s %s %s", "switch", ws[3], login, "no", "snmp", "enable", strings.Join(extra, " "))), nil
 	}
 	/*	if strings.HasPrefix(cmds, "config snmp trap ") {
 			if len(ws) < 8 {
@@ -0,0 +1,450 @@
+package mnms
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Device credential vault.
+
+	Device usernames and passwords are kept encrypted in the mnms config
+	as named credentials, scoped to devices and device groups. Commands
+	refer to a credential by name in place of the username and password,
+
+		switch AA-BB-CC-DD-EE-FF @cred:plant1 show ip
+
+	so the secrets never appear in the command text, the command list,
+	syslog or the audit log. The client running the command resolves
+	the reference from the root, the root returns the credential
+	encrypted with the mnms public key.
+
+	Mqtt and opcua connections use credentials too, a credential is sent
+	only to the brokers and opcua endpoints it lists.
+*/
+
+const (
+	PermCredentialsRead    = "credentials:read"
+	PermCredentialsWrite   = "credentials:write"
+	PermCredentialsResolve = "credentials:resolve"
+)
+
+// credRefPrefix starts a credential reference in command text.
+const credRefPrefix = "@cred:"
+
+// credentialMask replaces passwords in credential listings.
+const credentialMask = "***"
+
+// Credential is a named device login.
+type Credential struct {
+	Name         string   `json:"name"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	Devices      []string `json:"devices,omitempty"`
+	DeviceGroups []string `json:"deviceGroups,omitempty"`
+	Brokers      []string `json:"brokers,omitempty"`
+	Endpoints    []string `json:"endpoints,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Updated      int64    `json:"updated"`
+}
+
+// isCredentialRef reports whether the command argument arg is a
+// credential reference.
+func isCredentialRef(arg string) bool {
+	return strings.HasPrefix(arg, credRefPrefix) && len(arg) > len(credRefPrefix)
+}
+
+// isCredentialURL reports whether a credential target is the url of a
+// broker or an opcua endpoint rather than a device mac.
+func isCredentialURL(target string) bool {
+	return strings.Contains(target, "://")
+}
+
+// isOpcuaEndpoint reports whether a credential target is the url of an
+// opcua endpoint.
+func isOpcuaEndpoint(target string) bool {
+	return strings.HasPrefix(strings.ToLower(target), "opc.tcp://")
+}
+
+// AllowsDevice reports whether the credential may be used on the device
+// with mac. A credential without devices, device groups, brokers and
+// endpoints is usable on all devices.
+func (cred *Credential) AllowsDevice(mac string, groups []DeviceGroup) bool {
+	if len(cred.Devices) == 0 && len(cred.DeviceGroups) == 0 {
+		return len(cred.Brokers) == 0 && len(cred.Endpoints) == 0
+	}
+	mac = strings.ReplaceAll(mac, ":", "-")
+	if containsFold(cred.Devices, mac) {
+		return true
+	}
+	for _, name := range cred.DeviceGroups {
+		for _, g := range groups {
+			if g.Name == name && containsFold(g.Macs, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findCredential(c *MNMSConfig, name string) *Credential {
+	for i := range c.Credentials {
+		if c.Credentials[i].Name == name {
+			return &c.Credentials[i]
+		}
+	}
+	return nil
+}
+
+// lookupCredential returns the credential name for target, the mac of a
+// device or the url of a broker or opcua endpoint. Without a target only
+// credentials usable on all devices are returned.
+func lookupCredential(c *MNMSConfig, name, target string) (*Credential, error) {
+	cred := findCredential(c, name)
+	if cred == nil {
+		return nil, fmt.Errorf("credential %s not exist", name)
+	}
+	if isOpcuaEndpoint(target) {
+		if !containsFold(cred.Endpoints, target) {
+			return nil, fmt.Errorf("credential %s not allowed for endpoint %s", name, target)
+		}
+		return cred, nil
+	}
+	if isCredentialURL(target) {
+		if !containsFold(cred.Brokers, target) {
+			return nil, fmt.Errorf("credential %s not allowed for broker %s", name, target)
+		}
+		return cred, nil
+	}
+	mac := target
+	if mac == "" {
+		if len(cred.Devices) != 0 || len(cred.DeviceGroups) != 0 || len(cred.Brokers) != 0 || len(cred.Endpoints) != 0 {
+			return nil, fmt.Errorf("credential %s is scoped and no device given", name)
+		}
+		return cred, nil
+	}
+	if !cred.AllowsDevice(mac, c.DeviceGroups) {
+		return nil, fmt.Errorf("credential %s not allowed for device %s", name, mac)
+	}
+	return cred, nil
+}
+
+// GetCredentials returns the credentials with their passwords masked.
+func GetCredentials() ([]Credential, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]Credential, 0, len(c.Credentials))
+	for _, cred := range c.Credentials {
+		cred.Password = credentialMask
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+// SetCredential adds or replaces a credential. A masked password keeps
+// the password of the credential being replaced.
+func SetCredential(cred Credential) error {
+	if cred.Name == "" || strings.ContainsAny(cred.Name, " \t") {
+		return fmt.Errorf("invalid credential name %q", cred.Name)
+	}
+	if cred.Username == "" {
+		return errors.New("credential username is empty")
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, g := range cred.DeviceGroups {
+			if findDeviceGroup(c, g) == nil {
+				return fmt.Errorf("device group %s not exist", g)
+			}
+		}
+		for i, mac := range cred.Devices {
+			if !macRegexp.MatchString(mac) {
+				return fmt.Errorf("invalid device mac %s", mac)
+			}
+			cred.Devices[i] = strings.ToUpper(strings.ReplaceAll(mac, ":", "-"))
+		}
+		for _, broker := range cred.Brokers {
+			u, err := url.Parse(broker)
+			if err != nil || !isCredentialURL(broker) || isOpcuaEndpoint(broker) || u.Host == "" {
+				return fmt.Errorf("invalid broker url %s", broker)
+			}
+		}
+		for _, endpoint := range cred.Endpoints {
+			u, err := url.Parse(endpoint)
+			if err != nil || !isOpcuaEndpoint(endpoint) || u.Host == "" {
+				return fmt.Errorf("invalid opcua endpoint %s", endpoint)
+			}
+		}
+		cred.Updated = time.Now().Unix()
+		old := findCredential(c, cred.Name)
+		if cred.Password == credentialMask {
+			if old == nil {
+				return errors.New("credential password is empty")
+			}
+			cred.Password = old.Password
+		}
+		if old != nil {
+			*old = cred
+		} else {
+			c.Credentials = append(c.Credentials, cred)
+		}
+		return nil
+	})
+}
+
+// DeleteCredential deletes a credential.
+func DeleteCredential(name string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, cred := range c.Credentials {
+			if cred.Name == name {
+				c.Credentials = append(c.Credentials[:i], c.Credentials[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("credential %s not exist", name)
+	})
+}
+
+// CheckCommandCredentials checks that the credentials cmd refers to exist
+// and may be used on the devices, the broker or the opcua endpoint it
+// names.
+func CheckCommandCredentials(cmd string) error {
+	if !strings.Contains(cmd, credRefPrefix) {
+		return nil
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return err
+	}
+	macs := commandDevices(clientCommand(cmd))
+	if len(macs) == 0 {
+		// connect commands name a broker or endpoint in place of a device
+		for _, w := range strings.Split(cmd, " ") {
+			if isCredentialURL(w) {
+				macs = append(macs, w)
+			}
+		}
+	}
+	for _, w := range strings.Split(cmd, " ") {
+		if !isCredentialRef(w) {
+			continue
+		}
+		name := strings.TrimPrefix(w, credRefPrefix)
+		if len(macs) == 0 {
+			macs = []string{""}
+		}
+		for _, mac := range macs {
+			_, err = lookupCredential(c, name, mac)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ownPublicKey() ([]byte, error) {
+	if len(QC.OwnPublicKeys) > 0 {
+		return QC.OwnPublicKeys, nil
+	}
+	return GenerateOwnPublickey()
+}
+
+// resolveCredential returns the username and password of the credential
+// name for target, the mac of a device or the url of a broker or opcua
+// endpoint. The root reads its own config, clients ask the root.
+func resolveCredential(name, target string) (string, string, error) {
+	var cred *Credential
+	if QC.IsRoot || QC.RootURL == "" {
+		c, err := GetMNMSConfig()
+		if err != nil {
+			return "", "", err
+		}
+		cred, err = lookupCredential(c, name, target)
+		if err != nil {
+			return "", "", err
+		}
+		return cred.Username, cred.Password, nil
+	}
+	key := "mac"
+	if isCredentialURL(target) {
+		key = "url"
+	}
+	body, err := json.Marshal(map[string]string{"name": name, key: target})
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := PostWithToken(QC.RootURL+"/api/v1/credentials/resolve", QC.AdminToken, bytes.NewBuffer(body))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return "", "", errors.New(e.Error)
+		}
+		return "", "", fmt.Errorf("resolve credential %s: %s", name, resp.Status)
+	}
+	var ret struct {
+		Credential string `json:"credential"`
+	}
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return "", "", err
+	}
+	plain, err := DecryptWithOwnPrivateKey([]byte(ret.Credential))
+	if err != nil {
+		return "", "", err
+	}
+	cred = &Credential{}
+	err = json.Unmarshal(plain, cred)
+	if err != nil {
+		return "", "", err
+	}
+	return cred.Username, cred.Password, nil
+}
+
+// loginArgs returns the number of command arguments the device login
+// at ws[i] takes.
+func loginArgs(ws []string, i int) int {
+	if i < len(ws) && isCredentialRef(ws[i]) {
+		return 1
+	}
+	return 2
+}
+
+// deviceLogin returns the username and password at the start of the
+// command arguments args, either a credential reference or a username
+// and password, and the number of arguments they take.
+func deviceLogin(args []string, mac string) (string, string, int, error) {
+	if len(args) > 0 && isCredentialRef(args[0]) {
+		username, password, err := resolveCredential(strings.TrimPrefix(args[0], credRefPrefix), mac)
+		return username, password, 1, err
+	}
+	if len(args) < 2 {
+		return "", "", 0, errors.New("missing username and password")
+	}
+	return args[0], args[1], 2, nil
+}
+
+// HandleCredentials handles device credentials.
+//
+// GET /api/v1/credentials
+//
+//	returns the credentials, without their passwords
+//
+// POST /api/v1/credentials
+//
+//	Example parameter: {"name": "plant1", "username": "admin", "password": "default", "deviceGroups": ["plant1"]}
+//
+//	A password of "***" keeps the current password.
+//
+// DELETE /api/v1/credentials
+//
+//	Example parameter: {"name": "plant1"}
+func HandleCredentials(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var cred Credential
+		err := json.NewDecoder(r.Body).Decode(&cred)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set credential %s", cred.Name)
+			err = SetCredential(cred)
+		} else {
+			setAuditDetail(r, "delete credential %s", cred.Name)
+			err = DeleteCredential(cred.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	creds, err := GetCredentials()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(creds)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleCredentialResolve returns a credential for a device, broker or
+// opcua endpoint to a client running a command that refers to it,
+// encrypted with the mnms public key.
+//
+// POST /api/v1/credentials/resolve
+//
+//	Example parameter: {"name": "plant1", "mac": "00-60-E9-18-3C-3C"}
+//	Example parameter: {"name": "broker", "url": "ssl://192.168.12.1:8883"}
+//	Example return: {"credential": "k3Jx..."}
+func HandleCredentialResolve(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+		Mac  string `json:"mac"`
+		URL  string `json:"url"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	target := body.Mac
+	if body.URL != "" {
+		target = body.URL
+	}
+	setAuditDetail(r, "resolve credential %s for %s", body.Name, target)
+	c, err := GetMNMSConfig()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	cred, err := lookupCredential(c, body.Name, target)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	plain, err := json.Marshal(Credential{Name: cred.Name, Username: cred.Username, Password: cred.Password})
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	publicKey, err := ownPublicKey()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	encrypted, err := EncryptWithPublicKey(plain, publicKey)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(map[string]string{"credential": string(encrypted)})
+	if err != nil {
+		q.Q(err)
+	}
+}
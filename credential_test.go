@@ -0,0 +1,205 @@
+package mnms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// TestCredentials tests storing, scoping and resolving device credentials
+func TestCredentials(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+
+	const mac, other = "00-60-E9-18-3C-3C", "00-60-E9-18-3C-3D"
+	err = SetDeviceGroup(DeviceGroup{Name: "plant1", Macs: []string{mac}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetCredential(Credential{Name: "plant1", Username: "admin", Password: "Secret#1", DeviceGroups: []string{"plant1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetCredential(Credential{Name: "lab", Username: "admin", Password: credentialMask})
+	if err == nil {
+		t.Fatal("expect masked password of a new credential to fail")
+	}
+	err = SetCredential(Credential{Name: "plant1", Username: "root", Password: credentialMask, DeviceGroups: []string{"plant1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := GetCredentials()
+	if err != nil || len(creds) != 1 || creds[0].Password != credentialMask || creds[0].Username != "root" {
+		t.Fatal("expect masked credential", creds, err)
+	}
+
+	username, password, n, err := deviceLogin([]string{"@cred:plant1", "show", "ip"}, mac)
+	if err != nil || username != "root" || password != "Secret#1" || n != 1 {
+		t.Fatal("expect credential kept its password", username, password, n, err)
+	}
+	if _, _, _, err = deviceLogin([]string{"@cred:plant1"}, other); err == nil {
+		t.Fatal("expect credential out of scope to fail")
+	}
+	if username, password, n, err = deviceLogin([]string{"admin", "default", "show"}, mac); err != nil ||
+		username != "admin" || password != "default" || n != 2 {
+		t.Fatal("expect plain login", username, password, n, err)
+	}
+
+	if err = CheckCommandCredentials("switch " + mac + " @cred:plant1 show ip"); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckCommandCredentials("switch " + other + " @cred:plant1 show ip"); err == nil {
+		t.Fatal("expect command on device out of scope to fail")
+	}
+	if err = CheckCommandCredentials("switch " + mac + " @cred:nope show ip"); err == nil {
+		t.Fatal("expect unknown credential to fail")
+	}
+	if err = CheckCommandCredentials("switch 10.0.50.99 @cred:plant1 show ip"); err == nil {
+		t.Fatal("expect scoped credential without a device to fail")
+	}
+
+	// broker credentials are sent to the brokers they list only
+	const broker = "ssl://10.0.0.1:8883"
+	if err = SetCredential(Credential{Name: "broker", Username: "mnms", Password: "Secret#1", Brokers: []string{"10.0.0.1"}}); err == nil {
+		t.Fatal("expect invalid broker url to fail")
+	}
+	err = SetCredential(Credential{Name: "broker", Username: "mnms", Password: "Secret#1", Brokers: []string{broker}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetCredential(Credential{Name: "any", Username: "admin", Password: "Secret#1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckCommandCredentials("mqtt connect plant1 " + broker + " @cred:broker"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"mqtt connect plant1 ssl://10.9.9.9:8883 @cred:broker",
+		"mqtt connect plant1 " + broker + " @cred:any",
+		"mqtt connect plant1 " + broker + " @cred:plant1",
+		"switch " + mac + " @cred:broker show ip",
+	} {
+		if err = CheckCommandCredentials(cmd); err == nil {
+			t.Fatal("expect credential out of scope to fail", cmd)
+		}
+	}
+
+	// opcua credentials are sent to the endpoints they list only
+	const endpoint = "opc.tcp://10.0.0.5:4840"
+	if err = SetCredential(Credential{Name: "plc", Username: "mnms", Password: "Secret#1", Endpoints: []string{broker}}); err == nil {
+		t.Fatal("expect invalid opcua endpoint to fail")
+	}
+	err = SetCredential(Credential{Name: "plc", Username: "mnms", Password: "Secret#1", Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckCommandCredentials("opcua connect plc1 " + endpoint + " @cred:plc"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{
+		"opcua connect plc1 opc.tcp://10.9.9.9:4840 @cred:plc",
+		"opcua connect plc1 " + endpoint + " @cred:any",
+		"opcua connect plc1 " + endpoint + " @cred:broker",
+		"mqtt connect plant1 " + broker + " @cred:plc",
+		"switch " + mac + " @cred:plc show ip",
+	} {
+		if err = CheckCommandCredentials(cmd); err == nil {
+			t.Fatal("expect credential out of scope to fail", cmd)
+		}
+	}
+	if _, _, err = resolveCredential("plc", ""); err == nil {
+		t.Fatal("expect opcua credential without endpoint to fail")
+	}
+
+	// clients resolve credentials from the root
+	handler := jwtauth.Verifier(jwtTokenAuth)(requirePermission(PermCredentialsResolve)(http.HandlerFunc(HandleCredentialResolve)))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	isRoot, rootURL, adminToken := QC.IsRoot, QC.RootURL, QC.AdminToken
+	defer func() {
+		QC.IsRoot, QC.RootURL, QC.AdminToken = isRoot, rootURL, adminToken
+	}()
+	QC.IsRoot = false
+	QC.RootURL = srv.URL
+	QC.AdminToken, err = GetToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password, err = resolveCredential("plant1", mac)
+	if err != nil || username != "root" || password != "Secret#1" {
+		t.Fatal("expect credential from root", username, password, err)
+	}
+	if _, _, err = resolveCredential("plant1", other); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatal("expect root to refuse device out of scope", err)
+	}
+	if _, _, err = resolveCredential("plant1", ""); err == nil {
+		t.Fatal("expect root to refuse a scoped credential without a device")
+	}
+	if username, _, err = resolveCredential("broker", broker); err != nil || username != "mnms" {
+		t.Fatal("expect broker credential from root", username, err)
+	}
+	for _, target := range []string{"ssl://10.9.9.9:8883", ""} {
+		if _, _, err = resolveCredential("broker", target); err == nil {
+			t.Fatal("expect root to refuse broker credential for", target)
+		}
+	}
+	if _, _, err = resolveCredential("any", broker); err == nil {
+		t.Fatal("expect root to refuse a credential not listing the broker")
+	}
+	if username, _, err = resolveCredential("plc", endpoint); err != nil || username != "mnms" {
+		t.Fatal("expect opcua credential from root", username, err)
+	}
+	if _, _, err = resolveCredential("broker", endpoint); err == nil {
+		t.Fatal("expect root to refuse a credential not listing the endpoint")
+	}
+
+	err = DeleteCredential("plant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"broker", "any", "plc"} {
+		if err = DeleteCredential(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = DeleteCredential("plant1"); err == nil {
+		t.Fatal("expect deleting a deleted credential to fail")
+	}
+}
+
+// TestCredentialCommands tests commands with credential references
+func TestCredentialCommands(t *testing.T) {
+	for cmd, want := range map[string]string{
+		"switch 00-60-E9-18-3C-3C @cred:plant1 show ip":      "switch 00-60-E9-18-3C-3C @cred:plant1 show ip",
+		"switch 00-60-E9-18-3C-3C admin default show ip":     "switch 00-60-E9-18-3C-3C admin *** show ip",
+		"reset 00-60-E9-18-3C-3C 10.0.50.1 @cred:plant1":     "reset 00-60-E9-18-3C-3C 10.0.50.1 @cred:plant1",
+		"snmp communities @cred:plant1 00-60-E9-18-3C-3C":    "snmp communities @cred:plant1 00-60-E9-18-3C-3C",
+		"config snmp enable 00-60-E9-18-3C-3C admin default": "config snmp enable 00-60-E9-18-3C-3C admin ***",
+	} {
+		if got := RedactCommand(cmd); got != want {
+			t.Errorf("RedactCommand(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+	for cmd, want := range map[string]string{
+		"config snmp enable 00-60-E9-18-3C-3C @cred:plant1":   "switch 00-60-E9-18-3C-3C @cred:plant1 snmp enable",
+		"config snmp disable 00-60-E9-18-3C-3C admin default": "switch 00-60-E9-18-3C-3C admin default no snmp enable",
+	} {
+		got, err := ConvertSnmpCmd(cmd)
+		if err != nil || got != want {
+			t.Errorf("ConvertSnmpCmd(%q) = %q, %v, want %q", cmd, got, err, want)
+		}
+	}
+	if _, err := ConvertSnmpCmd("config snmp enable 00-60-E9-18-3C-3C admin"); err == nil {
+		t.Error("expect missing password to fail")
+	}
+}
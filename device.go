@@ -169,6 +169,7 @@ func InsertDev(deviceDesc DevInfo) bool {
 			QC.DevMutex.Unlock()
 
 			q.Q("override previous entry", dev, deviceDesc, len(QC.DevData))
+			publishDevice("update", deviceDesc)
 			return true
 		}
 		q.Q("incomplete device seen before", dev, deviceDesc, len(QC.DevData))
@@ -183,9 +184,23 @@ func InsertDev(deviceDesc DevInfo) bool {
 	QC.DevMutex.Lock()
 	QC.DevData[deviceDesc.Mac] = deviceDesc
 	QC.DevMutex.Unlock()
+	publishDevice("new", deviceDesc)
 	return true
 }
 
+// publishDevice sends device changes to websocket and mqtt clients.
+func publishDevice(change string, dev DevInfo) {
+	publishMqttDevice(dev)
+	PublishWebSocketMessage(WebSocketMessage{
+		Kind:    "device",
+		Topic:   WebSocketTopicDevices,
+		Level:   LOG_INFO,
+		Mac:     dev.Mac,
+		Message: change,
+		Data:    dev,
+	})
+}
+
 func SaveDevices() (string, error) {
 	// generate a file with timestamp
 	fn := fmt.Sprintf("devices-%s.json", time.Now().Format("20060102T150405"))
@@ -402,6 +402,7 @@ func ProcessDirectCommands() error {
 			}
 			// save config
 			err = WriteMNMSConfig(&c)
+			AuditLocal("config import", dc.In, err)
 			if err != nil {
 				return err
 			}
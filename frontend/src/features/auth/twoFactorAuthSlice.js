@@ -68,15 +68,15 @@ export const disableSecretKey = createAsyncThunk(
 
 export const validateCode = createAsyncThunk(
   "twoFactorAuth/validateCode",
-  async ({ sessionID, code }, thunkAPI) => {
+  // body is {sessionID, code}, {sessionID, recoveryCode} or
+  // {sessionID, assertion}
+  async (body, thunkAPI) => {
     try {
-      const response = await ProtectedApis.post("/api/v1/2fa/validate", {
-        sessionID,
-        code,
-      });
+      const response = await ProtectedApis.post("/api/v1/2fa/validate", body);
       let data = await response.data;
       if (response.status === 200) {
         sessionStorage.setItem("nmstoken", data.token);
+        sessionStorage.setItem("nmsrefreshtoken", data.refreshToken);
         sessionStorage.setItem("nmsuser", data.user);
         sessionStorage.setItem("nmsuserrole", data.role);
         ProtectedApis.defaults.headers.common[
@@ -135,6 +135,7 @@ const twoFactorAuthSlice = createSlice({
         state.account = payload?.account;
         state.issuer = payload?.issuer;
         state.secret = payload?.secret;
+        state.recoveryCodes = payload?.recoveryCodes;
         state.user = payload?.user;
         state.isFetching = false;
         state.isSuccess = true;
@@ -14,6 +14,7 @@ export const loginUser = createAsyncThunk(
       if (response.status === 200) {
         if (data.token) {
           sessionStorage.setItem("nmstoken", data.token);
+          sessionStorage.setItem("nmsrefreshtoken", data.refreshToken);
           sessionStorage.setItem("nmsuser", data.user);
           sessionStorage.setItem("nmsuserrole", data.role);
           sessionStorage.removeItem("sessionid");
@@ -25,6 +26,7 @@ export const loginUser = createAsyncThunk(
         // if sessionID is not empty, write to sessionIDSpan
         if (data.sessionID) {
           sessionStorage.setItem("sessionid", data.sessionID);
+          sessionStorage.setItem("2famethods", JSON.stringify(data.methods));
         }
         return data;
       } else {
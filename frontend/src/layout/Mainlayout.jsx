@@ -60,7 +60,10 @@ const Mainlayout = () => {
 
   useEffect(() => {
     console.log("in it");
-    const socket = new WebSocket.w3cwebsocket(`${wsURL}/api/v1/ws`);
+    const token = sessionStorage.getItem("nmstoken");
+    const socket = new WebSocket.w3cwebsocket(
+      `${wsURL}/api/v1/ws?token=${encodeURIComponent(token)}`
+    );
     socket.onopen = function () {
       socket.send(
         JSON.stringify({
@@ -1,14 +1,21 @@
-import { LogoutOutlined } from "@ant-design/icons";
-import { Avatar, Dropdown, Space, Typography } from "antd";
+import { KeyOutlined, LogoutOutlined } from "@ant-design/icons";
+import { App, Avatar, Dropdown, Space, Typography } from "antd";
 import React from "react";
 import { useNavigate } from "react-router-dom";
 import { useDispatch } from "react-redux";
 import { logoutUser } from "../../features/auth/userAuthSlice";
 import SettingsComp from "../../components/SettingsComp";
+import ProtectedApis from "../../utils/apis/protectedApis";
+import { createCredential } from "../../utils/comman/webauthn";
 
 const { Text } = Typography;
 
 const items = [
+  {
+    label: "Register Security Key",
+    key: "securitykey",
+    icon: <KeyOutlined />,
+  },
   {
     label: "Logout",
     key: "logout",
@@ -19,14 +26,53 @@ const items = [
 const HeaderRightContent = () => {
   const navigate = useNavigate();
   const dispatch = useDispatch();
+  const { modal, notification } = App.useApp();
+
+  const registerSecurityKey = async () => {
+    try {
+      const options = await ProtectedApis.get("/api/v1/2fa/webauthn/register");
+      const credential = await createCredential(options.data, "security key");
+      const response = await ProtectedApis.post(
+        "/api/v1/2fa/webauthn/register",
+        credential
+      );
+      notification.success({ message: "Security key registered!" });
+      if (response.data.recoveryCodes) {
+        modal.info({
+          title: "Recovery codes",
+          content: (
+            <>
+              <div>
+                Each code logs in once without the security key. They are not
+                shown again.
+              </div>
+              <pre>{response.data.recoveryCodes.join("\n")}</pre>
+            </>
+          ),
+        });
+      }
+    } catch (e) {
+      notification.error({
+        message: e.response?.data?.error || e.message,
+      });
+    }
+  };
+
   const handleMenuClick = (e) => {
+    if (e.key === "securitykey") {
+      registerSecurityKey();
+    }
     if (e.key === "logout") {
+      // revoke the server side session, the ui logs out either way
+      ProtectedApis.post("/api/v1/logout").catch(() => {});
       sessionStorage.removeItem("nmstoken");
+      sessionStorage.removeItem("nmsrefreshtoken");
       sessionStorage.removeItem("nmsuser");
       sessionStorage.removeItem("nmsuserrole");
       sessionStorage.removeItem("prevTopologyNodesData");
       sessionStorage.removeItem("qrcodeurl");
       sessionStorage.removeItem("sessionid");
+      sessionStorage.removeItem("2famethods");
       sessionStorage.removeItem("is2faenabled");
       dispatch(logoutUser());
       navigate("/login");
@@ -10,6 +10,7 @@ import {
   userAuthSelector,
 } from "../../features/auth/userAuthSlice";
 import ProtectedApis from "../../utils/apis/protectedApis";
+import PublicApis from "../../utils/apis/publicApis";
 import logo from "../../assets/images/bb-logo.svg";
 import SettingsComp from "../../components/SettingsComp";
 import TwoFAValidator from "../two_factor_auth/2FAValidator";
@@ -21,6 +22,7 @@ const Loginpage = () => {
   const navigate = useNavigate();
   const dispatch = useDispatch();
   const [is2FAModalOpen, set2FAModalOpen] = useState(false);
+  const [isOIDCEnabled, setOIDCEnabled] = useState(false);
   const { isFetching, isSuccess, isError, errorMessage } =
     useSelector(userAuthSelector);
   const [form] = Form.useForm();
@@ -32,6 +34,7 @@ const Loginpage = () => {
 
   useEffect(() => {
     sessionStorage.removeItem("nmstoken");
+    sessionStorage.removeItem("nmsrefreshtoken");
     sessionStorage.removeItem("nmsuser");
     sessionStorage.removeItem("nmsuserrole");
     sessionStorage.removeItem("sessionid");
@@ -39,6 +42,24 @@ const Loginpage = () => {
     delete ProtectedApis.defaults.headers.common["Authorization"];
     dispatch(clearAuthData());
 
+    // returning from an OpenID Connect login
+    const sso = new URLSearchParams(window.location.hash.substring(1));
+    if (sso.get("token")) {
+      window.history.replaceState(null, "", window.location.pathname);
+      sessionStorage.setItem("nmstoken", sso.get("token"));
+      sessionStorage.setItem("nmsrefreshtoken", sso.get("refreshToken"));
+      sessionStorage.setItem("nmsuser", sso.get("user"));
+      sessionStorage.setItem("nmsuserrole", sso.get("role"));
+      sessionStorage.setItem("is2faenabled", false);
+      ProtectedApis.defaults.headers.common[
+        "Authorization"
+      ] = `Bearer ${sso.get("token")}`;
+      navigate("/dashboard");
+    }
+    PublicApis.get("/api/v1/identity/providers")
+      .then((response) => setOIDCEnabled(response.data?.oidc === true))
+      .catch(() => setOIDCEnabled(false));
+
     return () => {
       dispatch(clearState());
     };
@@ -83,6 +104,7 @@ const Loginpage = () => {
           is2FAEnabled={is2FAEnabled}
           is2FAModalOpen={is2FAModalOpen}
           set2FAModalOpen={set2FAModalOpen}
+          isOIDCEnabled={isOIDCEnabled}
           //onGenPassordClick={() => setIsFormModalOpen(true)}
         />
       </Card>
@@ -140,6 +162,16 @@ const LoginForm = (props) => {
             Sign in
           </Button>
         </Form.Item>
+        {props.isOIDCEnabled && (
+          <Form.Item>
+            <Button
+              block
+              href={`${PublicApis.defaults.baseURL}/api/v1/oidc/login`}
+            >
+              Sign in with SSO
+            </Button>
+          </Form.Item>
+        )}
       </Form>
 
       {/**Start: 2FA Validator Modal */}
@@ -51,7 +51,7 @@ const UserManagement = () => {
   const [, set2FAEnabled] = useState(sessionId ? true : false);
   const [isQRModalOpen, setQRModalOpen] = useState(false);
   const { notification } = App.useApp();
-  const { isSuccess, isError, errorMessage, secret, account } =
+  const { isSuccess, isError, errorMessage, secret, account, recoveryCodes } =
     useSelector(twoFaAuthSelector);
 
   useEffect(() => {
@@ -81,6 +81,20 @@ const UserManagement = () => {
         notification.success({
           message: "Secret key generated successfully!",
         });
+        if (recoveryCodes) {
+          modal.info({
+            title: "Recovery codes",
+            content: (
+              <>
+                <div>
+                  Each code logs in once without the authenticator. They are
+                  not shown again.
+                </div>
+                <pre>{recoveryCodes.join("\n")}</pre>
+              </>
+            ),
+          });
+        }
         sessionStorage.setItem("is2faenabled", true);
         setQRModalOpen(true);
         dispatch(GetAllUsers());
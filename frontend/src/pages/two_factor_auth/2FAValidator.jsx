@@ -8,6 +8,8 @@ import {
 import logo from "../../assets/images/atop-full-logo.svg";
 import { validateCode } from "../../features/auth/twoFactorAuthSlice";
 import { useNavigate } from "react-router-dom";
+import PublicApis from "../../utils/apis/publicApis";
+import { getAssertion } from "../../utils/comman/webauthn";
 
 const TwoFAValidator = () => {
   const [form] = Form.useForm();
@@ -28,7 +30,9 @@ const QRCodeValidatorForm = (props) => {
   const navigate = useNavigate();
   const { notification } = App.useApp();
   const [qrCode, setQrCode] = useState("");
+  const [useRecovery, setUseRecovery] = useState(false);
   const sessionid = sessionStorage.getItem("sessionid") !== null;
+  const methods = JSON.parse(sessionStorage.getItem("2famethods") || "[]");
 
   const dispatch = useDispatch();
   const { isSuccess, isError} =
@@ -38,7 +42,7 @@ const QRCodeValidatorForm = (props) => {
     if (isError) {
       dispatch(clearState());
       notification.error({
-        message: "Invalid 2FA Code!",
+        message: useRecovery ? "Invalid recovery code!" : "Invalid 2FA Code!",
       });
     }
 
@@ -51,9 +55,28 @@ const QRCodeValidatorForm = (props) => {
 
   const ValidateCode = () => {
     const sessionId = sessionStorage.getItem("sessionid");
+    if (useRecovery) {
+      dispatch(validateCode({ sessionID: sessionId, recoveryCode: qrCode }));
+      return;
+    }
     dispatch(validateCode({ sessionID: sessionId, code: qrCode }));
   };
 
+  const ValidateSecurityKey = async () => {
+    const sessionId = sessionStorage.getItem("sessionid");
+    try {
+      const response = await PublicApis.post("/api/v1/2fa/webauthn/login", {
+        sessionID: sessionId,
+      });
+      const assertion = await getAssertion(response.data);
+      dispatch(validateCode({ sessionID: sessionId, assertion }));
+    } catch (e) {
+      notification.error({
+        message: e.response?.data?.error || e.message,
+      });
+    }
+  };
+
   return (
     <Space direction="vertical" align="center" size={40}>
       <Image height={56} src={logo} preview={false} />
@@ -62,7 +85,9 @@ const QRCodeValidatorForm = (props) => {
           {sessionid && sessionStorage.getItem("qrcodeurl") === null && (
             <>
               <div style={{ marginBottom: "10px" }}>
-                Open Google Authenticator to get 2fa code
+                {useRecovery
+                  ? "Enter one of your recovery codes"
+                  : "Open Google Authenticator to get 2fa code"}
               </div>
               <>
                 <Form.Item
@@ -75,7 +100,9 @@ const QRCodeValidatorForm = (props) => {
                   ]}
                 >
                   <Input
-                    placeholder="Enter 2FA Code"
+                    placeholder={
+                      useRecovery ? "Enter Recovery Code" : "Enter 2FA Code"
+                    }
                     onChange={(e) => {
                       setQrCode(e.target.value);
                     }}
@@ -90,6 +117,22 @@ const QRCodeValidatorForm = (props) => {
                   >
                     Validate Code
                   </Button>
+                  {methods.includes("webauthn") && (
+                    <Button
+                      block
+                      style={{ marginTop: "10px" }}
+                      onClick={() => ValidateSecurityKey()}
+                    >
+                      Use Security Key
+                    </Button>
+                  )}
+                  <Button
+                    type="link"
+                    block
+                    onClick={() => setUseRecovery(!useRecovery)}
+                  >
+                    {useRecovery ? "Use 2FA code" : "Use a recovery code"}
+                  </Button>
                   {/* <div style={{ marginTop: "15px", textAlign: "center" }}>
                     *If you forget 2FA code, contact Admin!
                   </div> */}
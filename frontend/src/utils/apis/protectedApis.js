@@ -13,4 +13,48 @@ instance.defaults.headers.common[
   "Authorization"
 ] = `Bearer ${sessionStorage.getItem("nmstoken")}`;
 
+// access tokens are short lived, renew them with the refresh token once
+// and retry the request
+let refreshing = null;
+
+const refreshToken = async () => {
+  const response = await axios.post(`${baseURL}/api/v1/token/refresh`, {
+    refreshToken: sessionStorage.getItem("nmsrefreshtoken"),
+  });
+  sessionStorage.setItem("nmstoken", response.data.token);
+  sessionStorage.setItem("nmsrefreshtoken", response.data.refreshToken);
+  instance.defaults.headers.common[
+    "Authorization"
+  ] = `Bearer ${response.data.token}`;
+  return response.data.token;
+};
+
+instance.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const config = error.config;
+    if (
+      error.response?.status !== 401 ||
+      config._retried ||
+      sessionStorage.getItem("nmsrefreshtoken") === null
+    ) {
+      return Promise.reject(error);
+    }
+    config._retried = true;
+    try {
+      refreshing = refreshing || refreshToken();
+      const token = await refreshing;
+      config.headers["Authorization"] = `Bearer ${token}`;
+      return instance(config);
+    } catch (e) {
+      sessionStorage.removeItem("nmstoken");
+      sessionStorage.removeItem("nmsrefreshtoken");
+      window.location.assign("/login");
+      return Promise.reject(error);
+    } finally {
+      refreshing = null;
+    }
+  }
+);
+
 export default instance;
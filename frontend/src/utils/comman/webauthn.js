@@ -0,0 +1,61 @@
+// The mnms api sends and expects binary WebAuthn fields base64url encoded,
+// the browser api uses ArrayBuffers.
+
+const toBuffer = (b64url) => {
+  const b64 = b64url.replace(/-/g, "+").replace(/_/g, "/");
+  const bin = atob(b64 + "===".slice((b64.length + 3) % 4));
+  return Uint8Array.from(bin, (c) => c.charCodeAt(0)).buffer;
+};
+
+const toBase64url = (buf) =>
+  btoa(String.fromCharCode(...new Uint8Array(buf)))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+
+// createCredential registers a security key with creation options from
+// GET /api/v1/2fa/webauthn/register
+export const createCredential = async (options, name) => {
+  const credential = await navigator.credentials.create({
+    publicKey: {
+      ...options,
+      challenge: toBuffer(options.challenge),
+      user: { ...options.user, id: toBuffer(options.user.id) },
+      excludeCredentials: (options.excludeCredentials || []).map((c) => ({
+        ...c,
+        id: toBuffer(c.id),
+      })),
+    },
+  });
+  return {
+    id: credential.id,
+    name,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      attestationObject: toBase64url(credential.response.attestationObject),
+    },
+  };
+};
+
+// getAssertion signs the challenge of request options from
+// POST /api/v1/2fa/webauthn/login
+export const getAssertion = async (options) => {
+  const credential = await navigator.credentials.get({
+    publicKey: {
+      ...options,
+      challenge: toBuffer(options.challenge),
+      allowCredentials: options.allowCredentials.map((c) => ({
+        ...c,
+        id: toBuffer(c.id),
+      })),
+    },
+  });
+  return {
+    id: credential.id,
+    response: {
+      clientDataJSON: toBase64url(credential.response.clientDataJSON),
+      authenticatorData: toBase64url(credential.response.authenticatorData),
+      signature: toBase64url(credential.response.signature),
+    },
+  };
+};
@@ -92,7 +92,7 @@ func GwdMain() {
 		}(ifaceName)
 	}
 	for {
-		time.Sleep(time.Duration(QC.GwdInterval) * time.Second)
+		time.Sleep(time.Duration(ReadSetting(&QC.GwdInterval)) * time.Second)
 		_ = GwdInvite()
 	}
 	//wg.Wait()
@@ -15,8 +15,12 @@ func HelpCmd(cmd string) string {
 		[ip address]  : target device ip address
 		[username]    : target device login user name
 		[password]    : target device login passwaord
+
+	Usage : mtderase [mac address] [ip address] @cred:[credential]
+		[credential]  : name of the device credential in the credential vault
 	Example :
 		mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 admin default
+		mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 @cred:plant1
 		`
 	}
 	if strings.HasPrefix(cmd, "help beep") {
@@ -39,8 +43,12 @@ func HelpCmd(cmd string) string {
 		[ip address]  : target device ip address
 		[username]    : target device login user name
 		[password]    : target device login passwaord
+
+	Usage : reset [mac address] [ip address] @cred:[credential]
+		[credential]  : name of the device credential in the credential vault
 	Example :
 		reset AA-BB-CC-DD-EE-FF 10.0.50.1 admin default
+		reset AA-BB-CC-DD-EE-FF 10.0.50.1 @cred:plant1
 		`
 	}
 	if strings.HasPrefix(cmd, "help scan") {
@@ -96,11 +104,13 @@ func HelpCmd(cmd string) string {
 		[password]    : target device login passwaord
 	Example :
 		config mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 admin default
+		config mtderase AA-BB-CC-DD-EE-FF 10.0.50.1 @cred:plant1
 		
 	Usage : config snmp [enable]
 		[enable]      : enable/disable
 	Example :
 		config snmp enable AA-BB-CC-DD-EE-FF admin default
+		config snmp enable AA-BB-CC-DD-EE-FF @cred:plant1
 		
 	Usage : config local syslog path [path]
 		[path]        : local syslog path
@@ -117,12 +127,19 @@ func HelpCmd(cmd string) string {
 	Example :
 		config local syslog compress true
 
+	Usage : config local syslog retention [days] [budget]
+		[days]         : remove archived syslog files older than days, 0 keeps them
+		[budget]       : total megabytes of syslog files to keep, 0 is unlimited
+	Example :
+		config local syslog retention 30 500
+
 	Usage : config switch save [mac address] [username] [password]
 		[mac address] : target device mac address
 		[username]    : target device login user name
 		[password]    : target device login passwaord
 	Example :
 		config switch save AA-BB-CC-DD-EE-FF admin default
+		config switch save AA-BB-CC-DD-EE-FF @cred:plant1
 
 	Usage : config local syslog read [start date] [start time] [end date] [end time] [max line]
 		[start date]   : search syslog start date
@@ -135,6 +152,48 @@ func HelpCmd(cmd string) string {
 		config local syslog read 5
 		config local syslog read 2023/02/21 22:06:00 2023/02/22 22:08:00 5
 
+	Usage : config local syslog rule add [name] [kind] [pattern]
+		[name]         : rule name
+		[kind]         : regex or kv
+		[pattern]      : regular expression, named groups become fields
+	Usage : config local syslog rule delete [name]
+	Usage : config local syslog rule list
+	Example :
+		config local syslog rule add fan regex fan (?P<fan>\d+) (?P<fanstate>failed|ok)
+		config local syslog rule delete fan
+		config local syslog rule list
+
+	Usage : config local syslog forward add [name] [protocol] [address] [format] [options]
+		[name]         : target name
+		[protocol]     : udp, tcp or tls
+		[address]      : target address as host:port
+		[format]       : rfc3164, rfc5424 or json
+		[options]      : severity=[0-7] facility=[list] host=[list] device=[list]
+		                 insecure=true match=[regex], match must be the last option
+	Usage : config local syslog forward delete [name]
+	Usage : config local syslog forward list
+	Example :
+		config local syslog forward add siem tls 10.0.50.2:6514 json severity=4
+		config local syslog forward add auth udp 10.0.50.3:514 rfc5424 facility=4,10 match=login fail
+		config local syslog forward delete siem
+		config local syslog forward list
+
+	Usage : config reload
+		reads the settings file and environment again, applies the settings
+		that can change while running and lists the settings needing a restart
+	Example :
+		config reload
+		@client1 config reload
+
+	Usage : config profile [hash] [key=value...]
+		[hash]         : hash of the profile settings
+		[key=value]    : setting of the settings file, fetched from root when not given
+		root sends the hash of the profile of a client node with this command
+	Usage : config profile clear
+	Example :
+		@client1 config profile 3f2a9c01
+		@client1 config profile 3f2a9c01 intervals.gwd=120 syslog.remote=10.0.50.2:5514
+
 		`
 	}
 	if strings.HasPrefix(cmd, "help switch") {
@@ -146,8 +205,12 @@ func HelpCmd(cmd string) string {
 		[username]    : target device login user name
 		[password]    : target device login passwaord
 		[cli cmd...]  : target device cli command
+
+	Usage : switch [mac address] @cred:[credential] [cli cmd...]
+		[credential]  : name of the device credential in the credential vault
 	Example :
 		switch AA-BB-CC-DD-EE-FF admin default show ip
+		switch AA-BB-CC-DD-EE-FF @cred:plant1 show ip
 		`
 	}
 
@@ -179,6 +242,7 @@ func HelpCmd(cmd string) string {
 
  Example: 
  		snmp communities admin default 00-60-E9-27-E3-39
+ 		snmp communities @cred:plant1 00-60-E9-27-E3-39
 
  Usage: snmp update community [mac] [read community] [write community]
  	Update device's SNMP communities manually.
@@ -244,18 +308,31 @@ Example:
 	}
 	if strings.HasPrefix(cmd, "help mqtt") {
 		return `
-  Use mqtt to publish/subscribe/unsubscribe/list topic.
-
-	Usage : mqtt [mqttcmd] [topic] [data...]
+  Use mqtt to connect/publish/subscribe/unsubscribe/list topic.
+
+	Usage : mqtt connect [name] [broker url] [@cred:name] [option=value...]
+		[name]        : connection name
+		[broker url]  : tcp://, ssl://, ws:// or wss:// host:port
+		[@cred:name]  : username and password of the broker from the credential vault
+		[option]      : user, password, clientid, clean, qos, retain,
+		                will, willmsg, willqos, willretain, ca, cert, key, insecure
+	Usage : mqtt disconnect [name]
+	Usage : mqtt [mqttcmd] [name|tcp address] [topic] [data...]
 		[mqttcmd]     : pub/sub/unsub/list
-		                list is show all subscribe topic
+		                list is show all connections and subscribe topic
+		[name]        : connection name
 		[tcp address] :	would pub/sub/unsub broker tcp address
 		[topic]       : topic name
-		[data...]     : data is messages, only publish use it.
+		[data...]     : data is messages, only publish use it,
+		                subscribe can give the qos.
 	Example :
+		mqtt connect plant1 ssl://192.168.12.1:8883 @cred:broker clientid=mnms1 clean=false qos=1 ca=ca.pem
+		mqtt sub plant1 factory/# 2
+		mqtt pub plant1 topictest "this is messages."
 		mqtt pub 192.168.12.1:1883 topictest "this is messages."
 		mqtt sub 192.168.12.1:1883 topictest
 		mqtt unsub 192.168.12.1:1883 topictest
+		mqtt disconnect plant1
 		mqtt list
 		`
 	}
@@ -263,35 +340,121 @@ Example:
 		return `
   Opcua setting.
   
-	Usage : opcua connect [url]	
+	Usage : opcua connect [name] [url] [@cred:name] [option=value...]
+		[name]        : connection name, default when left out
 		[url]         : connect to url
+		[@cred:name]  : username and password from the credential vault
+		[option]      : user, password, cert, key, ca,
+		                policy (best, none, Basic256Sha256, Aes128Sha256RsaOaep, Aes256Sha256RsaPss)
 	Example :
 		opcua connect opc.tcp://127.0.0.1:4840
+		opcua connect plc1 opc.tcp://10.0.0.5:4840 @cred:plc policy=Basic256Sha256
 
-	Usage : opcua read [node id]
+	Usage : opcua read [name] [node id]
+		[name]        : connection name, default when left out
 		[node id]     : opcua node id
 	Example :
 		opcua read i=1002
+		opcua read plc1 ns=2;s=Temperature
 
-	Usage : opcua browse [node id]
+	Usage : opcua browse [name] [node id]
+		[name]        : connection name, default when left out
 		[node id]     : opcua node id
 	Example :
 		opcua browse i=85
 
-	Usage : opcua sub [node id]
+	Usage : opcua export [name] [node id] [option=value...]
+		[name]        : connection name, default when left out
+		[node id]     : opcua node id of the subtree
+		[option]      : depth, levels to browse, default 5
+		                max, maximum number of nodes, default 5000
+	Example :
+		opcua export i=85
+		opcua export plc1 ns=2;s=Line1 depth=3
+
+	Usage : opcua write [name] [node id] [value]
+		[name]        : connection name, default when left out
 		[node id]     : opcua node id
+		[value]       : type:value, type[]:value,value for arrays, or a value
+		                of the data type of the node. types are boolean,
+		                sbyte, byte, int16, uint16, int32, uint32, int64, uint64,
+		                float, double, string, datetime, bytestring, nodeid,
+		                localizedtext
+	Example :
+		opcua write i=1002 21.5
+		opcua write plc1 ns=2;s=Setpoint double:21.5
+		opcua write plc1 ns=2;s=Recipe int32[]:1,2,3
+
+	Usage : opcua call [name] [object id] [method id] [argument...]
+		[name]        : connection name, default when left out
+		[object id]   : opcua node id of the object
+		[method id]   : opcua node id of the method
+		[argument]    : input arguments as type:value, see opcua write
+	Example :
+		opcua call plc1 ns=2;s=Pump ns=2;s=Pump/Start
+		opcua call plc1 ns=2;s=Mixer ns=2;s=Mixer/SetSpeed double:120.5 boolean:true
+
+	Usage : opcua historyread [name] [node id...] [option=value...]
+		[name]        : connection name, default when left out
+		[node id]     : opcua node ids
+		[option]      : start, RFC3339 time or duration before now, default 1h
+		                end, RFC3339 time or duration before now, default now
+		                max, maximum raw values per node, default all
+		                aggregate, read processed values with interpolative,
+		                  average, timeaverage, total, minimum, maximum, range,
+		                  count, start, end or delta
+		                interval, processing interval in ms, default start to end
+	Example :
+		opcua historyread i=1002
+		opcua historyread plc1 ns=2;s=Temperature start=24h max=100
+		opcua historyread plc1 ns=2;s=Temperature start=2023-02-10T00:00:00Z end=2023-02-11T00:00:00Z aggregate=average interval=3600000
+
+	Usage : opcua sub [name] [node id...] [option=value...]
+		[name]        : connection name, default when left out
+		[node id]     : opcua node ids to monitor
+		[option]      : interval, publishing interval in ms, default 1000
+		                sampling, sampling interval in ms, default 500
+		                queue, queue size, default 1
+		                deadband, deadband value, default none
+		                deadbandtype, absolute or percent, default absolute
 	Example :
 		opcua sub i=1002
+		opcua sub plc1 ns=2;s=Temperature ns=2;s=Pressure interval=500 sampling=100 deadband=0.5
 
-	Usage : opcua deletesub [sub id] [monitor id]
+	Usage : opcua unsub [name] [sub id]
+		[name]        : connection name, default when left out
+		[sub id]      : subscription id
+	Example :
+		opcua unsub plc1 1
+
+	Usage : opcua deletesub [name] [sub id] [monitor id]
+		[name]        : connection name, default when left out
 		[sub id]      : subscribe id
 		[monitor id]  : monitored item id
 	Example :
 		opcua deletesub 1 1
 
-	Usage : opcua close
+	Usage : opcua list
+	Example :
+		opcua list
+
+	Usage : opcua close [name]
+		[name]        : connection name, default when left out
 	Example :
 		opcua close
+		opcua close plc1
+
+	Usage : opcua cert list
+	Usage : opcua cert trust [file|thumbprint]
+	Usage : opcua cert reject [file|thumbprint]
+		[file]        : certificate file to import, PEM or DER
+		[thumbprint]  : SHA1 thumbprint of a certificate of the other store
+	Usage : opcua cert delete [thumbprint]
+	Example :
+		opcua cert list
+		opcua cert trust /tmp/scada.der
+		opcua cert reject 3f1c0a5e2b8d4c6f7a9e0b1d2c3e4f5a6b7c8d9e
+		opcua cert delete 3f1c0a5e2b8d4c6f7a9e0b1d2c3e4f5a6b7c8d9e
 		`
 	}
 	if strings.HasPrefix(cmd, "help util") {
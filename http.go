@@ -18,7 +18,6 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/jwtauth/v5"
-	"github.com/icza/backscanner"
 	"github.com/influxdata/go-syslog/v3"
 	"github.com/pquerna/otp/totp"
 	"github.com/qeof/q"
@@ -132,13 +131,6 @@ func BuildRouter() http.Handler {
 		}
 	})
 
-	varifySuperUser := func(next http.Handler) http.Handler {
-		return JWTAuthenticatorRole(MNMSSuperUserRole, next)
-	}
-	varifyAdmin := func(next http.Handler) http.Handler {
-		return JWTAuthenticatorRole(MNMSAdminRole, next)
-	}
-
 	// static file directory
 	fileDir, err := CheckStaticFilesFolder()
 	if err != nil {
@@ -146,45 +138,92 @@ func BuildRouter() http.Handler {
 	}
 
 	r.Route("/api/v1", func(r chi.Router) {
-		r.HandleFunc("/login", HandleLogin)
-		r.Post("/2fa/validate", HandleValidate2FA)
+		r.With(audit("login")).HandleFunc("/login", HandleLogin)
+		r.With(audit("login 2fa")).Post("/2fa/validate", HandleValidate2FA)
+		r.Post("/2fa/webauthn/login", HandleWebAuthnLogin)
 		r.HandleFunc("/ws", WsEndpoint)
 		r.HandleFunc("/register", HandleRegister)
+		r.With(audit("password change")).Post("/password", HandleChangePassword)
+		r.Get("/identity/providers", HandleIdentityProviders)
+		r.Get("/oidc/login", HandleOIDCLogin)
+		r.Get("/oidc/callback", HandleOIDCCallback)
+		r.With(audit("token refresh")).Post("/token/refresh", HandleRefreshToken)
 
-		// admin permission
-		r.Group(func(r chi.Router) {
-			r.Use(jwtauth.Verifier(jwtTokenAuth))
-			r.Use(varifyAdmin)
-			r.Post("/users", HandleAddUser)
-			r.Put("/users", HandleUpdateUser)
-			r.Delete("/users", HandleDeleteUser)
-		})
-
-		// superuser permission
+		// permissions of the user's role
 		r.Group(func(r chi.Router) {
 			r.Use(jwtauth.Verifier(jwtTokenAuth))
-			r.Use(varifySuperUser)
-
-			r.Post("/commands", HandleCommands)
-			r.Post("/devices", HandleDevices)
-			r.Post("/topology", HandleTopology)
-			r.Get("/syslogs", HandleLocalSyslogs)
-			r.Post("/logs", HandleLogs)
 
+			r.With(audit("user add"), requirePermission(PermUsersWrite)).Post("/users", HandleAddUser)
+			r.With(audit("user update"), requirePermission(PermUsersWrite)).Put("/users", HandleUpdateUser)
+			r.With(audit("user delete"), requirePermission(PermUsersWrite)).Delete("/users", HandleDeleteUser)
+			r.With(audit("password policy"), requirePermission(PermUsersWrite)).HandleFunc("/users/policy", HandlePasswordPolicy)
+			r.With(audit("role"), requirePermission(PermUsersWrite)).HandleFunc("/roles", HandleRoles)
+			r.With(audit("device group"), requirePermission(PermUsersWrite)).HandleFunc("/devicegroups", HandleDeviceGroups)
+			r.With(audit("service account"), requirePermission(PermUsersWrite)).HandleFunc("/serviceaccounts", HandleServiceAccounts)
+			r.With(audit("api key"), requirePermission(PermUsersWrite)).HandleFunc("/apikeys", HandleAPIKeys)
+			r.With(audit("identity"), requirePermission(PermUsersWrite)).HandleFunc("/identity", HandleIdentityConfig)
+			r.With(requirePermission(PermCredentialsRead)).Get("/credentials", HandleCredentials)
+			r.With(audit("credential"), requirePermission(PermCredentialsWrite)).Post("/credentials", HandleCredentials)
+			r.With(audit("credential"), requirePermission(PermCredentialsWrite)).Delete("/credentials", HandleCredentials)
+			r.With(audit("credential resolve"), requirePermission(PermCredentialsResolve)).Post("/credentials/resolve", HandleCredentialResolve)
+			r.With(requirePermission(PermUsersRead)).Get("/users", HandleUsers)
+			r.With(requirePermission(PermUsersRead)).Get("/mqtt/accounts", HandleMqttAccounts)
+			r.With(audit("mqtt account"), requirePermission(PermUsersWrite)).Post("/mqtt/accounts", HandleMqttAccounts)
+			r.With(audit("mqtt account"), requirePermission(PermUsersWrite)).Delete("/mqtt/accounts", HandleMqttAccounts)
+			r.With(requirePermission(PermUsersRead)).Get("/mqtt/acls", HandleMqttACLs)
+			r.With(audit("mqtt acl"), requirePermission(PermUsersWrite)).Post("/mqtt/acls", HandleMqttACLs)
+			r.With(audit("mqtt acl"), requirePermission(PermUsersWrite)).Delete("/mqtt/acls", HandleMqttACLs)
+			r.With(requirePermission(PermSettingsRead)).Get("/mqtt/rules", HandleMqttRules)
+			r.With(audit("mqtt rule"), requirePermission(PermSettingsWrite)).Post("/mqtt/rules", HandleMqttRules)
+			r.With(audit("mqtt rule"), requirePermission(PermSettingsWrite)).Delete("/mqtt/rules", HandleMqttRules)
+			r.With(requirePermission(PermSettingsRead)).Get("/opcua/bridge", HandleOpcuaBridge)
+			r.With(requirePermission(PermSettingsRead)).Get("/opcua/bridge/servers", HandleOpcuaBridgeServers)
+			r.With(audit("opcua bridge"), requirePermission(PermSettingsWrite)).Post("/opcua/bridge/servers", HandleOpcuaBridgeServers)
+			r.With(audit("opcua bridge"), requirePermission(PermSettingsWrite)).Delete("/opcua/bridge/servers", HandleOpcuaBridgeServers)
+			r.With(requirePermission(PermSettingsRead)).Get("/opcua/bridge/tags", HandleOpcuaTags)
+			r.With(audit("opcua bridge"), requirePermission(PermSettingsWrite)).Post("/opcua/bridge/tags", HandleOpcuaTags)
+			r.With(audit("opcua bridge"), requirePermission(PermSettingsWrite)).Delete("/opcua/bridge/tags", HandleOpcuaTags)
+			r.With(requirePermission(PermLogsRead)).Get("/mqtt/events", HandleMqttEvents)
+			r.With(requirePermission(PermLogsRead)).Get("/opcua/events", HandleOpcuaEvents)
+			r.With(requirePermission(PermSettingsRead)).Get("/settings", HandleSettings)
+			r.With(requirePermission(PermSettingsRead)).Get("/profiles", HandleProfiles)
+			r.With(requirePermission(PermSettingsRead)).Get("/profiles/drift", HandleProfileDrift)
+			r.With(audit("profile resolve"), requirePermission(PermSettingsWrite)).Post("/profiles/resolve", HandleProfileResolve)
+			r.With(audit("profile"), requirePermission(PermSettingsWrite)).Post("/profiles", HandleProfiles)
+			r.With(audit("profile"), requirePermission(PermSettingsWrite)).Delete("/profiles", HandleProfiles)
+			r.With(requirePermission(PermAuditRead)).Get("/audit", HandleAudit)
+			r.With(requirePermission(PermAuditRead)).Get("/audit/verify", HandleAuditVerify)
+
+			r.With(audit("command"), requirePermission(PermCommandsWrite)).Post("/commands", HandleCommands)
+			r.With(requirePermission(PermCommandsRead)).Get("/commands", HandleCommands)
+			r.With(requirePermission(PermDevicesWrite)).Post("/devices", HandleDevices)
+			r.With(requirePermission(PermDevicesRead)).Get("/devices", HandleDevices)
+			r.With(requirePermission(PermTopologyWrite)).Post("/topology", HandleTopology)
+			r.With(requirePermission(PermTopologyRead)).Get("/topology", HandleTopology)
+			r.With(requirePermission(PermLogsWrite)).Post("/logs", HandleLogs)
+			r.With(requirePermission(PermLogsRead)).Get("/logs", HandleLogs)
+
+			r.With(requirePermission(PermSyslogsRead)).Get("/syslogs", HandleLocalSyslogs)
+			r.With(requirePermission(PermSyslogsRead)).Get("/syslogs/search", HandleSyslogSearch)
+			r.With(requirePermission(PermSyslogsRead)).Get("/syslogs/counts", HandleSyslogCounts)
+			r.With(requirePermission(PermSyslogsRead)).Get("/syslogs/archive", HandleSyslogArchive)
+			r.With(requirePermission(PermSyslogsRead)).Get("/syslogs/export", HandleSyslogExport)
+
+			r.With(requirePermission(PermFilesRead)).Group(func(r chi.Router) {
+				FileServer(r, "/files", http.Dir(fileDir))
+			})
 		})
-		// user permission
+		// any authenticated user
 		r.Group(func(r chi.Router) {
 			r.Use(jwtauth.Verifier(jwtTokenAuth))
-			r.Use(jwtauth.Authenticator)
-
-			r.Get("/commands", HandleCommands)
-			r.Get("/devices", HandleDevices)
-			r.Get("/topology", HandleTopology)
-			r.Get("/logs", HandleLogs)
-			r.Get("/users", HandleUsers)
-			r.HandleFunc("/2fa/secret", Handle2FA)
-
-			FileServer(r, "/files", http.Dir(fileDir))
+			r.Use(requirePermission(""))
+
+			r.With(audit("2fa")).HandleFunc("/2fa/secret", Handle2FA)
+			r.With(audit("2fa")).HandleFunc("/2fa/webauthn/register", HandleWebAuthnRegister)
+			r.With(audit("2fa")).HandleFunc("/2fa/webauthn", HandleWebAuthnCredentials)
+			r.With(audit("2fa")).Post("/2fa/recovery", HandleRecoveryCodes)
+			r.With(audit("logout")).Post("/logout", HandleLogout)
+			r.With(audit("session")).HandleFunc("/sessions", HandleSessions)
 		})
 	})
 	return r
@@ -292,6 +331,7 @@ func HandleCommands(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, err)
 			return
 		}
+		submitted := []string{}
 		for k, v := range cmddata {
 			found := false
 			ws := strings.Split(k, " ")
@@ -312,6 +352,44 @@ func HandleCommands(w http.ResponseWriter, r *http.Request) {
 				v.Result = "error: invalid command"
 				cmddata[k] = v
 			}
+			// the key is the command that is checked, a different command
+			// would run unchecked
+			if v.Command != "" && v.Command != k && v.Command != clientCommand(k) {
+				q.Q("error: command does not match", k, v.Command)
+				v.Status = "error: command does not match"
+				v.Command = k
+				cmddata[k] = v
+				submitted = append(submitted, RedactCommand(k))
+				continue
+			}
+			user := userFromContext(r.Context())
+			if user != nil {
+				err = CheckCommandPermission(user, k)
+				if err == nil && v.Status == "" {
+					err = CheckCommandCredentials(k)
+				}
+				if err != nil {
+					q.Q(err)
+					v.Status = "error: " + err.Error()
+					cmddata[k] = v
+					submitted = append(submitted, RedactCommand(k))
+					continue
+				}
+			}
+			if v.Status != "" {
+				// status update of a client
+				continue
+			}
+			if user != nil {
+				v.User = user.Name
+				cmddata[k] = v
+			}
+			submitted = append(submitted, RedactCommand(k))
+		}
+		if len(submitted) == 0 {
+			skipAudit(r)
+		} else {
+			setAuditDetail(r, "%s", strings.Join(submitted, "; "))
 		}
 		retrieveRootCmd(cmddata)
 		UpdateCmds(&cmddata)
@@ -420,6 +498,9 @@ func HandleDevices(w http.ResponseWriter, r *http.Request) {
 	q.Q(devid)
 	if len(devid) > 0 {
 		dev, err := FindDev(devid)
+		if err == nil && !deviceInScope(userFromContext(r.Context()), dev.Mac) {
+			err = fmt.Errorf("device %s not in scope", devid)
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			_, err = w.Write([]byte("error: " + err.Error()))
@@ -448,7 +529,7 @@ func HandleDevices(w http.ResponseWriter, r *http.Request) {
 	QC.DevMutex.Lock()
 	QC.DevData[specialMac] = specialDev
 	QC.DevMutex.Unlock()
-	jsonBytes, err := json.Marshal(QC.DevData)
+	jsonBytes, err := json.Marshal(devicesInScope(userFromContext(r.Context()), QC.DevData))
 	if err != nil {
 		RespondWithError(w, err)
 		return
@@ -537,6 +618,7 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 		QC.ClientMutex.Lock()
 		QC.Clients[name] = ci
 		QC.ClientMutex.Unlock()
+		checkClientProfile(ci)
 		_, err = w.Write(body)
 		if err != nil {
 			q.Q(err)
@@ -562,8 +644,8 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 //		         {"user":"user1@example.com","password":"Pas$word1"}
 //
 //		Response:
-//	     need 2fa : {"sessionID": "sessionID", "user":"user1"}
-//		   {"token": "AAA...", "user": "user1", "role": "admin"}
+//	     need 2fa : {"sessionID": "sessionID", "user":"user1", "methods": ["totp", "webauthn", "recovery"]}
+//		   {"token": "AAA...", "refreshToken": "9c1e...", "expiresIn": 900, "user": "user1", "role": "admin"}
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		if !QC.IsRoot {
@@ -585,17 +667,9 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, err)
 			return
 		}
+		setAuditUser(r, body.User)
 
-		token, err := generateJWT(body.User, body.Password)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			_, err = w.Write([]byte(err.Error()))
-			if err != nil {
-				q.Q(err)
-			}
-			return
-		}
-		user, err := GetUserConfig(body.User)
+		user, err := loginUser(body.User, body.Password)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			_, err = w.Write([]byte(err.Error()))
@@ -607,25 +681,22 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		res := make(map[string]interface{})
 		// check 2fa
 		if user.Enable2FA {
-			sessionID := createLoginSession(*user)
+			sessionID, err := createLoginSession(*user)
+			if err != nil {
+				RespondWithError(w, err)
+				return
+			}
 			res["sessionID"] = sessionID
 			res["user"] = user.Name
 			res["email"] = user.Email
+			res["methods"] = secondFactors(user)
 			err = json.NewEncoder(w).Encode(res)
 			if err != nil {
 				RespondWithError(w, err)
 			}
 			return
 		}
-		res["token"] = token
-		res["user"] = body.User
-		res["role"] = user.Role
-		q.Q(res)
-		err = json.NewEncoder(w).Encode(res)
-		if err != nil {
-			RespondWithError(w, err)
-		}
-		// w.Write([]byte(token))
+		respondWithTokens(w, r, user)
 		return
 	}
 }
@@ -650,6 +721,7 @@ func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	setAuditDetail(r, "user %s", body.Name)
 	if !UserExist(body.Name) {
 		RespondWithError(w, fmt.Errorf("user %s not exist", body.Name))
 		return
@@ -678,6 +750,7 @@ func HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	setAuditDetail(r, "user %s role %s", body.Name, body.Role)
 	if !UserExist(body.Name) {
 		RespondWithError(w, fmt.Errorf("user %s not exist", body.Name))
 		return
@@ -709,6 +782,7 @@ func HandleAddUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	setAuditDetail(r, "user %s role %s", body.Name, body.Role)
 
 	if UserExist(body.Name) {
 		RespondWithError(w, fmt.Errorf("user %s already exist", body.Name))
@@ -727,75 +801,86 @@ func HandleAddUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// secondFactors returns the second factors user can log in with.
+func secondFactors(user *UserConfig) []string {
+	methods := []string{}
+	if user.Secret != "" {
+		methods = append(methods, "totp")
+	}
+	if len(user.WebAuthn) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	if len(user.RecoveryCodes) > 0 {
+		methods = append(methods, "recovery")
+	}
+	return methods
+}
+
 // HandleValidate2FA handles 2FA validation requests
 // POST /api/v1/2fa/validate
 // request :{"sessionID":"id", "code":"123456"}
-// Validate 2fa code
-// example response: {"valid": true, "user": "user1", "token": "token", "role": "admin""}
-
+// or {"sessionID":"id", "recoveryCode":"4f2a1-9be07"}
+// or {"sessionID":"id", "assertion": {"id": "AbC...", "response": {"clientDataJSON": "eyJ...",
+// "authenticatorData": "SZY...", "signature": "MEU..."}}}
+// Validate 2fa code, recovery code or security key
+// example response: {"user": "user1", "token": "token", "refreshToken": "9c1e...", "role": "admin"}
 func HandleValidate2FA(w http.ResponseWriter, r *http.Request) {
-	var data map[string]string
+	var data struct {
+		SessionID    string             `json:"sessionID"`
+		Code         string             `json:"code"`
+		RecoveryCode string             `json:"recoveryCode"`
+		Assertion    *webAuthnAssertion `json:"assertion"`
+	}
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
 		RespondWithError(w, err)
 		return
 	}
 	defer r.Body.Close()
-	sessionID := data["sessionID"]
-	code := data["code"]
-	user, err := getLoginSession(sessionID)
+	user, err := getLoginSession(data.SessionID)
 	if err != nil {
 		RespondWithError(w, err)
 		return
 	}
-
-	if code == "" {
-		RespondWithError(w, fmt.Errorf("code is empty"))
-		return
-	}
+	setAuditUser(r, user.Name)
 
 	if !user.Enable2FA {
 		RespondWithError(w, fmt.Errorf("2fa not enabled"))
 		return
 	}
-	secret := user.Secret
-
-	valid := totp.Validate(code, secret)
-	q.Q(code, secret, valid)
-	var token string
-	if !valid {
-
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte("invalid code"))
-		return
 
+	switch {
+	case data.Assertion != nil:
+		setAuditDetail(r, "security key")
+		err = verifyWebAuthnAssertion(user.Name, takeLoginSessionChallenge(data.SessionID), data.Assertion)
+	case data.RecoveryCode != "":
+		setAuditDetail(r, "recovery code")
+		err = useRecoveryCode(user.Name, data.RecoveryCode)
+	case data.Code == "":
+		err = fmt.Errorf("code is empty")
+	case user.Secret == "" || !totp.Validate(data.Code, user.Secret):
+		err = fmt.Errorf("invalid code")
 	}
-	token, err = generateJWT(user.Name, user.Password)
 	if err != nil {
-		RespondWithError(w, err)
+		q.Q(user.Name, err)
+		loginSessionFailed(data.SessionID)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
-
-	res := make(map[string]interface{})
-	res["user"] = user.Name
-	res["token"] = token
-	res["role"] = user.Role
-	err = json.NewEncoder(w).Encode(res)
-	if err != nil {
-		RespondWithError(w, err)
-	}
-	return
+	deleteLoginSession(data.SessionID)
+	respondWithTokens(w, r, user)
 }
 
 // Handle2FA handles 2FA requests
 // GET /api/v1/2fa/secret?user=user1
-// get current user's 2fa secret
-// response : {"user":"user1", "secret":"secret"}
+// get user's 2fa status, the secret is only returned on enrollment
+// response : {"user":"user1", "enable2fa":true, "methods":["totp","recovery"], "recoveryCodes":10}
 //
 // POST /api/v1/2fa/secret
 // request body {"user":"user1"}
-// response : {"user":"user1", "secret":"secret"}
-// Generate 2fa secret
+// response : {"user":"user1", "secret":"secret", "recoveryCodes":["4f2a1-9be07", ...]}
+// Generate 2fa secret, recovery codes are returned when this turns on 2fa
 //
 // PUT /api/v1/2fa/secret
 // request body {"user":"user1"}
@@ -803,7 +888,7 @@ func HandleValidate2FA(w http.ResponseWriter, r *http.Request) {
 //
 // DELETE /api/v1/2fa/secret
 // request body {"user":"user1"}
-// Disable user's 2fa
+// Remove user's 2fa secret, 2fa is disabled when the user has no security key
 func Handle2FA(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
@@ -812,22 +897,21 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, fmt.Errorf("user is empty"))
 			return
 		}
+		if !checkManageUser(w, r, userID) {
+			return
+		}
 		user, err := GetUserConfig(userID)
 		if err != nil {
 			RespondWithError(w, err)
 			return
 		}
-		if !user.Enable2FA {
-			RespondWithError(w, fmt.Errorf("2fa not enabled"))
-			return
-		}
-		secret := user.Secret
 		res := make(map[string]interface{})
 		res["user"] = userID
-		res["secret"] = secret
 		res["account"] = user.Email
 		res["issuer"] = IssuerOf2FA
 		res["enable2fa"] = user.Enable2FA
+		res["methods"] = secondFactors(user)
+		res["recoveryCodes"] = len(user.RecoveryCodes)
 		err = json.NewEncoder(w).Encode(res)
 		if err != nil {
 			RespondWithError(w, err)
@@ -844,13 +928,17 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 		}
 		defer r.Body.Close()
 		userID := data["user"]
+		if !checkManageUser(w, r, userID) {
+			return
+		}
+		setAuditDetail(r, "enable user %s", userID)
 
 		user, err := GetUserConfig(userID)
 		if err != nil {
 			RespondWithError(w, err)
 			return
 		}
-		if user.Enable2FA {
+		if user.Secret != "" {
 			RespondWithError(w, fmt.Errorf("2fa already enabled, use PUT to update"))
 			return
 		}
@@ -865,9 +953,21 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// save 2fa secret
-		user.Secret = secret
-		user.Enable2FA = true
-		err = MergeUserConfig(*user)
+		var codes []string
+		err = modifyUser(userID, func(u *UserConfig) error {
+			if len(u.RecoveryCodes) == 0 {
+				var hashes []string
+				var err error
+				codes, hashes, err = generateRecoveryCodes()
+				if err != nil {
+					return err
+				}
+				u.RecoveryCodes = hashes
+			}
+			u.Secret = secret
+			u.Enable2FA = true
+			return nil
+		})
 		if err != nil {
 			RespondWithError(w, err)
 			return
@@ -875,6 +975,9 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 		// write response
 		res := make(map[string]interface{})
 		res["secret"] = secret
+		if codes != nil {
+			res["recoveryCodes"] = codes
+		}
 		res["account"] = user.Email
 		res["issuer"] = IssuerOf2FA
 		res["user"] = userID
@@ -894,12 +997,16 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 		}
 		defer r.Body.Close()
 		userID := data["user"]
+		if !checkManageUser(w, r, userID) {
+			return
+		}
+		setAuditDetail(r, "renew user %s", userID)
 		user, err := GetUserConfig(userID)
 		if err != nil {
 			RespondWithError(w, err)
 			return
 		}
-		if !user.Enable2FA {
+		if user.Secret == "" {
 			RespondWithError(w, fmt.Errorf("2fa not enabled"))
 			return
 		}
@@ -942,18 +1049,24 @@ func Handle2FA(w http.ResponseWriter, r *http.Request) {
 		}
 		defer r.Body.Close()
 		userID := data["user"]
+		if !checkManageUser(w, r, userID) {
+			return
+		}
+		setAuditDetail(r, "disable user %s", userID)
 		user, err := GetUserConfig(userID)
 		if err != nil {
 			RespondWithError(w, err)
 			return
 		}
-		if !user.Enable2FA {
+		if user.Secret == "" {
 			RespondWithError(w, fmt.Errorf("2fa not enabled"))
 			return
 		}
-		user.Enable2FA = false
-		user.Secret = ""
-		err = MergeUserConfig(*user)
+		err = modifyUser(userID, func(u *UserConfig) error {
+			u.Secret = ""
+			disable2FAIfNoFactor(u)
+			return nil
+		})
 		if err != nil {
 			RespondWithError(w, err)
 			return
@@ -983,6 +1096,8 @@ func HandleUsers(w http.ResponseWriter, r *http.Request) {
 	// hash password
 	for k, v := range c.Users {
 		v.Password = "#####"
+		v.Secret = ""
+		v.RecoveryCodes = nil
 		c.Users[k] = v
 	}
 
@@ -1042,7 +1157,7 @@ func HandleLogs(w http.ResponseWriter, r *http.Request) {
 //
 // Example parameter: { "start": "2023/02/21 22:06:00", "end": "2023/02/23 22:08:00", "number": 3}
 //
-// returns local syslogs from files
+// returns local syslogs from files, including rotated backups, newest first
 func HandleLocalSyslogs(w http.ResponseWriter, r *http.Request) {
 	start := r.URL.Query().Get("start")
 	end := r.URL.Query().Get("end")
@@ -1052,61 +1167,26 @@ func HandleLocalSyslogs(w http.ResponseWriter, r *http.Request) {
 	if number <= 0 {
 		number = 0
 	}
-
-	f, err := os.Open(QC.SyslogLocalPath)
-	if err != nil {
-		_, err = w.Write([]byte(""))
-		if err != nil {
-			q.Q(err)
-		}
-		return
+	query := SyslogQuery{Limit: number}
+	// invalid or missing time range means no time filtering
+	if _, err := compareTime(start, end, start); err == nil {
+		query.Start, _ = parseSyslogTime(start)
+		query.End, _ = parseSyslogTime(end)
 	}
-	defer func() {
-		_ = f.Close()
-	}()
-	fi, err := f.Stat()
+
+	logs := []syslog.Base{}
+	idx, err := GetSyslogIndex()
 	if err != nil {
-		_, err = w.Write([]byte(""))
+		q.Q(err)
+	} else {
+		result, err := idx.Search(query)
 		if err != nil {
 			q.Q(err)
-		}
-		return
-	}
-	scanner := backscanner.New(f, int(fi.Size()))
-	//fileScanner := bufio.NewScanner(f)
-	//fileScanner.Split(bufio.ScanLines)
-	logs := []syslog.Base{}
-
-	for {
-		line, _, err := scanner.LineBytes()
-		if err != nil {
-			if err == io.EOF {
-				q.Q(QC.SyslogLocalPath, "found to EOF")
-			} else {
-				q.Q("err:", err)
-			}
-			break
-		}
-		b, t, err := parsingDataofSyslog(string(line))
-		if err != nil {
-			continue
-		}
-		r, err := compareTime(start, end, t.Format(foramt))
-
-		if err != nil {
-			logs = append(logs, b)
 		} else {
-			if r {
-				logs = append(logs, b)
-			}
-		}
-
-		if number != 0 {
-			if len(logs) >= number {
-				break
+			for _, rec := range result.Records {
+				logs = append(logs, rec.base)
 			}
 		}
-
 	}
 
 	jsonBytes, err := json.Marshal(&logs)
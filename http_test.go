@@ -236,8 +236,12 @@ func TestJWT(t *testing.T) {
 		_ = cleanMNMSConfig()
 	}()
 
+	err := validUserPassword("admin", AdminDefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
 	// sample token string taken from the New example
-	tokenString, err := generateJWT("admin", AdminDefaultPassword)
+	tokenString, err := generateJWT("admin", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,420 @@
+package mnms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	External identity providers.
+
+	Users of an LDAP directory log in with their directory password at
+	/api/v1/login, users of an OpenID Connect provider with the
+	authorization code flow at /api/v1/oidc/login. The role of an
+	external user is mapped from its groups on each login and the user
+	is kept in the mnms config with its provider.
+
+	Local users always log in with their local password and are never
+	looked up in the directory, so they stay usable as break-glass
+	accounts when the provider is down.
+*/
+
+// secretMask replaces secrets in returned configurations.
+const secretMask = "***"
+
+// IdentityGroupRole maps members of a provider group to a role.
+type IdentityGroupRole struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// LDAPConfig configures LDAP bind authentication.
+type LDAPConfig struct {
+	URL            string              `json:"url"` // ldap://host:389 with StartTLS or ldaps://host:636
+	BindDN         string              `json:"bindDN"`
+	BindPassword   string              `json:"bindPassword"`
+	BaseDN         string              `json:"baseDN"`
+	UserFilter     string              `json:"userFilter"`     // default (uid=%s)
+	GroupAttribute string              `json:"groupAttribute"` // default memberOf
+	GroupRoles     []IdentityGroupRole `json:"groupRoles"`
+	DefaultRole    string              `json:"defaultRole"` // role of users in no mapped group, empty denies them
+	Insecure       bool                `json:"insecure"`    // skip tls certificate verification
+}
+
+// OIDCConfig configures OpenID Connect login.
+type OIDCConfig struct {
+	Issuer        string              `json:"issuer"`
+	ClientID      string              `json:"clientID"`
+	ClientSecret  string              `json:"clientSecret"`
+	RedirectURL   string              `json:"redirectURL"` // the /api/v1/oidc/callback url of this mnms
+	Scopes        []string            `json:"scopes"`
+	UsernameClaim string              `json:"usernameClaim"` // default preferred_username
+	GroupsClaim   string              `json:"groupsClaim"`   // default groups
+	GroupRoles    []IdentityGroupRole `json:"groupRoles"`
+	DefaultRole   string              `json:"defaultRole"`
+	UIRedirect    string              `json:"uiRedirect"` // web UI url receiving the token, default /
+}
+
+// IdentityConfig is the external identity provider configuration.
+type IdentityConfig struct {
+	LDAP *LDAPConfig `json:"ldap"`
+	OIDC *OIDCConfig `json:"oidc"`
+}
+
+// mapGroupsToRole returns the role of the first mapping matching one of
+// groups, defaultRole otherwise.
+func mapGroupsToRole(mappings []IdentityGroupRole, groups []string, defaultRole string) string {
+	for _, m := range mappings {
+		if containsFold(groups, m.Group) {
+			return m.Role
+		}
+	}
+	return defaultRole
+}
+
+func checkGroupRoles(c *MNMSConfig, mappings []IdentityGroupRole, defaultRole string) error {
+	for _, m := range mappings {
+		_, err := findRole(c, m.Role)
+		if err != nil {
+			return err
+		}
+	}
+	if defaultRole != "" {
+		_, err := findRole(c, defaultRole)
+		return err
+	}
+	return nil
+}
+
+// GetIdentityConfig returns the identity provider configuration.
+func GetIdentityConfig() (*IdentityConfig, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityConfig{LDAP: c.LDAP, OIDC: c.OIDC}, nil
+}
+
+// SetIdentityConfig validates and stores the identity provider
+// configuration. Masked secrets keep their stored values.
+func SetIdentityConfig(ic IdentityConfig) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		var err error
+		if ic.LDAP != nil {
+			if ic.LDAP.URL == "" || ic.LDAP.BaseDN == "" {
+				return fmt.Errorf("ldap url and base dn required")
+			}
+			if ic.LDAP.BindPassword == secretMask && c.LDAP != nil {
+				ic.LDAP.BindPassword = c.LDAP.BindPassword
+			}
+			_, err = parseLDAPFilter(ldapUserFilter(ic.LDAP, "user"))
+			if err != nil {
+				return err
+			}
+			err = checkGroupRoles(c, ic.LDAP.GroupRoles, ic.LDAP.DefaultRole)
+			if err != nil {
+				return err
+			}
+		}
+		if ic.OIDC != nil {
+			if ic.OIDC.Issuer == "" || ic.OIDC.ClientID == "" || ic.OIDC.RedirectURL == "" {
+				return fmt.Errorf("oidc issuer, client id and redirect url required")
+			}
+			if ic.OIDC.ClientSecret == secretMask && c.OIDC != nil {
+				ic.OIDC.ClientSecret = c.OIDC.ClientSecret
+			}
+			err = checkGroupRoles(c, ic.OIDC.GroupRoles, ic.OIDC.DefaultRole)
+			if err != nil {
+				return err
+			}
+		}
+		c.LDAP = ic.LDAP
+		c.OIDC = ic.OIDC
+		return nil
+	})
+}
+
+// upsertExternalUser adds or updates the user of provider with role.
+func upsertExternalUser(name, provider, role string) (*UserConfig, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty user name from %s", provider)
+	}
+	var ret UserConfig
+	roleChanged := false
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		for i := range c.Users {
+			u := &c.Users[i]
+			if u.Name != name {
+				continue
+			}
+			if u.Provider != provider {
+				return fmt.Errorf("user %s exists and is not a %s user", name, provider)
+			}
+			ret = *u
+			if u.Role == role {
+				return errMNMSConfigUnchanged
+			}
+			u.Role = role
+			ret.Role = role
+			roleChanged = true
+			return nil
+		}
+		ret = UserConfig{Name: name, Role: role, Provider: provider}
+		c.Users = append(c.Users, ret)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if roleChanged {
+		RevokeUserSessions(name)
+	}
+	return &ret, nil
+}
+
+func ldapUserFilter(cfg *LDAPConfig, user string) string {
+	filter := cfg.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	return strings.ReplaceAll(filter, "%s", ldapEscape(user))
+}
+
+// ldapAuthenticate binds as user with password and returns the role
+// mapped from the groups of user.
+func ldapAuthenticate(cfg *LDAPConfig, user, password string) (string, error) {
+	l, err := dialLDAP(cfg)
+	if err != nil {
+		return "", err
+	}
+	defer l.close()
+	if cfg.BindDN != "" {
+		err = l.bind(cfg.BindDN, cfg.BindPassword)
+		if err != nil {
+			return "", fmt.Errorf("ldap service bind: %v", err)
+		}
+	}
+	groupAttr := cfg.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	entries, err := l.search(cfg.BaseDN, ldapUserFilter(cfg, user), []string{groupAttr}, 2)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		// unknown users fail like wrong passwords
+		return "", fmt.Errorf("ldap user %s not found: %w", user, ErrLDAPInvalidCredentials)
+	}
+	err = l.bind(entries[0].DN, password)
+	if err != nil {
+		return "", err
+	}
+	groups := entries[0].Attrs[strings.ToLower(groupAttr)]
+	role := mapGroupsToRole(cfg.GroupRoles, groups, cfg.DefaultRole)
+	if role == "" {
+		return "", fmt.Errorf("ldap user %s is in no group with a role", user)
+	}
+	return role, nil
+}
+
+// loginUser authenticates a local user, or a directory user when LDAP
+// is configured and user is not a local user.
+func loginUser(user, password string) (*UserConfig, error) {
+	u, err := authenticateUser(user, password)
+	if err == nil {
+		return u, nil
+	}
+	local, lerr := GetUserConfig(user)
+	if lerr == nil && local.Provider != "ldap" {
+		return nil, err
+	}
+	c, cerr := GetMNMSConfig()
+	if cerr != nil || c.LDAP == nil {
+		return nil, err
+	}
+	policy := DefaultPasswordPolicy
+	if c.PasswordPolicy != nil {
+		policy = *c.PasswordPolicy
+	}
+	// directory users are locked out after failed logins like local users
+	now := time.Now()
+	failures := local
+	if lerr != nil {
+		failures = getDirectoryFailures(user)
+	}
+	if err = failures.checkLockout(now); err != nil {
+		return nil, err
+	}
+	role, err := ldapAuthenticate(c.LDAP, user, password)
+	if err != nil {
+		q.Q(err)
+		if errors.Is(err, ErrLDAPInvalidCredentials) {
+			directoryLoginFailed(user, policy, now)
+			return nil, errors.New("password not match")
+		}
+		return nil, err
+	}
+	if failures.FailedLogins != 0 || failures.LockedUntil != 0 {
+		directoryLoginSucceeded(user)
+	}
+	return upsertExternalUser(user, "ldap", role)
+}
+
+// directoryFailuresMax is the number of directory users whose failed
+// logins are kept in memory.
+const directoryFailuresMax = 1000
+
+// directoryFailures keeps the failed logins of directory users who are
+// not in the mnms config yet.
+var directoryFailures = struct {
+	sync.Mutex
+	users map[string]UserConfig
+}{users: make(map[string]UserConfig)}
+
+func getDirectoryFailures(user string) *UserConfig {
+	directoryFailures.Lock()
+	defer directoryFailures.Unlock()
+	u, ok := directoryFailures.users[user]
+	if !ok {
+		u = UserConfig{Name: user}
+	}
+	return &u
+}
+
+// directoryLoginFailed counts a failed login of user with the user in
+// the mnms config, or in memory when user is not in the config.
+func directoryLoginFailed(user string, policy PasswordPolicy, now time.Time) {
+	err := modifyUser(user, func(u *UserConfig) error {
+		u.loginFailed(policy, now)
+		return nil
+	})
+	if err == nil {
+		return
+	}
+	directoryFailures.Lock()
+	defer directoryFailures.Unlock()
+	u, ok := directoryFailures.users[user]
+	if !ok && len(directoryFailures.users) >= directoryFailuresMax {
+		pruneDirectoryFailures(now)
+	}
+	u.Name = user
+	u.loginFailed(policy, now)
+	directoryFailures.users[user] = u
+}
+
+// pruneDirectoryFailures makes room for another user, it drops the users
+// who are not locked and, when all are, the lockout ending first. The
+// caller holds directoryFailures.
+func pruneDirectoryFailures(now time.Time) {
+	oldest := ""
+	for name, u := range directoryFailures.users {
+		if u.LockedUntil <= now.Unix() {
+			delete(directoryFailures.users, name)
+		} else if oldest == "" || u.LockedUntil < directoryFailures.users[oldest].LockedUntil {
+			oldest = name
+		}
+	}
+	if len(directoryFailures.users) >= directoryFailuresMax {
+		delete(directoryFailures.users, oldest)
+	}
+}
+
+// directoryLoginSucceeded clears the failed logins of user.
+func directoryLoginSucceeded(user string) {
+	directoryFailures.Lock()
+	delete(directoryFailures.users, user)
+	directoryFailures.Unlock()
+	err := modifyUser(user, func(u *UserConfig) error {
+		if u.FailedLogins == 0 && u.LockedUntil == 0 {
+			return errMNMSConfigUnchanged
+		}
+		u.FailedLogins = 0
+		u.LockedUntil = 0
+		return nil
+	})
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleIdentityConfig handles identity provider configuration requests
+//
+// GET /api/v1/identity
+//
+//	returns the configuration, secrets are masked
+//
+// PUT /api/v1/identity
+//
+//	Example parameter:
+//	    {"ldap": {"url": "ldaps://ldap.example.com", "bindDN": "cn=mnms,ou=services,dc=example,dc=com",
+//	              "bindPassword": "secret", "baseDN": "ou=people,dc=example,dc=com", "userFilter": "(uid=%s)",
+//	              "groupAttribute": "memberOf",
+//	              "groupRoles": [{"group": "cn=netops,ou=groups,dc=example,dc=com", "role": "superuser"}],
+//	              "defaultRole": "user"},
+//	     "oidc": {"issuer": "https://sso.example.com", "clientID": "mnms", "clientSecret": "secret",
+//	              "redirectURL": "https://mnms.example.com/api/v1/oidc/callback",
+//	              "groupRoles": [{"group": "netops", "role": "superuser"}], "uiRedirect": "https://mnms.example.com/login"}}
+//
+//	null disables a provider, masked secrets keep their values.
+func HandleIdentityConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var ic IdentityConfig
+		err := json.NewDecoder(r.Body).Decode(&ic)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		err = SetIdentityConfig(ic)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	ic, err := GetIdentityConfig()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	if ic.LDAP != nil && ic.LDAP.BindPassword != "" {
+		ldap := *ic.LDAP
+		ldap.BindPassword = secretMask
+		ic.LDAP = &ldap
+	}
+	if ic.OIDC != nil && ic.OIDC.ClientSecret != "" {
+		oidc := *ic.OIDC
+		oidc.ClientSecret = secretMask
+		ic.OIDC = &oidc
+	}
+	err = json.NewEncoder(w).Encode(ic)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleIdentityProviders tells the login page which providers are
+// enabled
+//
+// GET /api/v1/identity/providers
+//
+//	Example return: {"ldap": true, "oidc": false}
+func HandleIdentityProviders(w http.ResponseWriter, r *http.Request) {
+	res := map[string]bool{"ldap": false, "oidc": false}
+	c, err := GetMNMSConfig()
+	if err == nil {
+		res["ldap"] = c.LDAP != nil
+		res["oidc"] = c.OIDC != nil
+	}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		q.Q(err)
+	}
+}
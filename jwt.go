@@ -53,6 +53,7 @@ func GetToken(name string) (string, error) {
 		_, token, err = jwtTokenAuth.Encode(map[string]any{
 			"user":      name,
 			"timestamp": time.Now().Format(time.RFC3339),
+			"node":      true,
 		})
 		if err != nil {
 			return "", err
@@ -69,20 +70,18 @@ var jwtTokenAuth = jwtauth.New("HS256", jwtSecret, nil)
 // temprary token
 var tempararyUrlToken = jwtauth.New("HS256", []byte("mnmstemparayurl"), nil)
 
-func generateJWT(user, password string) (string, error) {
-
-	// Validate password
-	err := validUserPassword(user, password)
-	if err != nil {
-		return "", err
-	}
-
-	// token will expire in 30 days
-	_, token, err := jwtTokenAuth.Encode(map[string]any{
+// generateJWT issues a short lived access token of session sid to an
+// authenticated user.
+func generateJWT(user, sid string) (string, error) {
+	claims := map[string]any{
 		"user":      user,
 		"timestamp": time.Now().Format(time.RFC3339),
-		"exp":       time.Now().Add(time.Hour * 24 * 30).Unix(),
-	})
+		"exp":       time.Now().Add(AccessTokenLifetime).Unix(),
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	_, token, err := jwtTokenAuth.Encode(claims)
 
 	if err != nil {
 		return "", err
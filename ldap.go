@@ -0,0 +1,473 @@
+package mnms
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	A minimal LDAPv3 client for bind authentication: simple bind and
+	subtree search, encoded in BER as described in RFC 4511. Filters
+	support and, or, not, equality and presence, e.g.
+
+		(&(objectClass=person)(uid=%s))
+
+	Binds send passwords, so ldap:// connections are upgraded with
+	StartTLS before any bind, and ldaps:// connections use TLS from the
+	start.
+*/
+
+const ldapTimeout = 10 * time.Second
+
+const (
+	berUniversal   = 0x00
+	berApplication = 0x40
+	berContext     = 0x80
+	berConstructed = 0x20
+)
+
+const (
+	berTagBoolean     = 1
+	berTagInteger     = 2
+	berTagOctetString = 4
+	berTagEnumerated  = 10
+	berTagSequence    = 16
+	berTagSet         = 17
+)
+
+const (
+	ldapBindRequest       = 0
+	ldapBindResponse      = 1
+	ldapUnbindRequest     = 2
+	ldapSearchRequest     = 3
+	ldapSearchResultEntry = 4
+	ldapSearchResultDone  = 5
+	ldapExtendedRequest   = 23
+	ldapExtendedResponse  = 24
+)
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const (
+	ldapFilterAnd      = 0
+	ldapFilterOr       = 1
+	ldapFilterNot      = 2
+	ldapFilterEquality = 3
+	ldapFilterPresent  = 7
+)
+
+var ErrLDAPInvalidCredentials = errors.New("ldap invalid credentials")
+
+// berPacket is a BER element, constructed elements have children.
+type berPacket struct {
+	class       byte
+	constructed bool
+	tag         int
+	value       []byte
+	children    []*berPacket
+}
+
+// ldapEntry is an entry returned by a search, attribute names are lower
+// case.
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+func berPrimitive(class byte, tag int, value []byte) *berPacket {
+	return &berPacket{class: class, tag: tag, value: value}
+}
+
+func berConstruct(class byte, tag int, children ...*berPacket) *berPacket {
+	return &berPacket{class: class, constructed: true, tag: tag, children: children}
+}
+
+func berString(s string) *berPacket {
+	return berPrimitive(berUniversal, berTagOctetString, []byte(s))
+}
+
+func berInteger(class byte, tag int, v int) *berPacket {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return berPrimitive(class, tag, b)
+}
+
+func (p *berPacket) bytes() []byte {
+	content := p.value
+	if p.constructed {
+		content = nil
+		for _, c := range p.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	id := p.class | byte(p.tag)
+	if p.constructed {
+		id |= berConstructed
+	}
+	b := []byte{id}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	default:
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		b = append(b, 0x80|byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, content...)
+}
+
+func (p *berPacket) int() int {
+	v := 0
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+func (p *berPacket) child(i int) *berPacket {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &berPacket{}
+}
+
+func readBERPacket(r io.Reader) (*berPacket, error) {
+	var hdr [2]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0]&0x1f == 0x1f {
+		return nil, fmt.Errorf("ber: multi byte tags not supported")
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		l := n & 0x7f
+		if l == 0 || l > 4 {
+			return nil, fmt.Errorf("ber: unsupported length")
+		}
+		lb := make([]byte, l)
+		_, err = io.ReadFull(r, lb)
+		if err != nil {
+			return nil, err
+		}
+		n = 0
+		for _, b := range lb {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<24 {
+		return nil, fmt.Errorf("ber: element too large")
+	}
+	content := make([]byte, n)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return nil, err
+	}
+	p := &berPacket{
+		class:       hdr[0] & 0xc0,
+		constructed: hdr[0]&berConstructed != 0,
+		tag:         int(hdr[0] & 0x1f),
+	}
+	if !p.constructed {
+		p.value = content
+		return p, nil
+	}
+	cr := strings.NewReader(string(content))
+	for cr.Len() > 0 {
+		c, err := readBERPacket(cr)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, c)
+	}
+	return p, nil
+}
+
+// ldapEscape escapes s for use as a filter value.
+func ldapEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&sb, "\\%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func ldapUnescape(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// parseLDAPFilter encodes the filter string f.
+func parseLDAPFilter(f string) (*berPacket, error) {
+	p, rest, err := parseLDAPFilterItem(strings.TrimSpace(f))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid ldap filter %q", f)
+	}
+	return p, nil
+}
+
+func parseLDAPFilterItem(f string) (*berPacket, string, error) {
+	if !strings.HasPrefix(f, "(") {
+		return nil, "", fmt.Errorf("invalid ldap filter %q", f)
+	}
+	f = f[1:]
+	switch {
+	case strings.HasPrefix(f, "&"), strings.HasPrefix(f, "|"), strings.HasPrefix(f, "!"):
+		tag := ldapFilterAnd
+		if f[0] == '|' {
+			tag = ldapFilterOr
+		} else if f[0] == '!' {
+			tag = ldapFilterNot
+		}
+		f = f[1:]
+		p := berConstruct(berContext, tag)
+		for strings.HasPrefix(f, "(") {
+			c, rest, err := parseLDAPFilterItem(f)
+			if err != nil {
+				return nil, "", err
+			}
+			p.children = append(p.children, c)
+			f = rest
+		}
+		if !strings.HasPrefix(f, ")") || len(p.children) == 0 || (tag == ldapFilterNot && len(p.children) != 1) {
+			return nil, "", fmt.Errorf("invalid ldap filter")
+		}
+		return p, f[1:], nil
+	}
+	end := strings.Index(f, ")")
+	if end < 0 {
+		return nil, "", fmt.Errorf("invalid ldap filter, missing )")
+	}
+	attr, value, ok := strings.Cut(f[:end], "=")
+	if !ok || attr == "" {
+		return nil, "", fmt.Errorf("invalid ldap filter item %q", f[:end])
+	}
+	if value == "*" {
+		return berPrimitive(berContext, ldapFilterPresent, []byte(attr)), f[end+1:], nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("ldap substring filters not supported")
+	}
+	value, err := ldapUnescape(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstruct(berContext, ldapFilterEquality, berString(attr), berString(value)), f[end+1:], nil
+}
+
+func dialLDAP(cfg *LDAPConfig) (*ldapConn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: cfg.Insecure}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = net.DialTimeout("tcp", host, ldapTimeout)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("invalid ldap url %s", cfg.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(ldapTimeout))
+	l := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" {
+		err = l.startTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// startTLS upgrades the connection with the StartTLS extended operation.
+func (l *ldapConn) startTLS(config *tls.Config) error {
+	id, err := l.send(berConstruct(berApplication, ldapExtendedRequest,
+		berPrimitive(berContext, 0, []byte(ldapStartTLSOID))))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.class != berApplication || op.tag != ldapExtendedResponse {
+		return fmt.Errorf("unexpected ldap response %d", op.tag)
+	}
+	err = ldapResult(op)
+	if err != nil {
+		return fmt.Errorf("ldap starttls: %v", err)
+	}
+	conn := tls.Client(l.conn, config)
+	err = conn.Handshake()
+	if err != nil {
+		return fmt.Errorf("ldap starttls: %v", err)
+	}
+	l.conn = conn
+	l.r = bufio.NewReader(conn)
+	return nil
+}
+
+func (l *ldapConn) send(op *berPacket) (int, error) {
+	l.msgID++
+	msg := berConstruct(berUniversal, berTagSequence, berInteger(berUniversal, berTagInteger, l.msgID), op)
+	_, err := l.conn.Write(msg.bytes())
+	return l.msgID, err
+}
+
+// receive returns the protocol op of the next message for id.
+func (l *ldapConn) receive(id int) (*berPacket, error) {
+	for {
+		msg, err := readBERPacket(l.r)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg.children) < 2 {
+			return nil, fmt.Errorf("invalid ldap message")
+		}
+		if msg.children[0].int() == id {
+			return msg.children[1], nil
+		}
+	}
+}
+
+func ldapResult(op *berPacket) error {
+	code := op.child(0).int()
+	if code == 0 {
+		return nil
+	}
+	if code == 49 {
+		return ErrLDAPInvalidCredentials
+	}
+	return fmt.Errorf("ldap error %d: %s", code, op.child(2).value)
+}
+
+func (l *ldapConn) bind(dn, password string) error {
+	if password == "" {
+		// an empty password would be an unauthenticated bind
+		return ErrLDAPInvalidCredentials
+	}
+	id, err := l.send(berConstruct(berApplication, ldapBindRequest,
+		berInteger(berUniversal, berTagInteger, 3),
+		berString(dn),
+		berPrimitive(berContext, 0, []byte(password))))
+	if err != nil {
+		return err
+	}
+	op, err := l.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.class != berApplication || op.tag != ldapBindResponse {
+		return fmt.Errorf("unexpected ldap response %d", op.tag)
+	}
+	return ldapResult(op)
+}
+
+func (l *ldapConn) search(base, filter string, attrs []string, limit int) ([]ldapEntry, error) {
+	f, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := berConstruct(berUniversal, berTagSequence)
+	for _, a := range attrs {
+		attributes.children = append(attributes.children, berString(a))
+	}
+	id, err := l.send(berConstruct(berApplication, ldapSearchRequest,
+		berString(base),
+		berInteger(berUniversal, berTagEnumerated, 2), // whole subtree
+		berInteger(berUniversal, berTagEnumerated, 0), // never deref aliases
+		berInteger(berUniversal, berTagInteger, limit),
+		berInteger(berUniversal, berTagInteger, int(ldapTimeout/time.Second)),
+		berPrimitive(berUniversal, berTagBoolean, []byte{0}),
+		f,
+		attributes))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := l.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchResultEntry:
+			e := ldapEntry{DN: string(op.child(0).value), Attrs: map[string][]string{}}
+			for _, a := range op.child(1).children {
+				name := strings.ToLower(string(a.child(0).value))
+				for _, v := range a.child(1).children {
+					e.Attrs[name] = append(e.Attrs[name], string(v.value))
+				}
+			}
+			entries = append(entries, e)
+		case ldapSearchResultDone:
+			return entries, ldapResult(op)
+		}
+	}
+}
+
+func (l *ldapConn) close() {
+	_, _ = l.send(berPrimitive(berApplication, ldapUnbindRequest, nil))
+	l.conn.Close()
+}
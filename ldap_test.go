@@ -0,0 +1,270 @@
+package mnms
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ldapStubEntry is an entry of the in-process LDAP stub.
+type ldapStubEntry struct {
+	dn       string
+	uid      string
+	password string
+	groups   []string
+}
+
+// startLDAPStub serves StartTLS, simple binds and uid searches over
+// entries. Binds before StartTLS fail.
+func startLDAPStub(t *testing.T, entries []ldapStubEntry) string {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ldap.crt"), filepath.Join(dir, "ldap.key")
+	writeTestCertificate(t, certFile, keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	reply := func(conn net.Conn, id int, op *berPacket) {
+		msg := berConstruct(berUniversal, berTagSequence, berInteger(berUniversal, berTagInteger, id), op)
+		_, _ = conn.Write(msg.bytes())
+	}
+	result := func(tag, code int) *berPacket {
+		return berConstruct(berApplication, tag,
+			berInteger(berUniversal, berTagEnumerated, code), berString(""), berString(""))
+	}
+	// findUID returns the uid of the first equality match in filter.
+	var findUID func(f *berPacket) string
+	findUID = func(f *berPacket) string {
+		if f.tag == ldapFilterEquality && string(f.child(0).value) == "uid" {
+			return string(f.child(1).value)
+		}
+		for _, c := range f.children {
+			if uid := findUID(c); uid != "" {
+				return uid
+			}
+		}
+		return ""
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				secure := false
+				for {
+					msg, err := readBERPacket(r)
+					if err != nil {
+						return
+					}
+					id := msg.child(0).int()
+					op := msg.child(1)
+					switch op.tag {
+					case ldapExtendedRequest:
+						reply(conn, id, result(ldapExtendedResponse, 0))
+						tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+						if tc.Handshake() != nil {
+							return
+						}
+						conn, r, secure = tc, bufio.NewReader(tc), true
+					case ldapBindRequest:
+						dn, pw := string(op.child(1).value), string(op.child(2).value)
+						code := 49
+						for _, e := range entries {
+							if e.dn == dn && e.password == pw {
+								code = 0
+							}
+						}
+						if !secure {
+							// confidentiality required
+							code = 13
+						}
+						reply(conn, id, result(ldapBindResponse, code))
+					case ldapSearchRequest:
+						uid := findUID(op.child(6))
+						for _, e := range entries {
+							if e.uid == "" || e.uid != uid {
+								continue
+							}
+							vals := berConstruct(berUniversal, berTagSet)
+							for _, g := range e.groups {
+								vals.children = append(vals.children, berString(g))
+							}
+							reply(conn, id, berConstruct(berApplication, ldapSearchResultEntry,
+								berString(e.dn),
+								berConstruct(berUniversal, berTagSequence,
+									berConstruct(berUniversal, berTagSequence, berString("memberOf"), vals))))
+						}
+						reply(conn, id, result(ldapSearchResultDone, 0))
+					case ldapUnbindRequest:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+// TestLDAPFilter tests filter encoding and escaping
+func TestLDAPFilter(t *testing.T) {
+	f, err := parseLDAPFilter("(&(objectClass=person)(uid=" + ldapEscape("a*)(uid=b") + "))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.tag != ldapFilterAnd || len(f.children) != 2 {
+		t.Fatal("expect and filter of 2 items", f)
+	}
+	if v := string(f.children[1].child(1).value); v != "a*)(uid=b" {
+		t.Fatal("expect escaped value to round trip, got", v)
+	}
+	p, err := readBERPacket(strings.NewReader(string(f.bytes())))
+	if err != nil || len(p.children) != 2 || p.tag != ldapFilterAnd {
+		t.Fatal("expect encoded filter to decode", p, err)
+	}
+	for _, bad := range []string{"uid=a", "(uid=a", "(&)", "(uid=a*)"} {
+		if _, err = parseLDAPFilter(bad); err == nil {
+			t.Error("expect invalid filter", bad)
+		}
+	}
+	big := berInteger(berUniversal, berTagInteger, 300)
+	if big.int() != 300 {
+		t.Fatal("expect integer to round trip, got", big.int())
+	}
+}
+
+// TestLDAPLogin tests directory login with group to role mapping
+func TestLDAPLogin(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	url := startLDAPStub(t, []ldapStubEntry{
+		{dn: "cn=mnms,dc=example,dc=com", password: "svcpw"},
+		{dn: "uid=alice,ou=people,dc=example,dc=com", uid: "alice", password: "alicepw",
+			groups: []string{"cn=netops,ou=groups,dc=example,dc=com"}},
+		{dn: "uid=bob,ou=people,dc=example,dc=com", uid: "bob", password: "bobpw"},
+		{dn: "uid=admin,ou=people,dc=example,dc=com", uid: "admin", password: "ldapadmin"},
+		{dn: "uid=carol,ou=people,dc=example,dc=com", uid: "carol", password: "carolpw"},
+	})
+	err = SetIdentityConfig(IdentityConfig{LDAP: &LDAPConfig{
+		URL:          url,
+		BindDN:       "cn=mnms,dc=example,dc=com",
+		BindPassword: "svcpw",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		GroupRoles:   []IdentityGroupRole{{Group: "CN=netops,ou=groups,dc=example,dc=com", Role: MNMSSuperUserRole}},
+		Insecure:     true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := loginUser("alice", "alicepw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Role != MNMSSuperUserRole || u.Provider != "ldap" {
+		t.Fatal("expect ldap superuser", u)
+	}
+	_, err = loginUser("alice", "wrong")
+	if err == nil {
+		t.Fatal("expect wrong password to fail")
+	}
+	// unknown users are not told apart from wrong passwords
+	if _, uerr := loginUser("nobody", "wrong"); uerr == nil || uerr.Error() != err.Error() {
+		t.Fatal("expect unknown user to fail like a wrong password", uerr, err)
+	}
+	if _, err = loginUser("alice", ""); err == nil {
+		t.Fatal("expect empty password to fail")
+	}
+	if _, err = loginUser("bob", "bobpw"); err == nil {
+		t.Fatal("expect user without mapped group to fail")
+	}
+	// local users never fall through to the directory
+	if _, err = loginUser("admin", "ldapadmin"); err == nil {
+		t.Fatal("expect local admin not to use ldap")
+	}
+	if _, err = loginUser("admin", AdminDefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bind password is masked and kept
+	err = SetIdentityConfig(IdentityConfig{LDAP: &LDAPConfig{URL: url, BindDN: "cn=mnms,dc=example,dc=com",
+		BindPassword: secretMask, BaseDN: "ou=people,dc=example,dc=com", DefaultRole: MNMSUserRole, Insecure: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = loginUser("bob", "bobpw")
+	if err != nil || u.Role != MNMSUserRole {
+		t.Fatal("expect default role", u, err)
+	}
+
+	// the certificate of the directory is verified
+	c, err := GetMNMSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := *c.LDAP
+	verified.Insecure = false
+	if _, err = ldapAuthenticate(&verified, "bob", "bobpw"); err == nil {
+		t.Fatal("expect unverified certificate to fail")
+	}
+
+	// directory users are locked out, known or not yet known
+	policy := DefaultPasswordPolicy
+	policy.MaxFailures = 2
+	if err = SetPasswordPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"bob", "carol"} {
+		for i := 0; i < 2; i++ {
+			if _, err = loginUser(user, "wrong"); err == nil {
+				t.Fatal("expect wrong password to fail", user)
+			}
+		}
+		if _, err = loginUser(user, user+"pw"); !errors.Is(err, ErrAccountLocked) {
+			t.Fatal("expect account locked", user, err)
+		}
+	}
+
+	// failures of unknown users are kept for a bounded number of users
+	directoryFailures.Lock()
+	for i := len(directoryFailures.users); i < directoryFailuresMax; i++ {
+		name := fmt.Sprintf("ghost%d", i)
+		directoryFailures.users[name] = UserConfig{Name: name, FailedLogins: 1}
+	}
+	directoryFailures.Unlock()
+	directoryLoginFailed("nobody", policy, time.Now())
+	directoryFailures.Lock()
+	n := len(directoryFailures.users)
+	directoryFailures.Unlock()
+	if n > directoryFailuresMax {
+		t.Fatal("expect at most", directoryFailuresMax, "users with failures, got", n)
+	}
+	if _, err = loginUser("carol", "carolpw"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatal("expect locked user to stay locked", err)
+	}
+	directoryFailures.Lock()
+	directoryFailures.users = make(map[string]UserConfig)
+	directoryFailures.Unlock()
+}
@@ -73,6 +73,7 @@ func main() {
 	flag.StringVar(&mnms.QC.SyslogLocalPath, "so", mnms.QC.SyslogLocalPath, "local path of syslog")
 	flag.UintVar(&mnms.QC.SyslogFileSize, "sf", mnms.QC.SyslogFileSize, "file size(megabytes) of syslog")
 	flag.BoolVar(&mnms.QC.SyslogCompress, "sc", mnms.QC.SyslogCompress, "enable compress file of backup syslog")
+	flag.BoolVar(&mnms.QC.SyslogKeepLocal, "sk", mnms.QC.SyslogKeepLocal, "keep local syslog files on client")
 	prikeyfile := flag.String("privkey", "", "private key file")
 	cmdflagnoow := flag.Bool("cno", false, "command overwrite flag")
 	cmdflagall := flag.Bool("ca", false, "command all flag")
@@ -80,9 +81,20 @@ func main() {
 	cmdClient := flag.String("cc", "", "command client specification")
 	cmdTag := flag.String("ct", "", "command tag")
 	pp := flag.Bool("pprof", false, "enable pprof analysis")
+	configfile := flag.String("config", "", "settings file, default mnms.yaml")
 	var daemon string
 	flag.StringVar(&daemon, mnms.DaemonFlag, "", mnms.Usage)
 	flag.Parse()
+	// settings given as flags win over the settings file
+	setflags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setflags[f.Name] = true
+	})
+	err := mnms.LoadSettings(*configfile, setflags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: settings, %v\n", err)
+		mnms.DoExit(1)
+	}
 	service := func() {
 		if *flagversion {
 			info, _ := debug.ReadBuildInfo()
@@ -165,10 +177,15 @@ func main() {
 			fmt.Fprintln(os.Stderr, "error: can't get admin token")
 			mnms.DoExit(1)
 		}
-		if mnms.QC.RemoteSyslogServerAddr == "" {
+		if mnms.ReadSetting(&mnms.QC.RemoteSyslogServerAddr) == "" {
 			q.Q("warning: missing remote syslog server address")
 		}
 		if *svc || mnms.QC.IsRoot {
+			// syslog rules and forwarding set by commands before a restart
+			err := mnms.LoadSyslogState()
+			if err != nil {
+				q.Q(err)
+			}
 			if !*nosyslog {
 				wg.Add(1)
 				go func() {
@@ -312,10 +329,18 @@ func main() {
 
 		time.Sleep(1 * time.Second)
 
+		if mnms.QC.IsRoot && !*fake {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mnms.RunOpcuaBridge()
+			}()
+		}
+
 		if *svc {
 			if mnms.QC.RootURL != "" {
 				wg.Add(1)
-				q.Q(mnms.QC.RegisterInterval)
+				q.Q(mnms.ReadSetting(&mnms.QC.RegisterInterval))
 				go func() {
 					defer wg.Done()
 					mnms.RegisterMain()
@@ -358,6 +383,26 @@ func main() {
 			} else {
 				q.Q("skip running mqtt broker")
 			}
+			if mnms.QC.OpcuaServerURL != "" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := mnms.RunOpcuaServer()
+					if err != nil {
+						q.Q(err)
+					}
+				}()
+			}
+			if mnms.QC.SparkplugBroker != "" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := mnms.RunSparkplug()
+					if err != nil {
+						q.Q(err)
+					}
+				}()
+			}
 			if mnms.QC.RootURL != "" {
 				wg.Add(1)
 				go func() {
@@ -369,9 +414,9 @@ func main() {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				q.Q(mnms.QC.CmdInterval)
+				q.Q(mnms.ReadSetting(&mnms.QC.CmdInterval))
 				for {
-					time.Sleep(time.Duration(mnms.QC.CmdInterval) * time.Second) // XXX
+					time.Sleep(time.Duration(mnms.ReadSetting(&mnms.QC.CmdInterval)) * time.Second) // XXX
 					err := mnms.CheckCmds()
 					if err != nil {
 						q.Q(err)
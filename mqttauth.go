@@ -0,0 +1,658 @@
+package mnms
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/qeof/q"
+)
+
+/*
+	MQTT broker authentication and topic access control.
+
+	When mqtt.auth is set, clients of the embedded broker log in with
+
+	  - an mqtt account, a username and password only good for mqtt
+	  - an mnms user and its password, users with second factors and
+	    service accounts use a token
+	  - any username and the jwt or api key of an mnms user as password
+
+	Roles with mqtt:read may subscribe to and roles with mqtt:write may
+	publish to all topics. Topic ACLs grant users and roles access to
+	topic filters beyond that, e.g.
+
+		{"name": "scada", "users": ["scada"], "topics": ["mnms/+/devices/#"], "access": "read"}
+
+	Accounts and ACLs are read when a client connects, changes apply to
+	new connections. Each connection has its own login, clients logged
+	in with the same username do not share or end each other's access.
+	Failed logins lock accounts out like those of users. Command
+	requests run as the user logged in, only the root reads requests and
+	each user reads only its own replies.
+*/
+
+const (
+	PermMqttRead  = "mqtt:read"
+	PermMqttWrite = "mqtt:write"
+)
+
+const (
+	MqttAccessRead      = "read"
+	MqttAccessWrite     = "write"
+	MqttAccessReadWrite = "readwrite"
+)
+
+// MqttAccount is a login for the mqtt broker only.
+type MqttAccount struct {
+	Name        string `json:"name"`
+	Password    string `json:"password,omitempty"`
+	Role        string `json:"role"`
+	Description string `json:"description,omitempty"`
+	// lockout after failed logins
+	FailedLogins int   `json:"failedLogins,omitempty"`
+	LockedUntil  int64 `json:"lockedUntil,omitempty"`
+}
+
+// MqttACL grants users and roles access to topic filters.
+type MqttACL struct {
+	Name   string   `json:"name"`
+	Users  []string `json:"users,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Topics []string `json:"topics"`
+	Access string   `json:"access"`
+}
+
+// appliesTo reports whether the acl is for user with role.
+func (acl *MqttACL) appliesTo(user, role string) bool {
+	for _, u := range acl.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, r := range acl.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the acl grants reading or writing topic.
+func (acl *MqttACL) Allows(topic string, write bool) bool {
+	if write && acl.Access == MqttAccessRead || !write && acl.Access == MqttAccessWrite {
+		return false
+	}
+	for _, f := range acl.Topics {
+		if mqttFilterCovers(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// mqttFilterCovers reports whether topic filter f matches all topics of
+// topic, which may itself be a filter of a subscription.
+func mqttFilterCovers(f, topic string) bool {
+	fs := strings.Split(f, "/")
+	ts := strings.Split(topic, "/")
+	for i, l := range fs {
+		if l == "#" {
+			return true
+		}
+		if i >= len(ts) || ts[i] == "#" {
+			return false
+		}
+		if l != "+" && l != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// checkMqttTopicFilter checks that f is a valid topic filter.
+func checkMqttTopicFilter(f string) error {
+	if f == "" {
+		return errors.New("empty topic filter")
+	}
+	levels := strings.Split(f, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) ||
+			strings.Contains(l, "+") && l != "+" {
+			return fmt.Errorf("invalid topic filter %q", f)
+		}
+	}
+	return nil
+}
+
+func findMqttAccount(c *MNMSConfig, name string) *MqttAccount {
+	for i := range c.MqttAccounts {
+		if c.MqttAccounts[i].Name == name {
+			return &c.MqttAccounts[i]
+		}
+	}
+	return nil
+}
+
+// GetMqttAccounts returns the mqtt accounts without their passwords.
+func GetMqttAccounts() ([]MqttAccount, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	accounts := []MqttAccount{}
+	for _, a := range c.MqttAccounts {
+		a.Password = ""
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+// SetMqttAccount adds or updates an mqtt account. An empty password
+// keeps the current password, a new password ends a lockout.
+func SetMqttAccount(account MqttAccount) error {
+	if account.Name == "" || strings.ContainsAny(account.Name, " \t") {
+		return fmt.Errorf("invalid mqtt account name %q", account.Name)
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		var err error
+		for _, u := range c.Users {
+			if u.Name == account.Name {
+				return fmt.Errorf("%s is an mnms user", account.Name)
+			}
+		}
+		if _, err = findRole(c, account.Role); err != nil {
+			return err
+		}
+		old := findMqttAccount(c, account.Name)
+		if account.Password == "" {
+			if old == nil {
+				return errors.New("mqtt account password is empty")
+			}
+			account.Password = old.Password
+			account.FailedLogins, account.LockedUntil = old.FailedLogins, old.LockedUntil
+		} else {
+			account.FailedLogins, account.LockedUntil = 0, 0
+			err = GetPasswordPolicy().Check(account.Password)
+			if err != nil {
+				return err
+			}
+			account.Password, err = hashPassword(account.Password)
+			if err != nil {
+				return err
+			}
+		}
+		if old != nil {
+			*old = account
+		} else {
+			c.MqttAccounts = append(c.MqttAccounts, account)
+		}
+		return nil
+	})
+}
+
+// DeleteMqttAccount deletes an mqtt account.
+func DeleteMqttAccount(name string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, a := range c.MqttAccounts {
+			if a.Name == name {
+				c.MqttAccounts = append(c.MqttAccounts[:i], c.MqttAccounts[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("mqtt account %s not exist", name)
+	})
+}
+
+// GetMqttACLs returns the mqtt topic ACLs.
+func GetMqttACLs() ([]MqttACL, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.MqttACLs == nil {
+		return []MqttACL{}, nil
+	}
+	return c.MqttACLs, nil
+}
+
+// SetMqttACL adds or replaces an mqtt topic ACL.
+func SetMqttACL(acl MqttACL) error {
+	if acl.Name == "" || strings.ContainsAny(acl.Name, " \t") {
+		return fmt.Errorf("invalid mqtt acl name %q", acl.Name)
+	}
+	switch acl.Access {
+	case MqttAccessRead, MqttAccessWrite, MqttAccessReadWrite:
+	default:
+		return fmt.Errorf("invalid access %q, must be read, write or readwrite", acl.Access)
+	}
+	if len(acl.Topics) == 0 {
+		return errors.New("mqtt acl has no topics")
+	}
+	for _, f := range acl.Topics {
+		err := checkMqttTopicFilter(f)
+		if err != nil {
+			return err
+		}
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		var err error
+		for _, r := range acl.Roles {
+			if _, err = findRole(c, r); err != nil {
+				return err
+			}
+		}
+		for i := range c.MqttACLs {
+			if c.MqttACLs[i].Name == acl.Name {
+				c.MqttACLs[i] = acl
+				return nil
+			}
+		}
+		c.MqttACLs = append(c.MqttACLs, acl)
+		return nil
+	})
+}
+
+// DeleteMqttACL deletes an mqtt topic ACL.
+func DeleteMqttACL(name string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, acl := range c.MqttACLs {
+			if acl.Name == name {
+				c.MqttACLs = append(c.MqttACLs[:i], c.MqttACLs[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("mqtt acl %s not exist", name)
+	})
+}
+
+// mqttPrincipal is an authenticated broker user.
+type mqttPrincipal struct {
+	user UserConfig
+	role *RoleConfig
+	key  *APIKey
+	acls []MqttACL
+}
+
+// mqttAuth keeps the logins of the broker connections by remote address.
+type mqttAuth struct {
+	sync.Mutex
+	conns map[string]*mqttConn
+}
+
+func newMqttAuth() *mqttAuth {
+	return &mqttAuth{conns: make(map[string]*mqttConn)}
+}
+
+// brokerAuth keeps the logins of the embedded broker.
+var brokerAuth = newMqttAuth()
+
+// mqttConn is the auth controller of one broker connection.
+type mqttConn struct {
+	auth   *mqttAuth
+	remote string
+	p      *mqttPrincipal
+}
+
+// conn returns the auth controller of the connection from remote.
+func (a *mqttAuth) conn(remote string) *mqttConn {
+	c := &mqttConn{auth: a, remote: remote}
+	a.Lock()
+	a.conns[remote] = c
+	a.Unlock()
+	return c
+}
+
+// closeConn forgets the login of c.
+func (a *mqttAuth) closeConn(c *mqttConn) {
+	a.Lock()
+	if a.conns[c.remote] == c {
+		delete(a.conns, c.remote)
+	}
+	a.Unlock()
+}
+
+// principal returns the login of client, nil without mqtt.auth.
+func (a *mqttAuth) principal(client events.Client) *mqttPrincipal {
+	if !ReadSetting(&QC.MqttAuth) {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	c := a.conns[client.Remote]
+	if c == nil || c.p == nil || c.p.user.Name != string(client.Username) {
+		return nil
+	}
+	return c.p
+}
+
+// mqttAuthListener gives each connection of a listener its own auth
+// controller.
+type mqttAuthListener struct {
+	listeners.Listener
+	auth *mqttAuth
+}
+
+// listener wraps l to authenticate its connections.
+func (a *mqttAuth) listener(l listeners.Listener) listeners.Listener {
+	return &mqttAuthListener{Listener: l, auth: a}
+}
+
+// Serve establishes connections with their own auth controller.
+func (l *mqttAuthListener) Serve(establish listeners.EstablishFunc) {
+	l.Listener.Serve(func(id string, c net.Conn, _ auth.Controller) error {
+		conn := l.auth.conn(c.RemoteAddr().String())
+		defer l.auth.closeConn(conn)
+		return establish(id, c, conn)
+	})
+}
+
+// mqttFiltersOverlap reports whether a topic matches both topic filters
+// a and b.
+func mqttFiltersOverlap(a, b string) bool {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == "#" || bs[i] == "#" {
+			return true
+		}
+		if as[i] != "+" && bs[i] != "+" && as[i] != bs[i] {
+			return false
+		}
+	}
+	return len(as) == len(bs)
+}
+
+// mqttOwnReplies reports whether all topics of filter f are replies to
+// the command requests of user.
+func mqttOwnReplies(f, user string) bool {
+	return user != "" && !strings.ContainsAny(user, "/+#") &&
+		mqttFilterCovers(mqttTopic("", "commands", "reply", user, "#"), f)
+}
+
+// mqttCommandTopicAllowed reports whether a user may subscribe or publish
+// to topic filter f. The root alone reads command requests and publishes
+// replies.
+func mqttCommandTopicAllowed(f string, write bool) bool {
+	if !write && mqttFiltersOverlap(f, mqttTopic("", "commands", "request")) {
+		return false
+	}
+	return !mqttFiltersOverlap(f, mqttTopic("", "commands", "reply", "#"))
+}
+
+// mqttToken authenticates password as jwt or api key, it returns nil
+// when password does not look like one.
+func mqttToken(password string) (*UserConfig, *APIKey, error) {
+	if !strings.HasPrefix(password, APIKeyPrefix) && strings.Count(password, ".") != 2 {
+		return nil, nil, nil
+	}
+	return mqttUser(password)
+}
+
+// authenticateMqttAccount checks the password of mqtt account name, the
+// failures are counted in the same transaction which checks them.
+func authenticateMqttAccount(name, password string) (*MqttAccount, error) {
+	var ret *MqttAccount
+	var authErr error
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		account := findMqttAccount(c, name)
+		if account == nil {
+			return fmt.Errorf("mqtt account %s not found", name)
+		}
+		policy := DefaultPasswordPolicy
+		if c.PasswordPolicy != nil {
+			policy = *c.PasswordPolicy
+		}
+		now := time.Now()
+		// accounts are locked out like users
+		u := UserConfig{Name: name, FailedLogins: account.FailedLogins, LockedUntil: account.LockedUntil}
+		if err := u.checkLockout(now); err != nil {
+			return err
+		}
+		if !verifyPassword(account.Password, password) {
+			u.loginFailed(policy, now)
+			account.FailedLogins, account.LockedUntil = u.FailedLogins, u.LockedUntil
+			authErr = errors.New("password not match")
+			return nil
+		}
+		ret = &MqttAccount{}
+		*ret = *account
+		if account.FailedLogins == 0 && account.LockedUntil == 0 {
+			return errMNMSConfigUnchanged
+		}
+		account.FailedLogins, account.LockedUntil = 0, 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if authErr != nil {
+		return nil, authErr
+	}
+	return ret, nil
+}
+
+// login finds the role and key of user with password.
+func (a *mqttAuth) login(user, password string) (*mqttPrincipal, error) {
+	if user == "" {
+		return nil, errors.New("no username")
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	p := &mqttPrincipal{}
+	var role string
+	if account := findMqttAccount(c, user); account != nil {
+		account, err = authenticateMqttAccount(user, password)
+		if err != nil {
+			return nil, err
+		}
+		role = account.Role
+		p.user = UserConfig{Name: user, Role: role}
+	} else if u, key, err := mqttToken(password); u != nil && err == nil {
+		if u.Name != user {
+			return nil, fmt.Errorf("token is not of %s", user)
+		}
+		role, p.key = u.Role, key
+		p.user = *u
+	} else if strings.HasPrefix(password, APIKeyPrefix) {
+		return nil, fmt.Errorf("invalid api key: %v", err)
+	} else {
+		u, err := GetUserConfig(user)
+		if err != nil {
+			return nil, err
+		}
+		if u.Enable2FA || len(u.WebAuthn) > 0 {
+			return nil, fmt.Errorf("%s has a second factor, use a token", user)
+		}
+		u, err = authenticateUser(user, password)
+		if err != nil {
+			return nil, err
+		}
+		role = u.Role
+		p.user = *u
+	}
+	p.role, err = findRole(c, role)
+	if err != nil {
+		return nil, err
+	}
+	for _, acl := range c.MqttACLs {
+		if acl.appliesTo(user, role) {
+			p.acls = append(p.acls, acl)
+		}
+	}
+	return p, nil
+}
+
+// Authenticate authenticates the client of c on connect.
+func (c *mqttConn) Authenticate(user, password []byte) bool {
+	if !ReadSetting(&QC.MqttAuth) {
+		return true
+	}
+	p, err := c.auth.login(string(user), string(password))
+	if err != nil {
+		q.Q("mqtt login failed", string(user), c.remote, err)
+		return false
+	}
+	c.auth.Lock()
+	c.p = p
+	c.auth.Unlock()
+	return true
+}
+
+// ACL reports whether the client of c may publish or subscribe to topic.
+func (c *mqttConn) ACL(user []byte, topic string, write bool) bool {
+	if !ReadSetting(&QC.MqttAuth) {
+		return true
+	}
+	c.auth.Lock()
+	p := c.p
+	c.auth.Unlock()
+	return p.allows(topic, write)
+}
+
+// allows reports whether p may publish or subscribe to topic.
+func (p *mqttPrincipal) allows(topic string, write bool) bool {
+	if p == nil {
+		return false
+	}
+	// users read the replies to their requests
+	if !write && mqttOwnReplies(topic, p.user.Name) {
+		return true
+	}
+	if !mqttCommandTopicAllowed(topic, write) {
+		return false
+	}
+	perm := PermMqttRead
+	if write {
+		perm = PermMqttWrite
+	}
+	if p.key != nil && !p.key.Allows(perm) {
+		return false
+	}
+	if p.role.Allows(perm) {
+		return true
+	}
+	for i := range p.acls {
+		if p.acls[i].Allows(topic, write) {
+			return true
+		}
+	}
+	return false
+}
+
+// mqttTLSConfig loads the broker certificate, nil when none is set.
+func mqttTLSConfig() (*tls.Config, error) {
+	if QC.MqttTLSCert == "" && QC.MqttTLSKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(QC.MqttTLSCert, QC.MqttTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// HandleMqttAccounts handles mqtt account requests
+//
+// GET /api/v1/mqtt/accounts
+//
+//	returns the mqtt accounts, without their passwords
+//
+// POST /api/v1/mqtt/accounts
+//
+//	Example parameter: {"name": "scada", "password": "Secret#1", "role": "user"}
+//
+//	An empty password keeps the current password.
+//
+// DELETE /api/v1/mqtt/accounts
+//
+//	Example parameter: {"name": "scada"}
+func HandleMqttAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var account MqttAccount
+		err := json.NewDecoder(r.Body).Decode(&account)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set mqtt account %s", account.Name)
+			err = SetMqttAccount(account)
+		} else {
+			setAuditDetail(r, "delete mqtt account %s", account.Name)
+			err = DeleteMqttAccount(account.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	accounts, err := GetMqttAccounts()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(accounts)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleMqttACLs handles mqtt topic ACL requests
+//
+// GET /api/v1/mqtt/acls
+//
+//	returns the mqtt topic ACLs
+//
+// POST /api/v1/mqtt/acls
+//
+//	Example parameter: {"name": "scada", "users": ["scada"], "topics": ["mnms/+/devices/#"], "access": "read"}
+//
+// DELETE /api/v1/mqtt/acls
+//
+//	Example parameter: {"name": "scada"}
+func HandleMqttACLs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var acl MqttACL
+		err := json.NewDecoder(r.Body).Decode(&acl)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set mqtt acl %s", acl.Name)
+			err = SetMqttACL(acl)
+		} else {
+			setAuditDetail(r, "delete mqtt acl %s", acl.Name)
+			err = DeleteMqttACL(acl.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	acls, err := GetMqttACLs()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(acls)
+	if err != nil {
+		q.Q(err)
+	}
+}
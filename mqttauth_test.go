@@ -0,0 +1,246 @@
+package mnms
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+// TestMqttTopicFilter tests matching topics and subscriptions to ACL filters
+func TestMqttTopicFilter(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"mnms/#", "mnms/client1/devices/x/state", true},
+		{"mnms/#", "mnms", true},
+		{"mnms/+/devices/#", "mnms/client1/devices/x/state", true},
+		{"mnms/+/devices/#", "mnms/+/devices/#", true},
+		{"mnms/+/devices/#", "mnms/#", false},
+		{"mnms/+/events/trap", "mnms/client1/events/trap", true},
+		{"mnms/+/events/trap", "mnms/client1/events/syslog", false},
+		{"mnms/client1/#", "mnms/+/events/trap", false},
+		{"mnms/+", "mnms/client1/events", false},
+	} {
+		if got := mqttFilterCovers(c.filter, c.topic); got != c.want {
+			t.Errorf("mqttFilterCovers(%q, %q) = %v", c.filter, c.topic, got)
+		}
+	}
+	for _, f := range []string{"", "mnms/#/x", "mnms/a+", "mnms/x#"} {
+		if checkMqttTopicFilter(f) == nil {
+			t.Errorf("expect topic filter %q to fail", f)
+		}
+	}
+}
+
+// TestMqttAuth tests broker logins, topic ACLs and the TLS listener
+func TestMqttAuth(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	restoreSettings(t)
+	QC.MqttAuth = true
+	QC.Name = "root"
+
+	if err = SetMqttAccount(MqttAccount{Name: "admin", Password: "Secret#12", Role: MNMSUserRole}); err == nil {
+		t.Fatal("expect account named like a user to fail")
+	}
+	err = SetMqttAccount(MqttAccount{Name: "scada", Password: "Secret#12", Role: MNMSUserRole})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetMqttACL(MqttACL{Name: "scada", Users: []string{"scada"}, Topics: []string{"mnms/+/devices/#"}, Access: MqttAccessRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetMqttACL(MqttACL{Name: "bad", Users: []string{"scada"}, Topics: []string{"mnms/#/x"}, Access: MqttAccessRead}); err == nil {
+		t.Fatal("expect invalid topic filter to fail")
+	}
+	accounts, err := GetMqttAccounts()
+	if err != nil || len(accounts) != 1 || accounts[0].Password != "" {
+		t.Fatal("expect account without password", accounts, err)
+	}
+
+	auth := newMqttAuth()
+	scada := auth.conn("10.0.0.1:40000")
+	if !scada.Authenticate([]byte("scada"), []byte("Secret#12")) {
+		t.Fatal("expect account login")
+	}
+	// a failed login of another connection leaves the first logged in
+	if auth.conn("10.0.0.2:40000").Authenticate([]byte("scada"), []byte("wrong")) {
+		t.Fatal("expect wrong password to fail")
+	}
+	if !scada.ACL([]byte("scada"), "mnms/client1/devices/00-60-E9-18-3C-3C/state", false) ||
+		scada.ACL([]byte("scada"), "mnms/#", false) ||
+		scada.ACL([]byte("scada"), "mnms/client1/devices/00-60-E9-18-3C-3C/state", true) {
+		t.Fatal("expect scada to only read devices")
+	}
+	if !scada.ACL([]byte("scada"), "mnms/root/commands/reply/scada/#", false) ||
+		scada.ACL([]byte("scada"), "mnms/root/commands/reply/admin/1", false) ||
+		scada.ACL([]byte("scada"), "mnms/root/commands/reply/scada/1", true) {
+		t.Fatal("expect scada to only read its replies")
+	}
+	if auth.conn("10.0.0.3:40000").ACL([]byte("scada"), "mnms/client1/events/trap", false) {
+		t.Fatal("expect unauthenticated connection to be denied")
+	}
+	admin := auth.conn("10.0.0.4:40000")
+	if !admin.Authenticate([]byte("admin"), []byte(AdminDefaultPassword)) ||
+		!admin.ACL([]byte("admin"), "mnms/root/commands/request", true) {
+		t.Fatal("expect admin to log in with its password and publish")
+	}
+	for _, f := range []string{"#", "mnms/+/commands/request", "mnms/root/commands/+"} {
+		if admin.ACL([]byte("admin"), f, false) {
+			t.Fatal("expect subscribing to requests and replies to be denied", f)
+		}
+	}
+	token, err := GetToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.conn("10.0.0.5:40000").Authenticate([]byte("admin"), []byte(token)) ||
+		auth.conn("10.0.0.6:40000").Authenticate([]byte("scada"), []byte(token)) {
+		t.Fatal("expect token to log in its user only")
+	}
+	if p := auth.principal(events.Client{Remote: "10.0.0.1:40000", Username: []byte("scada")}); p == nil || p.user.Name != "scada" {
+		t.Fatal("expect principal of the connection", p)
+	}
+	auth.closeConn(scada)
+	if auth.principal(events.Client{Remote: "10.0.0.1:40000", Username: []byte("scada")}) != nil {
+		t.Fatal("expect closed connection to be forgotten")
+	}
+
+	// a client logs in over tls
+	dir := t.TempDir()
+	QC.MqttTLSCert, QC.MqttTLSKey = path.Join(dir, "mqtt.crt"), path.Join(dir, "mqtt.key")
+	writeTestCertificate(t, QC.MqttTLSCert, QC.MqttTLSKey)
+	tlsConfig, err := mqttTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	broker := MQTTBroker.NewServer(nil)
+	err = broker.AddListener(auth.listener(listeners.NewTCP("tls", addr)), &listeners.Config{TLSConfig: tlsConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	connect := func(user, password string) error {
+		opts := MQTTClient.NewClientOptions().AddBroker("ssl://" + addr).SetClientID("test" + user)
+		opts.SetUsername(user)
+		opts.SetPassword(password)
+		opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+		opts.SetConnectTimeout(5 * time.Second)
+		client := MQTTClient.NewClient(opts)
+		token := client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			client.Disconnect(100)
+		}
+		return token.Error()
+	}
+	if err = connect("scada", "wrong"); err == nil {
+		t.Fatal("expect wrong password to be refused")
+	}
+	if err = connect("scada", "Secret#12"); err != nil {
+		t.Fatal(err)
+	}
+
+	// accounts are locked out after failed logins like users
+	policy := DefaultPasswordPolicy
+	policy.MaxFailures = 2
+	if err = SetPasswordPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if auth.conn("10.0.0.7:40000").Authenticate([]byte("scada"), []byte("wrong")) {
+			t.Fatal("expect wrong password to fail")
+		}
+	}
+	if _, err = authenticateMqttAccount("scada", "Secret#12"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatal("expect account locked", err)
+	}
+	err = SetMqttAccount(MqttAccount{Name: "scada", Role: MNMSUserRole})
+	if err == nil {
+		_, err = authenticateMqttAccount("scada", "Secret#12")
+	}
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatal("expect account to stay locked without a new password", err)
+	}
+	err = SetMqttAccount(MqttAccount{Name: "scada", Password: "Secret#34", Role: MNMSUserRole})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.conn("10.0.0.7:40000").Authenticate([]byte("scada"), []byte("Secret#34")) {
+		t.Fatal("expect a new password to end the lockout")
+	}
+
+	err = DeleteMqttAccount("scada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteMqttACL("scada")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestCertificate writes a self signed certificate for localhost
+func writeTestCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
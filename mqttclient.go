@@ -0,0 +1,514 @@
+package mnms
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	"github.com/qeof/q"
+)
+
+/*
+	Managed mqtt client connections.
+
+	A connection is made with a connect profile,
+
+		mqtt connect plant1 ssl://10.0.0.1:8883 @cred:broker clientid=mnms1 clean=false qos=1 ca=ca.pem
+
+	and kept until it is disconnected. Lost connections are reconnected
+	and their subscriptions renewed. Messages received on subscriptions
+	are sent to syslog.
+
+	Commands which give a broker address in place of a connection name
+	connect with the default profile.
+*/
+
+const (
+	MqttStatusConnected    = "connected"
+	MqttStatusConnecting   = "connecting"
+	MqttStatusDisconnected = "disconnected"
+)
+
+// MqttWill is the last will a broker publishes when a client is lost.
+type MqttWill struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// MqttConnectProfile are the options of a client connection.
+type MqttConnectProfile struct {
+	Name         string    `json:"name"`
+	Broker       string    `json:"broker"`
+	ClientID     string    `json:"clientId"`
+	Username     string    `json:"username,omitempty"`
+	Password     string    `json:"-"`
+	Credential   string    `json:"credential,omitempty"`
+	CleanSession bool      `json:"cleanSession"`
+	QoS          byte      `json:"qos"`
+	Retain       bool      `json:"retain"`
+	Will         *MqttWill `json:"will,omitempty"`
+	CAFile       string    `json:"ca,omitempty"`
+	CertFile     string    `json:"cert,omitempty"`
+	KeyFile      string    `json:"key,omitempty"`
+	Insecure     bool      `json:"insecure,omitempty"`
+}
+
+// MqttSubscription is a subscription of a client connection.
+type MqttSubscription struct {
+	Topic    string `json:"topic"`
+	QoS      byte   `json:"qos"`
+	Messages int    `json:"messages"`
+}
+
+// MqttClientStatus is the state of a client connection for mqtt list.
+type MqttClientStatus struct {
+	MqttConnectProfile
+	Status        string             `json:"status"`
+	Error         string             `json:"error,omitempty"`
+	Since         string             `json:"since,omitempty"`
+	Subscriptions []MqttSubscription `json:"subscriptions"`
+}
+
+type mqttConnection struct {
+	profile MqttConnectProfile
+	client  MQTTClient.Client
+	subs    map[string]*MqttSubscription
+	err     string
+	since   time.Time
+	// onConnected is called after the subscriptions are renewed
+	onConnected func(MQTTClient.Client)
+	// onLost replaces reconnecting a lost connection when set
+	onLost func()
+}
+
+var mqttClients = struct {
+	sync.Mutex
+	conns map[string]*mqttConnection
+}{conns: make(map[string]*mqttConnection)}
+
+// defaultMqttProfile is the profile of a connection made by broker
+// address.
+func defaultMqttProfile(addr string) MqttConnectProfile {
+	return MqttConnectProfile{
+		Name:         addr,
+		Broker:       "tcp://" + addr,
+		ClientID:     QC.Name + ":" + addr,
+		CleanSession: true,
+		QoS:          1,
+	}
+}
+
+// parseMqttBroker checks the broker url, host:port means tcp.
+func parseMqttBroker(broker string) (string, error) {
+	scheme, addr, found := strings.Cut(broker, "://")
+	if !found {
+		scheme, addr = "tcp", broker
+	}
+	switch scheme {
+	case "tcp", "ssl", "tls", "ws", "wss":
+	default:
+		return "", fmt.Errorf("invalid broker scheme %s", scheme)
+	}
+	host, _, _ := strings.Cut(addr, "/")
+	if !strings.Contains(host, ":") {
+		return "", fmt.Errorf("broker %s has no port", broker)
+	}
+	return scheme + "://" + addr, nil
+}
+
+func parseMqttQoS(s string) (byte, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 2 {
+		return 0, fmt.Errorf("invalid qos %s", s)
+	}
+	return byte(n), nil
+}
+
+// ParseMqttConnect parses the arguments of mqtt connect, the
+// connection name, broker url, a credential reference and options.
+func ParseMqttConnect(args []string) (MqttConnectProfile, error) {
+	var p MqttConnectProfile
+	if len(args) < 2 {
+		return p, errors.New("mqtt connect needs a name and a broker")
+	}
+	if strings.Contains(args[0], ":") {
+		return p, fmt.Errorf("invalid connection name %s", args[0])
+	}
+	broker, err := parseMqttBroker(args[1])
+	if err != nil {
+		return p, err
+	}
+	p = MqttConnectProfile{Name: args[0], Broker: broker, ClientID: QC.Name + ":" + args[0],
+		CleanSession: true, QoS: 1}
+	for _, arg := range args[2:] {
+		if isCredentialRef(arg) {
+			p.Credential = strings.TrimPrefix(arg, credRefPrefix)
+			continue
+		}
+		k, v, found := strings.Cut(arg, "=")
+		if !found {
+			return p, fmt.Errorf("invalid option %s", arg)
+		}
+		switch k {
+		case "user":
+			p.Username = v
+		case "password":
+			p.Password = v
+		case "clientid":
+			p.ClientID = v
+		case "clean":
+			p.CleanSession, err = strconv.ParseBool(v)
+		case "qos":
+			p.QoS, err = parseMqttQoS(v)
+		case "retain":
+			p.Retain, err = strconv.ParseBool(v)
+		case "will":
+			if p.Will == nil {
+				p.Will = &MqttWill{}
+			}
+			p.Will.Topic = v
+		case "willmsg":
+			if p.Will == nil {
+				p.Will = &MqttWill{}
+			}
+			p.Will.Payload = v
+		case "willqos":
+			if p.Will == nil {
+				p.Will = &MqttWill{}
+			}
+			p.Will.QoS, err = parseMqttQoS(v)
+		case "willretain":
+			if p.Will == nil {
+				p.Will = &MqttWill{}
+			}
+			p.Will.Retain, err = strconv.ParseBool(v)
+		case "ca":
+			p.CAFile = v
+		case "cert":
+			p.CertFile = v
+		case "key":
+			p.KeyFile = v
+		case "insecure":
+			p.Insecure, err = strconv.ParseBool(v)
+		default:
+			return p, fmt.Errorf("unknown option %s", k)
+		}
+		if err != nil {
+			return p, fmt.Errorf("option %s: %v", k, err)
+		}
+	}
+	if p.Will != nil && p.Will.Topic == "" {
+		return p, errors.New("last will needs a topic")
+	}
+	if (p.CertFile == "") != (p.KeyFile == "") {
+		return p, errors.New("client certificate needs cert and key")
+	}
+	return p, nil
+}
+
+// tlsConfig returns the tls config of the profile, nil when the broker
+// url is not secure.
+func (p *MqttConnectProfile) tlsConfig() (*tls.Config, error) {
+	if !strings.HasPrefix(p.Broker, "ssl://") && !strings.HasPrefix(p.Broker, "tls://") &&
+		!strings.HasPrefix(p.Broker, "wss://") {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: p.Insecure, MinVersion: tls.VersionTLS12}
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", p.CAFile)
+		}
+	}
+	if p.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// clientOptions makes the paho options of connection c.
+func (c *mqttConnection) clientOptions() (*MQTTClient.ClientOptions, error) {
+	p := &c.profile
+	opts := MQTTClient.NewClientOptions().AddBroker(p.Broker).SetClientID(p.ClientID)
+	opts.SetKeepAlive(keepAlive * time.Second)
+	opts.SetPingTimeout(pingTimeout * time.Second)
+	opts.SetCleanSession(p.CleanSession)
+	opts.SetAutoReconnect(c.onLost == nil)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	username, password := p.Username, p.Password
+	if p.Credential != "" {
+		var err error
+		username, password, err = resolveCredential(p.Credential, p.Broker)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if username != "" {
+		opts.SetUsername(username)
+		opts.SetPassword(password)
+	}
+	if p.Will != nil {
+		opts.SetBinaryWill(p.Will.Topic, []byte(p.Will.Payload), p.Will.QoS, p.Will.Retain)
+	}
+	config, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		opts.SetTLSConfig(config)
+	}
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(func(_ MQTTClient.Client, err error) {
+		q.Q("mqtt connection lost", p.Name, err)
+		mqttClients.Lock()
+		c.err = err.Error()
+		c.since = time.Now()
+		current := mqttClients.conns[p.Name] == c
+		mqttClients.Unlock()
+		syslogerr := SendSyslog(LOG_WARNING, "mqttclient", "connection "+p.Name+" lost: "+err.Error())
+		if syslogerr != nil {
+			q.Q(syslogerr)
+		}
+		if c.onLost != nil && current {
+			go c.onLost()
+		}
+	})
+	return opts, nil
+}
+
+// onConnect renews the subscriptions after connecting.
+func (c *mqttConnection) onConnect(client MQTTClient.Client) {
+	mqttClients.Lock()
+	c.err = ""
+	c.since = time.Now()
+	subs := make(map[string]byte, len(c.subs))
+	for topic, s := range c.subs {
+		subs[topic] = s.QoS
+	}
+	mqttClients.Unlock()
+	q.Q("mqtt connected", c.profile.Name, len(subs))
+	if len(subs) > 0 {
+		token := client.SubscribeMultiple(subs, c.onMessage)
+		if token.WaitTimeout(clientTimeout*time.Second) && token.Error() != nil {
+			q.Q(token.Error())
+		}
+	}
+	if c.onConnected != nil {
+		c.onConnected(client)
+	}
+}
+
+// onMessage sends received messages to syslog.
+func (c *mqttConnection) onMessage(_ MQTTClient.Client, msg MQTTClient.Message) {
+	q.Q("Received message: ", msg.Payload(), msg.Topic())
+	mqttClients.Lock()
+	for topic, s := range c.subs {
+		if mqttFilterCovers(topic, msg.Topic()) {
+			s.Messages++
+		}
+	}
+	mqttClients.Unlock()
+	if routeMqttMessage(c.profile.Name, msg.Topic(), msg.Payload()) {
+		return
+	}
+	receivemsg := "connection: " + c.profile.Name + " topic: " + msg.Topic() + " message: " + string(msg.Payload())
+	syslogerr := SendSyslog(LOG_INFO, "mqttclient", receivemsg)
+	if syslogerr != nil {
+		q.Q(syslogerr)
+	}
+}
+
+// MqttConnect makes the connection of profile p, replacing a connection
+// of the same name. It waits a while for the broker, when it is not
+// reachable the connection is retried in the background.
+func MqttConnect(p MqttConnectProfile) error {
+	return connectMqtt(p, nil, nil)
+}
+
+// connectMqtt makes the connection of profile p which calls onConnected
+// each time it is connected. A lost connection calls onLost, when set,
+// instead of reconnecting.
+func connectMqtt(p MqttConnectProfile, onConnected func(MQTTClient.Client), onLost func()) error {
+	c := &mqttConnection{profile: p, subs: make(map[string]*MqttSubscription), onConnected: onConnected, onLost: onLost}
+	mqttClients.Lock()
+	old := mqttClients.conns[p.Name]
+	if old != nil {
+		// keep the subscriptions
+		c.subs = old.subs
+	}
+	mqttClients.Unlock()
+	opts, err := c.clientOptions()
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		old.client.Disconnect(250)
+	}
+	c.client = MQTTClient.NewClient(opts)
+	c.since = time.Now()
+	mqttClients.Lock()
+	mqttClients.conns[p.Name] = c
+	mqttClients.Unlock()
+	token := c.client.Connect()
+	if token.WaitTimeout(clientTimeout*time.Second) && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// MqttDisconnect closes the connection name.
+func MqttDisconnect(name string) error {
+	mqttClients.Lock()
+	c := mqttClients.conns[name]
+	delete(mqttClients.conns, name)
+	mqttClients.Unlock()
+	if c == nil {
+		return fmt.Errorf("mqtt connection %s not found", name)
+	}
+	c.client.Disconnect(250)
+	return nil
+}
+
+// getMqttConnection returns the connection name, connecting with the
+// default profile when name is a broker address.
+func getMqttConnection(name string) (*mqttConnection, error) {
+	mqttClients.Lock()
+	c := mqttClients.conns[name]
+	mqttClients.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	if !strings.Contains(name, ":") {
+		return nil, fmt.Errorf("mqtt connection %s not found", name)
+	}
+	err := MqttConnect(defaultMqttProfile(name))
+	if err != nil {
+		return nil, err
+	}
+	mqttClients.Lock()
+	c = mqttClients.conns[name]
+	mqttClients.Unlock()
+	return c, nil
+}
+
+// RunMqttPublish publishes messages to topicname with the qos and retain
+// of connection name.
+func RunMqttPublish(name string, topicname string, messages string) error {
+	c, err := getMqttConnection(name)
+	if err != nil {
+		return err
+	}
+	if !c.client.IsConnectionOpen() {
+		return fmt.Errorf("mqtt connection %s is not connected", name)
+	}
+	token := c.client.Publish(topicname, c.profile.QoS, c.profile.Retain, messages)
+	if !token.WaitTimeout(clientTimeout * time.Second) {
+		return errors.New("mqtt publish timeout")
+	}
+	return token.Error()
+}
+
+// RunMqttSubscribe subscribes connection name to topicname with qos,
+// the qos of the connection by default.
+func RunMqttSubscribe(name string, topicname string, qos ...byte) error {
+	c, err := getMqttConnection(name)
+	if err != nil {
+		return err
+	}
+	s := &MqttSubscription{Topic: topicname, QoS: c.profile.QoS}
+	if len(qos) > 0 {
+		s.QoS = qos[0]
+	}
+	mqttClients.Lock()
+	_, ok := c.subs[topicname]
+	if !ok {
+		c.subs[topicname] = s
+	}
+	mqttClients.Unlock()
+	if ok {
+		return errors.New("topic " + topicname + " in using.")
+	}
+	if !c.client.IsConnectionOpen() {
+		// subscribed on connect
+		return nil
+	}
+	token := c.client.Subscribe(topicname, s.QoS, c.onMessage)
+	if token.WaitTimeout(clientTimeout*time.Second) && token.Error() != nil {
+		mqttClients.Lock()
+		delete(c.subs, topicname)
+		mqttClients.Unlock()
+		return token.Error()
+	}
+	return nil
+}
+
+// RunMqttUnSubscribe unsubscribes connection name from topicname.
+func RunMqttUnSubscribe(name string, topicname string) error {
+	mqttClients.Lock()
+	c := mqttClients.conns[name]
+	ok := false
+	if c != nil {
+		_, ok = c.subs[topicname]
+		delete(c.subs, topicname)
+	}
+	mqttClients.Unlock()
+	if c == nil {
+		return errors.New("mqtt client not found")
+	}
+	if !ok {
+		return errors.New("topic " + topicname + " not found.")
+	}
+	if !c.client.IsConnectionOpen() {
+		return nil
+	}
+	token := c.client.Unsubscribe(topicname)
+	if token.WaitTimeout(clientTimeout*time.Second) && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// GetMqttClients returns the status of the client connections.
+func GetMqttClients() []MqttClientStatus {
+	mqttClients.Lock()
+	defer mqttClients.Unlock()
+	ret := []MqttClientStatus{}
+	for _, c := range mqttClients.conns {
+		s := MqttClientStatus{MqttConnectProfile: c.profile, Status: MqttStatusConnecting,
+			Error: c.err, Subscriptions: []MqttSubscription{}}
+		if c.client.IsConnectionOpen() {
+			s.Status = MqttStatusConnected
+		} else if !c.client.IsConnected() {
+			s.Status = MqttStatusDisconnected
+		}
+		if !c.since.IsZero() {
+			s.Since = c.since.Format(time.RFC3339)
+		}
+		for _, sub := range c.subs {
+			s.Subscriptions = append(s.Subscriptions, *sub)
+		}
+		sort.Slice(s.Subscriptions, func(i, j int) bool { return s.Subscriptions[i].Topic < s.Subscriptions[j].Topic })
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
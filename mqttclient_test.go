@@ -0,0 +1,135 @@
+package mnms
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+// TestParseMqttConnect tests connect profiles
+func TestParseMqttConnect(t *testing.T) {
+	p, err := ParseMqttConnect([]string{"plant1", "ssl://10.0.0.1:8883", "@cred:broker", "clientid=mnms1",
+		"clean=false", "qos=2", "retain=true", "will=mnms/status", "willmsg=offline", "willretain=true", "insecure=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Broker != "ssl://10.0.0.1:8883" || p.Credential != "broker" || p.ClientID != "mnms1" ||
+		p.CleanSession || p.QoS != 2 || !p.Retain || p.Will == nil || p.Will.Topic != "mnms/status" ||
+		p.Will.Payload != "offline" || !p.Will.Retain || !p.Insecure {
+		t.Fatal("unexpected profile", p)
+	}
+	if config, err := p.tlsConfig(); err != nil || config == nil || !config.InsecureSkipVerify {
+		t.Fatal("expect tls config", config, err)
+	}
+	p, err = ParseMqttConnect([]string{"plant2", "10.0.0.2:1883"})
+	if err != nil || p.Broker != "tcp://10.0.0.2:1883" || !p.CleanSession || p.QoS != 1 {
+		t.Fatal("unexpected default profile", p, err)
+	}
+	for _, args := range [][]string{
+		{"plant1"},
+		{"10.0.0.1:1883", "tcp://10.0.0.1:1883"},
+		{"plant1", "http://10.0.0.1:1883"},
+		{"plant1", "tcp://10.0.0.1"},
+		{"plant1", "tcp://10.0.0.1:1883", "qos=3"},
+		{"plant1", "tcp://10.0.0.1:1883", "color=red"},
+		{"plant1", "tcp://10.0.0.1:1883", "willmsg=offline"},
+		{"plant1", "tcp://10.0.0.1:1883", "cert=a.pem"},
+	} {
+		if _, err = ParseMqttConnect(args); err == nil {
+			t.Errorf("expect %v to fail", args)
+		}
+	}
+	cmd := "mqtt connect plant2 10.0.0.2:1883 user=mnms password=secret qos=1"
+	if got := RedactCommand(cmd); got != "mqtt connect plant2 10.0.0.2:1883 user=mnms password=*** qos=1" {
+		t.Error("unexpected redacted command", got)
+	}
+}
+
+// TestMqttClientReconnect tests that connections come back with their
+// subscriptions after the broker restarts.
+func TestMqttClientReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	startBroker := func() *MQTTBroker.Server {
+		broker := MQTTBroker.NewServer(nil)
+		err := broker.AddListener(listeners.NewTCP("t1", addr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = broker.Serve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return broker
+	}
+	status := func() MqttClientStatus {
+		for _, s := range GetMqttClients() {
+			if s.Name == "reconnect" {
+				return s
+			}
+		}
+		t.Fatal("connection not listed")
+		return MqttClientStatus{}
+	}
+	waitFor := func(what string, cond func(MqttClientStatus) bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond(status()) {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for", what, status())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	broker := startBroker()
+	cmdinfo := RunMqttCmd(&CmdInfo{Command: "mqtt connect reconnect tcp://" + addr + " clientid=reconnecttest qos=1"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	defer func() {
+		_ = MqttDisconnect("reconnect")
+	}()
+	cmdinfo = RunMqttCmd(&CmdInfo{Command: "mqtt sub reconnect test/# 1"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	if cmdinfo = RunMqttCmd(&CmdInfo{Command: "mqtt sub reconnect test/# 1"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect subscribing twice to fail")
+	}
+	err = RunMqttPublish("reconnect", "test/a", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("first message", func(s MqttClientStatus) bool {
+		return s.Status == MqttStatusConnected && len(s.Subscriptions) == 1 && s.Subscriptions[0].Messages == 1
+	})
+
+	broker.Close()
+	waitFor("connection lost", func(s MqttClientStatus) bool { return s.Status != MqttStatusConnected })
+	broker = startBroker()
+	defer broker.Close()
+	waitFor("reconnect", func(s MqttClientStatus) bool { return s.Status == MqttStatusConnected })
+	// the subscription is renewed after the connect, wait for the broker
+	// to have it
+	waitFor("resubscribe", func(MqttClientStatus) bool { return len(broker.Topics.Subscribers("test/b")) > 0 })
+	err = RunMqttPublish("reconnect", "test/b", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("message after reconnect", func(s MqttClientStatus) bool { return s.Subscriptions[0].Messages == 2 })
+
+	if err = MqttDisconnect("reconnect"); err != nil {
+		t.Fatal(err)
+	}
+	if cmdinfo = RunMqttCmd(&CmdInfo{Command: "mqtt pub reconnect test/c three"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect publishing to a closed connection to fail")
+	}
+}
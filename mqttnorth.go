@@ -0,0 +1,336 @@
+package mnms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/qeof/q"
+)
+
+/*
+	The MQTT northbound interface publishes the state of a node to its
+	embedded broker, so that SCADA and MES systems can integrate without
+	the REST API. Topics start with the prefix, mnms by default, and the
+	name of the client node which owns the data:
+
+		mnms/<client>/devices/<mac>/state     retained device record
+		mnms/<client>/devices/<mac>/status    retained online or offline
+		mnms/<client>/topology/<mac>          retained topology of a device
+		mnms/<client>/events/syslog           syslog messages
+		mnms/<client>/events/trap             snmp traps
+		mnms/<client>/events/firmware         firmware update progress
+		mnms/<client>/commands/result         finished commands
+
+	When commands and mqtt.auth are enabled the root accepts commands
+	published to mnms/<root>/commands/request as
+
+		{"id": "42", "command": "beep 00-60-E9-18-3C-3C 10.0.50.1"}
+
+	and publishes the command info to mnms/<root>/commands/reply/<user>/42
+	when the command is done. Commands run as the user logged in to the
+	broker, with the permissions of its role and api key.
+*/
+
+const (
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+	// devices not seen for this many gwd intervals are offline
+	mqttOfflineIntervals = 3
+)
+
+// MqttCommandRequest is a command published to the request topic
+type MqttCommandRequest struct {
+	Id      string `json:"id"`
+	Command string `json:"command"`
+}
+
+var northbound struct {
+	sync.Mutex
+	broker  *MQTTBroker.Server
+	status  map[string]string   // device mac to published status
+	pending map[string][]string // command to user/id of requests
+}
+
+func init() {
+	northbound.status = make(map[string]string)
+	northbound.pending = make(map[string][]string)
+}
+
+// mqttTopic joins the topic prefix, node name and levels
+func mqttTopic(node string, levels ...string) string {
+	if node == "" {
+		node = QC.Name
+	}
+	return strings.Join(append([]string{ReadSetting(&QC.MqttTopicPrefix), node}, levels...), "/")
+}
+
+// setNorthboundBroker sets the broker to publish to, nil to stop publishing
+func setNorthboundBroker(broker *MQTTBroker.Server) {
+	northbound.Lock()
+	northbound.broker = broker
+	northbound.status = make(map[string]string)
+	northbound.Unlock()
+}
+
+// mqttPublish publishes payload to topic of the embedded broker, if any
+func mqttPublish(topic string, payload any, retain bool) {
+	northbound.Lock()
+	broker := northbound.broker
+	northbound.Unlock()
+	if broker == nil || !ReadSetting(&QC.MqttNorthbound) {
+		return
+	}
+	var b []byte
+	switch p := payload.(type) {
+	case string:
+		b = []byte(p)
+	default:
+		var err error
+		b, err = json.Marshal(payload)
+		if err != nil {
+			q.Q(err)
+			return
+		}
+	}
+	err := broker.Publish(topic, b, retain)
+	if err != nil {
+		q.Q(err, topic)
+	}
+}
+
+// mqttBrokerPublish publishes payload to topic of the embedded broker,
+// also when the northbound interface is off.
+func mqttBrokerPublish(topic string, payload []byte, retain bool) error {
+	northbound.Lock()
+	broker := northbound.broker
+	northbound.Unlock()
+	if broker == nil {
+		return errors.New("mqtt broker is not running")
+	}
+	return broker.Publish(topic, payload, retain)
+}
+
+// deviceStatus tells whether dev is online or offline at now
+func deviceStatus(dev DevInfo, now time.Time) string {
+	if dev.ArpMissed >= 2 {
+		return mqttStatusOffline
+	}
+	ts, err := strconv.ParseInt(dev.Timestamp, 10, 64)
+	interval := ReadSetting(&QC.GwdInterval)
+	if err == nil && interval > 0 &&
+		now.Sub(time.Unix(ts, 0)) > time.Duration(mqttOfflineIntervals*interval)*time.Second {
+		return mqttStatusOffline
+	}
+	return mqttStatusOnline
+}
+
+// publishMqttStatus publishes the status of dev when it changed
+func publishMqttStatus(dev DevInfo, status string) {
+	northbound.Lock()
+	changed := northbound.status[dev.Mac] != status
+	northbound.status[dev.Mac] = status
+	northbound.Unlock()
+	if changed {
+		mqttPublish(mqttTopic(dev.ScannedBy, "devices", dev.Mac, "status"), status, true)
+	}
+}
+
+// publishMqttDevice publishes the record and status of dev.
+func publishMqttDevice(dev DevInfo) {
+	mqttPublish(mqttTopic(dev.ScannedBy, "devices", dev.Mac, "state"), dev, true)
+	publishMqttStatus(dev, deviceStatus(dev, time.Now()))
+}
+
+// publishMqttTopology publishes the topology of device mac.
+func publishMqttTopology(mac string, topo Topology) {
+	mqttPublish(mqttTopic("", "topology", mac), topo, true)
+}
+
+// publishMqttEvent publishes a syslog, trap or firmware event.
+func publishMqttEvent(msg WebSocketMessage) {
+	var kind string
+	switch msg.Topic {
+	case WebSocketTopicSyslog:
+		kind = "syslog"
+	case WebSocketTopicTraps:
+		kind = "trap"
+	case WebSocketTopicFirmware:
+		kind = "firmware"
+	default:
+		return
+	}
+	mqttPublish(mqttTopic("", "events", kind), msg, false)
+}
+
+// publishMqttCmd publishes finished commands and replies to the
+// requests waiting for them.
+func publishMqttCmd(cmd string, cmdinfo CmdInfo) {
+	if cmdinfo.Status != "ok" && !strings.HasPrefix(cmdinfo.Status, "error") {
+		return
+	}
+	// commands may carry device passwords
+	cmdinfo.Command = RedactCommand(cmdinfo.Command)
+	mqttPublish(mqttTopic(cmdinfo.Client, "commands", "result"), cmdinfo, false)
+	northbound.Lock()
+	ids := northbound.pending[cmd]
+	delete(northbound.pending, cmd)
+	northbound.Unlock()
+	for _, id := range ids {
+		mqttPublish(mqttTopic("", "commands", "reply", id), cmdinfo, false)
+	}
+}
+
+// checkMqttDevices publishes devices which went offline.
+func checkMqttDevices() {
+	now := time.Now()
+	QC.DevMutex.Lock()
+	devs := make([]DevInfo, 0, len(QC.DevData))
+	for _, dev := range QC.DevData {
+		devs = append(devs, dev)
+	}
+	QC.DevMutex.Unlock()
+	for _, dev := range devs {
+		publishMqttStatus(dev, deviceStatus(dev, now))
+	}
+}
+
+// mqttUser authenticates a jwt or api key
+func mqttUser(token string) (*UserConfig, *APIKey, error) {
+	if token == "" {
+		return nil, nil, fmt.Errorf("no token")
+	}
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		return authenticateAPIKey(token)
+	}
+	t, err := JWTVerifyToken(jwtTokenAuth, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = checkTokenSession(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, _ := t.Get("user")
+	user, _ := name.(string)
+	u, err := GetUserConfig(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, nil, nil
+}
+
+// submitMqttCommand checks and queues the command of req by the broker
+// user p.
+func submitMqttCommand(req MqttCommandRequest, p *mqttPrincipal) error {
+	if !QC.IsRoot {
+		return errors.New("commands are accepted by the root only")
+	}
+	if !ReadSetting(&QC.MqttCommands) {
+		return errors.New("mqtt commands are disabled")
+	}
+	if p == nil {
+		return errors.New("mqtt commands need broker logins, set mqtt.auth")
+	}
+	u := &p.user
+	if !p.role.Allows(PermCommandsWrite) || (p.key != nil && !p.key.Allows(PermCommandsWrite)) {
+		return fmt.Errorf("user %s has no %s permission", u.Name, PermCommandsWrite)
+	}
+	// client commands have prefix @client like on the command line
+	cmd := strings.TrimSpace(req.Command)
+	cmdinfo := CmdInfo{Kind: "usercommand", Command: cmd, User: u.Name}
+	if strings.HasPrefix(cmd, "@") {
+		cmdinfo.Client, cmdinfo.Command, _ = strings.Cut(cmd[1:], " ")
+	}
+	verb, _, _ := strings.Cut(cmdinfo.Command, " ")
+	found := false
+	for _, c := range ValidCommands {
+		if c == verb {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("invalid command %q", verb)
+	}
+	err := CheckCommandPermission(u, cmd)
+	if err != nil {
+		return err
+	}
+	err = CheckCommandCredentials(cmd)
+	if err != nil {
+		return err
+	}
+	northbound.Lock()
+	northbound.pending[cmd] = append(northbound.pending[cmd], u.Name+"/"+req.Id)
+	northbound.Unlock()
+	InsertCmd(cmd, cmdinfo)
+	return nil
+}
+
+// handleMqttRequest handles a command request published by client.
+// It reports whether pk was a request.
+func handleMqttRequest(client events.Client, pk events.Packet) bool {
+	if pk.TopicName != mqttTopic("", "commands", "request") {
+		return false
+	}
+	// replies go to a topic level named after the user
+	user := string(client.Username)
+	var req MqttCommandRequest
+	err := json.Unmarshal(pk.Payload, &req)
+	if err == nil && (req.Id == "" || strings.ContainsAny(req.Id, "/+#")) {
+		err = errors.New("invalid request id")
+	}
+	if err == nil && (user == "" || strings.ContainsAny(user, "/+#")) {
+		err = fmt.Errorf("invalid user %q", user)
+	}
+	if err != nil {
+		q.Q(err)
+		return true
+	}
+	err = submitMqttCommand(req, brokerAuth.principal(client))
+	outcome := "ok"
+	if err != nil {
+		q.Q(err)
+		outcome = "error: " + err.Error()
+		mqttPublish(mqttTopic("", "commands", "reply", user, req.Id),
+			CmdInfo{Command: req.Command, Status: outcome}, false)
+	}
+	err = WriteAuditRecord(AuditRecord{User: user, Source: "mqtt:" + client.ID, Action: "command",
+		Detail: RedactCommand(req.Command), Outcome: outcome})
+	if err != nil {
+		q.Q(err)
+	}
+	return true
+}
+
+// runMqttNorthbound publishes the devices known so far and then checks
+// for devices going offline until the broker is closed.
+func runMqttNorthbound(done chan struct{}) {
+	QC.DevMutex.Lock()
+	devs := make([]DevInfo, 0, len(QC.DevData))
+	for _, dev := range QC.DevData {
+		devs = append(devs, dev)
+	}
+	QC.DevMutex.Unlock()
+	for _, dev := range devs {
+		publishMqttDevice(dev)
+	}
+	for {
+		interval := ReadSetting(&QC.GwdInterval)
+		if interval <= 0 {
+			interval = 60
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+			checkMqttDevices()
+		}
+	}
+}
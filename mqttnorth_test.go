@@ -0,0 +1,180 @@
+package mnms
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+// TestMqttNorthbound tests publishing devices and running commands over mqtt
+func TestMqttNorthbound(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	restoreSettings(t)
+	isRoot := QC.IsRoot
+	defer func() {
+		QC.IsRoot = isRoot
+	}()
+	QC.IsRoot = true
+	QC.Name = "root1"
+	QC.MqttNorthbound = true
+	QC.MqttAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	broker := MQTTBroker.NewServer(nil)
+	err = broker.AddListener(brokerAuth.listener(listeners.NewTCP("north", addr)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Events.OnMessage = onMqttMessage
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setNorthboundBroker(broker)
+	defer func() {
+		setNorthboundBroker(nil)
+		broker.Close()
+	}()
+
+	received := make(chan MQTTClient.Message, 100)
+	opts := MQTTClient.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("scada")
+	opts.SetUsername("admin")
+	opts.SetPassword(AdminDefaultPassword)
+	client := MQTTClient.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(100)
+	subscribe := func(filter string) bool {
+		t.Helper()
+		token := client.Subscribe(filter, 0, func(_ MQTTClient.Client, msg MQTTClient.Message) {
+			received <- msg
+		})
+		if token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		return token.(*MQTTClient.SubscribeToken).Result()[filter] != 0x80
+	}
+	// requests and the replies of other users are not readable
+	for _, f := range []string{"mnms/#", "mnms/root1/commands/request", "mnms/+/commands/reply/+/1", "mnms/root1/commands/reply/bob/#"} {
+		if subscribe(f) {
+			t.Fatal("expect subscription to be refused", f)
+		}
+	}
+	if !subscribe("mnms/+/devices/#") || !subscribe("mnms/+/commands/result") || !subscribe("mnms/root1/commands/reply/admin/#") {
+		t.Fatal("expect subscriptions of devices, results and own replies")
+	}
+	expect := func(topic string) []byte {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-received:
+				if msg.Topic() == topic {
+					return msg.Payload()
+				}
+			case <-timeout:
+				t.Fatal("no message on", topic)
+			}
+		}
+	}
+
+	const mac = "00-60-E9-18-3C-3C"
+	now := time.Now()
+	dev := DevInfo{Mac: mac, ScannedBy: "client1", Timestamp: strconv.FormatInt(now.Unix(), 10)}
+	publishDevice("new", dev)
+	var state DevInfo
+	err = json.Unmarshal(expect("mnms/client1/devices/"+mac+"/state"), &state)
+	if err != nil || state.Mac != mac {
+		t.Fatal("unexpected device state", state, err)
+	}
+	if status := string(expect("mnms/client1/devices/" + mac + "/status")); status != mqttStatusOnline {
+		t.Fatal("unexpected status", status)
+	}
+	if status := deviceStatus(dev, now.Add(time.Duration(mqttOfflineIntervals*QC.GwdInterval+1)*time.Second)); status != mqttStatusOffline {
+		t.Fatal("expect device not seen for long to be offline", status)
+	}
+
+	request := func(id, cmd string) {
+		t.Helper()
+		b, err := json.Marshal(MqttCommandRequest{Id: id, Command: cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := client.Publish("mnms/root1/commands/request", 1, false, b); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	var reply CmdInfo
+	request("1", "beep "+mac+" 10.0.50.1")
+	err = json.Unmarshal(expect("mnms/root1/commands/reply/admin/1"), &reply)
+	if err != nil || reply.Status != "error: mqtt commands are disabled" {
+		t.Fatal("expect commands disabled by default", reply, err)
+	}
+
+	QC.MqttCommands = true
+	QC.MqttAuth = false
+	request("2", "beep "+mac+" 10.0.50.1")
+	err = json.Unmarshal(expect("mnms/root1/commands/reply/admin/2"), &reply)
+	QC.MqttAuth = true
+	if err != nil || reply.Status != "error: mqtt commands need broker logins, set mqtt.auth" {
+		t.Fatal("expect commands without mqtt.auth to fail", reply, err)
+	}
+
+	cmd := "@client1 beep " + mac + " 10.0.50.1"
+	defer func() {
+		QC.CmdMutex.Lock()
+		delete(QC.CmdData, cmd)
+		QC.CmdMutex.Unlock()
+	}()
+	request("3", cmd)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		QC.CmdMutex.Lock()
+		ci, ok := QC.CmdData[cmd]
+		QC.CmdMutex.Unlock()
+		if ok {
+			if ci.Client != "client1" || ci.Command != "beep "+mac+" 10.0.50.1" || ci.User != "admin" {
+				t.Fatal("unexpected command", ci)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect command queued")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// the client reports the result
+	UpdateCmds(&map[string]CmdInfo{cmd: {Command: "beep " + mac + " 10.0.50.1", Client: "client1", Status: "ok"}})
+	err = json.Unmarshal(expect("mnms/root1/commands/reply/admin/3"), &reply)
+	if err != nil || reply.Status != "ok" || reply.Client != "client1" {
+		t.Fatal("unexpected reply", reply, err)
+	}
+
+	// passwords are not published
+	secret := "switch " + mac + " admin default show ip"
+	publishMqttCmd(secret, CmdInfo{Command: secret, Client: "client1", Status: "ok"})
+	var result CmdInfo
+	err = json.Unmarshal(expect("mnms/client1/commands/result"), &result)
+	if err != nil || result.Command != "switch "+mac+" admin *** show ip" {
+		t.Fatal("expect redacted command", result, err)
+	}
+}
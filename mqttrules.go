@@ -0,0 +1,557 @@
+package mnms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Mqtt routing rules turn messages received by the broker of the root
+	and by its mqtt connections into mnms actions.
+
+	A rule matches a topic filter and optionally values at JSON paths of
+	the payload, such as "port.state" or "ports.0.state". Matching
+	messages are
+
+		event     stored as an mqtt event and sent on the websocket
+		syslog    sent as syslog at the severity of the rule
+		command   run as a command of the user who made the rule, within
+		          the scopes of its api key
+
+	Messages and commands are templates, {topic}, {topic.N} (level N of
+	the topic from 0), {payload} and {path} of the payload are replaced
+	by their values. Values put in a command must be a single word.
+*/
+
+// mqtt rule actions
+const (
+	MqttActionEvent   = "event"
+	MqttActionSyslog  = "syslog"
+	MqttActionCommand = "command"
+)
+
+const (
+	// mqttEventsMax is the number of mqtt events kept.
+	mqttEventsMax = 1000
+	// mqttRuleQueueSize is the number of rule actions waiting to run.
+	mqttRuleQueueSize = 1024
+)
+
+// MqttRule maps matching mqtt messages to an action.
+type MqttRule struct {
+	Name     string            `json:"name"`
+	Topic    string            `json:"topic"`
+	Match    map[string]string `json:"match,omitempty"` // json path to value, * for any value
+	Action   string            `json:"action"`
+	Severity *int              `json:"severity,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Command  string            `json:"command,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Key      string            `json:"key,omitempty"` // id of the api key the rule was made with
+}
+
+// MqttEvent is a message stored by an event rule.
+type MqttEvent struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Source  string    `json:"source"`
+	Topic   string    `json:"topic"`
+	Message string    `json:"message,omitempty"`
+	Payload any       `json:"payload"`
+}
+
+var mqttRules = struct {
+	sync.Mutex
+	rules  []MqttRule
+	loaded bool
+	events []MqttEvent
+}{}
+
+// mqttRuleAction is the action of a rule for a message.
+type mqttRuleAction struct {
+	rule MqttRule
+	m    *mqttMessage
+}
+
+// mqttRuleQueue holds the actions to run, so that commands, which read
+// the config, and syslog do not hold up the broker.
+var (
+	mqttRuleQueue     = make(chan mqttRuleAction, mqttRuleQueueSize)
+	mqttRuleQueueOnce sync.Once
+)
+
+var mqttTemplateRegexp = regexp.MustCompile(`\{([^{}\s]+)\}`)
+
+// mqttJSONPath returns the value at the dotted path of v.
+func mqttJSONPath(v any, path string) (any, bool) {
+	for _, k := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = x[k]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, false
+			}
+			v = x[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// mqttValueString formats a payload value, objects as json.
+func mqttValueString(v any) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case nil:
+		return "null"
+	case map[string]any, []any:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return fmt.Sprint(x)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// mqttMessage is a received message with its payload decoded when it
+// is json.
+type mqttMessage struct {
+	source  string
+	topic   string
+	payload []byte
+	json    any
+	isJSON  bool
+}
+
+func newMqttMessage(source, topic string, payload []byte) *mqttMessage {
+	m := &mqttMessage{source: source, topic: topic, payload: payload}
+	m.isJSON = json.Unmarshal(payload, &m.json) == nil
+	return m
+}
+
+// value returns the template variable name of the message.
+func (m *mqttMessage) value(name string) (string, bool) {
+	switch {
+	case name == "topic":
+		return m.topic, true
+	case name == "payload":
+		return string(m.payload), true
+	case strings.HasPrefix(name, "topic."):
+		i, err := strconv.Atoi(strings.TrimPrefix(name, "topic."))
+		levels := strings.Split(m.topic, "/")
+		if err != nil || i < 0 || i >= len(levels) {
+			return "", false
+		}
+		return levels[i], true
+	}
+	if !m.isJSON {
+		return "", false
+	}
+	v, ok := mqttJSONPath(m.json, name)
+	if !ok {
+		return "", false
+	}
+	return mqttValueString(v), true
+}
+
+// expand replaces the variables of template s, words requires each
+// value to be a single word.
+func (m *mqttMessage) expand(s string, words bool) (string, error) {
+	var err error
+	out := mqttTemplateRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		name := v[1 : len(v)-1]
+		value, ok := m.value(name)
+		if !ok {
+			err = fmt.Errorf("no %s in message on %s", name, m.topic)
+		} else if words && (value == "" || strings.ContainsAny(value, " \t\r\n@")) {
+			err = fmt.Errorf("%s of message on %s is not a single word", name, m.topic)
+		}
+		return value
+	})
+	return out, err
+}
+
+// matches reports whether message m matches the rule.
+func (rule *MqttRule) matches(m *mqttMessage) bool {
+	if !mqttFilterCovers(rule.Topic, m.topic) {
+		return false
+	}
+	for path, want := range rule.Match {
+		if !m.isJSON {
+			return false
+		}
+		v, ok := mqttJSONPath(m.json, path)
+		if !ok || (want != "*" && mqttValueString(v) != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMqttRule checks a rule before it is saved.
+func checkMqttRule(rule *MqttRule) error {
+	if rule.Name == "" || strings.ContainsAny(rule.Name, " \t") {
+		return fmt.Errorf("invalid mqtt rule name %q", rule.Name)
+	}
+	err := checkMqttTopicFilter(rule.Topic)
+	if err != nil {
+		return err
+	}
+	switch rule.Action {
+	case MqttActionEvent:
+	case MqttActionSyslog:
+		if rule.Severity == nil {
+			return errors.New("mqtt rule has no severity")
+		}
+		if *rule.Severity < LOG_EMERG || *rule.Severity > LOG_DEBUG {
+			return fmt.Errorf("invalid severity %d, must be 0 to 7", *rule.Severity)
+		}
+	case MqttActionCommand:
+		if rule.Command == "" {
+			return errors.New("mqtt rule has no command")
+		}
+		if rule.User == "" {
+			return errors.New("mqtt rule has no user")
+		}
+		cmd := rule.Command
+		if strings.HasPrefix(cmd, "@") {
+			_, cmd, _ = strings.Cut(cmd, " ")
+		}
+		verb, _, _ := strings.Cut(cmd, " ")
+		found := false
+		for _, c := range ValidCommands {
+			if c == verb {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid command %q", verb)
+		}
+	default:
+		return fmt.Errorf("invalid action %q, must be event, syslog or command", rule.Action)
+	}
+	return nil
+}
+
+// GetMqttRules returns the mqtt routing rules.
+func GetMqttRules() ([]MqttRule, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.MqttRules == nil {
+		return []MqttRule{}, nil
+	}
+	return c.MqttRules, nil
+}
+
+// SetMqttRule adds or replaces an mqtt routing rule.
+func SetMqttRule(rule MqttRule) error {
+	err := checkMqttRule(&rule)
+	if err != nil {
+		return err
+	}
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		if rule.Action == MqttActionCommand {
+			found := false
+			for _, u := range c.Users {
+				if u.Name == rule.User {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("user %s not exist", rule.User)
+			}
+		}
+		replaced := false
+		for i := range c.MqttRules {
+			if c.MqttRules[i].Name == rule.Name {
+				c.MqttRules[i] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.MqttRules = append(c.MqttRules, rule)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reloadMqttRules()
+	return nil
+}
+
+// DeleteMqttRule deletes an mqtt routing rule.
+func DeleteMqttRule(name string) error {
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, rule := range c.MqttRules {
+			if rule.Name == name {
+				c.MqttRules = append(c.MqttRules[:i], c.MqttRules[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("mqtt rule %s not exist", name)
+	})
+	if err != nil {
+		return err
+	}
+	reloadMqttRules()
+	return nil
+}
+
+// reloadMqttRules reads the rules again on the next message.
+func reloadMqttRules() {
+	mqttRules.Lock()
+	mqttRules.loaded = false
+	mqttRules.Unlock()
+}
+
+// activeMqttRules returns the rules, they are only read from the config
+// of the root when they changed.
+func activeMqttRules() []MqttRule {
+	mqttRules.Lock()
+	defer mqttRules.Unlock()
+	if !mqttRules.loaded {
+		mqttRules.rules = nil
+		mqttRules.loaded = true
+		if QC.IsRoot {
+			rules, err := GetMqttRules()
+			if err != nil {
+				q.Q(err)
+			}
+			mqttRules.rules = rules
+		}
+	}
+	return mqttRules.rules
+}
+
+// GetMqttEvents returns the stored mqtt events, oldest first.
+func GetMqttEvents() []MqttEvent {
+	mqttRules.Lock()
+	defer mqttRules.Unlock()
+	events := make([]MqttEvent, len(mqttRules.events))
+	copy(events, mqttRules.events)
+	return events
+}
+
+func addMqttEvent(e MqttEvent) {
+	mqttRules.Lock()
+	mqttRules.events = append(mqttRules.events, e)
+	if n := len(mqttRules.events); n > mqttEventsMax {
+		mqttRules.events = append([]MqttEvent(nil), mqttRules.events[n-mqttEventsMax:]...)
+	}
+	mqttRules.Unlock()
+}
+
+// runMqttRule runs the action of rule for message m.
+func runMqttRule(rule MqttRule, m *mqttMessage) error {
+	message := rule.Message
+	if message == "" {
+		message = "topic: {topic}, message: {payload}"
+	}
+	switch rule.Action {
+	case MqttActionEvent:
+		text, err := m.expand(message, false)
+		if err != nil {
+			return err
+		}
+		var payload any = string(m.payload)
+		if m.isJSON {
+			payload = m.json
+		}
+		e := MqttEvent{Time: time.Now(), Rule: rule.Name, Source: m.source, Topic: m.topic,
+			Message: text, Payload: payload}
+		addMqttEvent(e)
+		PublishWebSocketMessage(WebSocketMessage{
+			Kind:    "mqtt",
+			Topic:   WebSocketTopicMqtt,
+			Level:   LOG_INFO,
+			Message: text,
+			Data:    e,
+		})
+	case MqttActionSyslog:
+		text, err := m.expand(message, false)
+		if err != nil {
+			return err
+		}
+		return SendSyslog(*rule.Severity, "mqttrule", rule.Name+": "+text)
+	case MqttActionCommand:
+		cmd, err := m.expand(rule.Command, true)
+		if err != nil {
+			return err
+		}
+		u, err := GetUserConfig(rule.User)
+		if err != nil {
+			return err
+		}
+		role, err := GetRole(u.Role)
+		if err != nil || !role.Allows(PermCommandsWrite) {
+			return fmt.Errorf("user %s has no %s permission", u.Name, PermCommandsWrite)
+		}
+		if rule.Key != "" {
+			key, err := activeAPIKey(rule.Key)
+			if err != nil {
+				return err
+			}
+			if key.User != u.Name || !key.Allows(PermCommandsWrite) {
+				return fmt.Errorf("key %s has no %s permission", key.ID, PermCommandsWrite)
+			}
+		}
+		err = CheckCommandPermission(u, cmd)
+		if err != nil {
+			return err
+		}
+		err = CheckCommandCredentials(cmd)
+		if err != nil {
+			return err
+		}
+		cmdinfo := CmdInfo{Kind: "usercommand", Command: cmd, User: u.Name}
+		if strings.HasPrefix(cmd, "@") {
+			cmdinfo.Client, cmdinfo.Command, _ = strings.Cut(cmd[1:], " ")
+		}
+		InsertCmd(cmd, cmdinfo)
+		err = WriteAuditRecord(AuditRecord{User: u.Name, Source: "mqtt rule:" + rule.Name, Action: "command",
+			Detail: RedactCommand(cmd), Outcome: "ok"})
+		if err != nil {
+			q.Q(err)
+		}
+	}
+	return nil
+}
+
+// runMqttRules runs the queued rule actions in order.
+func runMqttRules() {
+	for a := range mqttRuleQueue {
+		err := runMqttRule(a.rule, a.m)
+		if err != nil {
+			q.Q(a.rule.Name, err)
+		}
+	}
+}
+
+// routeMqttMessage queues the actions of the rules matching a message
+// received from source, the broker or an mqtt connection. It reports
+// whether a rule matched.
+func routeMqttMessage(source, topic string, payload []byte) bool {
+	rules := activeMqttRules()
+	if len(rules) == 0 {
+		return false
+	}
+	mqttRuleQueueOnce.Do(func() {
+		go runMqttRules()
+	})
+	m := newMqttMessage(source, topic, payload)
+	matched := false
+	for _, rule := range rules {
+		if !rule.matches(m) {
+			continue
+		}
+		matched = true
+		select {
+		case mqttRuleQueue <- mqttRuleAction{rule: rule, m: m}:
+		default:
+			q.Q("mqtt rule queue full, message dropped", rule.Name, topic)
+		}
+	}
+	return matched
+}
+
+// HandleMqttRules handles mqtt routing rule requests
+//
+// GET /api/v1/mqtt/rules
+//
+//	returns the mqtt routing rules
+//
+// POST /api/v1/mqtt/rules
+//
+//	Example parameter: {"name": "plcbeep", "topic": "plc/+/beep", "match": {"enable": "true"},
+//	                    "action": "command", "command": "beep {mac} {ip}"}
+//
+//	command rules run as the user who posts them and need its
+//	commands:write permission, a rule posted with an api key keeps
+//	to the scopes of the key while it is active
+//
+// DELETE /api/v1/mqtt/rules
+//
+//	Example parameter: {"name": "plcbeep"}
+func HandleMqttRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var rule MqttRule
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set mqtt rule %s", rule.Name)
+			rule.User, rule.Key = "", ""
+			if rule.Action == MqttActionCommand {
+				u := userFromContext(r.Context())
+				if u == nil {
+					RespondWithError(w, errors.New("command rules need a user"))
+					return
+				}
+				key := apiKeyFromContext(r.Context())
+				role, err := GetRole(u.Role)
+				if err != nil || !role.Allows(PermCommandsWrite) || (key != nil && !key.Allows(PermCommandsWrite)) {
+					http.Error(w, fmt.Sprintf("user %s has no %s permission", u.Name, PermCommandsWrite), http.StatusForbidden)
+					return
+				}
+				rule.User = u.Name
+				if key != nil {
+					rule.Key = key.ID
+				}
+			}
+			err = SetMqttRule(rule)
+		} else {
+			setAuditDetail(r, "delete mqtt rule %s", rule.Name)
+			err = DeleteMqttRule(rule.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	rules, err := GetMqttRules()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(rules)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleMqttEvents handles mqtt event requests
+//
+// GET /api/v1/mqtt/events
+//
+//	returns the last 1000 messages stored by event rules, oldest first
+func HandleMqttEvents(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(GetMqttEvents())
+	if err != nil {
+		q.Q(err)
+	}
+}
@@ -0,0 +1,189 @@
+package mnms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitMqttRules waits for the queued rule actions to run.
+func waitMqttRules(t *testing.T) {
+	t.Helper()
+	mqttRuleQueueOnce.Do(func() {
+		go runMqttRules()
+	})
+	// the queue runs in order, the actions before the marker are done
+	// when its event is stored
+	marker := strconv.FormatInt(time.Now().UnixNano(), 10)
+	m := newMqttMessage("test", "wait", nil)
+	mqttRuleQueue <- mqttRuleAction{rule: MqttRule{Name: "wait", Action: MqttActionEvent, Message: marker}, m: m}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := GetMqttEvents()
+		if len(events) > 0 && events[len(events)-1].Message == marker {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mqtt rule actions did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMqttRules tests routing mqtt messages to events and commands
+func TestMqttRules(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+		reloadMqttRules()
+	}()
+	isRoot := QC.IsRoot
+	defer func() {
+		QC.IsRoot = isRoot
+	}()
+	QC.IsRoot = true
+	reloadMqttRules()
+
+	bad := 8
+	for _, rule := range []MqttRule{
+		{Name: "bad name", Topic: "plc/#", Action: MqttActionEvent},
+		{Name: "bad", Topic: "plc/#/x", Action: MqttActionEvent},
+		{Name: "bad", Topic: "plc/#", Action: "forward"},
+		{Name: "bad", Topic: "plc/#", Action: MqttActionSyslog},
+		{Name: "bad", Topic: "plc/#", Action: MqttActionSyslog, Severity: &bad},
+		{Name: "bad", Topic: "plc/#", Action: MqttActionCommand, Command: "format {mac}", User: "admin"},
+		{Name: "bad", Topic: "plc/#", Action: MqttActionCommand, Command: "beep {mac}", User: "nobody"},
+	} {
+		if err = SetMqttRule(rule); err == nil {
+			t.Errorf("expect rule %+v to fail", rule)
+		}
+	}
+	err = SetMqttRule(MqttRule{Name: "alarm", Topic: "plc/+/alarm", Action: MqttActionEvent,
+		Match: map[string]string{"level": "*"}, Message: "{topic.1} alarm {level}: {text}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetMqttRule(MqttRule{Name: "plcbeep", Topic: "plc/+/beep", Action: MqttActionCommand,
+		Match: map[string]string{"enable": "true"}, Command: "beep {device.mac} {device.ip}", User: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := GetMqttRules()
+	if err != nil || len(rules) != 2 {
+		t.Fatal("expect 2 rules", rules, err)
+	}
+
+	if routeMqttMessage("broker:plc1", "plc/line1/alarm", []byte(`{"text": "overheat"}`)) {
+		t.Fatal("expect message without level not to match")
+	}
+	if !routeMqttMessage("broker:plc1", "plc/line1/alarm", []byte(`{"level": 2, "text": "overheat"}`)) {
+		t.Fatal("expect alarm to match")
+	}
+	waitMqttRules(t)
+	events := GetMqttEvents()
+	if len(events) < 2 {
+		t.Fatal("expect an event")
+	}
+	e := events[len(events)-2]
+	if e.Rule != "alarm" || e.Source != "broker:plc1" || e.Message != "line1 alarm 2: overheat" {
+		t.Fatal("unexpected event", e)
+	}
+
+	const mac = "00-60-E9-18-3C-3C"
+	defer func() {
+		QC.CmdMutex.Lock()
+		delete(QC.CmdData, "beep "+mac+" 10.0.50.1")
+		QC.CmdMutex.Unlock()
+	}()
+	routeMqttMessage("plant1", "plc/line1/beep", []byte(`{"enable": true, "device": {"mac": "`+mac+` reset", "ip": "10.0.50.1"}}`))
+	routeMqttMessage("plant1", "plc/line1/beep", []byte(`{"enable": false, "device": {"mac": "`+mac+`", "ip": "10.0.50.1"}}`))
+	waitMqttRules(t)
+	QC.CmdMutex.Lock()
+	_, found := QC.CmdData["beep "+mac+" 10.0.50.1"]
+	QC.CmdMutex.Unlock()
+	if found {
+		t.Fatal("expect no command for a disabled request or a mac with spaces")
+	}
+	routeMqttMessage("plant1", "plc/line1/beep", []byte(`{"enable": true, "device": {"mac": "`+mac+`", "ip": "10.0.50.1"}}`))
+	waitMqttRules(t)
+	QC.CmdMutex.Lock()
+	cmdinfo, ok := QC.CmdData["beep "+mac+" 10.0.50.1"]
+	QC.CmdMutex.Unlock()
+	if !ok || cmdinfo.User != "admin" || cmdinfo.Kind != "usercommand" {
+		t.Fatal("expect command of admin", cmdinfo)
+	}
+
+	// a rule posted with an api key keeps to the scopes of the key
+	err = AddServiceAccount("plc", MNMSAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := requirePermission(PermSettingsWrite)(http.HandlerFunc(HandleMqttRules))
+	post := func(secret string) int {
+		t.Helper()
+		body := `{"name": "keybeep", "topic": "plc/+/keybeep", "action": "command", "command": "beep {mac} {ip}"}`
+		req := httptest.NewRequest("POST", "/api/v1/mqtt/rules", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	_, settingsOnly, err := CreateAPIKey("plc", "settings", []string{PermSettingsWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := post(settingsOnly); code != http.StatusForbidden {
+		t.Fatal("expect command rule of a key without commands:write to be forbidden", code)
+	}
+	key, secret, err := CreateAPIKey("plc", "rules", []string{PermSettingsWrite, PermCommandsWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := post(secret); code != http.StatusOK {
+		t.Fatal("expect command rule of the key", code)
+	}
+	const other = "00-60-E9-18-3C-3D"
+	keyCmd := "beep " + other + " 10.0.50.2"
+	defer func() {
+		QC.CmdMutex.Lock()
+		delete(QC.CmdData, keyCmd)
+		QC.CmdMutex.Unlock()
+	}()
+	keyBeep := []byte(`{"mac": "` + other + `", "ip": "10.0.50.2"}`)
+	routeMqttMessage("plant1", "plc/line1/keybeep", keyBeep)
+	waitMqttRules(t)
+	QC.CmdMutex.Lock()
+	cmdinfo, ok = QC.CmdData[keyCmd]
+	delete(QC.CmdData, keyCmd)
+	QC.CmdMutex.Unlock()
+	if !ok || cmdinfo.User != "plc" {
+		t.Fatal("expect command of the service account", cmdinfo)
+	}
+	err = RevokeAPIKey(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeMqttMessage("plant1", "plc/line1/keybeep", keyBeep)
+	waitMqttRules(t)
+	QC.CmdMutex.Lock()
+	_, found = QC.CmdData[keyCmd]
+	QC.CmdMutex.Unlock()
+	if found {
+		t.Fatal("expect no command after the key is revoked")
+	}
+
+	err = DeleteMqttRule("plcbeep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteMqttRule("plcbeep"); err == nil {
+		t.Fatal("expect deleting twice to fail")
+	}
+}
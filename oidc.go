@@ -0,0 +1,328 @@
+package mnms
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/qeof/q"
+)
+
+/*
+	OpenID Connect authorization code login.
+
+	/api/v1/oidc/login redirects the browser to the provider, which
+	redirects back to /api/v1/oidc/callback with a code. The state of
+	the login is also set as a cookie, so that the callback completes
+	only the login started by the same browser. The code is
+	exchanged for an ID token, verified with the keys of the provider,
+	and the browser is redirected to the web UI with an mnms token in
+	the URL fragment,
+
+		https://mnms.example.com/login#token=...&refreshToken=...&user=...&role=...
+*/
+
+const (
+	oidcStateTimeout = 10 * time.Minute
+	oidcHTTPTimeout  = 10 * time.Second
+	oidcStateCookie  = "mnms_oidc_state"
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	nonce   string
+	expires time.Time
+}
+
+var (
+	oidcStatesMutex sync.Mutex
+	oidcStates      = map[string]oidcState{}
+)
+
+var oidcClient = &http.Client{Timeout: oidcHTTPTimeout}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func getOIDCDiscovery(issuer string) (*oidcDiscovery, error) {
+	resp, err := oidcClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+	var d oidcDiscovery
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %s, expect %s", d.Issuer, issuer)
+	}
+	return &d, nil
+}
+
+// newOIDCState returns a new state and nonce for a login.
+func newOIDCState() (string, string, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	oidcStatesMutex.Lock()
+	defer oidcStatesMutex.Unlock()
+	for k, v := range oidcStates {
+		if now.After(v.expires) {
+			delete(oidcStates, k)
+		}
+	}
+	oidcStates[state] = oidcState{nonce: nonce, expires: now.Add(oidcStateTimeout)}
+	return state, nonce, nil
+}
+
+// takeOIDCState removes state and returns its nonce.
+func takeOIDCState(state string) (string, error) {
+	oidcStatesMutex.Lock()
+	defer oidcStatesMutex.Unlock()
+	s, ok := oidcStates[state]
+	delete(oidcStates, state)
+	if !ok || time.Now().After(s.expires) {
+		return "", fmt.Errorf("invalid or expired oidc state")
+	}
+	return s.nonce, nil
+}
+
+// oidcAuthURL returns the authorization url to redirect to and the
+// state of the login.
+func oidcAuthURL(cfg *OIDCConfig) (string, string, error) {
+	d, err := getOIDCDiscovery(cfg.Issuer)
+	if err != nil {
+		return "", "", err
+	}
+	state, nonce, err := newOIDCState()
+	if err != nil {
+		return "", "", err
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", cfg.ClientID)
+	v.Set("redirect_uri", cfg.RedirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), state, nil
+}
+
+// oidcExchange exchanges code for a verified ID token and returns the
+// user name and role of its subject.
+func oidcExchange(cfg *OIDCConfig, code, nonce string) (string, string, error) {
+	d, err := getOIDCDiscovery(cfg.Issuer)
+	if err != nil {
+		return "", "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("client_secret", cfg.ClientSecret)
+	resp, err := oidcClient.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("oidc token endpoint: %s %s", resp.Status, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return "", "", err
+	}
+	if tokens.IDToken == "" {
+		return "", "", fmt.Errorf("oidc token endpoint returned no id token")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), oidcHTTPTimeout)
+	defer cancel()
+	keys, err := jwk.Fetch(ctx, d.JWKSURI, jwk.WithHTTPClient(oidcClient))
+	if err != nil {
+		return "", "", err
+	}
+	token, err := jwt.Parse([]byte(tokens.IDToken),
+		jwt.WithKeySet(keys, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.ClientID))
+	if err != nil {
+		return "", "", fmt.Errorf("oidc id token: %v", err)
+	}
+	if n, _ := token.Get("nonce"); n != nonce {
+		return "", "", fmt.Errorf("oidc id token: nonce mismatch")
+	}
+	claims := token.PrivateClaims()
+	usernameClaim := cfg.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	name, _ := claims[usernameClaim].(string)
+	if name == "" {
+		name = token.Subject()
+	}
+	groupsClaim := cfg.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	var groups []string
+	switch g := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		groups = []string{g}
+	}
+	role := mapGroupsToRole(cfg.GroupRoles, groups, cfg.DefaultRole)
+	if role == "" {
+		return "", "", fmt.Errorf("oidc user %s is in no group with a role", name)
+	}
+	return name, role, nil
+}
+
+// HandleOIDCLogin starts an OpenID Connect login
+//
+// GET /api/v1/oidc/login
+//
+//	redirects to the provider and sets the state cookie of the login
+func HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	c, err := GetMNMSConfig()
+	if err != nil || c.OIDC == nil {
+		http.Error(w, "oidc not configured", http.StatusNotFound)
+		return
+	}
+	u, state, err := oidcAuthURL(c.OIDC)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	// lax, the provider redirects back with a top level navigation
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/v1/oidc",
+		MaxAge:   int(oidcStateTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// HandleOIDCCallback completes an OpenID Connect login
+//
+// GET /api/v1/oidc/callback?code=[code]&state=[state]
+//
+//	redirects to the web UI with #token=[jwt]&refreshToken=[token]&user=[user]&role=[role]
+func HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	c, err := GetMNMSConfig()
+	if err != nil || c.OIDC == nil {
+		http.Error(w, "oidc not configured", http.StatusNotFound)
+		return
+	}
+	name, res, err := oidcCallback(c.OIDC, r)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/v1/oidc", MaxAge: -1, HttpOnly: true})
+	outcome := "ok"
+	if err != nil {
+		outcome = "error: " + err.Error()
+	}
+	auditRequest(r, "login oidc", name, "", outcome)
+	if err != nil {
+		q.Q(err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ui := c.OIDC.UIRedirect
+	if ui == "" {
+		ui = "/"
+	}
+	http.Redirect(w, r, ui+"#"+res.Encode(), http.StatusFound)
+}
+
+func oidcCallback(cfg *OIDCConfig, r *http.Request) (string, url.Values, error) {
+	values := r.URL.Query()
+	if e := values.Get("error"); e != "" {
+		return "", nil, fmt.Errorf("oidc: %s %s", e, values.Get("error_description"))
+	}
+	// the login must be the one started by this browser
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(values.Get("state"))) != 1 {
+		return "", nil, fmt.Errorf("oidc state does not match the login of this browser")
+	}
+	nonce, err := takeOIDCState(values.Get("state"))
+	if err != nil {
+		return "", nil, err
+	}
+	name, role, err := oidcExchange(cfg, values.Get("code"), nonce)
+	if err != nil {
+		return name, nil, err
+	}
+	user, err := upsertExternalUser(name, "oidc", role)
+	if err != nil {
+		return name, nil, err
+	}
+	pair, err := CreateSession(user.Name, r)
+	if err != nil {
+		return name, nil, err
+	}
+	res := url.Values{}
+	res.Set("token", pair.Token)
+	res.Set("refreshToken", pair.RefreshToken)
+	res.Set("user", user.Name)
+	res.Set("role", user.Role)
+	return name, res, nil
+}
@@ -0,0 +1,175 @@
+package mnms
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// startOIDCIssuer starts a local OpenID Connect issuer. Codes passed to
+// authorize are accepted by the token endpoint with the nonce given.
+func startOIDCIssuer(t *testing.T, claims map[string]any) (*httptest.Server, func(code, nonce string)) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey, err := jwk.FromRaw(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = signKey.Set(jwk.KeyIDKey, "k1")
+	pubKey, err := jwk.FromRaw(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pubKey.Set(jwk.KeyIDKey, "k1")
+	_ = pubKey.Set(jwk.AlgorithmKey, jwa.RS256)
+	keys := jwk.NewSet()
+	_ = keys.AddKey(pubKey)
+
+	codes := map[string]string{}
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(keys)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := codes[r.FormValue("code")]
+		if !ok || r.FormValue("client_secret") != "oidcsecret" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		delete(codes, r.FormValue("code"))
+		tok := jwt.New()
+		_ = tok.Set(jwt.IssuerKey, srv.URL)
+		_ = tok.Set(jwt.AudienceKey, "mnms")
+		_ = tok.Set(jwt.SubjectKey, "sub-1")
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		_ = tok.Set("nonce", nonce)
+		for k, v := range claims {
+			_ = tok.Set(k, v)
+		}
+		signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256, signKey))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": string(signed), "token_type": "Bearer"})
+	})
+	return srv, func(code, nonce string) { codes[code] = nonce }
+}
+
+// TestOIDCLogin tests the authorization code flow against a local issuer
+func TestOIDCLogin(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	cleanAuditLog(t)
+	defer cleanAuditLog(t)
+
+	issuer, authorize := startOIDCIssuer(t, map[string]any{
+		"preferred_username": "carol",
+		"groups":             []string{"staff", "netops"},
+	})
+	err = SetIdentityConfig(IdentityConfig{OIDC: &OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "mnms",
+		ClientSecret: "oidcsecret",
+		RedirectURL:  "http://localhost:27182/api/v1/oidc/callback",
+		GroupRoles:   []IdentityGroupRole{{Group: "netops", Role: MNMSSuperUserRole}},
+		UIRedirect:   "http://localhost:3000/login",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleOIDCLogin(rec, httptest.NewRequest("GET", "/api/v1/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatal("expect redirect, got", rec.Code, rec.Body.String())
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), issuer.URL+"/authorize") || loc.Query().Get("client_id") != "mnms" {
+		t.Fatal("unexpected authorization url", loc)
+	}
+	state := loc.Query().Get("state")
+	authorize("code1", loc.Query().Get("nonce"))
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].Value != state || !cookies[0].HttpOnly {
+		t.Fatal("expect state cookie", cookies)
+	}
+
+	callback := func(code, state string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/oidc/callback?code="+code+"&state="+state, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		HandleOIDCCallback(rec, req)
+		return rec
+	}
+	// a login started by another browser is refused
+	if rec = callback("code1", state); rec.Code != http.StatusUnauthorized {
+		t.Fatal("expect callback without the state cookie to fail, got", rec.Code)
+	}
+	rec = callback("code1", state, cookies[0])
+	if rec.Code != http.StatusFound {
+		t.Fatal("expect redirect to ui, got", rec.Code, rec.Body.String())
+	}
+	ui, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragment, _ := url.ParseQuery(ui.Fragment)
+	if fragment.Get("user") != "carol" || fragment.Get("role") != MNMSSuperUserRole {
+		t.Fatal("unexpected ui redirect", ui)
+	}
+	if _, err = JWTVerifyToken(jwtTokenAuth, fragment.Get("token")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUserConfig("carol")
+	if err != nil || u.Provider != "oidc" {
+		t.Fatal("expect oidc user", u, err)
+	}
+	if _, err = authenticateUser("carol", ""); err == nil {
+		t.Fatal("expect oidc user password login to fail")
+	}
+
+	// states are single use
+	if rec = callback("code1", state, cookies[0]); rec.Code != http.StatusUnauthorized {
+		t.Fatal("expect replayed state to fail, got", rec.Code)
+	}
+	recs, err := QueryAuditLog(AuditQuery{Action: "login oidc"})
+	if err != nil || len(recs) != 3 || recs[1].User != "carol" || recs[1].Outcome != "ok" {
+		t.Fatal("expect audited oidc logins", recs, err)
+	}
+}
@@ -136,10 +136,15 @@ func ensurePKI() error {
 }
 func createNewCertificate(appName, certFile, keyFile string) error {
 
-	// create a keypair.
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return ua.BadCertificateInvalid
+	// create a keypair. the server decrypts in blocks sized by the private
+	// exponent, so keep generating until it is as long as the modulus.
+	var key *rsa.PrivateKey
+	for key == nil || len(key.D.Bytes()) != key.Size() {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return ua.BadCertificateInvalid
+		}
 	}
 
 	// get local hostname.
@@ -205,12 +210,35 @@ func createNewCertificate(appName, certFile, keyFile string) error {
 	return nil
 }
 
-func NewOpcuaServer(endpointurl string) *OpcuaServer {
+// NewOpcuaServer creates the opcua server of endpointurl, opts are added
+// to the default options.
+func NewOpcuaServer(endpointurl string, opts ...opcuaserver.Option) *OpcuaServer {
 	if err := ensurePKI(); err != nil {
 		q.Q("Error creating PKI.")
 		DoExit(1)
 	}
+	if err := writeOpcuaTrustList(); err != nil {
+		q.Q(err)
+		DoExit(1)
+	}
 
+	opts = append([]opcuaserver.Option{
+		opcuaserver.WithBuildInfo(
+			ua.BuildInfo{
+				ProductURI:       "http://github.com/awcullen/opcua",
+				ManufacturerName: "awcullen",
+				ProductName:      "testserver",
+				SoftwareVersion:  SoftwareVersion,
+			}),
+		opcuaserver.WithAuthenticateUserNameIdentityFunc(authenticateOpcuaUser),
+		opcuaserver.WithRolesProvider(opcuaRoles{}),
+		opcuaserver.WithRolePermissions(opcuaRolePermissions),
+		opcuaserver.WithAnonymousIdentity(QC.OpcuaAnonymous),
+		opcuaserver.WithSecurityPolicyNone(QC.OpcuaSecurityNone),
+		withOpcuaTrustList(opcuaTrustList),
+		opcuaserver.WithServerDiagnostics(true),
+		// server.WithTrace(),
+	}, opts...)
 	srv, err := opcuaserver.New(
 		ua.ApplicationDescription{
 			ApplicationURI: fmt.Sprintf("urn:%s:testserver", host),
@@ -227,25 +255,7 @@ func NewOpcuaServer(endpointurl string) *OpcuaServer {
 		"./pki/server.crt",
 		"./pki/server.key",
 		endpointurl,
-		opcuaserver.WithBuildInfo(
-			ua.BuildInfo{
-				ProductURI:       "http://github.com/awcullen/opcua",
-				ManufacturerName: "awcullen",
-				ProductName:      "testserver",
-				SoftwareVersion:  SoftwareVersion,
-			}),
-		opcuaserver.WithAuthenticateUserNameIdentityFunc(func(userIdentity ua.UserNameIdentity, applicationURI string, endpointURL string) error {
-
-			// log.Printf("Login user: %s from %s\n", userIdentity.UserName, applicationURI)
-			return nil
-		}),
-
-		opcuaserver.WithRolePermissions([]ua.RolePermissionType{{RoleID: ua.ObjectIDWellKnownRoleAnonymous, Permissions: (ua.PermissionTypeBrowse | ua.PermissionTypeRead | ua.PermissionTypeReadHistory | ua.PermissionTypeReceiveEvents | ua.PermissionTypeWrite)}}),
-		opcuaserver.WithAnonymousIdentity(true),
-		opcuaserver.WithSecurityPolicyNone(true),
-		opcuaserver.WithInsecureSkipVerify(),
-		opcuaserver.WithServerDiagnostics(true),
-		// server.WithTrace(),
+		opts...,
 	)
 	if err != nil {
 		q.Q(err)
@@ -255,7 +265,8 @@ func NewOpcuaServer(endpointurl string) *OpcuaServer {
 }
 
 type OpcuaServer struct {
-	srv *opcuaserver.Server
+	srv   *opcuaserver.Server
+	space *opcuaSpace
 }
 
 // OpcuaRun opcua server run
@@ -426,6 +437,42 @@ func (o *OpcuaClient) DeleteMonitoredItems(req *ua.DeleteMonitoredItemsRequest)
 
 }
 
+// BrowseNext
+func (o *OpcuaClient) BrowseNext(req *ua.BrowseNextRequest) (*ua.BrowseNextResponse, error) {
+	err := o.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	return o.ch.BrowseNext(ctx, req)
+}
+
+// Call
+func (o *OpcuaClient) Call(req *ua.CallRequest) (*ua.CallResponse, error) {
+	err := o.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	return o.ch.Call(ctx, req)
+}
+
+// HistoryRead
+func (o *OpcuaClient) HistoryRead(req *ua.HistoryReadRequest) (*ua.HistoryReadResponse, error) {
+	err := o.checkConnection()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	return o.ch.HistoryRead(ctx, req)
+}
+
 // ReadVariableAttributes read VariableAttributes
 func (o *OpcuaClient) ReadVariableAttributes(id ua.NodeID) (ua.VariableAttributes, error) {
 	req := &ua.ReadRequest{
@@ -550,24 +597,30 @@ func (o *OpcuaClient) BrowseReference(id ua.NodeID, dir ua.BrowseDirection) ([]u
 }
 
 /*========  opcua Cmd ========*/
-var opcuaclient *OpcuaClient
 
-func CheckOpcuaClient() error {
-	if opcuaclient == nil {
-		return ConnectError
+// opcuaCmdClient returns the client of connection name for a command.
+func opcuaCmdClient(name string) (*OpcuaClient, error) {
+	c, err := getOpcuaConnection(name)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return c.connectedClient()
 }
 
 // Opcua connect setting.
 //
-// Usage : opcua connect [url]
+// Usage : opcua connect [name] [url] [@cred:name] [option=value...]
 //
+//	[name]        : connection name, default when left out
 //	[url]         : connect to url
+//	[@cred:name]  : username and password from the credential vault
+//	[option]      : user, password, cert, key, ca,
+//	                policy (best, none, Basic256Sha256, Aes128Sha256RsaOaep, Aes256Sha256RsaPss)
 //
 // Example :
 //
 //	opcua connect opc.tcp://127.0.0.1:4840
+//	opcua connect plc1 opc.tcp://10.0.0.5:4840 @cred:plc policy=Basic256Sha256
 func OpcuaConnectCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
@@ -575,42 +628,44 @@ func OpcuaConnectCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	url := ws[2]
-	opclient := NewOpcuaClient()
-	err := opclient.Connect(url, client.WithInsecureSkipVerify(), client.WithClientCertificateFile("./pki/client.crt", "./pki/client.key"))
+	p, err := ParseOpcuaConnect(ws[2:])
+	if err == nil {
+		err = OpcuaConnect(p)
+	}
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	opcuaclient = opclient
 	cmdinfo.Status = "ok"
 	return cmdinfo
 }
 
 // Opcua read setting.
 //
-// Usage : opcua read [node id]
+// Usage : opcua read [name] [node id]
 //
+//	[name]        : connection name, default when left out
 //	[node id]     : opcua node id
 //
 // Example :
 //
 //	opcua read i=1002
+//	opcua read plc1 ns=2;s=Temperature
 func OpcuaReadCmd(cmdinfo *CmdInfo) *CmdInfo {
-	err := CheckOpcuaClient()
-	if err != nil {
-		cmdinfo.Status = "error: " + err.Error()
-		return cmdinfo
-	}
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 3 {
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 1 {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	id := ws[2]
-	nodeid := ua.ParseNodeID(id)
-	v, err := opcuaclient.ReadVariableAttributes(nodeid)
+	cli, err := opcuaCmdClient(name)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	nodeid := ua.ParseNodeID(args[0])
+	v, err := cli.ReadVariableAttributes(nodeid)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
@@ -628,28 +683,85 @@ func OpcuaReadCmd(cmdinfo *CmdInfo) *CmdInfo {
 
 // Opcua browse setting.
 //
-// Usage : opcua browse [node id]
+// Usage : opcua browse [name] [node id]
 //
+//	[name]        : connection name, default when left out
 //	[node id]     : opcua node id
 //
 // Example :
 //
 //	opcua browse i=85
 func OpcuaBrowseReferenceCmd(cmdinfo *CmdInfo) *CmdInfo {
-	err := CheckOpcuaClient()
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 1 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	cli, err := opcuaCmdClient(name)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	nodeid := ua.ParseNodeID(args[0])
+	v, err := cli.BrowseReference(nodeid, ua.BrowseDirectionForward)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	b, err := json.Marshal(v)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
+	cmdinfo.Status = "ok"
+	cmdinfo.Result = string(b)
+	q.Q(v)
+	return cmdinfo
+}
+
+// Opcua browse export setting.
+//
+// Usage : opcua export [name] [node id] [option=value...]
+//
+//	[name]        : connection name, default when left out
+//	[node id]     : opcua node id of the subtree
+//	[option]      : depth, levels to browse, default 5
+//	                max, maximum number of nodes, default 5000
+//
+// Example :
+//
+//	opcua export i=85
+//	opcua export plc1 ns=2;s=Line1 depth=3
+func OpcuaExportCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 3 {
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 1 {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	id := ws[2]
-	nodeid := ua.ParseNodeID(id)
-	v, err := opcuaclient.BrowseReference(nodeid, ua.BrowseDirectionForward)
+	depth, max := opcuaExportDepth, opcuaExportMaxNodes
+	for _, a := range args[1:] {
+		k, v, _ := strings.Cut(a, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || (k != "depth" && k != "max") {
+			cmdinfo.Status = "error: invalid option " + a
+			return cmdinfo
+		}
+		if k == "depth" {
+			depth = n
+		} else {
+			max = n
+		}
+	}
+	cli, err := opcuaCmdClient(name)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	v, err := OpcuaExport(cli, args[0], depth, max)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
@@ -661,134 +773,226 @@ func OpcuaBrowseReferenceCmd(cmdinfo *CmdInfo) *CmdInfo {
 	}
 	cmdinfo.Status = "ok"
 	cmdinfo.Result = string(b)
-	q.Q(v)
 	return cmdinfo
 }
 
-var opcuaNotificationFlag = false
-var opcuMap = map[uint32]ua.NodeID{}
-
-// Opcua subcribe setting.
+// Opcua write setting.
 //
-// Usage : opcua sub [node id]
+// Usage : opcua write [name] [node id] [value]
 //
+//	[name]        : connection name, default when left out
 //	[node id]     : opcua node id
+//	[value]       : type:value, type[]:value,value for arrays, or a value
+//	                of the data type of the node. types are boolean,
+//	                sbyte, byte, int16, uint16, int32, uint32, int64, uint64,
+//	                float, double, string, datetime, bytestring, nodeid,
+//	                localizedtext
 //
 // Example :
 //
-//	opcua sub i=1002
-func OpcuaSubscribeCmd(cmdinfo *CmdInfo) *CmdInfo {
-	err := CheckOpcuaClient()
+//	opcua write i=1002 21.5
+//	opcua write plc1 ns=2;s=Setpoint double:21.5
+//	opcua write plc1 ns=2;s=Recipe int32[]:1,2,3
+func OpcuaWriteCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 2 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	cli, err := opcuaCmdClient(name)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	// string values may have spaces
+	v, err := OpcuaWrite(cli, args[0], strings.Join(args[1:], " "))
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Result = string(b)
+	cmdinfo.Status = "ok"
+	if v.Status != "Good" {
+		cmdinfo.Status = "error: " + v.Status
+	}
+	return cmdinfo
+}
+
+// Opcua call setting.
+//
+// Usage : opcua call [name] [object id] [method id] [argument...]
+//
+//	[name]        : connection name, default when left out
+//	[object id]   : opcua node id of the object
+//	[method id]   : opcua node id of the method
+//	[argument]    : input arguments as type:value, see opcua write
+//
+// Example :
+//
+//	opcua call plc1 ns=2;s=Pump ns=2;s=Pump/Start
+//	opcua call plc1 ns=2;s=Mixer ns=2;s=Mixer/SetSpeed double:120.5 boolean:true
+func OpcuaCallCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 3 {
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 2 {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	req := &ua.CreateSubscriptionRequest{
-		RequestedPublishingInterval: 1000.0,
-		RequestedMaxKeepAliveCount:  30,
-		RequestedLifetimeCount:      30 * 3,
-		PublishingEnabled:           true,
-	}
-	res, err := opcuaclient.CreateSubscription(req)
+	cli, err := opcuaCmdClient(name)
 	if err != nil {
-		cmdinfo.Status = "error: " + err.Error() + ", Error creating subscription"
+		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	id := ws[2]
-	nodeid := ua.ParseNodeID(id)
-
-	req2 := &ua.CreateMonitoredItemsRequest{
-		SubscriptionID:     res.SubscriptionID,
-		TimestampsToReturn: ua.TimestampsToReturnBoth,
-		ItemsToCreate: []ua.MonitoredItemCreateRequest{
-			{
-				ItemToMonitor: ua.ReadValueID{
-					AttributeID: ua.AttributeIDValue,
-					NodeID:      nodeid,
-				},
-				MonitoringMode: ua.MonitoringModeReporting,
-				RequestedParameters: ua.MonitoringParameters{
-					ClientHandle: 42, QueueSize: 1, DiscardOldest: true, SamplingInterval: 500.0,
-				},
-			},
-		},
+	v, err := OpcuaCall(cli, args[0], args[1], args[2:])
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
 	}
-	res2, err := opcuaclient.CreateMonitoredItems(req2)
+	b, err := json.Marshal(v)
 	if err != nil {
-		cmdinfo.Status = "error: " + err.Error() + ",Error creating item"
+		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	_ = res2
-
+	cmdinfo.Result = string(b)
 	cmdinfo.Status = "ok"
-	cmdinfo.Result = fmt.Sprintf("SubscriptionID:%v,MonitoredItemID:%v", res.SubscriptionID, res2.Results[0].MonitoredItemID)
-	opcuMap[res.SubscriptionID] = nodeid
-	if !opcuaNotificationFlag {
-		opcuaNotificationFlag = true
-		go runOpcuaDataChangeNotification()
+	if v.Status != "Good" {
+		cmdinfo.Status = "error: " + v.Status
 	}
 	return cmdinfo
 }
 
-// runOpcuaDataChangeNotification
-func runOpcuaDataChangeNotification() {
-	req3 := &ua.PublishRequest{
-		RequestHeader:                ua.RequestHeader{TimeoutHint: 60000},
-		SubscriptionAcknowledgements: []ua.SubscriptionAcknowledgement{},
+// Opcua history read setting.
+//
+// Usage : opcua historyread [name] [node id...] [option=value...]
+//
+//	[name]        : connection name, default when left out
+//	[node id]     : opcua node ids
+//	[option]      : start, RFC3339 time or duration before now, default 1h
+//	                end, RFC3339 time or duration before now, default now
+//	                max, maximum raw values per node, default all
+//	                aggregate, read processed values with interpolative,
+//	                  average, timeaverage, total, minimum, maximum, range,
+//	                  count, start, end or delta
+//	                interval, processing interval in ms, default start to end
+//
+// Example :
+//
+//	opcua historyread i=1002
+//	opcua historyread plc1 ns=2;s=Temperature start=24h max=100
+//	opcua historyread plc1 ns=2;s=Temperature start=2023-02-10T00:00:00Z end=2023-02-11T00:00:00Z aggregate=average interval=3600000
+func OpcuaHistoryReadCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	name, args := splitOpcuaName(ws[2:])
+	h, err := ParseOpcuaHistoryQuery(args)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
 	}
-	for {
-		res3, err := opcuaclient.Publish(req3)
-		if err != nil {
-			opcuaNotificationFlag = false
-			q.Q("err:", err)
-			m := fmt.Errorf("connection error:%v", err)
-			err := SendSyslog(LOG_ALERT, "opcua ", m.Error())
-			if err != nil {
-				q.Q("syslog err:", err)
-			}
-			break
-		}
+	cli, err := opcuaCmdClient(name)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	v, err := OpcuaHistoryRead(cli, h)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Status = "ok"
+	cmdinfo.Result = string(b)
+	return cmdinfo
+}
 
-		// loop thru all the notifications.
-		for _, data := range res3.NotificationMessage.NotificationData {
-			switch body := data.(type) {
-			case ua.DataChangeNotification:
-				for _, z := range body.MonitoredItems {
-					if z.ClientHandle == 42 && z.Value.StatusCode.IsGood() {
-						if id, ok := opcuMap[res3.SubscriptionID]; ok {
-							m := fmt.Sprintf("SubscriptionID:%v,nodeid:%v,value:%v", res3.SubscriptionID, id, z.Value.Value)
-							err := SendSyslog(LOG_ALERT, "opcua ", m)
-							if err != nil {
-								q.Q("syslog err:", err)
-							}
-							q.Q("SubscriptionID :", res3.SubscriptionID, "nodeid:", id, "value:", z.Value.Value)
-						} else {
-							m := fmt.Sprintf("SubscriptionID:%v,value:%v", res3.SubscriptionID, z.Value.Value)
-							err := SendSyslog(LOG_ALERT, "opcua ", m)
-							if err != nil {
-								q.Q("syslog err:", err)
-							}
-							q.Q("SubscriptionID :", res3.SubscriptionID, "value:", z.Value.Value)
-						}
-					}
-				}
-			}
-		}
+// Opcua subcribe setting.
+//
+// Usage : opcua sub [name] [node id...] [option=value...]
+//
+//	[name]        : connection name, default when left out
+//	[node id]     : opcua node ids to monitor
+//	[option]      : interval, publishing interval in ms, default 1000
+//	                sampling, sampling interval in ms, default 500
+//	                queue, queue size, default 1
+//	                deadband, deadband value, default none
+//	                deadbandtype, absolute or percent, default absolute
+//
+// Example :
+//
+//	opcua sub i=1002
+//	opcua sub plc1 ns=2;s=Temperature ns=2;s=Pressure interval=500 sampling=100 deadband=0.5
+func OpcuaSubscribeCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	name, args := splitOpcuaName(ws[2:])
+	s, err := ParseOpcuaSubscription(args)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	id, err := OpcuaSubscribe(name, s)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error() + ", Error creating subscription"
+		return cmdinfo
 	}
+	items := []string{}
+	for _, item := range s.Items {
+		items = append(items, strconv.FormatUint(uint64(item.ID), 10))
+	}
+	cmdinfo.Status = "ok"
+	cmdinfo.Result = fmt.Sprintf("SubscriptionID:%v,MonitoredItemID:%v", id, strings.Join(items, ","))
+	return cmdinfo
 }
 
-// DeleteOpcuSubscribeCmd
+// Opcua unsubcribe setting.
+//
+// Usage : opcua unsub [name] [sub id]
+//
+//	[name]        : connection name, default when left out
+//	[sub id]      : subscription id
+//
+// Example :
+//
+//	opcua unsub plc1 1
+func OpcuaUnsubscribeCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 1 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	subid, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	err = OpcuaUnsubscribe(name, uint32(subid))
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
 
 // Opcua delete subcribe setting.
 //
-// Usage : opcua deletesub [sub id] [monitor id]
+// Usage : opcua deletesub [name] [sub id] [monitor id]
 //
+//	[name]        : connection name, default when left out
 //	[sub id]      : subscribe id
 //	[monitor id]  : monitored item id
 //
@@ -796,68 +1000,65 @@ func runOpcuaDataChangeNotification() {
 //
 //	opcua deletesub 1 1
 func OpcuDeleteSubscribeCmd(cmdinfo *CmdInfo) *CmdInfo {
-	err := CheckOpcuaClient()
-	if err != nil {
-		cmdinfo.Status = "error: " + err.Error()
-		return cmdinfo
-	}
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 4 {
+	name, args := splitOpcuaName(ws[2:])
+	if len(args) < 2 {
 		cmdinfo.Status = "error: invalid command"
 		return cmdinfo
 	}
-	subid, err := strconv.Atoi(ws[2])
+	subid, err := strconv.ParseUint(args[0], 10, 32)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	monid, err := strconv.Atoi(ws[3])
+	monid, err := strconv.ParseUint(args[1], 10, 32)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	req := &ua.DeleteMonitoredItemsRequest{SubscriptionID: uint32(subid), MonitoredItemIDs: []uint32{uint32(monid)}}
-
-	res, err := opcuaclient.DeleteMonitoredItems(req)
+	err = OpcuaDeleteItem(name, uint32(subid), uint32(monid))
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	for _, r := range res.Results {
-		if !r.IsGood() {
-			cmdinfo.Status = r.Error()
-			return cmdinfo
-		}
-	}
-
 	cmdinfo.Status = "ok"
 	return cmdinfo
 }
 
-// OpcuCloseCmd
-
-// Close opcua.
+// List opcua connections.
 //
-// Usage : opcua close
+// Usage : opcua list
 //
 // Example :
 //
-//	opcua close
-func OpcuCloseCmd(cmdinfo *CmdInfo) *CmdInfo {
-	err := CheckOpcuaClient()
+//	opcua list
+func OpcuaListCmd(cmdinfo *CmdInfo) *CmdInfo {
+	b, err := json.Marshal(GetOpcuaClients())
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
+	cmdinfo.Result = string(b)
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
+
+// Close opcua.
+//
+// Usage : opcua close [name]
+//
+//	[name]        : connection name, default when left out
+//
+// Example :
+//
+//	opcua close
+//	opcua close plc1
+func OpcuCloseCmd(cmdinfo *CmdInfo) *CmdInfo {
 	cmd := cmdinfo.Command
 	ws := strings.Split(cmd, " ")
-	if len(ws) < 2 {
-		cmdinfo.Status = "error: invalid command"
-		return cmdinfo
-	}
-
-	err = opcuaclient.Close()
+	name, _ := splitOpcuaName(ws[2:])
+	err := OpcuaDisconnect(name)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/awcullen/opcua/client"
+	opcuaserver "github.com/awcullen/opcua/server"
 	"github.com/awcullen/opcua/ua"
 	"github.com/pkg/errors"
 	"github.com/qeof/q"
@@ -993,3 +996,71 @@ func OpcuaClose() error {
 	}
 	return nil
 }
+
+// opcuaTestDir runs the test with default settings in a temporary
+// directory, where the opcua server and clients keep their pki.
+func opcuaTestDir(t *testing.T) {
+	t.Helper()
+	restoreSettings(t)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	err = InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveOpcuaTestServer runs a new opcua server on endpointURL and waits
+// until it listens, setup runs before the server starts. The server is
+// shut down when the test ends.
+func serveOpcuaTestServer(t *testing.T, endpointURL string, setup func(*OpcuaServer) error, opts ...opcuaserver.Option) (*OpcuaServer, bool) {
+	t.Helper()
+	s := NewOpcuaServer(endpointURL, opts...)
+	if setup != nil {
+		if err := setup(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.OpcuaRun()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.srv.State() != ua.ServerStateRunning {
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		_ = s.OpcuaShutdown()
+	})
+	return s, true
+}
+
+// startOpcuaTestServer starts an opcua server on a free port. The stack
+// binds the port itself, so a port taken by another test in between is
+// retried with the next one.
+func startOpcuaTestServer(t *testing.T, setup func(*OpcuaServer) error, opts ...opcuaserver.Option) (*OpcuaServer, string) {
+	t.Helper()
+	for i := 0; i < 5; i++ {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the server certificate names the host
+		endpointURL := fmt.Sprintf("opc.tcp://%s:%d", host, l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		if s, ok := serveOpcuaTestServer(t, endpointURL, setup, opts...); ok {
+			return s, endpointURL
+		}
+	}
+	t.Fatal("opcua server does not listen")
+	return nil, ""
+}
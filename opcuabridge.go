@@ -0,0 +1,743 @@
+package mnms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	The opcua bridge of the root forwards values of opcua servers to mqtt
+	and syslog. Servers and tags are kept in config.json and the bridge
+	starts with the root.
+
+	Each bridge server is an opcua connection named bridge-<server> with
+	one subscription for the node ids of its tags, so lost sessions are
+	reconnected as for opcua connect. A tag maps a node id to
+
+		topic     published on the embedded broker, or on the mqtt
+		          connection of the tag
+		severity  sent as syslog at the severity
+
+	Numeric values are scaled, value*scale+offset, and transformed by
+	round (to decimals), floor, ceil, abs, bool or not. A value is
+	forwarded when it changed by threshold or more since the last value
+	forwarded, or when its status changed. Topics and messages are
+	templates, {tag}, {server}, {nodeId}, {value}, {raw} and {status} are
+	replaced by their values. Values are queued and forwarded in order by
+	one worker, when the queue is full new values are dropped.
+*/
+
+// opcua bridge tag transforms
+const (
+	OpcuaTransformRound = "round"
+	OpcuaTransformFloor = "floor"
+	OpcuaTransformCeil  = "ceil"
+	OpcuaTransformAbs   = "abs"
+	OpcuaTransformBool  = "bool"
+	OpcuaTransformNot   = "not"
+)
+
+const (
+	opcuaBridgePrefix   = "bridge-"
+	opcuaBridgeInterval = 5 * time.Second
+	opcuaBridgeMessage  = "{tag} {value} {status}"
+	// values waiting to be forwarded, more are dropped
+	opcuaBridgeQueueSize = 1024
+)
+
+// OpcuaBridgeServer is an opcua server the bridge reads tags of. The
+// username and password are kept in the credential vault.
+type OpcuaBridgeServer struct {
+	Name       string  `json:"name"`
+	Endpoint   string  `json:"endpoint"`
+	Policy     string  `json:"policy,omitempty"`
+	Credential string  `json:"credential,omitempty"`
+	CAFile     string  `json:"ca,omitempty"`
+	Insecure   bool    `json:"insecure,omitempty"`
+	Interval   float64 `json:"interval,omitempty"` // publishing interval in ms
+}
+
+// OpcuaTag maps a node of a bridge server to an mqtt topic, syslog or
+// both.
+type OpcuaTag struct {
+	Name       string  `json:"name"`
+	Server     string  `json:"server"`
+	NodeID     string  `json:"nodeId"`
+	Topic      string  `json:"topic,omitempty"`
+	Connection string  `json:"connection,omitempty"` // mqtt connection, the embedded broker by default
+	Retain     bool    `json:"retain,omitempty"`
+	Payload    string  `json:"payload,omitempty"` // json or value
+	Severity   *int    `json:"severity,omitempty"`
+	Message    string  `json:"message,omitempty"`
+	Scale      float64 `json:"scale,omitempty"`
+	Offset     float64 `json:"offset,omitempty"`
+	Transform  string  `json:"transform,omitempty"`
+	Decimals   int     `json:"decimals,omitempty"`
+	Threshold  float64 `json:"threshold,omitempty"`
+}
+
+// OpcuaTagValue is a forwarded value of a tag, the payload published as
+// json.
+type OpcuaTagValue struct {
+	Tag    string    `json:"tag"`
+	Server string    `json:"server"`
+	NodeID string    `json:"nodeId"`
+	Value  any       `json:"value"`
+	Raw    any       `json:"raw"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// OpcuaTagStatus is the state of a tag for the bridge status.
+type OpcuaTagStatus struct {
+	OpcuaTag
+	Last      *OpcuaTagValue `json:"last,omitempty"`
+	Forwarded int            `json:"forwarded"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// OpcuaBridgeStatus is the state of the bridge.
+type OpcuaBridgeStatus struct {
+	Servers []OpcuaClientStatus `json:"servers"`
+	Tags    []OpcuaTagStatus    `json:"tags"`
+}
+
+type opcuaBridgeTag struct {
+	OpcuaTag
+	last      *OpcuaTagValue
+	forwarded int
+	err       string
+}
+
+type opcuaBridgeServer struct {
+	OpcuaBridgeServer
+	subscribed bool
+	tags       map[string][]*opcuaBridgeTag // by node id
+}
+
+var opcuaBridge = struct {
+	sync.Mutex
+	loaded  bool
+	servers map[string]*opcuaBridgeServer // by connection name
+}{servers: make(map[string]*opcuaBridgeServer)}
+
+// opcuaBridgeSync serializes starting and subscribing of the bridge.
+var opcuaBridgeSync sync.Mutex
+
+type opcuaBridgeForward struct {
+	tag   *opcuaBridgeTag
+	value OpcuaTagValue
+}
+
+// opcuaBridgeQueue holds the values to forward, so a slow broker or
+// syslog server does not hold up the publish loop of the connections.
+var (
+	opcuaBridgeQueue     = make(chan opcuaBridgeForward, opcuaBridgeQueueSize)
+	opcuaBridgeQueueOnce sync.Once
+)
+
+// opcuaFloat returns numeric value v as float64.
+func opcuaFloat(v any) (float64, bool) {
+	switch x := v.(type) {
+	case int8:
+		return float64(x), true
+	case uint8:
+		return float64(x), true
+	case int16:
+		return float64(x), true
+	case uint16:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// apply scales and transforms value v of the tag.
+func (t *OpcuaTag) apply(v any) (any, error) {
+	if t.Transform == OpcuaTransformNot {
+		b, ok := v.(bool)
+		if !ok {
+			f, isNumber := opcuaFloat(v)
+			if !isNumber {
+				return nil, fmt.Errorf("%v is not a boolean", v)
+			}
+			b = f != 0
+		}
+		return !b, nil
+	}
+	if t.Scale == 0 && t.Offset == 0 && t.Transform == "" {
+		return v, nil
+	}
+	f, ok := opcuaFloat(v)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a number", v)
+	}
+	if t.Scale != 0 {
+		f *= t.Scale
+	}
+	f += t.Offset
+	switch t.Transform {
+	case OpcuaTransformRound:
+		p := math.Pow(10, float64(t.Decimals))
+		f = math.Round(f*p) / p
+	case OpcuaTransformFloor:
+		f = math.Floor(f)
+	case OpcuaTransformCeil:
+		f = math.Ceil(f)
+	case OpcuaTransformAbs:
+		f = math.Abs(f)
+	case OpcuaTransformBool:
+		return f != 0, nil
+	}
+	return f, nil
+}
+
+// changed reports whether v is to be forwarded after the last value.
+func (t *OpcuaTag) changed(last *OpcuaTagValue, v OpcuaTagValue) bool {
+	if last == nil || last.Status != v.Status {
+		return true
+	}
+	a, ok1 := opcuaFloat(last.Value)
+	b, ok2 := opcuaFloat(v.Value)
+	if ok1 && ok2 {
+		return a != b && math.Abs(b-a) >= t.Threshold
+	}
+	return fmt.Sprint(last.Value) != fmt.Sprint(v.Value)
+}
+
+// expand replaces the variables of template s with those of v.
+func (v *OpcuaTagValue) expand(s string) string {
+	return strings.NewReplacer(
+		"{tag}", v.Tag,
+		"{server}", v.Server,
+		"{nodeId}", v.NodeID,
+		"{value}", mqttValueString(v.Value),
+		"{raw}", mqttValueString(v.Raw),
+		"{status}", v.Status,
+	).Replace(s)
+}
+
+// forward publishes and logs value v of tag t.
+func (t *OpcuaTag) forward(v OpcuaTagValue) error {
+	if t.Topic != "" {
+		payload := []byte(mqttValueString(v.Value))
+		if t.Payload != "value" {
+			var err error
+			payload, err = json.Marshal(v)
+			if err != nil {
+				return err
+			}
+		}
+		topic := v.expand(t.Topic)
+		var err error
+		if t.Connection == "" {
+			err = mqttBrokerPublish(topic, payload, t.Retain)
+		} else {
+			err = RunMqttPublish(t.Connection, topic, string(payload))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if t.Severity != nil {
+		message := t.Message
+		if message == "" {
+			message = opcuaBridgeMessage
+		}
+		return SendSyslog(*t.Severity, "opcuabridge", v.expand(message))
+	}
+	return nil
+}
+
+// bridgeOpcuaDataChange queues data change e for the tags of its node.
+func bridgeOpcuaDataChange(e OpcuaDataChange) {
+	opcuaBridgeQueueOnce.Do(func() {
+		go forwardOpcuaBridge()
+	})
+	opcuaBridge.Lock()
+	defer opcuaBridge.Unlock()
+	s := opcuaBridge.servers[e.Connection]
+	if s == nil {
+		return
+	}
+	for _, t := range s.tags[e.NodeID] {
+		v := OpcuaTagValue{Tag: t.Name, Server: s.Name, NodeID: e.NodeID, Raw: e.Value, Status: e.Status, Time: e.SourceTime}
+		if v.Time.IsZero() {
+			v.Time = e.Time
+		}
+		value, err := t.apply(e.Value)
+		if e.Status == "Good" && err != nil {
+			t.err = err.Error()
+			continue
+		}
+		v.Value = value
+		if !t.changed(t.last, v) {
+			continue
+		}
+		select {
+		case opcuaBridgeQueue <- opcuaBridgeForward{tag: t, value: v}:
+			t.last = &v
+		default:
+			t.err = "forward queue full, value dropped"
+			q.Q(t.Name, t.err)
+		}
+	}
+}
+
+// forwardOpcuaBridge forwards the queued values in order.
+func forwardOpcuaBridge() {
+	for f := range opcuaBridgeQueue {
+		err := f.tag.forward(f.value)
+		opcuaBridge.Lock()
+		f.tag.err = ""
+		if err != nil {
+			f.tag.err = err.Error()
+		} else {
+			f.tag.forwarded++
+		}
+		opcuaBridge.Unlock()
+		if err != nil {
+			q.Q(f.tag.Name, err)
+		}
+	}
+}
+
+// opcuaBridgeProfile is the connect profile of bridge server s.
+func opcuaBridgeProfile(s OpcuaBridgeServer) (OpcuaConnectProfile, error) {
+	args := []string{opcuaBridgePrefix + s.Name, s.Endpoint}
+	if s.Policy != "" {
+		args = append(args, "policy="+s.Policy)
+	}
+	if s.Credential != "" {
+		args = append(args, credRefPrefix+s.Credential)
+	}
+	if s.CAFile != "" {
+		args = append(args, "ca="+s.CAFile)
+	}
+	if s.Insecure {
+		args = append(args, "insecure=true")
+	}
+	return ParseOpcuaConnect(args)
+}
+
+// checkOpcuaBridgeServer checks a bridge server before it is saved.
+func checkOpcuaBridgeServer(s OpcuaBridgeServer) error {
+	if !opcuaNameRegexp.MatchString(s.Name) {
+		return fmt.Errorf("invalid opcua bridge server name %q", s.Name)
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("invalid interval %v", s.Interval)
+	}
+	_, err := opcuaBridgeProfile(s)
+	return err
+}
+
+// checkOpcuaTag checks a tag before it is saved.
+func checkOpcuaTag(t OpcuaTag) error {
+	if t.Name == "" || strings.ContainsAny(t.Name, " \t") {
+		return fmt.Errorf("invalid opcua tag name %q", t.Name)
+	}
+	_, err := parseOpcuaNodeID(t.NodeID)
+	if err != nil {
+		return err
+	}
+	if t.Topic == "" && t.Severity == nil {
+		return errors.New("opcua tag needs a topic or a severity")
+	}
+	if strings.ContainsAny(t.Topic, "+#") {
+		return fmt.Errorf("invalid topic %s, wildcards are not allowed", t.Topic)
+	}
+	if t.Severity != nil && (*t.Severity < LOG_EMERG || *t.Severity > LOG_DEBUG) {
+		return fmt.Errorf("invalid severity %d, must be 0 to 7", *t.Severity)
+	}
+	switch t.Payload {
+	case "", "json", "value":
+	default:
+		return fmt.Errorf("invalid payload %q, must be json or value", t.Payload)
+	}
+	switch t.Transform {
+	case "", OpcuaTransformRound, OpcuaTransformFloor, OpcuaTransformCeil,
+		OpcuaTransformAbs, OpcuaTransformBool, OpcuaTransformNot:
+	default:
+		return fmt.Errorf("invalid transform %q", t.Transform)
+	}
+	if t.Decimals < 0 || t.Threshold < 0 {
+		return errors.New("decimals and threshold must not be negative")
+	}
+	return nil
+}
+
+// GetOpcuaBridge returns the bridge servers and tags.
+func GetOpcuaBridge() ([]OpcuaBridgeServer, []OpcuaTag, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	servers, tags := c.OpcuaBridgeServers, c.OpcuaTags
+	if servers == nil {
+		servers = []OpcuaBridgeServer{}
+	}
+	if tags == nil {
+		tags = []OpcuaTag{}
+	}
+	return servers, tags, nil
+}
+
+// SetOpcuaBridgeServer adds or replaces a bridge server.
+func SetOpcuaBridgeServer(s OpcuaBridgeServer) error {
+	err := checkOpcuaBridgeServer(s)
+	if err != nil {
+		return err
+	}
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		replaced := false
+		for i := range c.OpcuaBridgeServers {
+			if c.OpcuaBridgeServers[i].Name == s.Name {
+				c.OpcuaBridgeServers[i] = s
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.OpcuaBridgeServers = append(c.OpcuaBridgeServers, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reloadOpcuaBridge()
+	return nil
+}
+
+// DeleteOpcuaBridgeServer deletes a bridge server without tags.
+func DeleteOpcuaBridgeServer(name string) error {
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, t := range c.OpcuaTags {
+			if t.Server == name {
+				return fmt.Errorf("opcua bridge server %s has tag %s", name, t.Name)
+			}
+		}
+		for i, s := range c.OpcuaBridgeServers {
+			if s.Name == name {
+				c.OpcuaBridgeServers = append(c.OpcuaBridgeServers[:i], c.OpcuaBridgeServers[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("opcua bridge server %s not exist", name)
+	})
+	if err != nil {
+		return err
+	}
+	reloadOpcuaBridge()
+	return nil
+}
+
+// SetOpcuaTag adds or replaces a tag.
+func SetOpcuaTag(t OpcuaTag) error {
+	err := checkOpcuaTag(t)
+	if err != nil {
+		return err
+	}
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		found := false
+		for _, s := range c.OpcuaBridgeServers {
+			if s.Name == t.Server {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("opcua bridge server %s not exist", t.Server)
+		}
+		replaced := false
+		for i := range c.OpcuaTags {
+			if c.OpcuaTags[i].Name == t.Name {
+				c.OpcuaTags[i] = t
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.OpcuaTags = append(c.OpcuaTags, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reloadOpcuaBridge()
+	return nil
+}
+
+// DeleteOpcuaTag deletes a tag.
+func DeleteOpcuaTag(name string) error {
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, t := range c.OpcuaTags {
+			if t.Name == name {
+				c.OpcuaTags = append(c.OpcuaTags[:i], c.OpcuaTags[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("opcua tag %s not exist", name)
+	})
+	if err != nil {
+		return err
+	}
+	reloadOpcuaBridge()
+	return nil
+}
+
+// reloadOpcuaBridge restarts the bridge with the saved servers and tags.
+func reloadOpcuaBridge() {
+	opcuaBridge.Lock()
+	opcuaBridge.loaded = false
+	opcuaBridge.Unlock()
+	go syncOpcuaBridge()
+}
+
+// stopOpcuaBridge closes the connections of the bridge.
+func stopOpcuaBridge() {
+	opcuaBridge.Lock()
+	servers := opcuaBridge.servers
+	opcuaBridge.servers = make(map[string]*opcuaBridgeServer)
+	opcuaBridge.Unlock()
+	for name := range servers {
+		_ = OpcuaDisconnect(name)
+	}
+}
+
+// startOpcuaBridge connects the servers which have tags.
+func startOpcuaBridge(servers []OpcuaBridgeServer, tags []OpcuaTag) {
+	bridge := make(map[string]*opcuaBridgeServer)
+	for _, s := range servers {
+		bridge[s.Name] = &opcuaBridgeServer{OpcuaBridgeServer: s, tags: make(map[string][]*opcuaBridgeTag)}
+	}
+	for _, t := range tags {
+		s := bridge[t.Server]
+		if s == nil {
+			continue
+		}
+		// node ids are listed as the connection reports them
+		id, err := parseOpcuaNodeID(t.NodeID)
+		if err != nil {
+			continue
+		}
+		nodeID := fmt.Sprint(id)
+		s.tags[nodeID] = append(s.tags[nodeID], &opcuaBridgeTag{OpcuaTag: t})
+	}
+	started := []*opcuaBridgeServer{}
+	opcuaBridge.Lock()
+	for _, s := range bridge {
+		if len(s.tags) > 0 {
+			opcuaBridge.servers[opcuaBridgePrefix+s.Name] = s
+			started = append(started, s)
+		}
+	}
+	opcuaBridge.Unlock()
+	for _, s := range started {
+		p, err := opcuaBridgeProfile(s.OpcuaBridgeServer)
+		if err == nil {
+			// not reachable servers are retried by the connection
+			err = OpcuaConnect(p)
+		}
+		if err != nil {
+			q.Q("opcua bridge", s.Name, err)
+		}
+	}
+}
+
+// syncOpcuaBridge starts the bridge when it is not loaded and subscribes
+// to the tags of connected servers.
+func syncOpcuaBridge() {
+	opcuaBridgeSync.Lock()
+	defer opcuaBridgeSync.Unlock()
+	opcuaBridge.Lock()
+	loaded := opcuaBridge.loaded
+	opcuaBridge.loaded = true
+	opcuaBridge.Unlock()
+	if !loaded {
+		stopOpcuaBridge()
+		servers, tags, err := GetOpcuaBridge()
+		if err != nil {
+			q.Q(err)
+			return
+		}
+		startOpcuaBridge(servers, tags)
+	}
+	opcuaBridge.Lock()
+	defer opcuaBridge.Unlock()
+	for name, s := range opcuaBridge.servers {
+		if s.subscribed {
+			continue
+		}
+		sub := &OpcuaSubscription{PublishingInterval: s.Interval, SamplingInterval: s.Interval, QueueSize: 1}
+		if sub.PublishingInterval == 0 {
+			sub.PublishingInterval, sub.SamplingInterval = 1000, 500
+		}
+		for nodeID := range s.tags {
+			sub.Items = append(sub.Items, &OpcuaMonitoredItem{NodeID: nodeID})
+		}
+		sort.Slice(sub.Items, func(i, j int) bool { return sub.Items[i].NodeID < sub.Items[j].NodeID })
+		_, err := OpcuaSubscribe(name, sub)
+		if err != nil {
+			// tried again when the connection is back
+			continue
+		}
+		s.subscribed = true
+	}
+}
+
+// RunOpcuaBridge runs the opcua bridge of the root.
+func RunOpcuaBridge() {
+	for {
+		syncOpcuaBridge()
+		time.Sleep(opcuaBridgeInterval)
+	}
+}
+
+// GetOpcuaBridgeStatus returns the connections and tags of the bridge.
+func GetOpcuaBridgeStatus() OpcuaBridgeStatus {
+	status := OpcuaBridgeStatus{Servers: []OpcuaClientStatus{}, Tags: []OpcuaTagStatus{}}
+	for _, c := range GetOpcuaClients() {
+		if strings.HasPrefix(c.Name, opcuaBridgePrefix) {
+			status.Servers = append(status.Servers, c)
+		}
+	}
+	opcuaBridge.Lock()
+	defer opcuaBridge.Unlock()
+	for _, s := range opcuaBridge.servers {
+		for _, tags := range s.tags {
+			for _, t := range tags {
+				status.Tags = append(status.Tags, OpcuaTagStatus{OpcuaTag: t.OpcuaTag, Last: t.last,
+					Forwarded: t.forwarded, Error: t.err})
+			}
+		}
+	}
+	sort.Slice(status.Tags, func(i, j int) bool { return status.Tags[i].Name < status.Tags[j].Name })
+	return status
+}
+
+// HandleOpcuaBridgeServers handles opcua bridge server requests
+//
+// GET /api/v1/opcua/bridge/servers
+//
+//	returns the bridge servers
+//
+// POST /api/v1/opcua/bridge/servers
+//
+//	Example parameter: {"name": "plc1", "endpoint": "opc.tcp://10.0.0.5:4840",
+//	                    "policy": "Basic256Sha256", "credential": "plc", "interval": 500}
+//
+// DELETE /api/v1/opcua/bridge/servers
+//
+//	Example parameter: {"name": "plc1"}
+func HandleOpcuaBridgeServers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var s OpcuaBridgeServer
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set opcua bridge server %s", s.Name)
+			err = SetOpcuaBridgeServer(s)
+		} else {
+			setAuditDetail(r, "delete opcua bridge server %s", s.Name)
+			err = DeleteOpcuaBridgeServer(s.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	servers, _, err := GetOpcuaBridge()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(servers)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleOpcuaTags handles opcua bridge tag requests
+//
+// GET /api/v1/opcua/bridge/tags
+//
+//	returns the tags
+//
+// POST /api/v1/opcua/bridge/tags
+//
+//	Example parameter: {"name": "boiler-temp", "server": "plc1", "nodeId": "ns=2;s=Temperature",
+//	                    "topic": "plant/{server}/{tag}", "scale": 0.1, "transform": "round",
+//	                    "decimals": 1, "threshold": 0.5}
+//
+// DELETE /api/v1/opcua/bridge/tags
+//
+//	Example parameter: {"name": "boiler-temp"}
+func HandleOpcuaTags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var t OpcuaTag
+		err := json.NewDecoder(r.Body).Decode(&t)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set opcua tag %s", t.Name)
+			err = SetOpcuaTag(t)
+		} else {
+			setAuditDetail(r, "delete opcua tag %s", t.Name)
+			err = DeleteOpcuaTag(t.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	_, tags, err := GetOpcuaBridge()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(tags)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleOpcuaBridge handles opcua bridge status requests
+//
+// GET /api/v1/opcua/bridge
+//
+//	returns the bridge connections and the tags with their last values
+func HandleOpcuaBridge(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(GetOpcuaBridgeStatus())
+	if err != nil {
+		q.Q(err)
+	}
+}
@@ -0,0 +1,179 @@
+package mnms
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	opcuaserver "github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+// TestOpcuaBridge tests forwarding scaled tag values to the broker with
+// thresholds, and saving servers and tags in the config
+func TestOpcuaBridge(t *testing.T) {
+	opcuaTestDir(t)
+	// the bridge logs in anonymously
+	s, endpointURL := startOpcuaTestServer(t, nil, opcuaserver.WithAnonymousIdentity(true))
+	setValue := func(v float32) {
+		t.Helper()
+		n, ok := s.srv.NamespaceManager().FindVariable(ua.ParseNodeID("i=1002"))
+		if !ok {
+			t.Fatal("no temperature node")
+		}
+		now := time.Now()
+		n.SetValue(ua.NewDataValue(v, 0, now, 0, now, 0))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	broker := MQTTBroker.NewServer(nil)
+	err = broker.AddListener(listeners.NewTCP("bridge", addr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	setNorthboundBroker(broker)
+	defer setNorthboundBroker(nil)
+	defer stopOpcuaBridge()
+
+	received := make(chan MQTTClient.Message, 100)
+	opts := MQTTClient.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("scada")
+	client := MQTTClient.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(100)
+	token := client.Subscribe("plant/#", 0, func(_ MQTTClient.Client, msg MQTTClient.Message) {
+		received <- msg
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect := func(topic string) string {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case msg := <-received:
+				if msg.Topic() == topic {
+					return string(msg.Payload())
+				}
+			case <-timeout:
+				t.Fatal("no message on", topic)
+				return ""
+			}
+		}
+	}
+
+	if err = SetOpcuaBridgeServer(OpcuaBridgeServer{Name: "plc 1", Endpoint: endpointURL}); err == nil {
+		t.Fatal("expect invalid server name to fail")
+	}
+	if err = SetOpcuaTag(OpcuaTag{Name: "temp", Server: "plc1", NodeID: "i=1002", Topic: "plant/temp"}); err == nil {
+		t.Fatal("expect unknown server to fail")
+	}
+	err = SetOpcuaBridgeServer(OpcuaBridgeServer{Name: "plc1", Endpoint: endpointURL, Policy: "none", Interval: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []OpcuaTag{
+		{Name: "bad", Server: "plc1", NodeID: "i=1002", Topic: "plant/#"},
+		{Name: "bad", Server: "plc1", NodeID: "i=1002"},
+		{Name: "bad", Server: "plc1", NodeID: "x=1", Topic: "plant/bad"},
+		{Name: "bad", Server: "plc1", NodeID: "i=1002", Topic: "plant/bad", Transform: "sqrt"},
+	} {
+		if err = SetOpcuaTag(tag); err == nil {
+			t.Fatal("expect invalid tag to fail", tag)
+		}
+	}
+	for _, tag := range []OpcuaTag{
+		{Name: "temp", Server: "plc1", NodeID: "i=1002", Topic: "plant/{server}/{tag}",
+			Scale: 10, Offset: 1, Transform: OpcuaTransformRound, Threshold: 20},
+		{Name: "temp-raw", Server: "plc1", NodeID: "i=1002", Topic: "plant/raw", Payload: "value"},
+	} {
+		if err = SetOpcuaTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = DeleteOpcuaBridgeServer("plc1"); err == nil {
+		t.Fatal("expect deleting a server with tags to fail")
+	}
+	c, err := GetMNMSConfig()
+	if err != nil || len(c.OpcuaBridgeServers) != 1 || len(c.OpcuaTags) != 2 {
+		t.Fatal("expect server and tags in config", c, err)
+	}
+
+	subscribed := func() bool {
+		syncOpcuaBridge()
+		for _, c := range GetOpcuaBridgeStatus().Servers {
+			if c.Name == "bridge-plc1" && len(c.Subscriptions) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !subscribed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !subscribed() {
+		t.Fatal("expect bridge to subscribe", GetOpcuaBridgeStatus())
+	}
+
+	var v OpcuaTagValue
+	if err = json.Unmarshal([]byte(expect("plant/plc1/temp")), &v); err != nil || v.Value != 6.0 || v.Raw != 0.5 ||
+		v.Status != "Good" || v.NodeID != "i=1002" {
+		t.Fatal("unexpected value", v, err)
+	}
+	if p := expect("plant/raw"); p != "0.5" {
+		t.Fatal("expect raw 0.5, got", p)
+	}
+	setValue(2)
+	if p := expect("plant/raw"); p != "2" {
+		t.Fatal("expect raw 2, got", p)
+	}
+	setValue(3)
+	if err = json.Unmarshal([]byte(expect("plant/plc1/temp")), &v); err != nil || v.Value != 31.0 {
+		t.Fatal("expect 31 after the threshold, got", v, err)
+	}
+	// values are forwarded in the background
+	forwarded := func(status OpcuaBridgeStatus) bool {
+		return len(status.Tags) == 2 && status.Tags[0].Name == "temp" && status.Tags[0].Forwarded == 2 && status.Tags[1].Forwarded == 3
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	status := GetOpcuaBridgeStatus()
+	for !forwarded(status) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		status = GetOpcuaBridgeStatus()
+	}
+	if !forwarded(status) {
+		t.Fatal("unexpected bridge status", status.Tags)
+	}
+
+	// a reload starts again with the saved tags
+	if err = DeleteOpcuaTag("temp-raw"); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for !subscribed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status = GetOpcuaBridgeStatus(); len(status.Tags) != 1 || status.Tags[0].Name != "temp" {
+		t.Fatal("expect temp left", status.Tags)
+	}
+	if err = json.Unmarshal([]byte(expect("plant/plc1/temp")), &v); err != nil || v.Value != 31.0 {
+		t.Fatal("expect 31 after the reload, got", v, err)
+	}
+}
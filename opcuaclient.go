@@ -0,0 +1,828 @@
+package mnms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awcullen/opcua/client"
+	"github.com/awcullen/opcua/ua"
+	"github.com/qeof/q"
+)
+
+/*
+	Managed OPC UA client connections.
+
+	A connection is made with a connect profile,
+
+		opcua connect plc1 opc.tcp://10.0.0.5:4840 @cred:plc policy=Basic256Sha256
+
+	and kept until it is disconnected. Commands without a connection
+	name use the connection "default".
+
+	A subscription monitors one or more nodes with its own publishing
+	interval, sampling interval, queue size and deadband. Subscriptions
+	and their items keep their ids for the life of the connection. A lost
+	session is reconnected, the subscriptions are transferred to the new
+	session or created again when the server can not transfer them.
+
+	Data changes are kept as OpcuaDataChange events and sent to the
+	websocket topic opcua.
+*/
+
+const (
+	OpcuaStatusConnected    = "connected"
+	OpcuaStatusConnecting   = "connecting"
+	OpcuaStatusDisconnected = "disconnected"
+)
+
+const (
+	// opcuaDefaultConnection is the connection of commands without name
+	opcuaDefaultConnection = "default"
+	// opcuaDataChangesMax is the number of data changes kept
+	opcuaDataChangesMax = 1000
+	// opcuaKeepAlive is the longest time between publish responses
+	opcuaKeepAlive = 10 * time.Second
+)
+
+var opcuaSecurityPolicies = map[string]string{
+	"best":                ua.SecurityPolicyURIBestAvailable,
+	"none":                ua.SecurityPolicyURINone,
+	"basic256sha256":      ua.SecurityPolicyURIBasic256Sha256,
+	"aes128sha256rsaoaep": ua.SecurityPolicyURIAes128Sha256RsaOaep,
+	"aes256sha256rsapss":  ua.SecurityPolicyURIAes256Sha256RsaPss,
+}
+
+var opcuaNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// OpcuaConnectProfile are the options of a client connection.
+type OpcuaConnectProfile struct {
+	Name       string `json:"name"`
+	Endpoint   string `json:"endpoint"`
+	Policy     string `json:"policy"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"-"`
+	Credential string `json:"credential,omitempty"`
+	CertFile   string `json:"cert"`
+	KeyFile    string `json:"key"`
+	CAFile     string `json:"ca,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+}
+
+// OpcuaMonitoredItem is a node monitored by a subscription.
+type OpcuaMonitoredItem struct {
+	ID       uint32 `json:"id"`
+	NodeID   string `json:"nodeId"`
+	Value    any    `json:"value"`
+	Status   string `json:"status,omitempty"`
+	Changes  int    `json:"changes"`
+	serverID uint32
+}
+
+// OpcuaSubscription is a subscription of a client connection.
+type OpcuaSubscription struct {
+	ID                 uint32                `json:"id"`
+	PublishingInterval float64               `json:"publishingInterval"`
+	SamplingInterval   float64               `json:"samplingInterval"`
+	QueueSize          uint32                `json:"queueSize"`
+	Deadband           float64               `json:"deadband,omitempty"`
+	DeadbandType       string                `json:"deadbandType,omitempty"`
+	Items              []*OpcuaMonitoredItem `json:"items"`
+	serverID           uint32
+}
+
+// OpcuaDataChange is a value change of a monitored item.
+type OpcuaDataChange struct {
+	Time         time.Time `json:"time"`
+	Connection   string    `json:"connection"`
+	Subscription uint32    `json:"subscription"`
+	Item         uint32    `json:"item"`
+	NodeID       string    `json:"nodeId"`
+	Value        any       `json:"value"`
+	Status       string    `json:"status"`
+	SourceTime   time.Time `json:"sourceTime"`
+}
+
+// OpcuaClientStatus is the state of a client connection for opcua list.
+type OpcuaClientStatus struct {
+	OpcuaConnectProfile
+	Status        string              `json:"status"`
+	Error         string              `json:"error,omitempty"`
+	Since         string              `json:"since,omitempty"`
+	Subscriptions []OpcuaSubscription `json:"subscriptions"`
+}
+
+type opcuaConnection struct {
+	profile    OpcuaConnectProfile
+	client     *OpcuaClient
+	subs       map[uint32]*OpcuaSubscription
+	items      map[uint32]*OpcuaMonitoredItem // by client handle
+	nextSub    uint32
+	nextHandle uint32
+	err        string
+	since      time.Time
+	wake       chan struct{}
+	done       chan struct{}
+}
+
+var opcuaClients = struct {
+	sync.Mutex
+	conns   map[string]*opcuaConnection
+	changes []OpcuaDataChange
+}{conns: make(map[string]*opcuaConnection)}
+
+// ParseOpcuaConnect parses the arguments of opcua connect, the
+// connection name, endpoint url, a credential reference and options.
+// The name may be left out for the default connection.
+func ParseOpcuaConnect(args []string) (OpcuaConnectProfile, error) {
+	var p OpcuaConnectProfile
+	if len(args) > 0 && strings.HasPrefix(args[0], "opc.tcp://") {
+		args = append([]string{opcuaDefaultConnection}, args...)
+	}
+	if len(args) < 2 {
+		return p, errors.New("opcua connect needs a name and an endpoint")
+	}
+	if !opcuaNameRegexp.MatchString(args[0]) {
+		return p, fmt.Errorf("invalid connection name %s", args[0])
+	}
+	if !strings.HasPrefix(args[1], "opc.tcp://") {
+		return p, fmt.Errorf("invalid endpoint %s, expect opc.tcp://host:port", args[1])
+	}
+	p = OpcuaConnectProfile{Name: args[0], Endpoint: args[1], Policy: "best",
+		CertFile: "./pki/client.crt", KeyFile: "./pki/client.key"}
+	for _, arg := range args[2:] {
+		if isCredentialRef(arg) {
+			p.Credential = strings.TrimPrefix(arg, credRefPrefix)
+			continue
+		}
+		k, v, found := strings.Cut(arg, "=")
+		if !found {
+			return p, fmt.Errorf("invalid option %s", arg)
+		}
+		switch k {
+		case "user":
+			p.Username = v
+		case "password":
+			p.Password = v
+		case "policy":
+			if _, ok := opcuaSecurityPolicies[strings.ToLower(v)]; !ok {
+				return p, fmt.Errorf("invalid security policy %s", v)
+			}
+			p.Policy = v
+		case "cert":
+			p.CertFile = v
+		case "key":
+			p.KeyFile = v
+		case "ca":
+			p.CAFile = v
+		case "insecure":
+			insecure, err := strconv.ParseBool(v)
+			if err != nil {
+				return p, fmt.Errorf("invalid option %s", arg)
+			}
+			p.Insecure = insecure
+		default:
+			return p, fmt.Errorf("unknown option %s", k)
+		}
+	}
+	return p, p.checkIdentity()
+}
+
+// checkIdentity checks that the user name and password of p are sent to
+// a server whose certificate is checked against ca, unless insecure is
+// set.
+func (p *OpcuaConnectProfile) checkIdentity() error {
+	if p.Credential == "" && p.Username == "" || p.Insecure {
+		return nil
+	}
+	if p.CAFile == "" || strings.EqualFold(p.Policy, "none") {
+		return fmt.Errorf("connection %s sends credentials, it needs ca= and a secure policy, or insecure=true", p.Name)
+	}
+	return nil
+}
+
+// clientOptions makes the client options of profile p.
+func (p *OpcuaConnectProfile) clientOptions() ([]client.Option, error) {
+	err := p.checkIdentity()
+	if err != nil {
+		return nil, err
+	}
+	opts := []client.Option{
+		client.WithClientCertificateFile(p.CertFile, p.KeyFile),
+		client.WithSecurityPolicyURI(opcuaSecurityPolicies[strings.ToLower(p.Policy)]),
+		client.WithSessionName(QC.Name + ":" + p.Name),
+	}
+	if p.CAFile != "" {
+		opts = append(opts, client.WithTrustedCertificatesFile(p.CAFile))
+	} else {
+		opts = append(opts, client.WithInsecureSkipVerify())
+	}
+	username, password := p.Username, p.Password
+	if p.Credential != "" {
+		username, password, err = resolveCredential(p.Credential, p.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if username != "" {
+		opts = append(opts, client.WithUserNameIdentity(username, password))
+	}
+	return opts, nil
+}
+
+// splitOpcuaName returns the connection name leading args and the rest
+// of args. Node ids and numbers are not names.
+func splitOpcuaName(args []string) (string, []string) {
+	if len(args) > 0 && opcuaNameRegexp.MatchString(args[0]) {
+		return args[0], args[1:]
+	}
+	return opcuaDefaultConnection, args
+}
+
+// OpcuaConnect makes the connection of profile p, replacing a connection
+// of the same name. When the server is not reachable the connection is
+// retried in the background.
+func OpcuaConnect(p OpcuaConnectProfile) error {
+	opts, err := p.clientOptions()
+	if err != nil {
+		return err
+	}
+	c := &opcuaConnection{
+		profile: p,
+		subs:    make(map[uint32]*OpcuaSubscription),
+		items:   make(map[uint32]*OpcuaMonitoredItem),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		since:   time.Now(),
+	}
+	_ = OpcuaDisconnect(p.Name)
+	cli := NewOpcuaClient()
+	err = cli.Connect(p.Endpoint, opts...)
+	if err == nil {
+		c.client = cli
+	} else {
+		c.err = err.Error()
+	}
+	opcuaClients.Lock()
+	opcuaClients.conns[p.Name] = c
+	opcuaClients.Unlock()
+	go c.run()
+	return err
+}
+
+// OpcuaDisconnect closes the connection name.
+func OpcuaDisconnect(name string) error {
+	opcuaClients.Lock()
+	c := opcuaClients.conns[name]
+	delete(opcuaClients.conns, name)
+	opcuaClients.Unlock()
+	if c == nil {
+		return fmt.Errorf("opcua connection %s not found", name)
+	}
+	close(c.done)
+	if cli := c.getClient(); cli != nil {
+		return cli.Close()
+	}
+	return nil
+}
+
+// getOpcuaConnection returns the connection name.
+func getOpcuaConnection(name string) (*opcuaConnection, error) {
+	opcuaClients.Lock()
+	defer opcuaClients.Unlock()
+	c := opcuaClients.conns[name]
+	if c == nil {
+		return nil, fmt.Errorf("opcua connection %s not found", name)
+	}
+	return c, nil
+}
+
+// getClient returns the client of a connected connection.
+func (c *opcuaConnection) getClient() *OpcuaClient {
+	opcuaClients.Lock()
+	defer opcuaClients.Unlock()
+	return c.client
+}
+
+// connectedClient returns the client or an error when c is not connected.
+func (c *opcuaConnection) connectedClient() (*OpcuaClient, error) {
+	cli := c.getClient()
+	if cli == nil {
+		return nil, fmt.Errorf("opcua connection %s is not connected", c.profile.Name)
+	}
+	return cli, nil
+}
+
+func (c *opcuaConnection) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lost drops the client of c after err.
+func (c *opcuaConnection) lost(cli *OpcuaClient, err error) {
+	opcuaClients.Lock()
+	if c.client != cli {
+		opcuaClients.Unlock()
+		return
+	}
+	c.client = nil
+	c.err = err.Error()
+	c.since = time.Now()
+	opcuaClients.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), cli.timeout)
+	_ = cli.ch.Abort(ctx)
+	cancel()
+	q.Q("opcua connection lost", c.profile.Name, err)
+	syslogerr := SendSyslog(LOG_WARNING, "opcuaclient", "connection "+c.profile.Name+" lost: "+err.Error())
+	if syslogerr != nil {
+		q.Q(syslogerr)
+	}
+}
+
+// reconnect makes a new session and restores the subscriptions.
+func (c *opcuaConnection) reconnect() error {
+	opts, err := c.profile.clientOptions()
+	if err != nil {
+		return err
+	}
+	cli := NewOpcuaClient()
+	err = cli.Connect(c.profile.Endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	opcuaClients.Lock()
+	subs := make([]*OpcuaSubscription, 0, len(c.subs))
+	for _, s := range c.subs {
+		subs = append(subs, s)
+	}
+	opcuaClients.Unlock()
+	transferred := c.transfer(cli, subs)
+	for _, s := range subs {
+		if transferred[s.ID] {
+			continue
+		}
+		err = c.createSubscription(cli, s)
+		if err != nil {
+			_ = cli.Close()
+			return err
+		}
+	}
+	opcuaClients.Lock()
+	c.client = cli
+	c.err = ""
+	c.since = time.Now()
+	opcuaClients.Unlock()
+	q.Q("opcua reconnected", c.profile.Name, len(subs), len(transferred))
+	return nil
+}
+
+// transfer moves subs to the session of cli, returning the ids of the
+// subscriptions which were transferred.
+func (c *opcuaConnection) transfer(cli *OpcuaClient, subs []*OpcuaSubscription) map[uint32]bool {
+	transferred := make(map[uint32]bool)
+	if len(subs) == 0 {
+		return transferred
+	}
+	req := &ua.TransferSubscriptionsRequest{SendInitialValues: true}
+	for _, s := range subs {
+		req.SubscriptionIDs = append(req.SubscriptionIDs, s.serverID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cli.timeout)
+	defer cancel()
+	res, err := cli.ch.TransferSubscriptions(ctx, req)
+	if err != nil {
+		q.Q("opcua transfer subscriptions", c.profile.Name, err)
+		return transferred
+	}
+	for i, r := range res.Results {
+		if i < len(subs) && r.StatusCode.IsGood() {
+			transferred[subs[i].ID] = true
+		}
+	}
+	return transferred
+}
+
+// createSubscription creates s and its items on the session of cli.
+func (c *opcuaConnection) createSubscription(cli *OpcuaClient, s *OpcuaSubscription) error {
+	// keep alive within opcuaKeepAlive
+	keepAlive := uint32(float64(opcuaKeepAlive/time.Millisecond) / s.PublishingInterval)
+	if keepAlive < 1 {
+		keepAlive = 1
+	}
+	res, err := cli.CreateSubscription(&ua.CreateSubscriptionRequest{
+		RequestedPublishingInterval: s.PublishingInterval,
+		RequestedMaxKeepAliveCount:  keepAlive,
+		RequestedLifetimeCount:      keepAlive * 3,
+		PublishingEnabled:           true,
+	})
+	if err != nil {
+		return err
+	}
+	opcuaClients.Lock()
+	s.serverID = res.SubscriptionID
+	items := append([]*OpcuaMonitoredItem(nil), s.Items...)
+	opcuaClients.Unlock()
+	return c.createItems(cli, s, items)
+}
+
+// createItems creates items of subscription s on the session of cli.
+func (c *opcuaConnection) createItems(cli *OpcuaClient, s *OpcuaSubscription, items []*OpcuaMonitoredItem) error {
+	var filter ua.ExtensionObject
+	if s.Deadband > 0 {
+		deadbandType := ua.DeadbandTypeAbsolute
+		if s.DeadbandType == "percent" {
+			deadbandType = ua.DeadbandTypePercent
+		}
+		filter = ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue,
+			DeadbandType: uint32(deadbandType), DeadbandValue: s.Deadband}
+	}
+	req := &ua.CreateMonitoredItemsRequest{
+		SubscriptionID:     s.serverID,
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	}
+	for _, item := range items {
+		req.ItemsToCreate = append(req.ItemsToCreate, ua.MonitoredItemCreateRequest{
+			ItemToMonitor:  ua.ReadValueID{AttributeID: ua.AttributeIDValue, NodeID: ua.ParseNodeID(item.NodeID)},
+			MonitoringMode: ua.MonitoringModeReporting,
+			RequestedParameters: ua.MonitoringParameters{
+				ClientHandle: item.ID, SamplingInterval: s.SamplingInterval, Filter: filter,
+				QueueSize: s.QueueSize, DiscardOldest: true,
+			},
+		})
+	}
+	res, err := cli.CreateMonitoredItems(req)
+	if err != nil {
+		return err
+	}
+	opcuaClients.Lock()
+	defer opcuaClients.Unlock()
+	for i, r := range res.Results {
+		if i >= len(items) {
+			break
+		}
+		if !r.StatusCode.IsGood() {
+			items[i].Status = r.StatusCode.Error()
+			continue
+		}
+		items[i].serverID = r.MonitoredItemID
+		items[i].Status = ""
+	}
+	return nil
+}
+
+// run publishes while c has subscriptions and reconnects lost sessions.
+func (c *opcuaConnection) run() {
+	backoff := time.Second
+	var acks []ua.SubscriptionAcknowledgement
+	for !c.closed() {
+		cli := c.getClient()
+		if cli == nil {
+			err := c.reconnect()
+			if err != nil {
+				opcuaClients.Lock()
+				c.err = err.Error()
+				opcuaClients.Unlock()
+				select {
+				case <-c.done:
+				case <-time.After(backoff):
+				}
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			acks = nil
+			continue
+		}
+		opcuaClients.Lock()
+		n := len(c.subs)
+		opcuaClients.Unlock()
+		if n == 0 {
+			select {
+			case <-c.done:
+			case <-c.wake:
+			case <-time.After(opcuaKeepAlive):
+				// check the session while nothing is published
+				_, err := cli.ReadVariableAttributes(ua.VariableIDServerServerStatusState)
+				if err != nil && !c.closed() {
+					c.lost(cli, err)
+				}
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*opcuaKeepAlive)
+		res, err := cli.ch.Publish(ctx, &ua.PublishRequest{
+			RequestHeader:                ua.RequestHeader{TimeoutHint: uint32(3 * opcuaKeepAlive / time.Millisecond)},
+			SubscriptionAcknowledgements: acks,
+		})
+		cancel()
+		acks = nil
+		if c.closed() {
+			return
+		}
+		if err != nil {
+			if err == ua.BadNoSubscription || err == ua.BadTooManyPublishRequests {
+				continue
+			}
+			c.lost(cli, err)
+			continue
+		}
+		if len(res.NotificationMessage.NotificationData) > 0 {
+			acks = []ua.SubscriptionAcknowledgement{{SubscriptionID: res.SubscriptionID,
+				SequenceNumber: res.NotificationMessage.SequenceNumber}}
+		}
+		c.dispatch(res)
+	}
+}
+
+// dispatch turns the data changes of res into events.
+func (c *opcuaConnection) dispatch(res *ua.PublishResponse) {
+	changes := []OpcuaDataChange{}
+	opcuaClients.Lock()
+	var sub *OpcuaSubscription
+	for _, s := range c.subs {
+		if s.serverID == res.SubscriptionID {
+			sub = s
+		}
+	}
+	for _, data := range res.NotificationMessage.NotificationData {
+		body, ok := data.(ua.DataChangeNotification)
+		if !ok || sub == nil {
+			continue
+		}
+		for _, z := range body.MonitoredItems {
+			item := c.items[z.ClientHandle]
+			if item == nil {
+				continue
+			}
+			item.Value = z.Value.Value
+			status := "Good"
+			item.Status = ""
+			if !z.Value.StatusCode.IsGood() {
+				status = z.Value.StatusCode.Error()
+				item.Status = status
+			}
+			item.Changes++
+			changes = append(changes, OpcuaDataChange{
+				Time:         time.Now(),
+				Connection:   c.profile.Name,
+				Subscription: sub.ID,
+				Item:         item.ID,
+				NodeID:       item.NodeID,
+				Value:        z.Value.Value,
+				Status:       status,
+				SourceTime:   z.Value.SourceTimestamp,
+			})
+		}
+	}
+	opcuaClients.Unlock()
+	for _, e := range changes {
+		onOpcuaDataChange(e)
+	}
+}
+
+// onOpcuaDataChange keeps data change e, sends it to websocket clients
+// and forwards it to the tags of the opcua bridge.
+func onOpcuaDataChange(e OpcuaDataChange) {
+	opcuaClients.Lock()
+	opcuaClients.changes = append(opcuaClients.changes, e)
+	if n := len(opcuaClients.changes); n > opcuaDataChangesMax {
+		opcuaClients.changes = append([]OpcuaDataChange(nil), opcuaClients.changes[n-opcuaDataChangesMax:]...)
+	}
+	opcuaClients.Unlock()
+	PublishWebSocketMessage(WebSocketMessage{
+		Kind:    "opcua",
+		Topic:   WebSocketTopicOpcua,
+		Level:   LOG_INFO,
+		Message: fmt.Sprintf("%s %s: %v", e.Connection, e.NodeID, e.Value),
+		Data:    e,
+	})
+	bridgeOpcuaDataChange(e)
+}
+
+// GetOpcuaDataChanges returns the kept data changes, oldest first.
+func GetOpcuaDataChanges() []OpcuaDataChange {
+	opcuaClients.Lock()
+	defer opcuaClients.Unlock()
+	changes := make([]OpcuaDataChange, len(opcuaClients.changes))
+	copy(changes, opcuaClients.changes)
+	return changes
+}
+
+// HandleOpcuaEvents handles opcua data change requests
+//
+// GET /api/v1/opcua/events
+//
+//	returns the last 1000 data changes of the opcua client
+//	subscriptions, oldest first
+func HandleOpcuaEvents(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(GetOpcuaDataChanges())
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// ParseOpcuaSubscription parses the node ids and options of opcua sub.
+func ParseOpcuaSubscription(args []string) (*OpcuaSubscription, error) {
+	s := &OpcuaSubscription{PublishingInterval: 1000, SamplingInterval: 500, QueueSize: 1}
+	for _, arg := range args {
+		k, v, _ := strings.Cut(arg, "=")
+		var err error
+		switch k {
+		case "interval":
+			s.PublishingInterval, err = strconv.ParseFloat(v, 64)
+			if err == nil && s.PublishingInterval <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "sampling":
+			s.SamplingInterval, err = strconv.ParseFloat(v, 64)
+			if err == nil && s.SamplingInterval < 0 {
+				err = errors.New("must not be negative")
+			}
+		case "queue":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			s.QueueSize = uint32(n)
+		case "deadband":
+			s.Deadband, err = strconv.ParseFloat(v, 64)
+			if err == nil && s.Deadband < 0 {
+				err = errors.New("must not be negative")
+			}
+			if s.DeadbandType == "" {
+				s.DeadbandType = "absolute"
+			}
+		case "deadbandtype":
+			if v != "absolute" && v != "percent" {
+				err = errors.New("expect absolute or percent")
+			}
+			s.DeadbandType = v
+		default:
+			s.Items = append(s.Items, &OpcuaMonitoredItem{NodeID: arg})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("option %s: %v", k, err)
+		}
+	}
+	if len(s.Items) == 0 {
+		return nil, errors.New("no node to monitor")
+	}
+	return s, nil
+}
+
+// OpcuaSubscribe creates subscription s on connection name and returns
+// its id.
+func OpcuaSubscribe(name string, s *OpcuaSubscription) (uint32, error) {
+	c, err := getOpcuaConnection(name)
+	if err != nil {
+		return 0, err
+	}
+	cli, err := c.connectedClient()
+	if err != nil {
+		return 0, err
+	}
+	opcuaClients.Lock()
+	c.nextSub++
+	s.ID = c.nextSub
+	for _, item := range s.Items {
+		c.nextHandle++
+		item.ID = c.nextHandle
+	}
+	opcuaClients.Unlock()
+	err = c.createSubscription(cli, s)
+	if err != nil {
+		return 0, err
+	}
+	opcuaClients.Lock()
+	c.subs[s.ID] = s
+	for _, item := range s.Items {
+		c.items[item.ID] = item
+	}
+	opcuaClients.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return s.ID, nil
+}
+
+// OpcuaUnsubscribe deletes subscription id of connection name.
+func OpcuaUnsubscribe(name string, id uint32) error {
+	c, err := getOpcuaConnection(name)
+	if err != nil {
+		return err
+	}
+	opcuaClients.Lock()
+	s := c.subs[id]
+	delete(c.subs, id)
+	if s != nil {
+		for _, item := range s.Items {
+			delete(c.items, item.ID)
+		}
+	}
+	opcuaClients.Unlock()
+	if s == nil {
+		return fmt.Errorf("subscription %d not found", id)
+	}
+	cli := c.getClient()
+	if cli == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cli.timeout)
+	defer cancel()
+	_, err = cli.ch.DeleteSubscriptions(ctx, &ua.DeleteSubscriptionsRequest{SubscriptionIDs: []uint32{s.serverID}})
+	return err
+}
+
+// OpcuaDeleteItem deletes monitored item of subscription id of
+// connection name. The subscription is deleted with its last item.
+func OpcuaDeleteItem(name string, id, item uint32) error {
+	c, err := getOpcuaConnection(name)
+	if err != nil {
+		return err
+	}
+	opcuaClients.Lock()
+	s := c.subs[id]
+	var found *OpcuaMonitoredItem
+	if s != nil {
+		for i, it := range s.Items {
+			if it.ID == item {
+				found = it
+				s.Items = append(s.Items[:i:i], s.Items[i+1:]...)
+				delete(c.items, item)
+				break
+			}
+		}
+	}
+	last := s != nil && len(s.Items) == 0
+	opcuaClients.Unlock()
+	if s == nil {
+		return fmt.Errorf("subscription %d not found", id)
+	}
+	if found == nil {
+		return fmt.Errorf("monitored item %d not found", item)
+	}
+	if last {
+		return OpcuaUnsubscribe(name, id)
+	}
+	cli := c.getClient()
+	if cli == nil {
+		return nil
+	}
+	res, err := cli.DeleteMonitoredItems(&ua.DeleteMonitoredItemsRequest{SubscriptionID: s.serverID,
+		MonitoredItemIDs: []uint32{found.serverID}})
+	if err != nil {
+		return err
+	}
+	for _, r := range res.Results {
+		if !r.IsGood() {
+			return r
+		}
+	}
+	return nil
+}
+
+// GetOpcuaClients returns the status of the client connections.
+func GetOpcuaClients() []OpcuaClientStatus {
+	opcuaClients.Lock()
+	defer opcuaClients.Unlock()
+	ret := []OpcuaClientStatus{}
+	for _, c := range opcuaClients.conns {
+		s := OpcuaClientStatus{OpcuaConnectProfile: c.profile, Status: OpcuaStatusConnecting,
+			Error: c.err, Subscriptions: []OpcuaSubscription{}}
+		if c.client != nil {
+			s.Status = OpcuaStatusConnected
+		} else if c.closed() {
+			s.Status = OpcuaStatusDisconnected
+		}
+		if !c.since.IsZero() {
+			s.Since = c.since.Format(time.RFC3339)
+		}
+		for _, sub := range c.subs {
+			copied := *sub
+			copied.Items = make([]*OpcuaMonitoredItem, len(sub.Items))
+			for i, item := range sub.Items {
+				it := *item
+				copied.Items[i] = &it
+			}
+			s.Subscriptions = append(s.Subscriptions, copied)
+		}
+		sort.Slice(s.Subscriptions, func(i, j int) bool { return s.Subscriptions[i].ID < s.Subscriptions[j].ID })
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
@@ -0,0 +1,148 @@
+package mnms
+
+import (
+	"testing"
+	"time"
+
+	opcuaserver "github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+)
+
+// TestOpcuaClients tests named connections, subscriptions with several
+// items and deadband, and restoring subscriptions after a reconnect
+func TestOpcuaClients(t *testing.T) {
+	opcuaTestDir(t)
+	// plc1 logs in anonymously
+	s, endpointURL := startOpcuaTestServer(t, nil, opcuaserver.WithAnonymousIdentity(true))
+	setValue := func(v float32) {
+		t.Helper()
+		n, ok := s.srv.NamespaceManager().FindVariable(ua.ParseNodeID("i=1002"))
+		if !ok {
+			t.Fatal("no temperature node")
+		}
+		now := time.Now()
+		n.SetValue(ua.NewDataValue(v, 0, now, 0, now, 0))
+	}
+	expect := func(conn string, want float32) OpcuaDataChange {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, e := range GetOpcuaDataChanges() {
+				if e.Connection == conn && e.NodeID == "i=1002" && e.Value == want {
+					return e
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("no data change of %s to %v", conn, want)
+		return OpcuaDataChange{}
+	}
+
+	if _, err := ParseOpcuaConnect([]string{"plc 1", endpointURL}); err == nil {
+		t.Fatal("expect invalid name to fail")
+	}
+	if _, err := ParseOpcuaConnect([]string{"plc1", endpointURL, "policy=rot13"}); err == nil {
+		t.Fatal("expect invalid policy to fail")
+	}
+	// credentials go to verified servers only
+	for _, args := range [][]string{
+		{"plc1", endpointURL, "user=admin", "password=secret"},
+		{"plc1", endpointURL, "@cred:plc"},
+		{"plc1", endpointURL, "@cred:plc", "ca=./pki/ca.crt", "policy=none"},
+	} {
+		if _, err := ParseOpcuaConnect(args); err == nil {
+			t.Fatal("expect credentials without a verified server to fail", args)
+		}
+	}
+	if _, err := ParseOpcuaConnect([]string{"plc1", endpointURL, "@cred:plc", "ca=./pki/ca.crt"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"plc1", endpointURL, "policy=none"},
+		{"plc2", endpointURL, "policy=none", "user=admin", "password=" + AdminDefaultPassword, "insecure=true"},
+	} {
+		p, err := ParseOpcuaConnect(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = OpcuaConnect(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func(name string) {
+			_ = OpcuaDisconnect(name)
+		}(p.Name)
+	}
+
+	cmdinfo := OpcuaSubscribeCmd(&CmdInfo{Command: "opcua sub plc1 i=1002 i=1003 interval=100 sampling=50 queue=5"})
+	if cmdinfo.Status != "ok" || cmdinfo.Result != "SubscriptionID:1,MonitoredItemID:1,2" {
+		t.Fatal("unexpected subscription", cmdinfo.Status, cmdinfo.Result)
+	}
+	cmdinfo = OpcuaSubscribeCmd(&CmdInfo{Command: "opcua sub plc2 i=1002 interval=100 sampling=50 deadband=5"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	if cmdinfo = OpcuaSubscribeCmd(&CmdInfo{Command: "opcua sub plc3 i=1002"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect unknown connection to fail")
+	}
+	expect("plc1", 0.5)
+	expect("plc2", 0.5)
+	setValue(1)
+	e := expect("plc1", 1)
+	if e.Subscription != 1 || e.Item != 1 || e.Status != "Good" {
+		t.Fatal("unexpected data change", e)
+	}
+	setValue(10)
+	expect("plc2", 10)
+	for _, e := range GetOpcuaDataChanges() {
+		if e.Connection == "plc2" && e.Value == float32(1) {
+			t.Fatal("expect change within deadband to be dropped")
+		}
+	}
+
+	// restart the server, the subscriptions are made again
+	_ = s.OpcuaShutdown()
+	if s, _ = serveOpcuaTestServer(t, endpointURL, nil, opcuaserver.WithAnonymousIdentity(true)); s == nil {
+		t.Fatal("expect server to restart")
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	connected := func() bool {
+		for _, c := range GetOpcuaClients() {
+			if c.Name == "plc1" {
+				return c.Status == OpcuaStatusConnected && c.Since != "" && c.Error == ""
+			}
+		}
+		return false
+	}
+	time.Sleep(500 * time.Millisecond)
+	for !connected() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !connected() {
+		t.Fatal("expect plc1 to reconnect", GetOpcuaClients())
+	}
+	setValue(20)
+	if e = expect("plc1", 20); e.Subscription != 1 || e.Item != 1 {
+		t.Fatal("expect subscription ids to be kept", e)
+	}
+
+	cmdinfo = OpcuDeleteSubscribeCmd(&CmdInfo{Command: "opcua deletesub plc1 1 2"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	clients := GetOpcuaClients()
+	if len(clients) != 2 || len(clients[0].Subscriptions) != 1 || len(clients[0].Subscriptions[0].Items) != 1 {
+		t.Fatal("expect one item left", clients)
+	}
+	cmdinfo = OpcuaUnsubscribeCmd(&CmdInfo{Command: "opcua unsub plc1 1"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	cmdinfo = OpcuCloseCmd(&CmdInfo{Command: "opcua close plc1"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	if clients = GetOpcuaClients(); len(clients) != 1 || clients[0].Name != "plc2" {
+		t.Fatal("expect plc2 left", clients)
+	}
+}
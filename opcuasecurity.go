@@ -0,0 +1,420 @@
+package mnms
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	opcuaserver "github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+	"github.com/qeof/q"
+)
+
+/*
+	OPC UA server security.
+
+	Sessions log in anonymously, when opcua.anonymous is set, or with the
+	name and password of an mnms user whose role has opcua:read. The mnms
+	role is mapped to the well known OPC UA roles:
+
+		anonymous      Anonymous        browse, read, events
+		opcua:read     Observer         browse, read, history, events
+		opcua:write    Operator         also write and call methods
+
+	The server offers Basic256Sha256 and the other sign and encrypt
+	policies, and SecurityPolicyNone when opcua.securityNone is set.
+
+	Client certificates are kept under ./pki, trusted in ./pki/trusted
+	and rejected in ./pki/rejected, named by their SHA1 thumbprint. The
+	trusted certificates are also written to ./pki/trusted.pem, which the
+	stack verifies the certificate of each secure channel against, so a
+	client is admitted only with the very certificate that was trusted,
+	or one issued by a trusted CA. The server certificate is always in
+	the list, as the stack falls back to the system roots when it has no
+	root.
+*/
+
+const (
+	PermOpcuaRead  = "opcua:read"
+	PermOpcuaWrite = "opcua:write"
+)
+
+const (
+	OpcuaCertTrusted  = "trusted"
+	OpcuaCertRejected = "rejected"
+)
+
+var opcuaCertDirs = map[string]string{
+	OpcuaCertTrusted:  "./pki/trusted",
+	OpcuaCertRejected: "./pki/rejected",
+}
+
+const opcuaTrustList = "./pki/trusted.pem"
+
+var opcuaThumbprintRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// OpcuaCertificate is a client certificate of the trust store.
+type OpcuaCertificate struct {
+	Thumbprint     string `json:"thumbprint"`
+	Store          string `json:"store"`
+	Subject        string `json:"subject"`
+	ApplicationURI string `json:"applicationUri"`
+	NotAfter       string `json:"notAfter"`
+}
+
+// parseOpcuaCertificate parses a PEM or DER certificate.
+func parseOpcuaCertificate(b []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected pem block %s", block.Type)
+		}
+		b = block.Bytes
+	}
+	return x509.ParseCertificate(b)
+}
+
+// opcuaThumbprint is the SHA1 thumbprint of cert.
+func opcuaThumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// opcuaApplicationURI is the application uri of cert, as the stack
+// takes it.
+func opcuaApplicationURI(cert *x509.Certificate) string {
+	if len(cert.URIs) == 0 {
+		return ""
+	}
+	return cert.URIs[0].String()
+}
+
+// loadOpcuaStore returns the certificates of store by thumbprint.
+func loadOpcuaStore(store string) (map[string]*x509.Certificate, error) {
+	certs := make(map[string]*x509.Certificate)
+	files, err := os.ReadDir(opcuaCertDirs[store])
+	if os.IsNotExist(err) {
+		return certs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".der" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(opcuaCertDirs[store], f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cert, err := parseOpcuaCertificate(b)
+		if err != nil {
+			q.Q("skip certificate", f.Name(), err)
+			continue
+		}
+		certs[opcuaThumbprint(cert)] = cert
+	}
+	return certs, nil
+}
+
+// ListOpcuaCertificates returns the trusted and rejected certificates.
+func ListOpcuaCertificates() ([]OpcuaCertificate, error) {
+	list := []OpcuaCertificate{}
+	for _, store := range []string{OpcuaCertTrusted, OpcuaCertRejected} {
+		certs, err := loadOpcuaStore(store)
+		if err != nil {
+			return nil, err
+		}
+		for thumbprint, cert := range certs {
+			list = append(list, OpcuaCertificate{
+				Thumbprint:     thumbprint,
+				Store:          store,
+				Subject:        cert.Subject.String(),
+				ApplicationURI: opcuaApplicationURI(cert),
+				NotAfter:       cert.NotAfter.Format(time.RFC3339),
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Store != list[j].Store {
+			return list[i].Store > list[j].Store
+		}
+		return list[i].Thumbprint < list[j].Thumbprint
+	})
+	return list, nil
+}
+
+// MoveOpcuaCertificate puts a certificate into store. The certificate is
+// a file to import or the thumbprint of a certificate of the other store.
+func MoveOpcuaCertificate(certificate, store string) (string, error) {
+	if _, ok := opcuaCertDirs[store]; !ok {
+		return "", fmt.Errorf("invalid store %s", store)
+	}
+	var der []byte
+	thumbprint := strings.ToLower(certificate)
+	if opcuaThumbprintRegexp.MatchString(thumbprint) {
+		for other := range opcuaCertDirs {
+			b, err := os.ReadFile(filepath.Join(opcuaCertDirs[other], thumbprint+".der"))
+			if err == nil {
+				der = b
+				break
+			}
+		}
+		if der == nil {
+			return "", fmt.Errorf("certificate %s not exist", thumbprint)
+		}
+	} else {
+		b, err := os.ReadFile(certificate)
+		if err != nil {
+			return "", err
+		}
+		cert, err := parseOpcuaCertificate(b)
+		if err != nil {
+			return "", err
+		}
+		der, thumbprint = cert.Raw, opcuaThumbprint(cert)
+	}
+	err := os.MkdirAll(opcuaCertDirs[store], 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(opcuaCertDirs[store], thumbprint+".der"), der, 0644)
+	if err != nil {
+		return "", err
+	}
+	for other, dir := range opcuaCertDirs {
+		if other != store {
+			err = os.Remove(filepath.Join(dir, thumbprint+".der"))
+			if err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	return thumbprint, writeOpcuaTrustList()
+}
+
+// DeleteOpcuaCertificate removes the certificate with thumbprint from
+// the stores.
+func DeleteOpcuaCertificate(thumbprint string) error {
+	thumbprint = strings.ToLower(thumbprint)
+	if !opcuaThumbprintRegexp.MatchString(thumbprint) {
+		return fmt.Errorf("invalid thumbprint %s", thumbprint)
+	}
+	found := false
+	for _, dir := range opcuaCertDirs {
+		err := os.Remove(filepath.Join(dir, thumbprint+".der"))
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("certificate %s not exist", thumbprint)
+	}
+	return writeOpcuaTrustList()
+}
+
+// writeOpcuaTrustList writes the server certificate and the trusted
+// certificates to the trust list of the stack. Without a server
+// certificate the list is written when the server starts.
+func writeOpcuaTrustList() error {
+	b, err := os.ReadFile("./pki/server.crt")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	trusted, err := loadOpcuaStore(OpcuaCertTrusted)
+	if err != nil {
+		return err
+	}
+	thumbprints := make([]string, 0, len(trusted))
+	for thumbprint := range trusted {
+		thumbprints = append(thumbprints, thumbprint)
+	}
+	sort.Strings(thumbprints)
+	for _, thumbprint := range thumbprints {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trusted[thumbprint].Raw})...)
+	}
+	tmp := opcuaTrustList + ".tmp"
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, opcuaTrustList)
+}
+
+// withOpcuaTrustList makes the stack verify client certificates against
+// the PEM file path. The stack has no option for its trust list, so the
+// field is set directly, failing when a new version of the stack renames
+// it.
+func withOpcuaTrustList(path string) opcuaserver.Option {
+	return func(srv *opcuaserver.Server) error {
+		f := reflect.ValueOf(srv).Elem().FieldByName("trustedCertsPath")
+		if !f.IsValid() || f.Kind() != reflect.String {
+			return errors.New("opcua stack without trusted certificates path")
+		}
+		reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().SetString(path)
+		return nil
+	}
+}
+
+// checkOpcuaApplication checks the client application uri of a session.
+// The stack verified the certificate of a secure channel already, only
+// sessions on SecurityPolicyNone have no uri.
+func checkOpcuaApplication(applicationURI string) error {
+	if applicationURI == "" && !QC.OpcuaSecurityNone {
+		return errors.New("client certificate without application uri")
+	}
+	return nil
+}
+
+// authenticateOpcuaUser authenticates the mnms user of a session.
+func authenticateOpcuaUser(identity ua.UserNameIdentity, applicationURI, endpointURL string) error {
+	u, err := GetUserConfig(identity.UserName)
+	if err != nil {
+		return ua.BadUserAccessDenied
+	}
+	if u.Enable2FA || len(u.WebAuthn) > 0 {
+		q.Q("opcua login failed, second factor", identity.UserName)
+		return ua.BadUserAccessDenied
+	}
+	u, err = authenticateUser(identity.UserName, identity.Password)
+	if err != nil {
+		q.Q("opcua login failed", identity.UserName, err)
+		return ua.BadUserAccessDenied
+	}
+	role, err := GetRole(u.Role)
+	if err != nil || !role.Allows(PermOpcuaRead) {
+		q.Q("opcua login failed, no permission", identity.UserName)
+		return ua.BadUserAccessDenied
+	}
+	return nil
+}
+
+// opcuaRoles maps the identity of a session to OPC UA roles.
+type opcuaRoles struct{}
+
+// GetRoles returns the roles of a session, failing for sessions without
+// security when the server requires it.
+func (opcuaRoles) GetRoles(identity interface{}, applicationURI string, endpointURL string) ([]ua.NodeID, error) {
+	err := checkOpcuaApplication(applicationURI)
+	if err != nil {
+		q.Q(err)
+		return nil, ua.BadSecurityChecksFailed
+	}
+	switch id := identity.(type) {
+	case ua.AnonymousIdentity:
+		return []ua.NodeID{ua.ObjectIDWellKnownRoleAnonymous}, nil
+	case ua.UserNameIdentity:
+		u, err := GetUserConfig(id.UserName)
+		if err != nil {
+			return nil, ua.BadUserAccessDenied
+		}
+		role, err := GetRole(u.Role)
+		if err != nil {
+			return nil, ua.BadUserAccessDenied
+		}
+		roles := []ua.NodeID{ua.ObjectIDWellKnownRoleAuthenticatedUser}
+		if role.Allows(PermOpcuaRead) {
+			roles = append(roles, ua.ObjectIDWellKnownRoleObserver)
+		}
+		if role.Allows(PermOpcuaWrite) {
+			roles = append(roles, ua.ObjectIDWellKnownRoleOperator)
+		}
+		return roles, nil
+	}
+	return nil, ua.BadUserAccessDenied
+}
+
+// opcuaRolePermissions are the server permissions of the roles.
+var opcuaRolePermissions = []ua.RolePermissionType{
+	{RoleID: ua.ObjectIDWellKnownRoleAnonymous, Permissions: ua.PermissionTypeBrowse | ua.PermissionTypeRead | ua.PermissionTypeReceiveEvents},
+	{RoleID: ua.ObjectIDWellKnownRoleAuthenticatedUser, Permissions: ua.PermissionTypeBrowse},
+	{RoleID: ua.ObjectIDWellKnownRoleObserver, Permissions: ua.PermissionTypeBrowse | ua.PermissionTypeRead | ua.PermissionTypeReadHistory | ua.PermissionTypeReceiveEvents},
+	{RoleID: ua.ObjectIDWellKnownRoleOperator, Permissions: ua.PermissionTypeBrowse | ua.PermissionTypeRead | ua.PermissionTypeReadHistory | ua.PermissionTypeReceiveEvents |
+		ua.PermissionTypeWrite | ua.PermissionTypeCall},
+}
+
+// Manage the client certificates of the opcua server.
+//
+// Usage : opcua cert list
+//
+// Usage : opcua cert trust [file|thumbprint]
+//
+// Usage : opcua cert reject [file|thumbprint]
+//
+//	[file]        : certificate file to import, PEM or DER
+//	[thumbprint]  : SHA1 thumbprint of a certificate of the other store
+//
+// Usage : opcua cert delete [thumbprint]
+//
+// Example :
+//
+//	opcua cert list
+//	opcua cert trust /tmp/scada.der
+//	opcua cert reject 3f1c0a5e2b8d4c6f7a9e0b1d2c3e4f5a6b7c8d9e
+//	opcua cert delete 3f1c0a5e2b8d4c6f7a9e0b1d2c3e4f5a6b7c8d9e
+func OpcuaCertCmd(cmdinfo *CmdInfo) *CmdInfo {
+	ws := strings.Split(cmdinfo.Command, " ")
+	if len(ws) < 3 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	if ws[2] == "list" {
+		list, err := ListOpcuaCertificates()
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Result = string(b)
+		cmdinfo.Status = "ok"
+		return cmdinfo
+	}
+	if len(ws) < 4 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	switch ws[2] {
+	case "trust", "reject":
+		store := OpcuaCertTrusted
+		if ws[2] == "reject" {
+			store = OpcuaCertRejected
+		}
+		thumbprint, err := MoveOpcuaCertificate(ws[3], store)
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Result = thumbprint
+	case "delete":
+		err := DeleteOpcuaCertificate(ws[3])
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+	default:
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
@@ -0,0 +1,132 @@
+package mnms
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/awcullen/opcua/client"
+	"github.com/awcullen/opcua/ua"
+)
+
+// TestOpcuaSecurity tests user authentication, secure endpoints and the
+// certificate trust store of the opcua server
+func TestOpcuaSecurity(t *testing.T) {
+	opcuaTestDir(t)
+	QC.OpcuaAnonymous = false
+	QC.OpcuaSecurityNone = false
+	_, endpointURL := startOpcuaTestServer(t, nil)
+
+	c := NewOpcuaClient()
+	eps, err := c.GetEndpoints(&ua.GetEndpointsRequest{EndpointURL: endpointURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure := false
+	for _, ep := range eps.Endpoints {
+		if ep.SecurityMode == ua.MessageSecurityModeNone {
+			t.Fatal("expect no endpoint without security", ep.SecurityPolicyURI)
+		}
+		if ep.SecurityPolicyURI == ua.SecurityPolicyURIBasic256Sha256 && ep.SecurityMode == ua.MessageSecurityModeSignAndEncrypt {
+			secure = true
+		}
+		for _, tok := range ep.UserIdentityTokens {
+			if tok.TokenType == ua.UserTokenTypeAnonymous {
+				t.Fatal("expect no anonymous token policy")
+			}
+		}
+	}
+	if !secure {
+		t.Fatal("expect a Basic256Sha256 sign and encrypt endpoint")
+	}
+
+	connectAs := func(name string, opts ...client.Option) error {
+		opts = append(opts, client.WithInsecureSkipVerify(),
+			client.WithClientCertificateFile("./pki/"+name+".crt", "./pki/"+name+".key"),
+			client.WithSecurityPolicyURI(ua.SecurityPolicyURIBasic256Sha256))
+		c := NewOpcuaClient()
+		err := c.Connect(endpointURL, opts...)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = c.ReadVariableAttributes(ua.VariableIDServerServerStatusState)
+		return err
+	}
+	connect := func(opts ...client.Option) error {
+		return connectAs("client", opts...)
+	}
+	admin := client.WithUserNameIdentity("admin", AdminDefaultPassword)
+	if err = connect(admin); err == nil {
+		t.Fatal("expect untrusted client to fail")
+	}
+	cmdinfo := OpcuaCertCmd(&CmdInfo{Command: "opcua cert trust ./pki/client.crt"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	thumbprint := cmdinfo.Result
+	if err = connect(admin); err != nil {
+		t.Fatal("expect trusted admin to connect", err)
+	}
+	// another certificate with the application uri of the trusted one
+	err = createNewCertificate("test-client", "./pki/impostor.crt", "./pki/impostor.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = connectAs("impostor", admin); err == nil {
+		t.Fatal("expect certificate which is not trusted to fail")
+	}
+	if err = connect(client.WithUserNameIdentity("admin", "wrong")); err == nil {
+		t.Fatal("expect wrong password to fail")
+	}
+	if err = connect(); err == nil {
+		t.Fatal("expect anonymous to fail")
+	}
+
+	cmdinfo = OpcuaCertCmd(&CmdInfo{Command: "opcua cert reject " + thumbprint})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	cmdinfo = OpcuaCertCmd(&CmdInfo{Command: "opcua cert list"})
+	var list []OpcuaCertificate
+	err = json.Unmarshal([]byte(cmdinfo.Result), &list)
+	if err != nil || len(list) != 1 || list[0].Store != OpcuaCertRejected || list[0].Thumbprint != thumbprint {
+		t.Fatal("expect a rejected certificate", cmdinfo.Result, err)
+	}
+	if err = connect(admin); err == nil {
+		t.Fatal("expect rejected client to fail")
+	}
+	cmdinfo = OpcuaCertCmd(&CmdInfo{Command: "opcua cert delete " + thumbprint})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	cmdinfo = OpcuaCertCmd(&CmdInfo{Command: "opcua cert delete " + thumbprint})
+	if cmdinfo.Status == "ok" {
+		t.Fatal("expect deleting twice to fail")
+	}
+}
+
+// TestOpcuaRoles tests mapping mnms roles to opcua roles
+func TestOpcuaRoles(t *testing.T) {
+	restoreSettings(t)
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	QC.OpcuaSecurityNone = true
+	roles, err := opcuaRoles{}.GetRoles(ua.UserNameIdentity{UserName: "admin"}, "", "")
+	if err != nil || len(roles) != 3 || roles[2] != ua.ObjectIDWellKnownRoleOperator {
+		t.Fatal("expect admin to be operator", roles, err)
+	}
+	roles, err = opcuaRoles{}.GetRoles(ua.AnonymousIdentity{}, "", "")
+	if err != nil || len(roles) != 1 || roles[0] != ua.ObjectIDWellKnownRoleAnonymous {
+		t.Fatal("expect anonymous role", roles, err)
+	}
+	QC.OpcuaSecurityNone = false
+	if _, err = (opcuaRoles{}).GetRoles(ua.AnonymousIdentity{}, "", ""); err == nil {
+		t.Fatal("expect session without certificate to fail")
+	}
+}
@@ -0,0 +1,676 @@
+package mnms
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awcullen/opcua/ua"
+)
+
+/*
+	Typed values of opcua write and opcua call are written as type:value,
+	arrays as type[]:value,value. A value without a known type prefix is
+	converted to the data type of the node by opcua write.
+
+		boolean:true  int32:-5  uint16:7  double:1.5  string:Hello
+		datetime:2023-02-10T14:30:00Z  bytestring:aGVsbG8=  nodeid:ns=2;s=Pump
+		float[]:1.5,2.5
+*/
+
+// opcuaTypes are the value types by name with their data type ids.
+var opcuaTypes = map[string]uint32{
+	"boolean":       1,
+	"sbyte":         2,
+	"byte":          3,
+	"int16":         4,
+	"uint16":        5,
+	"int32":         6,
+	"uint32":        7,
+	"int64":         8,
+	"uint64":        9,
+	"float":         10,
+	"double":        11,
+	"string":        12,
+	"datetime":      13,
+	"bytestring":    15,
+	"nodeid":        17,
+	"localizedtext": 21,
+}
+
+const (
+	opcuaExportDepth    = 5
+	opcuaExportMaxNodes = 5000
+	opcuaHistoryPeriod  = time.Hour
+)
+
+// opcuaAggregates are the aggregate functions of opcua historyread.
+var opcuaAggregates = map[string]ua.NodeID{
+	"interpolative": ua.ObjectIDAggregateFunctionInterpolative,
+	"average":       ua.ObjectIDAggregateFunctionAverage,
+	"timeaverage":   ua.ObjectIDAggregateFunctionTimeAverage,
+	"total":         ua.ObjectIDAggregateFunctionTotal,
+	"minimum":       ua.ObjectIDAggregateFunctionMinimum,
+	"maximum":       ua.ObjectIDAggregateFunctionMaximum,
+	"range":         ua.ObjectIDAggregateFunctionRange,
+	"count":         ua.ObjectIDAggregateFunctionCount,
+	"start":         ua.ObjectIDAggregateFunctionStart,
+	"end":           ua.ObjectIDAggregateFunctionEnd,
+	"delta":         ua.ObjectIDAggregateFunctionDelta,
+}
+
+// OpcuaWriteResult is the result of opcua write.
+type OpcuaWriteResult struct {
+	NodeID string `json:"nodeId"`
+	Type   string `json:"type"`
+	Value  any    `json:"value"`
+	Status string `json:"status"`
+}
+
+// OpcuaCallResult is the result of opcua call.
+type OpcuaCallResult struct {
+	ObjectID             string   `json:"objectId"`
+	MethodID             string   `json:"methodId"`
+	Status               string   `json:"status"`
+	InputArgumentResults []string `json:"inputArgumentResults,omitempty"`
+	OutputArguments      []any    `json:"outputArguments"`
+}
+
+// OpcuaHistoryQuery are the options of opcua historyread. With an
+// Aggregate processed values are read, raw values otherwise.
+type OpcuaHistoryQuery struct {
+	NodeIDs   []string
+	Start     time.Time
+	End       time.Time
+	Max       uint32
+	Aggregate string
+	Interval  float64
+}
+
+// OpcuaHistoryValue is a value of the history of a node.
+type OpcuaHistoryValue struct {
+	Time   time.Time `json:"time"`
+	Value  any       `json:"value"`
+	Status string    `json:"status"`
+}
+
+// OpcuaHistoryResult is the history of a node.
+type OpcuaHistoryResult struct {
+	NodeID string              `json:"nodeId"`
+	Status string              `json:"status"`
+	Values []OpcuaHistoryValue `json:"values"`
+}
+
+// OpcuaNode is a node of an exported subtree.
+type OpcuaNode struct {
+	NodeID         string       `json:"nodeId"`
+	BrowseName     string       `json:"browseName"`
+	DisplayName    string       `json:"displayName"`
+	NodeClass      string       `json:"nodeClass"`
+	ReferenceType  string       `json:"referenceType,omitempty"`
+	TypeDefinition string       `json:"typeDefinition,omitempty"`
+	DataType       string       `json:"dataType,omitempty"`
+	Value          any          `json:"value,omitempty"`
+	Children       []*OpcuaNode `json:"children,omitempty"`
+}
+
+// opcuaStatus is the text of status code c.
+func opcuaStatus(c ua.StatusCode) string {
+	if c.IsGood() {
+		return "Good"
+	}
+	return c.Error()
+}
+
+// parseOpcuaNodeID parses node id s.
+func parseOpcuaNodeID(s string) (ua.NodeID, error) {
+	id := ua.ParseNodeID(s)
+	if id == nil {
+		return nil, fmt.Errorf("invalid node id %q", s)
+	}
+	return id, nil
+}
+
+// opcuaTypeName is the type name of data type id, empty when it is not
+// a built-in type.
+func opcuaTypeName(id ua.NodeID) string {
+	n, ok := id.(ua.NodeIDNumeric)
+	if !ok || n.NamespaceIndex != 0 {
+		return ""
+	}
+	for name, t := range opcuaTypes {
+		if t == n.ID {
+			return name
+		}
+	}
+	return ""
+}
+
+// splitOpcuaTypedValue splits s into type and value, the type is empty
+// when s has no known type prefix.
+func splitOpcuaTypedValue(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", s
+	}
+	typ := strings.ToLower(s[:i])
+	if _, ok := opcuaTypes[strings.TrimSuffix(typ, "[]")]; !ok {
+		return "", s
+	}
+	return typ, s[i+1:]
+}
+
+// ParseOpcuaTypedValue parses s written as type:value.
+func ParseOpcuaTypedValue(s string) (any, error) {
+	typ, v := splitOpcuaTypedValue(s)
+	if typ == "" {
+		return nil, fmt.Errorf("%q needs a type, e.g. double:1.5", s)
+	}
+	return ParseOpcuaValue(typ, v)
+}
+
+// ParseOpcuaValue parses s as a value of type typ, typ[] parses comma
+// separated values as an array.
+func ParseOpcuaValue(typ, s string) (any, error) {
+	typ = strings.ToLower(typ)
+	if strings.HasSuffix(typ, "[]") {
+		return parseOpcuaArray(strings.TrimSuffix(typ, "[]"), s)
+	}
+	bits := map[string]int{"sbyte": 8, "byte": 8, "int16": 16, "uint16": 16,
+		"int32": 32, "uint32": 32, "int64": 64, "uint64": 64, "float": 32, "double": 64}
+	var v any
+	var err error
+	switch typ {
+	case "boolean":
+		v, err = strconv.ParseBool(s)
+	case "sbyte", "int16", "int32", "int64":
+		var i int64
+		i, err = strconv.ParseInt(s, 0, bits[typ])
+		switch typ {
+		case "sbyte":
+			v = int8(i)
+		case "int16":
+			v = int16(i)
+		case "int32":
+			v = int32(i)
+		default:
+			v = i
+		}
+	case "byte", "uint16", "uint32", "uint64":
+		var u uint64
+		u, err = strconv.ParseUint(s, 0, bits[typ])
+		switch typ {
+		case "byte":
+			v = uint8(u)
+		case "uint16":
+			v = uint16(u)
+		case "uint32":
+			v = uint32(u)
+		default:
+			v = u
+		}
+	case "float", "double":
+		var f float64
+		f, err = strconv.ParseFloat(s, bits[typ])
+		if typ == "float" {
+			v = float32(f)
+		} else {
+			v = f
+		}
+	case "string":
+		v = s
+	case "datetime":
+		v, err = time.Parse(time.RFC3339, s)
+	case "bytestring":
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(s)
+		v = ua.ByteString(b)
+	case "nodeid":
+		v, err = parseOpcuaNodeID(s)
+	case "localizedtext":
+		v = ua.NewLocalizedText(s, "")
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", typ, s)
+	}
+	return v, nil
+}
+
+// parseOpcuaArray parses comma separated values of type typ.
+func parseOpcuaArray(typ, s string) (any, error) {
+	ws := []string{}
+	if s != "" {
+		ws = strings.Split(s, ",")
+	}
+	values := make([]any, len(ws))
+	for i, w := range ws {
+		v, err := ParseOpcuaValue(typ, w)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	switch typ {
+	case "boolean":
+		return opcuaArray[bool](values), nil
+	case "sbyte":
+		return opcuaArray[int8](values), nil
+	case "byte":
+		return opcuaArray[uint8](values), nil
+	case "int16":
+		return opcuaArray[int16](values), nil
+	case "uint16":
+		return opcuaArray[uint16](values), nil
+	case "int32":
+		return opcuaArray[int32](values), nil
+	case "uint32":
+		return opcuaArray[uint32](values), nil
+	case "int64":
+		return opcuaArray[int64](values), nil
+	case "uint64":
+		return opcuaArray[uint64](values), nil
+	case "float":
+		return opcuaArray[float32](values), nil
+	case "double":
+		return opcuaArray[float64](values), nil
+	case "string":
+		return opcuaArray[string](values), nil
+	case "datetime":
+		return opcuaArray[time.Time](values), nil
+	case "bytestring":
+		return opcuaArray[ua.ByteString](values), nil
+	case "nodeid":
+		return opcuaArray[ua.NodeID](values), nil
+	case "localizedtext":
+		return opcuaArray[ua.LocalizedText](values), nil
+	}
+	return nil, fmt.Errorf("unknown type %s", typ)
+}
+
+// opcuaArray converts values to a typed slice, the encoder needs one.
+func opcuaArray[T any](values []any) []T {
+	a := make([]T, len(values))
+	for i, v := range values {
+		a[i] = v.(T)
+	}
+	return a
+}
+
+// OpcuaWrite writes value s to the node id. Without a type prefix the
+// data type of the node is read first.
+func OpcuaWrite(cli *OpcuaClient, nodeID, s string) (OpcuaWriteResult, error) {
+	id, err := parseOpcuaNodeID(nodeID)
+	if err != nil {
+		return OpcuaWriteResult{}, err
+	}
+	typ, v := splitOpcuaTypedValue(s)
+	if typ == "" {
+		attrs, err := cli.ReadVariableAttributes(id)
+		if err != nil {
+			return OpcuaWriteResult{}, err
+		}
+		typ = opcuaTypeName(attrs.DataType)
+		if typ == "" {
+			return OpcuaWriteResult{}, fmt.Errorf("unknown data type %v of %s, give the type as type:value", attrs.DataType, nodeID)
+		}
+		if attrs.ValueRank > 0 {
+			typ += "[]"
+		}
+	}
+	value, err := ParseOpcuaValue(typ, v)
+	if err != nil {
+		return OpcuaWriteResult{}, err
+	}
+	res, err := cli.WriteNodeID(&ua.WriteRequest{
+		NodesToWrite: []ua.WriteValue{
+			{
+				NodeID:      id,
+				AttributeID: ua.AttributeIDValue,
+				Value:       ua.NewDataValue(value, 0, time.Time{}, 0, time.Time{}, 0),
+			},
+		},
+	})
+	if err != nil {
+		return OpcuaWriteResult{}, err
+	}
+	if len(res.Results) != 1 {
+		return OpcuaWriteResult{}, fmt.Errorf("no write result")
+	}
+	return OpcuaWriteResult{NodeID: nodeID, Type: typ, Value: value, Status: opcuaStatus(res.Results[0])}, nil
+}
+
+// OpcuaCall calls method of object with the arguments written as
+// type:value.
+func OpcuaCall(cli *OpcuaClient, objectID, methodID string, args []string) (OpcuaCallResult, error) {
+	object, err := parseOpcuaNodeID(objectID)
+	if err != nil {
+		return OpcuaCallResult{}, err
+	}
+	method, err := parseOpcuaNodeID(methodID)
+	if err != nil {
+		return OpcuaCallResult{}, err
+	}
+	inputs := make([]ua.Variant, len(args))
+	for i, a := range args {
+		v, err := ParseOpcuaTypedValue(a)
+		if err != nil {
+			return OpcuaCallResult{}, err
+		}
+		inputs[i] = v
+	}
+	res, err := cli.Call(&ua.CallRequest{
+		MethodsToCall: []ua.CallMethodRequest{
+			{
+				ObjectID:       object,
+				MethodID:       method,
+				InputArguments: inputs,
+			},
+		},
+	})
+	if err != nil {
+		return OpcuaCallResult{}, err
+	}
+	if len(res.Results) != 1 {
+		return OpcuaCallResult{}, fmt.Errorf("no call result")
+	}
+	r := res.Results[0]
+	result := OpcuaCallResult{
+		ObjectID:        objectID,
+		MethodID:        methodID,
+		Status:          opcuaStatus(r.StatusCode),
+		OutputArguments: []any{},
+	}
+	for _, c := range r.InputArgumentResults {
+		result.InputArgumentResults = append(result.InputArgumentResults, opcuaStatus(c))
+	}
+	for _, v := range r.OutputArguments {
+		result.OutputArguments = append(result.OutputArguments, v)
+	}
+	return result, nil
+}
+
+// parseOpcuaTime parses s as RFC3339 time or as a duration before now.
+func parseOpcuaTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+// ParseOpcuaHistoryQuery parses the arguments of opcua historyread, node
+// ids and options start, end, max, aggregate and interval.
+func ParseOpcuaHistoryQuery(args []string) (OpcuaHistoryQuery, error) {
+	now := time.Now()
+	h := OpcuaHistoryQuery{Start: now.Add(-opcuaHistoryPeriod), End: now}
+	var err error
+	for _, a := range args {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			h.NodeIDs = append(h.NodeIDs, a)
+			continue
+		}
+		switch k {
+		case "start":
+			h.Start, err = parseOpcuaTime(v, now)
+		case "end":
+			h.End, err = parseOpcuaTime(v, now)
+		case "max":
+			var n uint64
+			n, err = strconv.ParseUint(v, 10, 32)
+			h.Max = uint32(n)
+		case "aggregate":
+			if _, ok := opcuaAggregates[strings.ToLower(v)]; !ok {
+				err = fmt.Errorf("unknown aggregate %s", v)
+			}
+			h.Aggregate = strings.ToLower(v)
+		case "interval":
+			h.Interval, err = strconv.ParseFloat(v, 64)
+			if err == nil && h.Interval <= 0 {
+				err = fmt.Errorf("invalid interval %s", v)
+			}
+		default:
+			// node ids such as ns=2;s=Temperature contain =
+			h.NodeIDs = append(h.NodeIDs, a)
+		}
+		if err != nil {
+			return h, err
+		}
+	}
+	if len(h.NodeIDs) == 0 {
+		return h, fmt.Errorf("no node id")
+	}
+	if !h.End.After(h.Start) {
+		return h, fmt.Errorf("end must be after start")
+	}
+	return h, nil
+}
+
+// OpcuaHistoryRead reads the history of the nodes of query h, following
+// continuation points until all values are read.
+func OpcuaHistoryRead(cli *OpcuaClient, h OpcuaHistoryQuery) ([]OpcuaHistoryResult, error) {
+	var details ua.ExtensionObject = ua.ReadRawModifiedDetails{
+		StartTime:        h.Start,
+		EndTime:          h.End,
+		NumValuesPerNode: h.Max,
+	}
+	if h.Aggregate != "" {
+		interval := h.Interval
+		if interval == 0 {
+			interval = float64(h.End.Sub(h.Start).Milliseconds())
+		}
+		details = ua.ReadProcessedDetails{
+			StartTime:          h.Start,
+			EndTime:            h.End,
+			ProcessingInterval: interval,
+			AggregateType:      []ua.NodeID{opcuaAggregates[h.Aggregate]},
+			AggregateConfiguration: ua.AggregateConfiguration{
+				UseServerCapabilitiesDefaults: true,
+			},
+		}
+	}
+	results := make([]OpcuaHistoryResult, len(h.NodeIDs))
+	nodes := make([]ua.HistoryReadValueID, len(h.NodeIDs))
+	// index of the result of each node read
+	index := make([]int, len(h.NodeIDs))
+	for i, id := range h.NodeIDs {
+		n, err := parseOpcuaNodeID(id)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = OpcuaHistoryResult{NodeID: id, Values: []OpcuaHistoryValue{}}
+		nodes[i] = ua.HistoryReadValueID{NodeID: n}
+		index[i] = i
+	}
+	for len(nodes) > 0 {
+		res, err := cli.HistoryRead(&ua.HistoryReadRequest{
+			HistoryReadDetails: details,
+			TimestampsToReturn: ua.TimestampsToReturnBoth,
+			NodesToRead:        nodes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !res.ResponseHeader.ServiceResult.IsGood() {
+			return nil, res.ResponseHeader.ServiceResult
+		}
+		next, nextIndex := []ua.HistoryReadValueID{}, []int{}
+		for i, r := range res.Results {
+			if i >= len(nodes) {
+				break
+			}
+			result := &results[index[i]]
+			result.Status = opcuaStatus(r.StatusCode)
+			if data, ok := r.HistoryData.(ua.HistoryData); ok {
+				for _, dv := range data.DataValues {
+					t := dv.SourceTimestamp
+					if t.IsZero() {
+						t = dv.ServerTimestamp
+					}
+					result.Values = append(result.Values, OpcuaHistoryValue{Time: t, Value: dv.Value, Status: opcuaStatus(dv.StatusCode)})
+				}
+			}
+			if r.StatusCode.IsGood() && len(r.ContinuationPoint) > 0 {
+				next = append(next, ua.HistoryReadValueID{NodeID: nodes[i].NodeID, ContinuationPoint: r.ContinuationPoint})
+				nextIndex = append(nextIndex, index[i])
+			}
+		}
+		nodes, index = next, nextIndex
+	}
+	return results, nil
+}
+
+// OpcuaExport browses the subtree of hierarchical references under
+// nodeID to depth levels and reads the values of the variables. Nodes
+// reached twice are listed once.
+func OpcuaExport(cli *OpcuaClient, nodeID string, depth, max int) (*OpcuaNode, error) {
+	id, err := parseOpcuaNodeID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := cli.ReadNodeID(&ua.ReadRequest{
+		NodesToRead: []ua.ReadValueID{
+			{NodeID: id, AttributeID: ua.AttributeIDBrowseName},
+			{NodeID: id, AttributeID: ua.AttributeIDDisplayName},
+			{NodeID: id, AttributeID: ua.AttributeIDNodeClass},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Results) != 3 || !res.Results[0].StatusCode.IsGood() {
+		return nil, fmt.Errorf("node %s not found", nodeID)
+	}
+	root := &OpcuaNode{NodeID: fmt.Sprint(id)}
+	if v, ok := res.Results[0].Value.(ua.QualifiedName); ok {
+		root.BrowseName = v.String()
+	}
+	if v, ok := res.Results[1].Value.(ua.LocalizedText); ok {
+		root.DisplayName = v.Text
+	}
+	if v, ok := res.Results[2].Value.(int32); ok {
+		root.NodeClass = ua.NodeClass(v).String()
+	}
+	seen := map[string]bool{root.NodeID: true}
+	level := []*OpcuaNode{root}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		refs, err := opcuaBrowseAll(cli, level)
+		if err != nil {
+			return nil, err
+		}
+		next := []*OpcuaNode{}
+		for i, parent := range level {
+			for _, r := range refs[i] {
+				child := &OpcuaNode{
+					NodeID:        fmt.Sprint(ua.ToNodeID(r.NodeID, nil)),
+					BrowseName:    r.BrowseName.String(),
+					DisplayName:   r.DisplayName.Text,
+					NodeClass:     r.NodeClass.String(),
+					ReferenceType: fmt.Sprint(r.ReferenceTypeID),
+				}
+				if r.TypeDefinition.NodeID != nil {
+					child.TypeDefinition = fmt.Sprint(ua.ToNodeID(r.TypeDefinition, nil))
+				}
+				if seen[child.NodeID] {
+					continue
+				}
+				seen[child.NodeID] = true
+				if len(seen) > max {
+					return nil, fmt.Errorf("more than %d nodes, reduce depth", max)
+				}
+				parent.Children = append(parent.Children, child)
+				next = append(next, child)
+			}
+		}
+		err = opcuaReadValues(cli, next)
+		if err != nil {
+			return nil, err
+		}
+		level = next
+	}
+	return root, nil
+}
+
+// opcuaBrowseAll browses the hierarchical references of nodes, following
+// continuation points.
+func opcuaBrowseAll(cli *OpcuaClient, nodes []*OpcuaNode) ([][]ua.ReferenceDescription, error) {
+	refs := make([][]ua.ReferenceDescription, len(nodes))
+	req := &ua.BrowseRequest{}
+	for _, n := range nodes {
+		req.NodesToBrowse = append(req.NodesToBrowse, ua.BrowseDescription{
+			NodeID:          ua.ParseNodeID(n.NodeID),
+			BrowseDirection: ua.BrowseDirectionForward,
+			ReferenceTypeID: ua.ReferenceTypeIDHierarchicalReferences,
+			IncludeSubtypes: true,
+			ResultMask:      uint32(ua.BrowseResultMaskAll),
+		})
+	}
+	res, err := cli.Browse(req)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range res.Results {
+		if i >= len(refs) || !r.StatusCode.IsGood() {
+			continue
+		}
+		refs[i] = append(refs[i], r.References...)
+		cp := r.ContinuationPoint
+		for len(cp) > 0 {
+			next, err := cli.BrowseNext(&ua.BrowseNextRequest{ContinuationPoints: []ua.ByteString{cp}})
+			if err != nil {
+				return nil, err
+			}
+			if len(next.Results) != 1 || !next.Results[0].StatusCode.IsGood() {
+				break
+			}
+			refs[i] = append(refs[i], next.Results[0].References...)
+			cp = next.Results[0].ContinuationPoint
+		}
+	}
+	return refs, nil
+}
+
+// opcuaReadValues reads value and data type of the variables of nodes.
+func opcuaReadValues(cli *OpcuaClient, nodes []*OpcuaNode) error {
+	req := &ua.ReadRequest{}
+	vars := []*OpcuaNode{}
+	for _, n := range nodes {
+		if n.NodeClass != ua.NodeClassVariable.String() {
+			continue
+		}
+		id := ua.ParseNodeID(n.NodeID)
+		req.NodesToRead = append(req.NodesToRead,
+			ua.ReadValueID{NodeID: id, AttributeID: ua.AttributeIDValue},
+			ua.ReadValueID{NodeID: id, AttributeID: ua.AttributeIDDataType})
+		vars = append(vars, n)
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	res, err := cli.ReadNodeID(req)
+	if err != nil {
+		return err
+	}
+	for i, n := range vars {
+		if 2*i+1 >= len(res.Results) {
+			break
+		}
+		if v := res.Results[2*i]; v.StatusCode.IsGood() {
+			n.Value = v.Value
+		}
+		if v, ok := res.Results[2*i+1].Value.(ua.NodeID); ok {
+			n.DataType = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package mnms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	opcuaserver "github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+)
+
+// testHistorian serves the raw values of one node, two per read.
+type testHistorian struct {
+	values []ua.DataValue
+}
+
+func (h *testHistorian) inRange(start, end time.Time) []ua.DataValue {
+	values := []ua.DataValue{}
+	for _, v := range h.values {
+		if !v.SourceTimestamp.Before(start) && v.SourceTimestamp.Before(end) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (h *testHistorian) ReadRawModified(ctx context.Context, nodesToRead []ua.HistoryReadValueID, details ua.ReadRawModifiedDetails,
+	timestampsToReturn ua.TimestampsToReturn, releaseContinuationPoints bool) ([]ua.HistoryReadResult, ua.StatusCode) {
+	results := make([]ua.HistoryReadResult, len(nodesToRead))
+	for i, n := range nodesToRead {
+		if n.NodeID != ua.ParseNodeID("i=1002") {
+			results[i] = ua.HistoryReadResult{StatusCode: ua.BadNoData}
+			continue
+		}
+		values := h.inRange(details.StartTime, details.EndTime)
+		offset, _ := strconv.Atoi(string(n.ContinuationPoint))
+		values = values[offset:]
+		var cp ua.ByteString
+		if details.NumValuesPerNode > 0 && len(values) > int(details.NumValuesPerNode) {
+			values = values[:details.NumValuesPerNode]
+			cp = ua.ByteString(strconv.Itoa(offset + len(values)))
+		}
+		results[i] = ua.HistoryReadResult{ContinuationPoint: cp, HistoryData: ua.HistoryData{DataValues: values}}
+	}
+	return results, ua.Good
+}
+
+func (h *testHistorian) ReadProcessed(ctx context.Context, nodesToRead []ua.HistoryReadValueID, details ua.ReadProcessedDetails,
+	timestampsToReturn ua.TimestampsToReturn, releaseContinuationPoints bool) ([]ua.HistoryReadResult, ua.StatusCode) {
+	if len(details.AggregateType) != 1 || details.AggregateType[0] != ua.ObjectIDAggregateFunctionAverage {
+		return nil, ua.BadAggregateNotSupported
+	}
+	sum := 0.0
+	values := h.inRange(details.StartTime, details.EndTime)
+	for _, v := range values {
+		sum += float64(v.Value.(float32))
+	}
+	avg := ua.NewDataValue(sum/float64(len(values)), 0, details.StartTime, 0, time.Now(), 0)
+	return []ua.HistoryReadResult{{HistoryData: ua.HistoryData{DataValues: []ua.DataValue{avg}}}}, ua.Good
+}
+
+func (h *testHistorian) ReadEvent(ctx context.Context, nodesToRead []ua.HistoryReadValueID, details ua.ReadEventDetails,
+	timestampsToReturn ua.TimestampsToReturn, releaseContinuationPoints bool) ([]ua.HistoryReadResult, ua.StatusCode) {
+	return nil, ua.BadHistoryOperationUnsupported
+}
+
+func (h *testHistorian) ReadAtTime(ctx context.Context, nodesToRead []ua.HistoryReadValueID, details ua.ReadAtTimeDetails,
+	timestampsToReturn ua.TimestampsToReturn, releaseContinuationPoints bool) ([]ua.HistoryReadResult, ua.StatusCode) {
+	return nil, ua.BadHistoryOperationUnsupported
+}
+
+func (h *testHistorian) WriteEvent(ctx context.Context, nodeID ua.NodeID, eventFields []ua.Variant) error {
+	return nil
+}
+
+func (h *testHistorian) WriteValue(ctx context.Context, nodeID ua.NodeID, value ua.DataValue) error {
+	return nil
+}
+
+// TestOpcuaServices tests opcua write, call, historyread and export
+func TestOpcuaServices(t *testing.T) {
+	opcuaTestDir(t)
+	now := time.Now()
+	h := &testHistorian{}
+	for i := 1; i <= 5; i++ {
+		ts := now.Add(-time.Duration(6-i) * time.Minute)
+		h.values = append(h.values, ua.NewDataValue(float32(i), 0, ts, 0, ts, 0))
+	}
+	s, endpointURL := startOpcuaTestServer(t, nil, opcuaserver.WithHistorian(h), opcuaserver.WithAnonymousIdentity(true))
+	nm := s.srv.NamespaceManager()
+	ns := nm.Add("urn:mnms:test")
+	add := opcuaserver.NewMethodNode(
+		ua.NewNodeIDString(ns, "Add"),
+		ua.NewQualifiedName(ns, "Add"),
+		ua.NewLocalizedText("Add", ""),
+		ua.NewLocalizedText("adds two doubles", ""),
+		nil,
+		[]ua.Reference{
+			{ReferenceTypeID: ua.ReferenceTypeIDHasComponent, IsInverse: true, TargetID: ua.NewExpandedNodeID(ua.ParseNodeID("i=1001"))},
+		},
+		true,
+	)
+	add.SetCallMethodHandler(func(ctx context.Context, req ua.CallMethodRequest) ua.CallMethodResult {
+		if len(req.InputArguments) != 2 {
+			return ua.CallMethodResult{StatusCode: ua.BadArgumentsMissing}
+		}
+		a, ok1 := req.InputArguments[0].(float64)
+		b, ok2 := req.InputArguments[1].(float64)
+		if !ok1 || !ok2 {
+			return ua.CallMethodResult{StatusCode: ua.BadInvalidArgument,
+				InputArgumentResults: []ua.StatusCode{ua.BadTypeMismatch, ua.BadTypeMismatch}}
+		}
+		return ua.CallMethodResult{OutputArguments: []ua.Variant{a + b}}
+	})
+	err := nm.AddNodes([]opcuaserver.Node{add})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addID := fmt.Sprintf("ns=%d;s=Add", ns)
+
+	for _, args := range [][]string{
+		{"plc1", endpointURL, "policy=none", "user=admin", "password=" + AdminDefaultPassword, "insecure=true"},
+		{"anon", endpointURL, "policy=none"},
+	} {
+		p, err := ParseOpcuaConnect(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = OpcuaConnect(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func(name string) {
+			_ = OpcuaDisconnect(name)
+		}(p.Name)
+	}
+
+	// write
+	cmdinfo := RunCmd(&CmdInfo{Command: "opcua write plc1 i=1002 21.5"})
+	var w OpcuaWriteResult
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &w); err != nil || cmdinfo.Status != "ok" || w.Type != "float" {
+		t.Fatal("unexpected write", cmdinfo.Status, cmdinfo.Result)
+	}
+	if v, _ := s.srv.NamespaceManager().FindVariable(ua.ParseNodeID("i=1002")); v.Value().Value != float32(21.5) {
+		t.Fatal("expect 21.5, got", v.Value().Value)
+	}
+	if cmdinfo = RunCmd(&CmdInfo{Command: "opcua write plc1 i=1002 warm"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect invalid float to fail")
+	}
+	if cmdinfo = RunCmd(&CmdInfo{Command: "opcua write anon i=1002 float:1"}); cmdinfo.Status != "error: "+ua.BadUserAccessDenied.Error() {
+		t.Fatal("expect anonymous write to be denied", cmdinfo.Status)
+	}
+
+	// call
+	cmdinfo = RunCmd(&CmdInfo{Command: "opcua call plc1 i=1001 " + addID + " double:1.5 double:2"})
+	var c OpcuaCallResult
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &c); err != nil || cmdinfo.Status != "ok" ||
+		len(c.OutputArguments) != 1 || c.OutputArguments[0] != 3.5 {
+		t.Fatal("unexpected call", cmdinfo.Status, cmdinfo.Result)
+	}
+	cmdinfo = RunCmd(&CmdInfo{Command: "opcua call plc1 i=1001 " + addID + " int32:1 int32:2"})
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &c); err != nil || cmdinfo.Status == "ok" || len(c.InputArgumentResults) != 2 {
+		t.Fatal("expect type mismatch", cmdinfo.Status, cmdinfo.Result)
+	}
+	if cmdinfo = RunCmd(&CmdInfo{Command: "opcua call plc1 i=1001 " + addID + " 1.5 2"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect untyped arguments to fail")
+	}
+
+	// history
+	var hist []OpcuaHistoryResult
+	cmdinfo = RunCmd(&CmdInfo{Command: "opcua historyread plc1 i=1002 max=2"})
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &hist); err != nil || cmdinfo.Status != "ok" || len(hist) != 1 || len(hist[0].Values) != 5 {
+		t.Fatal("expect 5 raw values", cmdinfo.Status, cmdinfo.Result)
+	}
+	if hist[0].Values[4].Value != 5.0 || hist[0].Status != "Good" {
+		t.Fatal("unexpected raw values", hist)
+	}
+	cmdinfo = RunCmd(&CmdInfo{Command: "opcua historyread plc1 i=1002 start=150s aggregate=average"})
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &hist); err != nil || cmdinfo.Status != "ok" || len(hist[0].Values) != 1 || hist[0].Values[0].Value != 4.5 {
+		t.Fatal("expect average 4.5", cmdinfo.Status, cmdinfo.Result)
+	}
+	if cmdinfo = RunCmd(&CmdInfo{Command: "opcua historyread plc1 i=1002 aggregate=median"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect unknown aggregate to fail")
+	}
+
+	// export
+	cmdinfo = RunCmd(&CmdInfo{Command: "opcua export plc1 i=85 depth=2"})
+	var root OpcuaNode
+	if err = json.Unmarshal([]byte(cmdinfo.Result), &root); err != nil || cmdinfo.Status != "ok" || root.BrowseName != "0:Objects" || root.NodeClass != "Object" {
+		t.Fatal("unexpected export", cmdinfo.Status, err)
+	}
+	var boiler *OpcuaNode
+	for _, n := range root.Children {
+		if n.NodeID == "i=1001" {
+			boiler = n
+		}
+	}
+	if boiler == nil || len(boiler.Children) != 3 {
+		t.Fatal("expect boiler with temperature, pressure and add", boiler)
+	}
+	for _, n := range boiler.Children {
+		if n.DisplayName == "Temperature" && (n.Value != 21.5 || n.DataType != "i=10" || n.NodeClass != "Variable") {
+			t.Fatal("unexpected temperature", n)
+		}
+		if n.DisplayName == "Add" && (n.NodeID != addID || n.NodeClass != "Method") {
+			t.Fatal("unexpected method", n)
+		}
+	}
+	if cmdinfo = RunCmd(&CmdInfo{Command: "opcua export plc1 i=84 max=10"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect export over max nodes to fail")
+	}
+}
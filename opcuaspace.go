@@ -0,0 +1,489 @@
+package mnms
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	opcuaserver "github.com/awcullen/opcua/server"
+	"github.com/awcullen/opcua/ua"
+	"github.com/qeof/q"
+)
+
+/*
+	The OPC UA server exposes the network inventory in namespace
+	urn:mnms:network, with string node ids:
+
+		Objects/Devices                          folder
+		Devices/<mac>                            device object
+		Devices/<mac>/MAC, IP, Model,
+		  Firmware, Hostname, Online             variables
+		Devices/<mac>/Ports/<n>/Link,
+		  InOctets, OutOctets                    polled port variables
+		Devices/<mac>/Beep, Reset(Credential)    methods, enqueue mnms commands
+		Objects/Topology                         folder
+		Topology/<link>/Source, SourcePort,
+		  Target, TargetPort, Blocked            link variables
+
+	The address space is synced with the devices and topology every
+	opcua.interval seconds, subscribers get the changed values.
+*/
+
+const opcuaNetworkNamespace = "urn:mnms:network"
+
+// opcuaDevice are the nodes of a device.
+type opcuaDevice struct {
+	object *opcuaserver.ObjectNode
+	nodes  []opcuaserver.Node
+	vars   map[string]*opcuaserver.VariableNode
+}
+
+// opcuaSpace is the network address space of a server.
+type opcuaSpace struct {
+	sync.Mutex
+	srv            *opcuaserver.Server
+	ns             uint16
+	devices        map[string]*opcuaDevice
+	links          map[string]*opcuaDevice
+	devicesFolder  *opcuaserver.ObjectNode
+	topologyFolder *opcuaserver.ObjectNode
+}
+
+func (s *opcuaSpace) nodeID(id string) ua.NodeID {
+	return ua.NewNodeIDString(s.ns, id)
+}
+
+// object returns object node id referenced by parent with refType.
+func (s *opcuaSpace) object(id, name string, parent, refType, typeID ua.NodeID) *opcuaserver.ObjectNode {
+	return opcuaserver.NewObjectNode(
+		s.nodeID(id),
+		ua.NewQualifiedName(s.ns, name),
+		ua.NewLocalizedText(name, ""),
+		ua.NewLocalizedText("", ""),
+		nil,
+		[]ua.Reference{
+			{ReferenceTypeID: ua.ReferenceTypeIDHasTypeDefinition, TargetID: ua.NewExpandedNodeID(typeID)},
+			{ReferenceTypeID: refType, IsInverse: true, TargetID: ua.NewExpandedNodeID(parent)},
+		},
+		ua.EventNotifierSubscribeToEvents,
+	)
+}
+
+// variable returns read only variable node id, a component of parent.
+func (s *opcuaSpace) variable(id, name string, parent ua.NodeID, value any, dataType ua.NodeID) *opcuaserver.VariableNode {
+	now := time.Now()
+	return opcuaserver.NewVariableNode(
+		s.nodeID(id),
+		ua.NewQualifiedName(s.ns, name),
+		ua.NewLocalizedText(name, ""),
+		ua.NewLocalizedText("", ""),
+		nil,
+		[]ua.Reference{
+			{ReferenceTypeID: ua.ReferenceTypeIDHasTypeDefinition, TargetID: ua.NewExpandedNodeID(ua.VariableTypeIDBaseDataVariableType)},
+			{ReferenceTypeID: ua.ReferenceTypeIDHasComponent, IsInverse: true, TargetID: ua.NewExpandedNodeID(parent)},
+		},
+		ua.NewDataValue(value, 0, now, 0, now, 0),
+		dataType,
+		ua.ValueRankScalar,
+		[]uint32{},
+		ua.AccessLevelsCurrentRead,
+		1000,
+		false,
+		nil,
+	)
+}
+
+// inputArguments returns the InputArguments property of method id.
+func (s *opcuaSpace) inputArguments(id string, args []ua.Argument) *opcuaserver.VariableNode {
+	now := time.Now()
+	value := make([]ua.ExtensionObject, len(args))
+	for i, arg := range args {
+		value[i] = arg
+	}
+	return opcuaserver.NewVariableNode(
+		s.nodeID(id+"/InputArguments"),
+		ua.NewQualifiedName(0, "InputArguments"),
+		ua.NewLocalizedText("InputArguments", ""),
+		ua.NewLocalizedText("", ""),
+		nil,
+		[]ua.Reference{
+			{ReferenceTypeID: ua.ReferenceTypeIDHasTypeDefinition, TargetID: ua.NewExpandedNodeID(ua.VariableTypeIDPropertyType)},
+			{ReferenceTypeID: ua.ReferenceTypeIDHasProperty, IsInverse: true, TargetID: ua.NewExpandedNodeID(s.nodeID(id))},
+		},
+		ua.NewDataValue(value, 0, now, 0, now, 0),
+		ua.DataTypeIDArgument,
+		ua.ValueRankOneDimension,
+		[]uint32{0},
+		ua.AccessLevelsCurrentRead,
+		0,
+		false,
+		nil,
+	)
+}
+
+// setOpcuaValue sets the value of v when it changed.
+func setOpcuaValue(v *opcuaserver.VariableNode, value any) {
+	if v.Value().Value == value {
+		return
+	}
+	now := time.Now()
+	v.SetValue(ua.NewDataValue(value, 0, now, 0, now, 0))
+}
+
+// opcuaDataType is the data type of a variable value.
+func opcuaDataType(value any) ua.NodeID {
+	switch value.(type) {
+	case bool:
+		return ua.DataTypeIDBoolean
+	case uint32:
+		return ua.DataTypeIDUInt32
+	default:
+		return ua.DataTypeIDString
+	}
+}
+
+// opcuaDeviceValues are the variables of dev.
+func opcuaDeviceValues(dev DevInfo, online bool) map[string]any {
+	return map[string]any{
+		"MAC":      dev.Mac,
+		"IP":       dev.IPAddress,
+		"Model":    dev.ModelName,
+		"Firmware": dev.Ap,
+		"Hostname": dev.Hostname,
+		"Online":   online,
+	}
+}
+
+// opcuaMethod is a device method, it enqueues the command verb with the
+// device mac and ip and its input arguments.
+type opcuaMethod struct {
+	verb string
+	args []ua.Argument
+}
+
+// opcuaMethods are the device methods. Reset logs in with a credential
+// of the vault.
+var opcuaMethods = map[string]opcuaMethod{
+	"Beep": {verb: "beep"},
+	"Reset": {verb: "reset", args: []ua.Argument{{
+		Name:        "Credential",
+		DataType:    ua.DataTypeIDString,
+		ValueRank:   ua.ValueRankScalar,
+		Description: ua.NewLocalizedText("name of the device credential", ""),
+	}}},
+}
+
+// command returns the command of calling m on device mac with inputs.
+func (m opcuaMethod) command(mac string, inputs []ua.Variant) (string, ua.CallMethodResult) {
+	if len(inputs) < len(m.args) {
+		return "", ua.CallMethodResult{StatusCode: ua.BadArgumentsMissing}
+	}
+	if len(inputs) > len(m.args) {
+		return "", ua.CallMethodResult{StatusCode: ua.BadTooManyArguments}
+	}
+	dev, err := FindDev(mac)
+	if err != nil {
+		return "", ua.CallMethodResult{StatusCode: ua.BadNodeIDUnknown}
+	}
+	cmd := m.verb + " " + mac + " " + dev.IPAddress
+	results := make([]ua.StatusCode, len(inputs))
+	bad := false
+	for i, input := range inputs {
+		name, ok := input.(string)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			results[i] = ua.BadTypeMismatch
+			bad = true
+			continue
+		}
+		cmd += " " + credRefPrefix + name
+	}
+	if bad {
+		return "", ua.CallMethodResult{StatusCode: ua.BadInvalidArgument, InputArgumentResults: results}
+	}
+	return cmd, ua.CallMethodResult{StatusCode: ua.Good}
+}
+
+// callOpcuaMethod enqueues the command of a device method for the user
+// of the session.
+func callOpcuaMethod(ctx context.Context, cmd string) ua.StatusCode {
+	session, ok := ctx.Value(opcuaserver.SessionKey).(*opcuaserver.Session)
+	if !ok {
+		return ua.BadUserAccessDenied
+	}
+	identity, ok := session.UserIdentity().(ua.UserNameIdentity)
+	if !ok {
+		return ua.BadUserAccessDenied
+	}
+	u, err := GetUserConfig(identity.UserName)
+	if err != nil {
+		q.Q(err)
+		return ua.BadUserAccessDenied
+	}
+	role, err := GetRole(u.Role)
+	if err != nil || !role.Allows(PermCommandsWrite) {
+		return ua.BadUserAccessDenied
+	}
+	err = CheckCommandPermission(u, cmd)
+	if err != nil {
+		q.Q(err)
+		return ua.BadUserAccessDenied
+	}
+	err = CheckCommandCredentials(cmd)
+	if err != nil {
+		q.Q(err)
+		return ua.BadInvalidArgument
+	}
+	InsertCmd(cmd, CmdInfo{Kind: "usercommand", Command: cmd, User: u.Name})
+	err = WriteAuditRecord(AuditRecord{User: u.Name, Source: "opcua:" + session.SessionName(), Action: "command",
+		Detail: cmd, Outcome: "ok"})
+	if err != nil {
+		q.Q(err)
+	}
+	return ua.Good
+}
+
+// addDevice adds the nodes of dev. The caller holds the lock.
+func (s *opcuaSpace) addDevice(dev DevInfo, online bool) error {
+	id := "Devices/" + dev.Mac
+	d := &opcuaDevice{
+		object: s.object(id, dev.Mac, s.devicesFolder.NodeID(), ua.ReferenceTypeIDOrganizes, ua.ObjectTypeIDBaseObjectType),
+		vars:   make(map[string]*opcuaserver.VariableNode),
+	}
+	d.nodes = append(d.nodes, d.object)
+	for name, value := range opcuaDeviceValues(dev, online) {
+		v := s.variable(id+"/"+name, name, d.object.NodeID(), value, opcuaDataType(value))
+		d.vars[name] = v
+		d.nodes = append(d.nodes, v)
+	}
+	for name, method := range opcuaMethods {
+		mac, method := dev.Mac, method
+		m := opcuaserver.NewMethodNode(
+			s.nodeID(id+"/"+name),
+			ua.NewQualifiedName(s.ns, name),
+			ua.NewLocalizedText(name, ""),
+			ua.NewLocalizedText(method.verb+" "+mac, ""),
+			nil,
+			[]ua.Reference{
+				{ReferenceTypeID: ua.ReferenceTypeIDHasComponent, IsInverse: true, TargetID: ua.NewExpandedNodeID(d.object.NodeID())},
+			},
+			true,
+		)
+		// the ip is looked up on each call, it may change
+		m.SetCallMethodHandler(func(ctx context.Context, req ua.CallMethodRequest) ua.CallMethodResult {
+			cmd, result := method.command(mac, req.InputArguments)
+			if result.StatusCode != ua.Good {
+				return result
+			}
+			return ua.CallMethodResult{StatusCode: callOpcuaMethod(ctx, cmd)}
+		})
+		d.nodes = append(d.nodes, m)
+		if len(method.args) > 0 {
+			d.nodes = append(d.nodes, s.inputArguments(id+"/"+name, method.args))
+		}
+	}
+	ports := s.object(id+"/Ports", "Ports", d.object.NodeID(), ua.ReferenceTypeIDHasComponent, ua.ObjectTypeIDFolderType)
+	d.nodes = append(d.nodes, ports)
+	s.devices[dev.Mac] = d
+	return s.srv.NamespaceManager().AddNodes(d.nodes)
+}
+
+// updatePorts adds and updates the port variables of device mac. The
+// caller holds the lock.
+func (s *opcuaSpace) updatePorts(mac string, ports map[string]PortStats) error {
+	d := s.devices[mac]
+	added := []opcuaserver.Node{}
+	for port, stats := range ports {
+		values := map[string]any{"Link": stats.Link, "InOctets": stats.InOctets, "OutOctets": stats.OutOctets}
+		id := "Devices/" + mac + "/Ports/" + port
+		if _, ok := d.vars["Ports/"+port+"/Link"]; !ok {
+			object := s.object(id, port, s.nodeID("Devices/"+mac+"/Ports"), ua.ReferenceTypeIDHasComponent, ua.ObjectTypeIDBaseObjectType)
+			added = append(added, object)
+			for name, value := range values {
+				v := s.variable(id+"/"+name, name, object.NodeID(), value, opcuaDataType(value))
+				d.vars["Ports/"+port+"/"+name] = v
+				added = append(added, v)
+			}
+			continue
+		}
+		for name, value := range values {
+			setOpcuaValue(d.vars["Ports/"+port+"/"+name], value)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	d.nodes = append(d.nodes, added...)
+	return s.srv.NamespaceManager().AddNodes(added)
+}
+
+// opcuaLinkID is the node id of a topology link.
+func opcuaLinkID(l Link) string {
+	return fmt.Sprintf("%s_%s-%s_%s", l.Source, l.SourcePort, l.Target, l.TargetPort)
+}
+
+// syncLinks adds, updates and deletes the topology links. The caller
+// holds the lock.
+func (s *opcuaSpace) syncLinks(links map[string]Link) error {
+	nm := s.srv.NamespaceManager()
+	for id, l := range links {
+		values := map[string]any{"Source": l.Source, "SourcePort": l.SourcePort, "Target": l.Target,
+			"TargetPort": l.TargetPort, "Blocked": l.BlockedPort}
+		if d, ok := s.links[id]; ok {
+			setOpcuaValue(d.vars["Blocked"], l.BlockedPort)
+			continue
+		}
+		d := &opcuaDevice{
+			object: s.object("Topology/"+id, id, s.topologyFolder.NodeID(), ua.ReferenceTypeIDOrganizes, ua.ObjectTypeIDBaseObjectType),
+			vars:   make(map[string]*opcuaserver.VariableNode),
+		}
+		d.nodes = append(d.nodes, d.object)
+		for name, value := range values {
+			v := s.variable("Topology/"+id+"/"+name, name, d.object.NodeID(), value, opcuaDataType(value))
+			d.vars[name] = v
+			d.nodes = append(d.nodes, v)
+		}
+		s.links[id] = d
+		err := nm.AddNodes(d.nodes)
+		if err != nil {
+			return err
+		}
+	}
+	for id, d := range s.links {
+		if _, ok := links[id]; !ok {
+			delete(s.links, id)
+			// the components are deleted with the object
+			err := nm.DeleteNodes([]opcuaserver.Node{d.object}, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sync updates the address space with the devices and topology.
+func (s *opcuaSpace) Sync() error {
+	now := time.Now()
+	QC.DevMutex.Lock()
+	devs := make([]DevInfo, 0, len(QC.DevData))
+	for _, dev := range QC.DevData {
+		if dev.Mac != specialMac {
+			devs = append(devs, dev)
+		}
+	}
+	links := map[string]Link{}
+	for _, topo := range QC.TopologyData {
+		for _, l := range topo.LinkData {
+			links[opcuaLinkID(l)] = l
+		}
+	}
+	QC.DevMutex.Unlock()
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Mac < devs[j].Mac })
+	// port stats polled within the interval, e.g. for sparkplug, are
+	// not polled again
+	maxAge := time.Duration(opcuaSyncInterval()) * time.Second
+	ports := make(map[string]map[string]PortStats)
+	for _, dev := range devs {
+		if deviceStatus(dev, now) == mqttStatusOnline {
+			ports[dev.Mac] = devicePortStats(dev, maxAge)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	seen := map[string]bool{}
+	for _, dev := range devs {
+		seen[dev.Mac] = true
+		online := deviceStatus(dev, now) == mqttStatusOnline
+		d, ok := s.devices[dev.Mac]
+		if !ok {
+			err := s.addDevice(dev, online)
+			if err != nil {
+				return err
+			}
+		} else {
+			for name, value := range opcuaDeviceValues(dev, online) {
+				setOpcuaValue(d.vars[name], value)
+			}
+		}
+		err := s.updatePorts(dev.Mac, ports[dev.Mac])
+		if err != nil {
+			return err
+		}
+	}
+	for mac, d := range s.devices {
+		if !seen[mac] {
+			delete(s.devices, mac)
+			err := s.srv.NamespaceManager().DeleteNodes([]opcuaserver.Node{d.object}, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.syncLinks(links)
+}
+
+// AddNetworkSpace adds the Devices and Topology folders of the network
+// address space to the server.
+func (o *OpcuaServer) AddNetworkSpace() error {
+	nm := o.srv.NamespaceManager()
+	s := &opcuaSpace{
+		srv:     o.srv,
+		ns:      nm.Add(opcuaNetworkNamespace),
+		devices: make(map[string]*opcuaDevice),
+		links:   make(map[string]*opcuaDevice),
+	}
+	s.devicesFolder = s.object("Devices", "Devices", ua.ObjectIDObjectsFolder, ua.ReferenceTypeIDOrganizes, ua.ObjectTypeIDFolderType)
+	s.topologyFolder = s.object("Topology", "Topology", ua.ObjectIDObjectsFolder, ua.ReferenceTypeIDOrganizes, ua.ObjectTypeIDFolderType)
+	err := nm.AddNodes([]opcuaserver.Node{s.devicesFolder, s.topologyFolder})
+	if err != nil {
+		return err
+	}
+	o.space = s
+	return s.Sync()
+}
+
+// SyncNetworkSpace updates the network address space.
+func (o *OpcuaServer) SyncNetworkSpace() error {
+	if o.space == nil {
+		return fmt.Errorf("no network address space")
+	}
+	return o.space.Sync()
+}
+
+// opcuaSyncInterval returns opcua.interval, 60 seconds when unset.
+func opcuaSyncInterval() int {
+	interval := ReadSetting(&QC.OpcuaInterval)
+	if interval <= 0 {
+		interval = 60
+	}
+	return interval
+}
+
+// RunOpcuaServer serves the network address space at opcua.server and
+// syncs it every opcua.interval seconds.
+func RunOpcuaServer() error {
+	err := checkOpcuaURL(QC.OpcuaServerURL)
+	if err != nil {
+		return err
+	}
+	s := NewOpcuaServer(QC.OpcuaServerURL)
+	err = s.AddNetworkSpace()
+	if err != nil {
+		return err
+	}
+	s.OpcuaRun()
+	defer func() {
+		_ = s.OpcuaShutdown()
+	}()
+	for {
+		time.Sleep(time.Duration(opcuaSyncInterval()) * time.Second)
+		err = s.SyncNetworkSpace()
+		if err != nil {
+			q.Q(err)
+		}
+	}
+}
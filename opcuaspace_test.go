@@ -0,0 +1,226 @@
+package mnms
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/awcullen/opcua/client"
+	"github.com/awcullen/opcua/ua"
+)
+
+// forgetPortStats makes the next sync poll the port stats again
+func forgetPortStats() {
+	portStats.Lock()
+	portStats.devices = make(map[string]polledPortStats)
+	portStats.Unlock()
+}
+
+// TestOpcuaNetworkSpace tests browsing devices, subscribing to port
+// values and calling device methods on the opcua server
+func TestOpcuaNetworkSpace(t *testing.T) {
+	opcuaTestDir(t)
+	poll := PollPortStats
+	defer func() {
+		PollPortStats = poll
+	}()
+	inOctets := uint32(100)
+	polls := 0
+	PollPortStats = func(dev DevInfo) map[string]PortStats {
+		polls++
+		return map[string]PortStats{"1": {Link: true, InOctets: inOctets}}
+	}
+	forgetPortStats()
+	defer forgetPortStats()
+	const mac = "00-60-E9-18-3C-3C"
+	QC.DevMutex.Lock()
+	QC.DevData[mac] = DevInfo{Mac: mac, IPAddress: "10.0.50.1", ModelName: "EHG7508", Ap: "K1.2",
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10)}
+	QC.TopologyData[mac] = Topology{LinkData: []Link{{Source: mac, SourcePort: "port1", Target: "00-60-E9-18-3C-3D", TargetPort: "port2"}}}
+	QC.DevMutex.Unlock()
+	defer func() {
+		QC.DevMutex.Lock()
+		delete(QC.DevData, mac)
+		delete(QC.TopologyData, mac)
+		QC.DevMutex.Unlock()
+		QC.CmdMutex.Lock()
+		delete(QC.CmdData, "beep "+mac+" 10.0.50.1")
+		delete(QC.CmdData, "reset "+mac+" 10.0.50.1 @cred:plant1")
+		QC.CmdMutex.Unlock()
+	}()
+	err := SetCredential(Credential{Name: "plant1", Username: "admin", Password: "Secret#1", Devices: []string{mac}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, endpointURL := startOpcuaTestServer(t, (*OpcuaServer).AddNetworkSpace)
+	ns := s.space.ns
+
+	c := NewOpcuaClient()
+	err = c.Connect(endpointURL, client.WithInsecureSkipVerify(), client.WithUserNameIdentity("admin", AdminDefaultPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	refs, err := c.BrowseReference(ua.NewNodeIDString(ns, "Devices"), ua.BrowseDirectionForward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range refs {
+		if r.BrowseName.Name == mac {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expect device in Devices folder", refs)
+	}
+	res, err := c.ReadNodeID(&ua.ReadRequest{NodesToRead: []ua.ReadValueID{
+		{NodeID: ua.NewNodeIDString(ns, "Devices/"+mac+"/Model"), AttributeID: ua.AttributeIDValue},
+		{NodeID: ua.NewNodeIDString(ns, "Devices/"+mac+"/Online"), AttributeID: ua.AttributeIDValue},
+		{NodeID: ua.NewNodeIDString(ns, "Topology/"+mac+"_port1-00-60-E9-18-3C-3D_port2/TargetPort"), AttributeID: ua.AttributeIDValue},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].Value != "EHG7508" || res.Results[1].Value != true || res.Results[2].Value != "port2" {
+		t.Fatal("unexpected values", res.Results)
+	}
+
+	sub, err := c.CreateSubscription(&ua.CreateSubscriptionRequest{
+		RequestedPublishingInterval: 100.0,
+		RequestedMaxKeepAliveCount:  30,
+		RequestedLifetimeCount:      30 * 3,
+		PublishingEnabled:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.CreateMonitoredItems(&ua.CreateMonitoredItemsRequest{
+		SubscriptionID:     sub.SubscriptionID,
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+		ItemsToCreate: []ua.MonitoredItemCreateRequest{{
+			ItemToMonitor:  ua.ReadValueID{AttributeID: ua.AttributeIDValue, NodeID: ua.NewNodeIDString(ns, "Devices/"+mac+"/Ports/1/InOctets")},
+			MonitoringMode: ua.MonitoringModeReporting,
+			RequestedParameters: ua.MonitoringParameters{
+				ClientHandle: 1, QueueSize: 1, DiscardOldest: true, SamplingInterval: 100.0,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want uint32) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			res, err := c.Publish(&ua.PublishRequest{RequestHeader: ua.RequestHeader{TimeoutHint: 5000}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range res.NotificationMessage.NotificationData {
+				if body, ok := data.(ua.DataChangeNotification); ok {
+					for _, item := range body.MonitoredItems {
+						if item.ClientHandle == 1 && item.Value.Value == want {
+							return
+						}
+					}
+				}
+			}
+		}
+		t.Fatal("no data change to", want)
+	}
+	expect(100)
+	// port stats polled within the interval are reused
+	n := polls
+	err = s.SyncNetworkSpace()
+	if err != nil || polls != n {
+		t.Fatal("expect port stats not to be polled again", polls, n, err)
+	}
+	inOctets = 200
+	forgetPortStats()
+	err = s.SyncNetworkSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(200)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	callMethod := func(name string, inputs ...ua.Variant) ua.StatusCode {
+		t.Helper()
+		call, err := c.ch.Call(ctx, &ua.CallRequest{MethodsToCall: []ua.CallMethodRequest{{
+			ObjectID:       ua.NewNodeIDString(ns, "Devices/"+mac),
+			MethodID:       ua.NewNodeIDString(ns, "Devices/"+mac+"/"+name),
+			InputArguments: inputs,
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return call.Results[0].StatusCode
+	}
+	if status := callMethod("Beep"); status != ua.Good {
+		t.Fatal("expect beep to be called", status)
+	}
+	QC.CmdMutex.Lock()
+	cmdinfo, ok := QC.CmdData["beep "+mac+" 10.0.50.1"]
+	QC.CmdMutex.Unlock()
+	if !ok || cmdinfo.User != "admin" {
+		t.Fatal("expect beep command of admin", cmdinfo)
+	}
+	// the queued command has the mac and ip the beep command needs
+	ran := RunCmd(&cmdinfo)
+	if ran.Status != "ok" {
+		t.Fatal("expect beep command to run", ran.Status)
+	}
+
+	res, err = c.ReadNodeID(&ua.ReadRequest{NodesToRead: []ua.ReadValueID{
+		{NodeID: ua.NewNodeIDString(ns, "Devices/"+mac+"/Reset/InputArguments"), AttributeID: ua.AttributeIDValue},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, ok := res.Results[0].Value.([]ua.ExtensionObject)
+	if !ok || len(args) != 1 {
+		t.Fatal("expect reset input arguments", res.Results[0])
+	}
+	if arg, ok := args[0].(ua.Argument); !ok || arg.Name != "Credential" {
+		t.Fatal("expect credential argument", args[0])
+	}
+	for _, tc := range []struct {
+		inputs []ua.Variant
+		status ua.StatusCode
+	}{
+		{nil, ua.BadArgumentsMissing},
+		{[]ua.Variant{"plant1", "x"}, ua.BadTooManyArguments},
+		{[]ua.Variant{int32(1)}, ua.BadInvalidArgument},
+		{[]ua.Variant{"nope"}, ua.BadInvalidArgument},
+		{[]ua.Variant{"plant1"}, ua.Good},
+	} {
+		if status := callMethod("Reset", tc.inputs...); status != tc.status {
+			t.Fatal("unexpected reset status", tc.inputs, status)
+		}
+	}
+	QC.CmdMutex.Lock()
+	cmdinfo, ok = QC.CmdData["reset "+mac+" 10.0.50.1 @cred:plant1"]
+	QC.CmdMutex.Unlock()
+	if !ok || cmdinfo.User != "admin" {
+		t.Fatal("expect reset command with the credential", cmdinfo)
+	}
+
+	QC.DevMutex.Lock()
+	delete(QC.DevData, mac)
+	QC.DevMutex.Unlock()
+	err = s.SyncNetworkSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.ReadNodeID(&ua.ReadRequest{NodesToRead: []ua.ReadValueID{
+		{NodeID: ua.NewNodeIDString(ns, "Devices/"+mac+"/Model"), AttributeID: ua.AttributeIDValue},
+	}})
+	if err != nil || res.Results[0].StatusCode != ua.BadNodeIDUnknown {
+		t.Fatal("expect removed device to be unknown", res, err)
+	}
+}
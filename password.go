@@ -0,0 +1,384 @@
+package mnms
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/qeof/q"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	User passwords are stored as argon2id hashes in the PHC string
+	format. Entries written by older versions hold the plaintext
+	password, they are hashed the next time the user logs in. bcrypt
+	hashes are accepted as well.
+
+	The password policy, account lockout and password expiry are
+	configured with the password policy kept in the mnms config.
+*/
+
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// PasswordSpecialChars are the special characters accepted in passwords.
+const PasswordSpecialChars = "@$!%*#?&"
+
+// PasswordPolicy configures password strength, lockout and expiry.
+type PasswordPolicy struct {
+	MinLength      int  `json:"minLength"`
+	MaxLength      int  `json:"maxLength"`
+	RequireUpper   bool `json:"requireUpper"`
+	RequireLower   bool `json:"requireLower"`
+	RequireDigit   bool `json:"requireDigit"`
+	RequireSpecial bool `json:"requireSpecial"`
+	MaxFailures    int  `json:"maxFailures"`    // failed logins before lockout, 0 disables lockout
+	LockoutMinutes int  `json:"lockoutMinutes"` // how long an account stays locked
+	MaxAgeDays     int  `json:"maxAgeDays"`     // password expiry, 0 never expires
+}
+
+// DefaultPasswordPolicy is used when the mnms config has no policy.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      20,
+	RequireUpper:   true,
+	RequireLower:   true,
+	RequireDigit:   true,
+	RequireSpecial: true,
+	MaxFailures:    5,
+	LockoutMinutes: 15,
+}
+
+var (
+	ErrAccountLocked   = errors.New("account locked")
+	ErrPasswordExpired = errors.New("password expired")
+)
+
+// hashPassword returns the argon2id hash of password.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// isPasswordHash reports whether stored is a password hash rather than
+// a plaintext password of an older config.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$") || strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks password against the stored hash or plaintext.
+func verifyPassword(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if strings.HasPrefix(stored, "$argon2id$") {
+		var version int
+		var memory, time uint32
+		var threads uint8
+		ws := strings.Split(stored, "$")
+		if len(ws) != 6 {
+			return false
+		}
+		_, err := fmt.Sscanf(ws[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false
+		}
+		_, err = fmt.Sscanf(ws[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+		if err != nil {
+			return false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(ws[4])
+		if err != nil {
+			return false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(ws[5])
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// GetPasswordPolicy returns the configured password policy.
+func GetPasswordPolicy() PasswordPolicy {
+	c, err := GetMNMSConfig()
+	if err != nil || c.PasswordPolicy == nil {
+		return DefaultPasswordPolicy
+	}
+	return *c.PasswordPolicy
+}
+
+// SetPasswordPolicy validates and stores the password policy.
+func SetPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength < 1 || (policy.MaxLength > 0 && policy.MaxLength < policy.MinLength) {
+		return fmt.Errorf("invalid password length %d-%d", policy.MinLength, policy.MaxLength)
+	}
+	if policy.MaxFailures < 0 || policy.LockoutMinutes < 0 || policy.MaxAgeDays < 0 {
+		return fmt.Errorf("invalid password policy")
+	}
+	if policy.MaxFailures > 0 && policy.LockoutMinutes == 0 {
+		return fmt.Errorf("lockout minutes required with max failures")
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		c.PasswordPolicy = &policy
+		return nil
+	})
+}
+
+// Check checks pw against the strength rules of the policy.
+func (p PasswordPolicy) Check(pw string) error {
+	var upper, lower, digit, special bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case strings.ContainsRune(PasswordSpecialChars, r):
+			special = true
+		default:
+			return fmt.Errorf("password may only contain letters, digits and %s", PasswordSpecialChars)
+		}
+	}
+	n := len([]rune(pw))
+	rules := []string{}
+	if n < p.MinLength || (p.MaxLength > 0 && n > p.MaxLength) {
+		if p.MaxLength > 0 {
+			rules = append(rules, fmt.Sprintf("%d-%d characters", p.MinLength, p.MaxLength))
+		} else {
+			rules = append(rules, fmt.Sprintf("at least %d characters", p.MinLength))
+		}
+	}
+	if p.RequireUpper && !upper {
+		rules = append(rules, "one uppercase")
+	}
+	if p.RequireLower && !lower {
+		rules = append(rules, "one lowercase")
+	}
+	if p.RequireDigit && !digit {
+		rules = append(rules, "one digit")
+	}
+	if p.RequireSpecial && !special {
+		rules = append(rules, "one special character")
+	}
+	if len(rules) > 0 {
+		return fmt.Errorf("password must have %s", strings.Join(rules, ", "))
+	}
+	return nil
+}
+
+// checkLockout returns ErrAccountLocked while u is locked.
+func (u *UserConfig) checkLockout(now time.Time) error {
+	if u.LockedUntil > now.Unix() {
+		return fmt.Errorf("%w until %s", ErrAccountLocked,
+			time.Unix(u.LockedUntil, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// loginFailed counts a failed login of u and locks u after the
+// failures allowed by policy.
+func (u *UserConfig) loginFailed(policy PasswordPolicy, now time.Time) {
+	u.FailedLogins++
+	if policy.MaxFailures > 0 && u.FailedLogins >= policy.MaxFailures {
+		u.FailedLogins = 0
+		u.LockedUntil = now.Add(time.Duration(policy.LockoutMinutes) * time.Minute).Unix()
+		q.Q("account locked", u.Name)
+	}
+}
+
+// authenticateUser checks the password of user, applying lockout and
+// expiry, and hashes a plaintext password on success.
+func authenticateUser(user, password string) (*UserConfig, error) {
+	if _, err := GetMNMSConfig(); err != nil {
+		// admin works without config.json
+		u, uerr := GetUserConfig(user)
+		if uerr != nil || !verifyPassword(u.Password, password) {
+			q.Q(err)
+			return nil, err
+		}
+		return u, nil
+	}
+	// the failures are counted in the same transaction which checks them
+	var ret *UserConfig
+	var authErr error
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		policy := DefaultPasswordPolicy
+		if c.PasswordPolicy != nil {
+			policy = *c.PasswordPolicy
+		}
+		now := time.Now()
+		for i := range c.Users {
+			u := &c.Users[i]
+			if u.Name != user {
+				continue
+			}
+			if u.Service {
+				return fmt.Errorf("%s is a service account, use an api key", user)
+			}
+			if u.Provider != "" {
+				return fmt.Errorf("%s is a %s user", user, u.Provider)
+			}
+			if err := u.checkLockout(now); err != nil {
+				return err
+			}
+			if !verifyPassword(u.Password, password) {
+				u.loginFailed(policy, now)
+				authErr = errors.New("password not match")
+				return nil
+			}
+			dirty := u.FailedLogins != 0 || u.LockedUntil != 0
+			u.FailedLogins = 0
+			u.LockedUntil = 0
+			if !isPasswordHash(u.Password) {
+				// migrate plaintext password of an older config
+				var err error
+				u.Password, err = hashPassword(password)
+				if err != nil {
+					return err
+				}
+				if u.PasswordChanged == 0 {
+					u.PasswordChanged = now.Unix()
+				}
+				dirty = true
+			}
+			if policy.MaxAgeDays > 0 && u.PasswordChanged > 0 &&
+				now.After(time.Unix(u.PasswordChanged, 0).Add(time.Duration(policy.MaxAgeDays)*24*time.Hour)) {
+				authErr = ErrPasswordExpired
+			}
+			ret = &UserConfig{}
+			*ret = *u
+			if !dirty {
+				return errMNMSConfigUnchanged
+			}
+			return nil
+		}
+		return fmt.Errorf("user %s not found", user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if authErr != nil {
+		return nil, authErr
+	}
+	return ret, nil
+}
+
+// ChangeUserPassword replaces the password of user after checking the
+// old one. Expired passwords can be changed this way.
+func ChangeUserPassword(user, oldPassword, newPassword string) error {
+	_, err := authenticateUser(user, oldPassword)
+	if err != nil && !errors.Is(err, ErrPasswordExpired) {
+		return err
+	}
+	if oldPassword == newPassword {
+		return errors.New("new password must differ from the old password")
+	}
+	err = checkUsersPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	err = MergeUserConfig(UserConfig{Name: user, Password: newPassword})
+	if err != nil {
+		return err
+	}
+	RevokeUserSessions(user)
+	return nil
+}
+
+// HandlePasswordPolicy handles password policy requests
+//
+// GET /api/v1/users/policy
+//
+//	returns the password policy
+//
+// PUT /api/v1/users/policy
+//
+//	Example parameter: {"minLength": 10, "maxLength": 64, "requireUpper": true, "requireLower": true,
+//	                    "requireDigit": true, "requireSpecial": false, "maxFailures": 5,
+//	                    "lockoutMinutes": 15, "maxAgeDays": 90}
+func HandlePasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var policy PasswordPolicy
+		err := json.NewDecoder(r.Body).Decode(&policy)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		err = SetPasswordPolicy(policy)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	err := json.NewEncoder(w).Encode(GetPasswordPolicy())
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleChangePassword handles password change requests
+//
+// POST /api/v1/password
+//
+//	Example parameter: {"user": "user1", "password": "Pas$word1", "newPassword": "Pas$word2"}
+//
+//	Changing an expired password is allowed, users can not log in otherwise.
+func HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User        string `json:"user"`
+		Password    string `json:"password"`
+		NewPassword string `json:"newPassword"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	setAuditUser(r, body.User)
+	err = ChangeUserPassword(body.User, body.Password, body.NewPassword)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, err = w.Write([]byte(err.Error()))
+		if err != nil {
+			q.Q(err)
+		}
+		return
+	}
+	_, err = w.Write([]byte("ok"))
+	if err != nil {
+		q.Q(err)
+	}
+}
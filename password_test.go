@@ -0,0 +1,171 @@
+package mnms
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPasswordHash tests hashing and verifying passwords
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("Pas$word1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") || !isPasswordHash(hash) {
+		t.Fatal("unexpected hash", hash)
+	}
+	other, _ := hashPassword("Pas$word1")
+	if hash == other {
+		t.Fatal("expect salted hashes to differ")
+	}
+	if !verifyPassword(hash, "Pas$word1") || verifyPassword(hash, "Pas$word2") {
+		t.Fatal("unexpected argon2id verification")
+	}
+	bcryptHash := "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	if verifyPassword(bcryptHash, "wrong") {
+		t.Fatal("unexpected bcrypt verification")
+	}
+	if !verifyPassword("default", "default") || isPasswordHash("default") {
+		t.Fatal("expect plaintext to verify")
+	}
+}
+
+// TestPasswordPolicy tests policy checks
+func TestPasswordPolicy(t *testing.T) {
+	p := PasswordPolicy{MinLength: 12, RequireDigit: true}
+	if err := p.Check("shortpass1"); err == nil {
+		t.Fatal("expect too short password to fail")
+	}
+	if err := p.Check("longpassword1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check("long password1"); err == nil {
+		t.Fatal("expect space to be rejected")
+	}
+	if err := DefaultPasswordPolicy.Check("MyPassword123$"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAuthenticateUser tests migration, lockout and expiry
+func TestAuthenticateUser(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+
+	// plaintext default password is hashed on first login
+	_, err = authenticateUser("admin", AdminDefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := GetUserConfig("admin")
+	if !isPasswordHash(c.Password) || c.PasswordChanged == 0 {
+		t.Fatal("expect password to be migrated", c)
+	}
+	_, err = authenticateUser("admin", AdminDefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUserConfig("lock", MNMSUserRole, "tA%@18632Nest", "lock@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetPasswordPolicy(PasswordPolicy{MinLength: 8, MaxFailures: 2, LockoutMinutes: 1, MaxAgeDays: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = authenticateUser("lock", "wrong")
+	_, _ = authenticateUser("lock", "wrong")
+	_, err = authenticateUser("lock", "tA%@18632Nest")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatal("expect account to be locked", err)
+	}
+
+	// expire the password of admin
+	config, _ := GetMNMSConfig()
+	for i := range config.Users {
+		if config.Users[i].Name == "admin" {
+			config.Users[i].PasswordChanged = time.Now().Add(-31 * 24 * time.Hour).Unix()
+		}
+	}
+	_ = WriteMNMSConfig(config)
+	_, err = authenticateUser("admin", AdminDefaultPassword)
+	if !errors.Is(err, ErrPasswordExpired) {
+		t.Fatal("expect password to be expired", err)
+	}
+	err = ChangeUserPassword("admin", AdminDefaultPassword, "N3w$password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authenticateUser("admin", "N3w$password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a password which looks like a hash is hashed as well
+	hashLike := "$argon2id$v=19$m=1,t=1,p=1$c2FsdA$a2V5"
+	err = MergeUserConfig(UserConfig{Name: "admin", Password: hashLike})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ = GetUserConfig("admin"); c.Password == hashLike {
+		t.Fatal("expect hash like password to be hashed")
+	}
+	_, err = authenticateUser("admin", hashLike)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stored hash of GetUserConfig is kept as it is
+	stored := c.Password
+	c.Email = "admin@test.com"
+	err = MergeUserConfig(*c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ = GetUserConfig("admin"); c.Password != stored {
+		t.Fatal("expect stored hash to be kept")
+	}
+}
+
+// TestConcurrentLoginFailures tests that failed logins at the same time
+// are all counted
+func TestConcurrentLoginFailures(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	err = SetPasswordPolicy(PasswordPolicy{MinLength: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = authenticateUser("admin", "wrong")
+		}()
+	}
+	wg.Wait()
+	u, err := GetUserConfig("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FailedLogins != n {
+		t.Fatal("expect all failed logins to be counted, got", u.FailedLogins)
+	}
+}
@@ -0,0 +1,703 @@
+package mnms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Client configuration profiles.
+
+	Root keeps configuration profiles of settings for its client nodes
+	in the mnms config. The "default" profile applies to all clients, a
+	named profile to the clients it lists and overrides the default.
+
+	Root tells a client about its effective profile with the command
+
+		@client1 config profile 3f2a9c01
+
+	when the client registers with another profile and when the
+	profiles change. The client fetches the settings of the profile
+	from root encrypted with the mnms public key, so settings such as
+	snmp.community never appear in the command list or syslog. The
+	client keeps the profile in <name>_profile.json and reports its
+	effective settings on registration, root compares them with the
+	profile to find drift.
+*/
+
+// DefaultProfile is the profile of all clients.
+const DefaultProfile = "default"
+
+// ClientProfile is a set of settings for client nodes.
+type ClientProfile struct {
+	Name     string            `json:"name"`
+	Clients  []string          `json:"clients,omitempty"`
+	Settings map[string]string `json:"settings"`
+}
+
+// SettingDrift is a setting of a client that differs from its profile.
+type SettingDrift struct {
+	Key      string      `json:"key"`
+	Expected string      `json:"expected"`
+	Actual   interface{} `json:"actual"`
+	Source   string      `json:"source"`
+}
+
+// ClientDrift is the drift of a client from its profile.
+type ClientDrift struct {
+	Client   string            `json:"client"`
+	Profile  map[string]string `json:"profile"`
+	Hash     string            `json:"hash"`
+	Applied  string            `json:"applied"`
+	Settings []SettingDrift    `json:"settings"`
+}
+
+// checkProfileSettings checks the keys and values of profile settings.
+func checkProfileSettings(m map[string]string) error {
+	for k, v := range m {
+		def := findSettingDef(k)
+		if def == nil {
+			return fmt.Errorf("unknown setting %s", k)
+		}
+		if def.node {
+			return fmt.Errorf("setting %s can not be in a profile", k)
+		}
+		if v == "" || strings.ContainsAny(v, " \t\n") {
+			return fmt.Errorf("setting %s: invalid value %q", k, v)
+		}
+		_, err := def.parse(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// profileHash identifies the settings of a profile, it is empty for no
+// settings.
+func profileHash(m map[string]string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, m[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// clientProfile returns the effective profile settings of client.
+func clientProfile(profiles []ClientProfile, client string) map[string]string {
+	ret := map[string]string{}
+	for _, p := range profiles {
+		if p.Name == DefaultProfile {
+			for k, v := range p.Settings {
+				ret[k] = v
+			}
+		}
+	}
+	for _, p := range profiles {
+		if p.Name != DefaultProfile && containsFold(p.Clients, client) {
+			for k, v := range p.Settings {
+				ret[k] = v
+			}
+		}
+	}
+	return ret
+}
+
+// profileCache keeps the profiles of the mnms config, so that client
+// registrations do not decrypt the config each time. It is valid while
+// the config file is unchanged.
+var profileCache = struct {
+	sync.Mutex
+	modTime  time.Time
+	size     int64
+	profiles []ClientProfile
+}{}
+
+// cacheProfiles caches the profiles of config c.
+func cacheProfiles(c *MNMSConfig) {
+	profileCache.Lock()
+	defer profileCache.Unlock()
+	profileCache.modTime = time.Time{}
+	p, err := checkMNMSConfigPath()
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	profileCache.modTime, profileCache.size = fi.ModTime(), fi.Size()
+	profileCache.profiles = c.Profiles
+}
+
+// cachedProfiles returns the profiles of the mnms config.
+func cachedProfiles() ([]ClientProfile, error) {
+	p, err := checkMNMSConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(p); err == nil {
+		profileCache.Lock()
+		ok := !profileCache.modTime.IsZero() && fi.ModTime().Equal(profileCache.modTime) && fi.Size() == profileCache.size
+		profiles := profileCache.profiles
+		profileCache.Unlock()
+		if ok {
+			return profiles, nil
+		}
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		return nil, err
+	}
+	cacheProfiles(c)
+	return c.Profiles, nil
+}
+
+// GetProfiles returns the client profiles.
+func GetProfiles() ([]ClientProfile, error) {
+	profiles, err := cachedProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if profiles == nil {
+		return []ClientProfile{}, nil
+	}
+	return profiles, nil
+}
+
+// SetProfile adds or replaces a client profile and pushes the changed
+// profiles to the clients.
+func SetProfile(profile ClientProfile) error {
+	if profile.Name == "" || strings.ContainsAny(profile.Name, " \t") {
+		return fmt.Errorf("invalid profile name %q", profile.Name)
+	}
+	if profile.Name == DefaultProfile && len(profile.Clients) > 0 {
+		return errors.New("default profile applies to all clients")
+	}
+	err := checkProfileSettings(profile.Settings)
+	if err != nil {
+		return err
+	}
+	var saved *MNMSConfig
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, p := range c.Profiles {
+			if p.Name == profile.Name || p.Name == DefaultProfile {
+				continue
+			}
+			for _, cl := range profile.Clients {
+				if containsFold(p.Clients, cl) {
+					return fmt.Errorf("client %s is in profile %s", cl, p.Name)
+				}
+			}
+		}
+		found := false
+		for i := range c.Profiles {
+			if c.Profiles[i].Name == profile.Name {
+				c.Profiles[i] = profile
+				found = true
+			}
+		}
+		if !found {
+			c.Profiles = append(c.Profiles, profile)
+		}
+		saved = c
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cacheProfiles(saved)
+	pushProfiles(saved.Profiles)
+	return nil
+}
+
+// DeleteProfile deletes a client profile and pushes the changed
+// profiles to the clients.
+func DeleteProfile(name string) error {
+	var saved *MNMSConfig
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		for i, p := range c.Profiles {
+			if p.Name == name {
+				c.Profiles = append(c.Profiles[:i], c.Profiles[i+1:]...)
+				saved = c
+				return nil
+			}
+		}
+		return fmt.Errorf("profile %s not exist", name)
+	})
+	if err != nil {
+		return err
+	}
+	cacheProfiles(saved)
+	pushProfiles(saved.Profiles)
+	return nil
+}
+
+// profileCmd returns the command applying settings m, the client
+// fetches the settings from root.
+func profileCmd(m map[string]string) string {
+	hash := profileHash(m)
+	if hash == "" {
+		return "config profile clear"
+	}
+	return "config profile " + hash
+}
+
+// pushProfile sends its profile to client when the client has applied
+// another one.
+func pushProfile(profiles []ClientProfile, client, applied string) {
+	m := clientProfile(profiles, client)
+	if profileHash(m) == applied {
+		return
+	}
+	cmd := profileCmd(m)
+	q.Q("push profile", client, cmd)
+	InsertCmd("@"+client+" "+cmd, CmdInfo{
+		Kind:        "profile",
+		Command:     cmd,
+		Client:      client,
+		NoOverwrite: true,
+	})
+}
+
+// pushProfiles sends their profiles to the registered clients.
+func pushProfiles(profiles []ClientProfile) {
+	QC.ClientMutex.Lock()
+	applied := make(map[string]string, len(QC.Clients))
+	for name, ci := range QC.Clients {
+		applied[name] = ci.Profile
+	}
+	QC.ClientMutex.Unlock()
+	for name, hash := range applied {
+		pushProfile(profiles, name, hash)
+	}
+}
+
+// checkClientProfile is called on registration of a client.
+func checkClientProfile(ci ClientInfo) {
+	if !QC.IsRoot {
+		return
+	}
+	profiles, err := cachedProfiles()
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	pushProfile(profiles, ci.Name, ci.Profile)
+}
+
+// sameSetting reports whether the setting key has the value expected.
+func sameSetting(key, expected string, value interface{}) bool {
+	def := findSettingDef(key)
+	if def == nil {
+		return false
+	}
+	if def.secret {
+		// clients report the hash of secret settings
+		return expected != "" && settingHash(expected) == fmt.Sprint(value) ||
+			expected == "" && value == ""
+	}
+	a, err := def.parse(expected)
+	if err != nil {
+		return false
+	}
+	b, err := def.parse(fmt.Sprint(value))
+	if err != nil {
+		return false
+	}
+	return a == b
+}
+
+// maskProfileSettings returns m with the secret settings masked.
+func maskProfileSettings(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		if def := findSettingDef(k); def != nil && def.secret && v != "" {
+			v = secretMask
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+// GetProfileDrift returns the clients whose profile is not applied or
+// whose effective settings differ from their profile.
+func GetProfileDrift() ([]ClientDrift, error) {
+	profiles, err := cachedProfiles()
+	if err != nil {
+		return nil, err
+	}
+	QC.ClientMutex.Lock()
+	clients := make([]ClientInfo, 0, len(QC.Clients))
+	for _, ci := range QC.Clients {
+		clients = append(clients, ci)
+	}
+	QC.ClientMutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	ret := []ClientDrift{}
+	for _, ci := range clients {
+		m := clientProfile(profiles, ci.Name)
+		d := ClientDrift{Client: ci.Name, Profile: maskProfileSettings(m), Hash: profileHash(m), Applied: ci.Profile}
+		actual := make(map[string]Setting, len(ci.Settings))
+		for _, s := range ci.Settings {
+			actual[s.Key] = s
+		}
+		for k, v := range m {
+			s, ok := actual[k]
+			if !ok || !sameSetting(k, v, s.Value) {
+				if def := findSettingDef(k); def != nil && def.secret {
+					v = d.Profile[k]
+					if s.Value != nil && s.Value != "" {
+						s.Value = secretMask
+					}
+				}
+				d.Settings = append(d.Settings, SettingDrift{Key: k, Expected: v, Actual: s.Value, Source: s.Source})
+			}
+		}
+		sort.Slice(d.Settings, func(i, j int) bool { return d.Settings[i].Key < d.Settings[j].Key })
+		if d.Hash != d.Applied || len(d.Settings) > 0 {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
+
+// client side
+
+type savedProfile struct {
+	Hash     string            `json:"hash"`
+	Settings map[string]string `json:"settings"`
+}
+
+func profilePath(name string) string {
+	mnmsDir, err := CheckMNMSFolder()
+	if err != nil {
+		mnmsDir = "."
+	}
+	return path.Join(mnmsDir, fmt.Sprintf("%s_profile.json", name))
+}
+
+func parseProfile(m map[string]string) (map[string]interface{}, error) {
+	err := checkProfileSettings(m)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{}, len(m))
+	for k, s := range m {
+		ret[k], err = findSettingDef(k).parse(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// loadProfile reads the profile node name received from root.
+func loadProfile(name string) (map[string]interface{}, string, error) {
+	if name == "" {
+		return nil, "", nil
+	}
+	data, err := os.ReadFile(profilePath(name))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var p savedProfile
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, "", err
+	}
+	values, err := parseProfile(p.Settings)
+	if err != nil {
+		return nil, "", err
+	}
+	return values, p.Hash, nil
+}
+
+// resolveProfile returns the settings of the profile of this node. The
+// root reads its own config, clients ask the root.
+func resolveProfile() (map[string]string, error) {
+	if QC.IsRoot || QC.RootURL == "" {
+		profiles, err := cachedProfiles()
+		if err != nil {
+			return nil, err
+		}
+		return clientProfile(profiles, QC.Name), nil
+	}
+	body, err := json.Marshal(map[string]string{"client": QC.Name})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := PostWithToken(QC.RootURL+"/api/v1/profiles/resolve", QC.AdminToken, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		return nil, fmt.Errorf("resolve profile: %s", resp.Status)
+	}
+	var ret struct {
+		Profile string `json:"profile"`
+	}
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := DecryptWithOwnPrivateKey([]byte(ret.Profile))
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	err = json.Unmarshal(plain, &m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ApplyProfile keeps the profile settings m from root and applies them
+// like "config reload".
+func ApplyProfile(hash string, m map[string]string) ([]string, []string, error) {
+	if hash != profileHash(m) {
+		return nil, nil, errors.New("profile hash mismatch")
+	}
+	values, err := parseProfile(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings.Lock()
+	defer settings.Unlock()
+	p := profilePath(QC.Name)
+	if len(m) == 0 {
+		err = os.Remove(p)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		var data []byte
+		data, err = json.Marshal(savedProfile{Hash: hash, Settings: m})
+		if err == nil {
+			// the profile may carry secrets like snmp.community
+			err = os.WriteFile(p, data, 0o600)
+		}
+		if err == nil {
+			err = os.Chmod(p, 0o600)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	settings.profile = values
+	settings.hash = hash
+	return reloadSettings()
+}
+
+// AppliedProfile returns the hash of the profile applied on this node.
+func AppliedProfile() string {
+	settings.Lock()
+	defer settings.Unlock()
+	return settings.hash
+}
+
+// Apply settings profile from root.
+//
+// Usage : config profile [hash] [key=value...]
+//
+//	[hash]        : hash of the profile settings
+//	[key=value]   : setting of the settings file, as intervals.gwd=120,
+//	                the settings are fetched from root when not given
+//
+// Usage : config profile clear
+//
+//	removes the profile
+//
+// Root sends this command with the hash only to client nodes, the result
+// lists the applied settings and the settings needing a restart.
+//
+// Example :
+//
+//	config profile 3f2a9c01
+//	config profile 3f2a9c01 intervals.gwd=120 syslog.remote=10.0.50.2:5514
+//	config profile clear
+func ConfigProfileCmd(cmdinfo *CmdInfo) *CmdInfo {
+	ws := strings.Fields(cmdinfo.Command)
+	if len(ws) < 3 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	m := map[string]string{}
+	hash := ""
+	if ws[2] != "clear" {
+		hash = ws[2]
+		for _, kv := range ws[3:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				cmdinfo.Status = "error: invalid setting " + kv
+				return cmdinfo
+			}
+			m[k] = v
+		}
+		if len(ws) == 3 {
+			var err error
+			m, err = resolveProfile()
+			if err != nil {
+				cmdinfo.Status = "error: " + err.Error()
+				return cmdinfo
+			}
+		}
+	}
+	applied, restart, err := ApplyProfile(hash, m)
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	b, err := json.Marshal(map[string][]string{"applied": applied, "restart": restart})
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Result = string(b)
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
+
+// HandleProfiles handles client configuration profiles.
+//
+// GET /api/v1/profiles
+//
+//	returns the profiles
+//
+// POST /api/v1/profiles
+//
+//	Example parameter: {"name": "plant1", "clients": ["client1", "client2"], "settings": {"intervals.gwd": "120", "syslog.remote": "10.0.50.2:5514"}}
+//
+// DELETE /api/v1/profiles
+//
+//	Example parameter: {"name": "plant1"}
+func HandleProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST", "DELETE":
+		var profile ClientProfile
+		err := json.NewDecoder(r.Body).Decode(&profile)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			setAuditDetail(r, "set profile %s", profile.Name)
+			err = SetProfile(profile)
+		} else {
+			setAuditDetail(r, "delete profile %s", profile.Name)
+			err = DeleteProfile(profile.Name)
+		}
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	profiles, err := GetProfiles()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(profiles)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleProfileResolve returns the profile settings of a client to the
+// client, encrypted with the mnms public key.
+//
+// POST /api/v1/profiles/resolve
+//
+//	Example parameter: {"client": "client1"}
+//	Example return: {"profile": "k3Jx..."}
+func HandleProfileResolve(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Client string `json:"client"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	setAuditDetail(r, "resolve profile for %s", body.Client)
+	profiles, err := cachedProfiles()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	plain, err := json.Marshal(clientProfile(profiles, body.Client))
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	publicKey, err := ownPublicKey()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	encrypted, err := EncryptWithPublicKey(plain, publicKey)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(map[string]string{"profile": string(encrypted)})
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleProfileDrift returns the clients that drift from their profile.
+//
+// GET /api/v1/profiles/drift
+//
+//	Example return: [{"client": "client1", "profile": {"intervals.gwd": "120"}, "hash": "3f2a9c01", "applied": "3f2a9c01", "settings": [{"key": "intervals.gwd", "expected": "120", "actual": 60, "source": "flag"}]}]
+func HandleProfileDrift(w http.ResponseWriter, r *http.Request) {
+	drift, err := GetProfileDrift()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(drift)
+	if err != nil {
+		q.Q(err)
+	}
+}
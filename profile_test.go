@@ -0,0 +1,193 @@
+package mnms
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// TestProfiles tests pushing client profiles and finding drift
+func TestProfiles(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	restoreSettings(t)
+	QC.ClientMutex.Lock()
+	QC.Clients["pclient1"] = ClientInfo{Name: "pclient1"}
+	QC.Clients["pclient2"] = ClientInfo{Name: "pclient2"}
+	QC.ClientMutex.Unlock()
+	defer func() {
+		QC.ClientMutex.Lock()
+		delete(QC.Clients, "pclient1")
+		delete(QC.Clients, "pclient2")
+		QC.ClientMutex.Unlock()
+		QC.CmdMutex.Lock()
+		for k := range QC.CmdData {
+			if strings.Contains(k, " config profile ") {
+				delete(QC.CmdData, k)
+			}
+		}
+		QC.CmdMutex.Unlock()
+	}()
+
+	for _, p := range []ClientProfile{
+		{Name: "bad", Settings: map[string]string{"name": "x"}},
+		{Name: "bad", Settings: map[string]string{"intervals.gwd": "-1"}},
+		{Name: "bad", Settings: map[string]string{"syslog.localPath": "a b"}},
+		{Name: DefaultProfile, Clients: []string{"pclient1"}},
+	} {
+		if err = SetProfile(p); err == nil {
+			t.Fatal("expect invalid profile to fail", p)
+		}
+	}
+	err = SetProfile(ClientProfile{Name: DefaultProfile, Settings: map[string]string{"intervals.gwd": "120", "syslog.compress": "false"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetProfile(ClientProfile{Name: "plant1", Clients: []string{"pclient1"}, Settings: map[string]string{"intervals.gwd": "30", "snmp.community": "plant1secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetProfile(ClientProfile{Name: "plant2", Clients: []string{"pclient1"}}); err == nil {
+		t.Fatal("expect client in two profiles to fail")
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := clientProfile(c.Profiles, "pclient1")
+	if m["intervals.gwd"] != "30" || m["syslog.compress"] != "false" {
+		t.Fatal("unexpected profile", m)
+	}
+	// the settings are not in the command, they may be secrets
+	cmd := profileCmd(m)
+	if cmd != "config profile "+profileHash(m) {
+		t.Fatal("unexpected profile command", cmd)
+	}
+	QC.CmdMutex.Lock()
+	_, ok := QC.CmdData["@pclient1 "+cmd]
+	QC.CmdMutex.Unlock()
+	if !ok {
+		t.Fatal("expect profile pushed to pclient1")
+	}
+
+	// the client fetches the profile from root, applies and keeps it
+	handler := jwtauth.Verifier(jwtTokenAuth)(requirePermission(PermSettingsWrite)(http.HandlerFunc(HandleProfileResolve)))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	isRoot, rootURL, adminToken := QC.IsRoot, QC.RootURL, QC.AdminToken
+	defer func() {
+		QC.IsRoot, QC.RootURL, QC.AdminToken = isRoot, rootURL, adminToken
+	}()
+	QC.IsRoot = false
+	QC.RootURL = srv.URL
+	QC.AdminToken, err = GetToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	QC.Name = "pclient1"
+	file := t.TempDir() + "/mnms.yaml"
+	err = os.WriteFile(file, []byte("version: 1\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadSettings(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(profilePath("pclient1"))
+	cmdinfo := ConfigProfileCmd(&CmdInfo{Command: cmd})
+	if cmdinfo.Status != "ok" || QC.GwdInterval != 30 || QC.SyslogCompress || QC.SnmpOptions.Community != "plant1secret" ||
+		AppliedProfile() != profileHash(m) {
+		t.Fatal("expect profile applied", cmdinfo.Status, QC.GwdInterval, QC.SyslogCompress)
+	}
+	if cmdinfo = ConfigProfileCmd(&CmdInfo{Command: "config profile 00000000 intervals.gwd=1"}); cmdinfo.Status == "ok" {
+		t.Fatal("expect hash mismatch to fail")
+	}
+	values, hash, err := loadProfile("pclient1")
+	if err != nil || hash != profileHash(m) || values["intervals.gwd"] != 30 {
+		t.Fatal("expect saved profile", values, hash, err)
+	}
+	t.Setenv("MNMS_INTERVALS_GWD", "45")
+	_, _, err = ReloadSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	QC.ClientMutex.Lock()
+	QC.Clients["pclient1"] = ClientInfo{Name: "pclient1", Settings: RegisteredSettings(), Profile: AppliedProfile()}
+	QC.ClientMutex.Unlock()
+	all, err := GetProfileDrift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other tests may have registered clients
+	drift := []ClientDrift{}
+	for _, d := range all {
+		if strings.HasPrefix(d.Client, "pclient") {
+			drift = append(drift, d)
+		}
+	}
+	if len(drift) != 2 || drift[0].Client != "pclient1" || len(drift[0].Settings) != 1 ||
+		drift[0].Settings[0].Key != "intervals.gwd" || drift[0].Settings[0].Source != SettingEnv {
+		t.Fatal("expect drift of pclient1 by env and pclient2 not applied", drift)
+	}
+	if drift[1].Client != "pclient2" || drift[1].Applied != "" {
+		t.Fatal("unexpected drift of pclient2", drift[1])
+	}
+	if drift[0].Profile["snmp.community"] != secretMask {
+		t.Fatal("expect masked community in the drift", drift[0].Profile)
+	}
+	if fi, err := os.Stat(profilePath("pclient1")); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatal("expect saved profile readable by the owner only", fi, err)
+	}
+	// a differing secret is reported without its value
+	QC.ClientMutex.Lock()
+	ci := QC.Clients["pclient1"]
+	ci.Settings = append([]Setting{}, ci.Settings...)
+	for i := range ci.Settings {
+		if ci.Settings[i].Key == "snmp.community" {
+			if ci.Settings[i].Value != settingHash("plant1secret") {
+				t.Error("expect the hash of the community registered", ci.Settings[i])
+			}
+			ci.Settings[i].Value = settingHash("other")
+		}
+	}
+	QC.Clients["pclient1"] = ci
+	QC.ClientMutex.Unlock()
+	all, err = GetProfileDrift()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, d := range all {
+		for _, s := range d.Settings {
+			if d.Client == "pclient1" && s.Key == "snmp.community" {
+				found = s.Expected == secretMask && s.Actual == secretMask
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expect masked community drift", all)
+	}
+
+	err = DeleteProfile("plant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	QC.CmdMutex.Lock()
+	_, ok = QC.CmdData["@pclient1 "+profileCmd(clientProfile(c.Profiles, "pclient2"))]
+	QC.CmdMutex.Unlock()
+	if !ok {
+		t.Fatal("expect default profile pushed to pclient1")
+	}
+}
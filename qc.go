@@ -8,7 +8,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/gosnmp/gosnmp"
 	"github.com/qeof/q"
 )
@@ -27,15 +26,35 @@ type QContext struct {
 	ClientMutex               sync.Mutex
 	Clients                   map[string]ClientInfo
 	Logs                      map[string]Log
+	SyslogMutex               sync.Mutex
 	RemoteSyslogServer        net.Conn
 	RemoteSyslogServerAddr    string
 	SyslogLocalPath           string
 	SyslogFileSize            uint
 	SyslogCompress            bool
+	SyslogKeepLocal           bool
+	SyslogRetentionDays       int
+	SyslogRetentionBudget     uint
 	MqttBrokerAddr            string
+	MqttNorthbound            bool
+	MqttTopicPrefix           string
+	MqttCommands              bool
+	MqttAuth                  bool
+	MqttTLSAddr               string
+	MqttTLSCert               string
+	MqttTLSKey                string
+	MqttWebSocketAddr         string
+	SparkplugBroker           string
+	SparkplugGroup            string
+	SparkplugCredential       string
+	SparkplugCA               string
+	SparkplugInterval         int
+	OpcuaServerURL            string
+	OpcuaInterval             int
+	OpcuaAnonymous            bool
+	OpcuaSecurityNone         bool
 	SyslogServerAddr          string
 	TrapServerAddr            string
-	WebSocketClient           map[*websocket.Conn]bool
 	WebSocketMessageBroadcast chan WebSocketMessage
 	CmdInterval               int
 	RegisterInterval          int
@@ -55,8 +74,13 @@ func init() {
 	QC.MqttBrokerAddr = ":11883"             // ":1883"
 	QC.SyslogServerAddr = ":5514"            // ":514"
 	QC.TrapServerAddr = ":5162"              // ":162"
+	QC.MqttTopicPrefix = "mnms"
+	QC.SparkplugGroup = "mnms"
+	QC.SparkplugInterval = 60
+	QC.OpcuaInterval = 60
+	QC.OpcuaAnonymous = false
+	QC.OpcuaSecurityNone = true
 	QC.WebSocketMessageBroadcast = make(chan WebSocketMessage, 100)
-	QC.WebSocketClient = make(map[*websocket.Conn]bool)
 	QC.TopologyData = make(map[string]Topology)
 	QC.CmdInterval = 5
 	QC.RegisterInterval = 60
@@ -83,6 +107,9 @@ type ClientInfo struct {
 	Now             int
 	NumGoroutines   int
 	IPAddresses     []string
+	Port            int
+	Settings        []Setting `json:",omitempty"`
+	Profile         string    `json:",omitempty"` // hash of the applied profile
 }
 
 func RegisterMain() {
@@ -103,6 +130,9 @@ func RegisterMain() {
 			Now:             int(time.Now().Unix()),
 			NumGoroutines:   runtime.NumGoroutine(),
 			IPAddresses:     ips,
+			Port:            QC.Port,
+			Settings:        RegisteredSettings(),
+			Profile:         AppliedProfile(),
 		}
 		jsonBytes, err := json.Marshal(ci)
 		if err != nil {
@@ -118,6 +148,6 @@ func RegisterMain() {
 			// save close, resp should not be nil here
 			resp.Body.Close()
 		}
-		time.Sleep(time.Duration(QC.RegisterInterval) * time.Second) // XXX
+		time.Sleep(time.Duration(ReadSetting(&QC.RegisterInterval)) * time.Second) // XXX
 	}
 }
@@ -0,0 +1,545 @@
+package mnms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/qeof/q"
+)
+
+/*
+	Role based access control.
+
+	A role is a set of permissions on API areas, the command verbs its
+	users may run and the device groups the commands may target. The
+	admin, superuser and user roles are built in, custom roles and device
+	groups are kept in the mnms config.
+
+	Permissions are "area:read" or "area:write", "area:*" or "*" for all.
+	Commands are matched by their leading words, "config local syslog"
+	allows all local syslog configuration commands, "*" allows all. An
+	empty device group list puts all devices in scope.
+*/
+
+const (
+	PermCommandsRead  = "commands:read"
+	PermCommandsWrite = "commands:write"
+	PermDevicesRead   = "devices:read"
+	PermDevicesWrite  = "devices:write"
+	PermTopologyRead  = "topology:read"
+	PermTopologyWrite = "topology:write"
+	PermLogsRead      = "logs:read"
+	PermLogsWrite     = "logs:write"
+	PermSyslogsRead   = "syslogs:read"
+	PermUsersRead     = "users:read"
+	PermUsersWrite    = "users:write"
+	PermFilesRead     = "files:read"
+)
+
+// ErrPermissionDenied is returned when a role lacks a permission.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// RoleConfig is a named set of permissions.
+type RoleConfig struct {
+	Name         string   `json:"name"`
+	Permissions  []string `json:"permissions"`
+	Commands     []string `json:"commands"`
+	DeviceGroups []string `json:"deviceGroups,omitempty"`
+}
+
+// DeviceGroup is a named set of devices.
+type DeviceGroup struct {
+	Name string   `json:"name"`
+	Macs []string `json:"macs"`
+}
+
+var userPermissions = []string{PermCommandsRead, PermDevicesRead, PermTopologyRead,
+	PermLogsRead, PermUsersRead, PermFilesRead}
+
+// BuiltinRoles are the roles every mnms knows.
+var BuiltinRoles = []RoleConfig{
+	{Name: MNMSAdminRole, Permissions: []string{"*"}, Commands: []string{"*"}},
+	{
+		Name: MNMSSuperUserRole,
+		Permissions: append([]string{PermCommandsWrite, PermDevicesWrite, PermTopologyWrite,
+			PermLogsWrite, PermSyslogsRead, PermCredentialsRead, PermSettingsRead, PermMqttRead, PermMqttWrite,
+			PermOpcuaRead, PermOpcuaWrite}, userPermissions...),
+		Commands: []string{"*"},
+	},
+	{Name: MNMSUserRole, Permissions: userPermissions},
+}
+
+var macRegexp = regexp.MustCompile(`(?i)\b[0-9a-f]{2}(?:[-:][0-9a-f]{2}){5}\b`)
+
+type rbacContextKey struct{}
+
+type rbacKeyContextKey struct{}
+
+// Allows reports whether the role has permission perm.
+func (role *RoleConfig) Allows(perm string) bool {
+	area, _, _ := strings.Cut(perm, ":")
+	for _, p := range role.Permissions {
+		if p == "*" || p == perm || p == area+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsCommand reports whether the role may run cmd.
+func (role *RoleConfig) AllowsCommand(cmd string) bool {
+	for _, c := range role.Commands {
+		if c == "*" || cmd == c || strings.HasPrefix(cmd, c+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDevice reports whether the device with mac is in scope of the role.
+func (role *RoleConfig) AllowsDevice(mac string, groups []DeviceGroup) bool {
+	if len(role.DeviceGroups) == 0 {
+		return true
+	}
+	mac = strings.ReplaceAll(mac, ":", "-")
+	for _, name := range role.DeviceGroups {
+		if name == "*" {
+			return true
+		}
+		for _, g := range groups {
+			if g.Name == name && containsFold(g.Macs, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findRole(c *MNMSConfig, name string) (*RoleConfig, error) {
+	for i := range BuiltinRoles {
+		if BuiltinRoles[i].Name == name {
+			return &BuiltinRoles[i], nil
+		}
+	}
+	if c != nil {
+		for i := range c.Roles {
+			if c.Roles[i].Name == name {
+				return &c.Roles[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("role %s not exist", name)
+}
+
+// GetRole returns the built in or custom role with the name.
+func GetRole(name string) (*RoleConfig, error) {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		c = nil
+	}
+	return findRole(c, name)
+}
+
+// GetRoles returns the built in and custom roles.
+func GetRoles() []RoleConfig {
+	roles := append([]RoleConfig{}, BuiltinRoles...)
+	c, err := GetMNMSConfig()
+	if err == nil {
+		roles = append(roles, c.Roles...)
+	}
+	return roles
+}
+
+// SetRole adds or replaces a custom role.
+func SetRole(role RoleConfig) error {
+	if role.Name == "" {
+		return fmt.Errorf("role name required")
+	}
+	for _, r := range BuiltinRoles {
+		if r.Name == role.Name {
+			return fmt.Errorf("role %s is built in", role.Name)
+		}
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, g := range role.DeviceGroups {
+			if g != "*" && findDeviceGroup(c, g) == nil {
+				return fmt.Errorf("device group %s not exist", g)
+			}
+		}
+		for i, r := range c.Roles {
+			if r.Name == role.Name {
+				c.Roles[i] = role
+				return nil
+			}
+		}
+		c.Roles = append(c.Roles, role)
+		return nil
+	})
+}
+
+// DeleteRole deletes a custom role no user has.
+func DeleteRole(name string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, u := range c.Users {
+			if u.Role == name {
+				return fmt.Errorf("role %s is used by user %s", name, u.Name)
+			}
+		}
+		for i, r := range c.Roles {
+			if r.Name == name {
+				c.Roles = append(c.Roles[:i], c.Roles[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("role %s not exist", name)
+	})
+}
+
+func findDeviceGroup(c *MNMSConfig, name string) *DeviceGroup {
+	for i := range c.DeviceGroups {
+		if c.DeviceGroups[i].Name == name {
+			return &c.DeviceGroups[i]
+		}
+	}
+	return nil
+}
+
+// SetDeviceGroup adds or replaces a device group.
+func SetDeviceGroup(group DeviceGroup) error {
+	if group.Name == "" || group.Name == "*" {
+		return fmt.Errorf("invalid device group name %q", group.Name)
+	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		if g := findDeviceGroup(c, group.Name); g != nil {
+			*g = group
+		} else {
+			c.DeviceGroups = append(c.DeviceGroups, group)
+		}
+		return nil
+	})
+}
+
+// DeleteDeviceGroup deletes a device group no role refers to.
+func DeleteDeviceGroup(name string) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for _, r := range c.Roles {
+			for _, g := range r.DeviceGroups {
+				if g == name {
+					return fmt.Errorf("device group %s is used by role %s", name, r.Name)
+				}
+			}
+		}
+		for i, g := range c.DeviceGroups {
+			if g.Name == name {
+				c.DeviceGroups = append(c.DeviceGroups[:i], c.DeviceGroups[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("device group %s not exist", name)
+	})
+}
+
+// CheckCommandPermission checks that user may run cmd on the devices it
+// names.
+func CheckCommandPermission(user *UserConfig, cmd string) error {
+	c, err := GetMNMSConfig()
+	if err != nil {
+		c = nil
+	}
+	role, err := findRole(c, user.Role)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	cmd = clientCommand(cmd)
+	if !role.AllowsCommand(cmd) {
+		verb, _, _ := strings.Cut(cmd, " ")
+		return fmt.Errorf("%w: role %s may not run %s", ErrPermissionDenied, role.Name, verb)
+	}
+	var groups []DeviceGroup
+	if c != nil {
+		groups = c.DeviceGroups
+	}
+	for _, mac := range commandDevices(cmd) {
+		if !role.AllowsDevice(mac, groups) {
+			return fmt.Errorf("%w: device %s not in scope of role %s", ErrPermissionDenied, mac, role.Name)
+		}
+	}
+	return nil
+}
+
+// clientCommand returns cmd without the @client prefix of client commands.
+func clientCommand(cmd string) string {
+	if strings.HasPrefix(cmd, "@") {
+		_, cmd, _ = strings.Cut(cmd, " ")
+	}
+	return cmd
+}
+
+// commandDevices returns the macs of the devices cmd names, by mac, by ip
+// address or by hostname.
+func commandDevices(cmd string) []string {
+	macs := macRegexp.FindAllString(cmd, -1)
+	args := strings.Fields(cmd)
+	if len(args) < 2 {
+		return macs
+	}
+	QC.DevMutex.Lock()
+	defer QC.DevMutex.Unlock()
+	for _, arg := range args[1:] {
+		ip := net.ParseIP(arg) != nil
+		for _, dev := range QC.DevData {
+			if ip && dev.IPAddress == arg ||
+				dev.Hostname != "" && strings.EqualFold(dev.Hostname, arg) {
+				macs = append(macs, dev.Mac)
+			}
+		}
+	}
+	return macs
+}
+
+// deviceInScope reports whether user may see the device with mac, a nil
+// user sees all devices.
+func deviceInScope(user *UserConfig, mac string) bool {
+	if user == nil {
+		return true
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		c = nil
+	}
+	role, err := findRole(c, user.Role)
+	if err != nil {
+		return false
+	}
+	if c == nil {
+		return role.AllowsDevice(mac, nil)
+	}
+	return role.AllowsDevice(mac, c.DeviceGroups)
+}
+
+// devicesInScope returns the devices of devs user may see.
+func devicesInScope(user *UserConfig, devs map[string]DevInfo) map[string]DevInfo {
+	if user == nil {
+		return devs
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		c = nil
+	}
+	role, err := findRole(c, user.Role)
+	if err != nil {
+		return map[string]DevInfo{}
+	}
+	if len(role.DeviceGroups) == 0 {
+		return devs
+	}
+	var groups []DeviceGroup
+	if c != nil {
+		groups = c.DeviceGroups
+	}
+	ret := make(map[string]DevInfo)
+	for k, v := range devs {
+		if k == specialMac || role.AllowsDevice(v.Mac, groups) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// userFromContext returns the user authenticated by JWTAuthenticatorPermission.
+func userFromContext(ctx context.Context) *UserConfig {
+	u, _ := ctx.Value(rbacContextKey{}).(*UserConfig)
+	return u
+}
+
+// apiKeyFromContext returns the API key authenticated by
+// JWTAuthenticatorPermission, nil for a JWT.
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(rbacKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// userFromRequest authenticates the API key or the verified JWT of r.
+func userFromRequest(r *http.Request) (*UserConfig, *APIKey, error) {
+	if apikey := apiKeyFromRequest(r); apikey != "" {
+		return authenticateAPIKey(apikey)
+	}
+	token, _, err := jwtauth.FromContext(r.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	if token == nil || jwt.Validate(token) != nil {
+		return nil, nil, errors.New(http.StatusText(http.StatusUnauthorized))
+	}
+	err = checkTokenSession(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	userRaw, _ := token.Get("user")
+	userString, ok := userRaw.(string)
+	if !ok {
+		q.Q("no user", token)
+		return nil, nil, errors.New(http.StatusText(http.StatusUnauthorized))
+	}
+	u, err := GetUserConfig(userString)
+	if err != nil {
+		q.Q("GetUserConfig fail", err)
+		return nil, nil, err
+	}
+	return u, nil, nil
+}
+
+// JWTAuthenticatorPermission is an authentication middleware like
+// JWTAuthenticatorRole which lets users through whose role has
+// permission perm, any user when perm is empty. API keys are accepted
+// as bearer tokens, limited to their scopes. The user and key are stored
+// in the request context.
+func JWTAuthenticatorPermission(perm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, key, err := userFromRequest(r)
+		if err != nil {
+			q.Q(err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		userString := u.Name
+		setAuditUser(r, userString)
+		role, err := GetRole(u.Role)
+		if perm != "" && (err != nil || !role.Allows(perm) || (key != nil && !key.Allows(perm))) {
+			q.Q("permission denied", userString, perm)
+			http.Error(w, fmt.Sprintf("user %s has no %s permission", userString, perm), http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), rbacContextKey{}, u)
+		if key != nil {
+			ctx = context.WithValue(ctx, rbacKeyContextKey{}, key)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// canManageUser reports whether self may manage the sessions and second
+// factors of user, its own or all with users:write permission.
+func canManageUser(self *UserConfig, user string) bool {
+	if self.Name == user {
+		return true
+	}
+	role, err := GetRole(self.Role)
+	return err == nil && role.Allows(PermUsersWrite)
+}
+
+// checkManageUser answers forbidden unless the user of r may manage
+// user.
+func checkManageUser(w http.ResponseWriter, r *http.Request, user string) bool {
+	self := userFromContext(r.Context())
+	if self == nil || !canManageUser(self, user) {
+		http.Error(w, fmt.Sprintf("no %s permission to manage user %s", PermUsersWrite, user), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requirePermission returns middleware enforcing perm.
+func requirePermission(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return JWTAuthenticatorPermission(perm, next)
+	}
+}
+
+// HandleRoles handles role requests
+//
+// GET /api/v1/roles
+//
+//	returns built in and custom roles
+//
+// POST /api/v1/roles
+//
+//	Example parameter: {"name": "operator", "permissions": ["devices:read", "commands:*"],
+//	                    "commands": ["beep", "scan", "config local syslog"], "deviceGroups": ["plant1"]}
+//
+// DELETE /api/v1/roles
+//
+//	Example parameter: {"name": "operator"}
+func HandleRoles(w http.ResponseWriter, r *http.Request) {
+	var role RoleConfig
+	if r.Method == "POST" || r.Method == "DELETE" {
+		err := json.NewDecoder(r.Body).Decode(&role)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		setAuditDetail(r, "role %s", role.Name)
+	}
+	var err error
+	switch r.Method {
+	case "POST":
+		err = SetRole(role)
+	case "DELETE":
+		err = DeleteRole(role.Name)
+	}
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(GetRoles())
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleDeviceGroups handles device group requests
+//
+// GET /api/v1/devicegroups
+//
+// POST /api/v1/devicegroups
+//
+//	Example parameter: {"name": "plant1", "macs": ["00-60-E9-18-3C-3C", "00-60-E9-18-3C-3D"]}
+//
+// DELETE /api/v1/devicegroups
+//
+//	Example parameter: {"name": "plant1"}
+func HandleDeviceGroups(w http.ResponseWriter, r *http.Request) {
+	var group DeviceGroup
+	if r.Method == "POST" || r.Method == "DELETE" {
+		err := json.NewDecoder(r.Body).Decode(&group)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		setAuditDetail(r, "device group %s", group.Name)
+	}
+	var err error
+	switch r.Method {
+	case "POST":
+		err = SetDeviceGroup(group)
+	case "DELETE":
+		err = DeleteDeviceGroup(group.Name)
+	}
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	c, err := GetMNMSConfig()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	groups := c.DeviceGroups
+	if groups == nil {
+		groups = []DeviceGroup{}
+	}
+	err = json.NewEncoder(w).Encode(groups)
+	if err != nil {
+		q.Q(err)
+	}
+}
@@ -0,0 +1,208 @@
+package mnms
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// TestRBACRole tests permission and command matching of roles
+func TestRBACRole(t *testing.T) {
+	role := RoleConfig{
+		Name:        "operator",
+		Permissions: []string{PermDevicesRead, "commands:*"},
+		Commands:    []string{"beep", "config local syslog"},
+	}
+	if !role.Allows(PermDevicesRead) || !role.Allows(PermCommandsWrite) {
+		t.Fatal("expect devices:read and commands:write")
+	}
+	if role.Allows(PermDevicesWrite) || role.Allows(PermUsersWrite) {
+		t.Fatal("unexpected permission")
+	}
+	if !role.AllowsCommand("beep 00-60-E9-18-3C-3C") || !role.AllowsCommand("config local syslog path /tmp/x") {
+		t.Fatal("expect command to be allowed")
+	}
+	if role.AllowsCommand("beeper 00-60-E9-18-3C-3C") || role.AllowsCommand("reset 00-60-E9-18-3C-3C") {
+		t.Fatal("unexpected command allowed")
+	}
+	admin, err := GetRole(MNMSAdminRole)
+	if err != nil || !admin.Allows(PermUsersWrite) || !admin.AllowsCommand("reset 00-60-E9-18-3C-3C") {
+		t.Fatal("expect admin to be allowed everything", err)
+	}
+	user, err := GetRole(MNMSUserRole)
+	if err != nil || user.Allows(PermCommandsWrite) || user.AllowsCommand("beep 00-60-E9-18-3C-3C") {
+		t.Fatal("expect user to be read only", err)
+	}
+}
+
+// TestRBACCommandPermission tests command and device scope checks
+func TestRBACCommandPermission(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+
+	err = SetRole(RoleConfig{Name: "operator", Permissions: []string{"commands:*"},
+		Commands: []string{"beep"}, DeviceGroups: []string{"plant1"}})
+	if err == nil {
+		t.Fatal("expect missing device group to fail")
+	}
+	err = SetDeviceGroup(DeviceGroup{Name: "plant1", Macs: []string{"00-60-E9-18-3C-3C"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetRole(RoleConfig{Name: "operator", Permissions: []string{"commands:*"},
+		Commands: []string{"beep"}, DeviceGroups: []string{"plant1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetRole(RoleConfig{Name: MNMSAdminRole}); err == nil {
+		t.Fatal("expect built in role to be read only")
+	}
+	err = AddUserConfig("op", "operator", "tA%@18632Nest", "op@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = AddUserConfig("bad", "norole", "tA%@18632Nest", "bad@test.com"); err == nil {
+		t.Fatal("expect unknown role to fail")
+	}
+	op, err := GetUserConfig("op")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckCommandPermission(op, "beep 00:60:e9:18:3c:3c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckCommandPermission(op, "@client1 beep 00-60-E9-18-3C-3C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckCommandPermission(op, "beep 00-60-E9-18-3C-3D")
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatal("expect device out of scope", err)
+	}
+	err = CheckCommandPermission(op, "reset 00-60-E9-18-3C-3C")
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatal("expect command to be denied", err)
+	}
+	// a device named by ip address or hostname is in scope of its mac
+	QC.DevMutex.Lock()
+	QC.DevData["00-60-E9-18-3C-3D"] = DevInfo{Mac: "00-60-E9-18-3C-3D", IPAddress: "10.0.50.9", Hostname: "line2"}
+	QC.DevMutex.Unlock()
+	defer func() {
+		QC.DevMutex.Lock()
+		delete(QC.DevData, "00-60-E9-18-3C-3D")
+		QC.DevMutex.Unlock()
+	}()
+	for _, cmd := range []string{"beep 10.0.50.9", "beep LINE2"} {
+		err = CheckCommandPermission(op, cmd)
+		if !errors.Is(err, ErrPermissionDenied) {
+			t.Fatal("expect device out of scope", cmd, err)
+		}
+	}
+	devs := devicesInScope(op, map[string]DevInfo{
+		"00-60-E9-18-3C-3C": {Mac: "00-60-E9-18-3C-3C"},
+		"00-60-E9-18-3C-3D": {Mac: "00-60-E9-18-3C-3D"},
+	})
+	if len(devs) != 1 {
+		t.Fatal("expect one device in scope", devs)
+	}
+
+	if err = DeleteRole("operator"); err == nil {
+		t.Fatal("expect role in use to be kept")
+	}
+	if err = DeleteDeviceGroup("plant1"); err == nil {
+		t.Fatal("expect device group in use to be kept")
+	}
+}
+
+// TestRBACMiddleware tests enforcement of permissions on api routes
+func TestRBACMiddleware(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	err = AddUserConfig("viewer", MNMSUserRole, "tA%@18632Nest", "viewer@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetDeviceGroup(DeviceGroup{Name: "plant1", Macs: []string{"00-60-E9-18-3C-3C"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetRole(RoleConfig{Name: "beeper", Permissions: []string{PermCommandsWrite},
+		Commands: []string{"beep"}, DeviceGroups: []string{"plant1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AddUserConfig("beeper", "beeper", "tA%@18632Nest", "beeper@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := jwtauth.Verifier(jwtTokenAuth)(requirePermission(PermCommandsWrite)(http.HandlerFunc(HandleCommands)))
+	post := func(user, body string) *httptest.ResponseRecorder {
+		token, err := GetToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/commands", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("viewer", `{"beep 00-60-E9-18-3C-3C":{}}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("expect forbidden, got", rec.Code)
+	}
+
+	rec = post("beeper", `{"reset 00-60-E9-18-3C-3C":{}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("expect ok, got", rec.Code)
+	}
+	QC.CmdMutex.Lock()
+	cmdinfo := QC.CmdData["reset 00-60-E9-18-3C-3C"]
+	QC.CmdMutex.Unlock()
+	if !strings.HasPrefix(cmdinfo.Status, "error: permission denied") {
+		t.Fatal("expect command to be denied", cmdinfo)
+	}
+
+	// the checked key must be the command that runs
+	rec = post("beeper", `{"beep 00-60-E9-18-3C-3C":{"command":"reset 00-60-E9-18-3C-3C"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("expect ok, got", rec.Code)
+	}
+	QC.CmdMutex.Lock()
+	cmdinfo = QC.CmdData["beep 00-60-E9-18-3C-3C"]
+	QC.CmdMutex.Unlock()
+	if cmdinfo.Status != "error: command does not match" || cmdinfo.Command != "beep 00-60-E9-18-3C-3C" {
+		t.Fatal("expect mismatched command to be rejected", cmdinfo)
+	}
+	// a status update keeps the command it was posted with
+	rec = post("beeper", `{"reset 00-60-E9-18-3C-3C":{"command":"reset 00-60-E9-18-3C-3C","status":"pending: retry"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatal("expect ok, got", rec.Code)
+	}
+	QC.CmdMutex.Lock()
+	cmdinfo = QC.CmdData["reset 00-60-E9-18-3C-3C"]
+	QC.CmdMutex.Unlock()
+	if !strings.HasPrefix(cmdinfo.Status, "error: permission denied") {
+		t.Fatal("expect denied command to stay denied", cmdinfo)
+	}
+}
@@ -0,0 +1,129 @@
+package mnms
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Recovery codes.
+
+	Turning on 2FA returns ten one-time recovery codes. A code is
+	accepted by /api/v1/2fa/validate in place of a TOTP code or security
+	key when the authenticator is lost, and is used up. Only hashes of
+	the codes are stored.
+*/
+
+const recoveryCodeCount = 10
+
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// generateRecoveryCodes returns new recovery codes and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		s, err := randomHex(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode checks code against the recovery codes of user and
+// uses it up. The code is removed in the config transaction which checks
+// it, so a code used at the same time by another login fails.
+func useRecoveryCode(user, code string) error {
+	if code == "" {
+		return errors.New("recovery code is empty")
+	}
+	hash := recoveryCodeHash(code)
+	return modifyUser(user, func(u *UserConfig) error {
+		for i, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				q.Q("recovery code used", user, len(u.RecoveryCodes))
+				return nil
+			}
+		}
+		return errors.New("invalid recovery code")
+	})
+}
+
+// disable2FAIfNoFactor turns off 2fa of u when it has neither TOTP nor
+// security keys left.
+func disable2FAIfNoFactor(u *UserConfig) {
+	if u.Secret == "" && len(u.WebAuthn) == 0 {
+		u.Enable2FA = false
+		u.RecoveryCodes = nil
+	}
+}
+
+// HandleRecoveryCodes replaces the recovery codes of a user. Users
+// replace their own codes, users with users:write permission those of
+// all users.
+//
+// POST /api/v1/2fa/recovery
+//
+//	Example parameter: {"user": "user1"}
+//	Example return: {"user": "user1", "recoveryCodes": ["4f2a1-9be07", "03c9d-e1a52", ...]}
+func HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	self := userFromContext(r.Context())
+	if self == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		User string `json:"user"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	if body.User == "" {
+		body.User = self.Name
+	}
+	if !checkManageUser(w, r, body.User) {
+		return
+	}
+	setAuditDetail(r, "recovery codes of user %s", body.User)
+	var codes []string
+	err = modifyUser(body.User, func(u *UserConfig) error {
+		if !u.Enable2FA {
+			return errors.New("2fa not enabled")
+		}
+		var hashes []string
+		var err error
+		codes, hashes, err = generateRecoveryCodes()
+		if err != nil {
+			return err
+		}
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(map[string]any{"user": body.User, "recoveryCodes": codes})
+	if err != nil {
+		q.Q(err)
+	}
+}
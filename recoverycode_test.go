@@ -0,0 +1,126 @@
+package mnms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// TestRecoveryCodes tests TOTP enrollment, hidden secrets and one time
+// recovery codes
+func TestRecoveryCodes(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	cleanSessions(t)
+	defer cleanSessions(t)
+
+	for _, u := range []string{"op1", "op2"} {
+		err = AddUserConfig(u, MNMSUserRole, "OpPass#2023", u+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := jwtauth.Verifier(jwtTokenAuth)(requirePermission("")(http.HandlerFunc(Handle2FA)))
+	call := func(user, method, target, body string) *httptest.ResponseRecorder {
+		token, err := GetToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := call("op2", "POST", "/api/v1/2fa/secret", `{"user":"op1"}`); rec.Code != http.StatusForbidden {
+		t.Fatal("expect enrolling another user to fail, got", rec.Code)
+	}
+	rec := call("op1", "POST", "/api/v1/2fa/secret", `{"user":"op1"}`)
+	var enroll struct {
+		Secret        string   `json:"secret"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &enroll)
+	if err != nil || enroll.Secret == "" || len(enroll.RecoveryCodes) != recoveryCodeCount {
+		t.Fatal("expect secret and recovery codes on enrollment", rec.Body.String())
+	}
+	rec = call("admin", "GET", "/api/v1/2fa/secret?user=op1", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), enroll.Secret) {
+		t.Fatal("expect status without the secret", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"recoveryCodes":10`) {
+		t.Fatal("expect recovery code count", rec.Body.String())
+	}
+
+	u, err := GetUserConfig("op1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validate := func(code string) int {
+		sessionID, err := createLoginSession(*u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(map[string]string{"sessionID": sessionID, "recoveryCode": code})
+		rec := httptest.NewRecorder()
+		HandleValidate2FA(rec, httptest.NewRequest("POST", "/api/v1/2fa/validate", strings.NewReader(string(body))))
+		return rec.Code
+	}
+	code := strings.ToUpper(enroll.RecoveryCodes[3])
+	if c := validate(code); c != http.StatusOK {
+		t.Fatal("expect recovery code login, got", c)
+	}
+	if c := validate(code); c != http.StatusUnauthorized {
+		t.Fatal("expect used recovery code to fail, got", c)
+	}
+	// a code is used once when two logins send it at the same time
+	code = enroll.RecoveryCodes[4]
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			codes <- validate(code)
+		}()
+	}
+	if c1, c2 := <-codes, <-codes; c1+c2 != http.StatusOK+http.StatusUnauthorized {
+		t.Fatal("expect one login with the recovery code, got", c1, c2)
+	}
+	if c := validate("00000-00000"); c != http.StatusUnauthorized {
+		t.Fatal("expect unknown recovery code to fail, got", c)
+	}
+
+	// a login session ends after too many wrong codes
+	sessionID, err := createLoginSession(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxLoginSessionFailures; i++ {
+		body, _ := json.Marshal(map[string]string{"sessionID": sessionID, "code": "000000"})
+		rec = httptest.NewRecorder()
+		HandleValidate2FA(rec, httptest.NewRequest("POST", "/api/v1/2fa/validate", strings.NewReader(string(body))))
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatal("expect wrong code to fail, got", rec.Code)
+		}
+	}
+	if _, err = getLoginSession(sessionID); err == nil {
+		t.Fatal("expect login session to end")
+	}
+
+	// removing the only factor turns 2fa off
+	if rec = call("op1", "DELETE", "/api/v1/2fa/secret", `{"user":"op1"}`); rec.Code != http.StatusOK {
+		t.Fatal("expect 2fa removed, got", rec.Code, rec.Body.String())
+	}
+	u, err = GetUserConfig("op1")
+	if err != nil || u.Enable2FA || u.Secret != "" || len(u.RecoveryCodes) != 0 {
+		t.Fatal("expect 2fa off", u, err)
+	}
+}
@@ -13,7 +13,7 @@ func retrieveRootCmd(cmddata map[string]CmdInfo) {
 	}
 
 	for k, v := range cmddata {
-		if strings.HasPrefix(k, "config local syslog ") {
+		if strings.HasPrefix(k, "config local syslog ") && !strings.HasPrefix(v.Status, "error:") {
 			cmd := v
 			cmd.Name = QC.Name
 			if cmd.Command == "" {
@@ -46,6 +46,18 @@ func configOfLocalSyslogCmd(cmdinfo *CmdInfo) *CmdInfo {
 		return SyslogSetCompressCmd(cmdinfo)
 	}
 
+	if strings.HasPrefix(cmd, "config local syslog rule ") && QC.IsRoot {
+		return SyslogRuleCmd(cmdinfo)
+	}
+
+	if strings.HasPrefix(cmd, "config local syslog forward ") {
+		return SyslogForwardCmd(cmdinfo)
+	}
+
+	if strings.HasPrefix(cmd, "config local syslog retention ") {
+		return SyslogRetentionCmd(cmdinfo)
+	}
+
 	if strings.HasPrefix(cmd, "config local syslog read") && QC.IsRoot {
 		return ReadSyslogCmd(cmdinfo)
 	}
@@ -0,0 +1,474 @@
+package mnms
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/qeof/q"
+)
+
+/*
+	Login sessions.
+
+	A login opens a session and returns a short lived access token, a
+	JWT carrying the session id, and a refresh token. The refresh token
+	is exchanged at /api/v1/token/refresh for a new pair, each refresh
+	token works once. Presenting a used refresh token revokes the
+	session, it was probably stolen.
+
+	Sessions are kept in sessions.json in the mnms folder. Access tokens
+	of a revoked session stop working immediately. Sessions of a user
+	are revoked when the user is deleted, the role or password of the
+	user changes.
+*/
+
+var (
+	AccessTokenLifetime  = 15 * time.Minute
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// sessionLastSeenInterval limits how often last seen times are written.
+const sessionLastSeenInterval = time.Minute
+
+var ErrSessionRevoked = errors.New("session revoked")
+
+// Session is a login session of a user.
+type Session struct {
+	ID          string `json:"id"`
+	User        string `json:"user"`
+	Device      string `json:"device"`
+	IP          string `json:"ip"`
+	Created     int64  `json:"created"`
+	LastSeen    int64  `json:"lastSeen"`
+	Expires     int64  `json:"expires"`
+	RefreshHash string `json:"refreshHash,omitempty"`
+	// PrevRefreshHash detects reuse of the last rotated refresh token
+	PrevRefreshHash string `json:"prevRefreshHash,omitempty"`
+	Current         bool   `json:"current,omitempty"`
+}
+
+// TokenPair is returned by logins and refreshes.
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds until the token expires
+}
+
+var sessionStore = struct {
+	sync.Mutex
+	loaded bool
+	m      map[string]*Session
+}{m: make(map[string]*Session)}
+
+func sessionsPath() (string, error) {
+	mnmsDir, err := CheckMNMSFolder()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mnmsDir, "sessions.json"), nil
+}
+
+// loadSessions reads the sessions once, sessionStore must be locked.
+func loadSessions() {
+	if sessionStore.loaded {
+		return
+	}
+	sessionStore.loaded = true
+	p, err := sessionsPath()
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			q.Q(err)
+		}
+		return
+	}
+	var sessions []*Session
+	err = json.Unmarshal(b, &sessions)
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, s := range sessions {
+		if s.Expires > now {
+			sessionStore.m[s.ID] = s
+		}
+	}
+}
+
+// saveSessions writes the sessions, sessionStore must be locked.
+func saveSessions() {
+	p, err := sessionsPath()
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	sessions := make([]*Session, 0, len(sessionStore.m))
+	for _, s := range sessionStore.m {
+		sessions = append(sessions, s)
+	}
+	b, err := json.Marshal(sessions)
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	err = os.WriteFile(p, b, 0600)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+func refreshHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// newTokenPair sets a new refresh token of s and issues a token pair,
+// sessionStore must be locked.
+func newTokenPair(s *Session) (*TokenPair, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	s.PrevRefreshHash = s.RefreshHash
+	s.RefreshHash = refreshHash(secret)
+	s.Expires = time.Now().Add(RefreshTokenLifetime).Unix()
+	token, err := generateJWT(s.User, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Token:        token,
+		RefreshToken: s.ID + "." + secret,
+		ExpiresIn:    int64(AccessTokenLifetime / time.Second),
+	}, nil
+}
+
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// CreateSession opens a session of user for request r and issues its
+// tokens.
+func CreateSession(user string, r *http.Request) (*TokenPair, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	s := &Session{
+		ID:       id,
+		User:     user,
+		Device:   r.UserAgent(),
+		IP:       requestIP(r),
+		Created:  now,
+		LastSeen: now,
+	}
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	pair, err := newTokenPair(s)
+	if err != nil {
+		return nil, err
+	}
+	sessionStore.m[id] = s
+	saveSessions()
+	return pair, nil
+}
+
+// RefreshSession exchanges refreshToken for a new token pair.
+func RefreshSession(refreshToken string, r *http.Request) (*TokenPair, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid refresh token")
+	}
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	s, ok := sessionStore.m[id]
+	if !ok || s.Expires < time.Now().Unix() {
+		return nil, ErrSessionRevoked
+	}
+	hash := refreshHash(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(s.RefreshHash)) != 1 {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(s.PrevRefreshHash)) == 1 {
+			q.Q("refresh token reused, session revoked", s.User, s.ID)
+			delete(sessionStore.m, id)
+			saveSessions()
+			return nil, ErrSessionRevoked
+		}
+		return nil, fmt.Errorf("invalid refresh token")
+	}
+	_, err := GetUserConfig(s.User)
+	if err != nil {
+		delete(sessionStore.m, id)
+		saveSessions()
+		return nil, ErrSessionRevoked
+	}
+	pair, err := newTokenPair(s)
+	if err != nil {
+		return nil, err
+	}
+	s.LastSeen = time.Now().Unix()
+	s.IP = requestIP(r)
+	saveSessions()
+	return pair, nil
+}
+
+// checkSession checks that the session id of an access token is open
+// and updates its last seen time.
+func checkSession(id string) error {
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	s, ok := sessionStore.m[id]
+	now := time.Now().Unix()
+	if !ok || s.Expires < now {
+		return ErrSessionRevoked
+	}
+	if now-s.LastSeen >= int64(sessionLastSeenInterval/time.Second) {
+		s.LastSeen = now
+		saveSessions()
+	}
+	return nil
+}
+
+// checkTokenSession checks the session of a verified JWT. Tokens without
+// a session id must be internal tokens of mnms nodes made by GetToken.
+func checkTokenSession(token jwt.Token) error {
+	sid, ok := token.Get("sid")
+	if !ok {
+		if node, _ := token.Get("node"); node != true {
+			return ErrSessionRevoked
+		}
+		return nil
+	}
+	id, _ := sid.(string)
+	return checkSession(id)
+}
+
+// GetSessions returns the open sessions of user, of all users when user
+// is empty, without refresh token hashes.
+func GetSessions(user string) []Session {
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	now := time.Now().Unix()
+	ret := []Session{}
+	for _, s := range sessionStore.m {
+		if s.Expires < now || (user != "" && s.User != user) {
+			continue
+		}
+		c := *s
+		c.RefreshHash = ""
+		c.PrevRefreshHash = ""
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].LastSeen > ret[j].LastSeen })
+	return ret
+}
+
+// RevokeSession revokes the session with id.
+func RevokeSession(id string) error {
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	if _, ok := sessionStore.m[id]; !ok {
+		return fmt.Errorf("session %s not exist", id)
+	}
+	delete(sessionStore.m, id)
+	saveSessions()
+	return nil
+}
+
+// RevokeUserSessions revokes all sessions of user.
+func RevokeUserSessions(user string) {
+	sessionStore.Lock()
+	defer sessionStore.Unlock()
+	loadSessions()
+	n := 0
+	for id, s := range sessionStore.m {
+		if s.User == user {
+			delete(sessionStore.m, id)
+			n++
+		}
+	}
+	if n > 0 {
+		q.Q("sessions revoked", user, n)
+		saveSessions()
+	}
+}
+
+// sessionIDFromRequest returns the session id of the JWT of r.
+func sessionIDFromRequest(r *http.Request) string {
+	t, _, err := jwtauth.FromContext(r.Context())
+	if err != nil || t == nil {
+		return ""
+	}
+	sid, _ := t.Get("sid")
+	id, _ := sid.(string)
+	return id
+}
+
+// respondWithTokens opens a session of user and writes its tokens with
+// the user and role.
+func respondWithTokens(w http.ResponseWriter, r *http.Request, user *UserConfig) {
+	pair, err := CreateSession(user.Name, r)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	res := make(map[string]interface{})
+	res["token"] = pair.Token
+	res["refreshToken"] = pair.RefreshToken
+	res["expiresIn"] = pair.ExpiresIn
+	res["user"] = user.Name
+	res["role"] = user.Role
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		RespondWithError(w, err)
+	}
+}
+
+// HandleRefreshToken handles token refresh requests
+//
+// POST /api/v1/token/refresh
+//
+//	Example parameter: {"refreshToken": "9c1e...d2.4b7f...a0"}
+//	Example return: {"token": "eyJ...", "refreshToken": "9c1e...d2.77aa...19", "expiresIn": 900}
+func HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	pair, err := RefreshSession(body.RefreshToken, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	err = json.NewEncoder(w).Encode(pair)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleLogout revokes the session of the request
+//
+// POST /api/v1/logout
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	id := sessionIDFromRequest(r)
+	if id == "" {
+		RespondWithError(w, fmt.Errorf("token has no session"))
+		return
+	}
+	err := RevokeSession(id)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	_, err = w.Write([]byte("ok"))
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleSessions handles session requests. Users see and revoke their
+// own sessions, users with users:write permission those of all users.
+//
+// GET /api/v1/sessions?user=[user]
+//
+//	Example return: [{"id": "9c1e...d2", "user": "admin", "device": "Mozilla/5.0 ...", "ip": "10.0.0.7",
+//	                  "created": 1686000000, "lastSeen": 1686000600, "expires": 1688592000, "current": true}]
+//
+// DELETE /api/v1/sessions
+//
+//	Example parameter: {"id": "9c1e...d2"} or {"user": "user1"} to revoke all sessions of user1
+func HandleSessions(w http.ResponseWriter, r *http.Request) {
+	self := userFromContext(r.Context())
+	if self == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	admin := canManageUser(self, "")
+	user := r.URL.Query().Get("user")
+	var body struct {
+		ID   string `json:"id"`
+		User string `json:"user"`
+	}
+	if r.Method == "DELETE" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+		user = body.User
+		if body.ID != "" {
+			user = ""
+			for _, s := range GetSessions("") {
+				if s.ID == body.ID {
+					user = s.User
+				}
+			}
+			if user == "" {
+				RespondWithError(w, fmt.Errorf("session %s not exist", body.ID))
+				return
+			}
+		}
+	}
+	if user == "" && !admin {
+		user = self.Name
+	}
+	if user != self.Name && !admin {
+		http.Error(w, fmt.Sprintf("user %s has no %s permission", self.Name, PermUsersWrite), http.StatusForbidden)
+		return
+	}
+	if r.Method == "DELETE" {
+		setAuditDetail(r, "user %s session %s", user, body.ID)
+		if body.ID != "" {
+			err := RevokeSession(body.ID)
+			if err != nil {
+				RespondWithError(w, err)
+				return
+			}
+		} else {
+			RevokeUserSessions(user)
+		}
+	}
+	current := sessionIDFromRequest(r)
+	sessions := GetSessions(user)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	err := json.NewEncoder(w).Encode(sessions)
+	if err != nil {
+		q.Q(err)
+	}
+}
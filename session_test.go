@@ -0,0 +1,145 @@
+package mnms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+func cleanSessions(t *testing.T) {
+	p, err := sessionsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(p)
+	sessionStore.Lock()
+	sessionStore.m = make(map[string]*Session)
+	sessionStore.loaded = false
+	sessionStore.Unlock()
+}
+
+// TestSessions tests refresh token rotation and session revocation
+func TestSessions(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	cleanSessions(t)
+	defer cleanSessions(t)
+
+	err = AddUserConfig("op1", MNMSUserRole, "Op1Pass#2023", "op1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := httptest.NewRequest("POST", "/api/v1/login", nil)
+	login.Header.Set("User-Agent", "test-agent")
+	pair, err := CreateSession("op1", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := jwtauth.Verifier(jwtTokenAuth)(requirePermission("")(http.HandlerFunc(HandleSessions)))
+	call := func(method, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/sessions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := call("GET", pair.Token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatal("expect sessions, got", rec.Code, rec.Body.String())
+	}
+	var sessions []Session
+	err = json.Unmarshal(rec.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current || sessions[0].Device != "test-agent" || sessions[0].RefreshHash != "" {
+		t.Fatal("expect the current session without hashes", sessions)
+	}
+
+	// refresh tokens rotate, reusing an old one revokes the session
+	next, err := RefreshSession(pair.RefreshToken, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.RefreshToken == pair.RefreshToken {
+		t.Fatal("expect a new refresh token")
+	}
+	if _, err = RefreshSession(pair.RefreshToken, login); err != ErrSessionRevoked {
+		t.Fatal("expect reused refresh token to revoke the session, got", err)
+	}
+	if rec = call("GET", next.Token, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("expect token of revoked session to fail, got", rec.Code)
+	}
+
+	// internal tokens of mnms nodes have no session
+	internal, err := GetToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = call("GET", internal, ""); rec.Code != http.StatusOK {
+		t.Fatal("expect internal token to work, got", rec.Code)
+	}
+	// other tokens without a session are rejected
+	sessionless, err := generateJWT("admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = call("GET", sessionless, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("expect token without a session to be rejected, got", rec.Code)
+	}
+
+	// users revoke only their own sessions
+	pair, err = CreateSession("op1", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := CreateSession("admin", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = call("DELETE", pair.Token, `{"user": "admin"}`); rec.Code != http.StatusForbidden {
+		t.Fatal("expect revoking other users' sessions to fail, got", rec.Code)
+	}
+	if rec = call("DELETE", admin.Token, `{"user": "op1"}`); rec.Code != http.StatusOK {
+		t.Fatal("expect admin to revoke sessions, got", rec.Code, rec.Body.String())
+	}
+	if len(GetSessions("op1")) != 0 || len(GetSessions("admin")) != 1 {
+		t.Fatal("expect only op1 sessions revoked", GetSessions(""))
+	}
+
+	// a role change revokes all sessions of the user
+	pair, err = CreateSession("op1", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateUserConfig("op1", MNMSSuperUserRole, "Op1Pass#2023", "op1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RefreshSession(pair.RefreshToken, login); err == nil {
+		t.Fatal("expect sessions revoked after role change")
+	}
+	pair, err = CreateSession("op1", login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteUserConfig("op1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec = call("GET", pair.Token, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("expect token of deleted user to fail, got", rec.Code)
+	}
+}
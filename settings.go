@@ -0,0 +1,738 @@
+package mnms
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/qeof/q"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Settings file.
+
+	The runtime settings of an mnms service can be kept in one YAML
+	file instead of mnmsctl flags,
+
+		version: 1
+		name: client1
+		root: http://10.10.10.1:27182
+		intervals:
+		  gwd: 120
+		syslog:
+		  remote: 10.10.10.1:5514
+		  retentionDays: 30
+
+	A setting comes from the first of the mnmsctl flag, the environment
+	variable (syslog.localPath is MNMS_SYSLOG_LOCAL_PATH), the settings
+	file and the built in default. Unknown keys and invalid values are
+	rejected. "config reload" reads the file and environment again and
+	applies the settings that can change while running, the others
+	need a restart. Client nodes also take settings from the profile
+	root pushes to them, between the environment and the settings file.
+	Settings which commands change and the service keeps, like the
+	syslog retention in syslog.json, come between the settings file and
+	the default.
+
+	The services read settings that change while running with
+	ReadSetting.
+*/
+
+const (
+	PermSettingsRead  = "settings:read"
+	PermSettingsWrite = "settings:write"
+)
+
+// SettingsVersion is the version of the settings file format.
+const SettingsVersion = 1
+
+// DefaultSettingsFile is read from the mnms folder when no settings file
+// is given.
+const DefaultSettingsFile = "mnms.yaml"
+
+// Sources of a setting.
+const (
+	SettingDefault = "default"
+	SettingFile    = "file"
+	SettingEnv     = "env"
+	SettingFlag    = "flag"
+	SettingProfile = "profile"
+	SettingSaved   = "saved"
+)
+
+type settingDef struct {
+	key        string // key in the settings file, sections separated by "."
+	flag       string // mnmsctl flag
+	reloadable bool
+	node       bool        // identifies the node, not part of profiles
+	value      interface{} // pointer to the QC field
+	check      func(interface{}) error
+	follows    string // setting whose value is the default, listed before
+	secret     bool   // masked when the settings are shown
+}
+
+// Setting is the effective value of a setting.
+type Setting struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Source     string      `json:"source"`
+	Flag       string      `json:"flag,omitempty"`
+	Env        string      `json:"env"`
+	Reloadable bool        `json:"reloadable"`
+}
+
+var settingDefs = []settingDef{
+	{key: "name", flag: "n", node: true, value: &QC.Name},
+	{key: "port", flag: "p", node: true, value: &QC.Port, check: checkPort},
+	{key: "root", flag: "r", node: true, value: &QC.RootURL},
+	{key: "domain", flag: "d", node: true, value: &QC.Domain},
+	{key: "intervals.command", flag: "ic", reloadable: true, value: &QC.CmdInterval, check: checkPositive},
+	{key: "intervals.register", flag: "ir", reloadable: true, value: &QC.RegisterInterval, check: checkPositive},
+	{key: "intervals.gwd", flag: "ig", reloadable: true, value: &QC.GwdInterval, check: checkPositive},
+	{key: "mqtt.broker", flag: "mb", value: &QC.MqttBrokerAddr, check: checkHostPort},
+	{key: "mqtt.auth", reloadable: true, value: &QC.MqttAuth},
+	// nothing is published on a broker anyone may read, unless asked to
+	{key: "mqtt.northbound", reloadable: true, value: &QC.MqttNorthbound, follows: "mqtt.auth"},
+	{key: "mqtt.prefix", reloadable: true, value: &QC.MqttTopicPrefix, check: checkTopicPrefix},
+	{key: "mqtt.commands", reloadable: true, value: &QC.MqttCommands},
+	{key: "mqtt.tls", value: &QC.MqttTLSAddr, check: checkHostPort},
+	{key: "mqtt.tlsCert", value: &QC.MqttTLSCert},
+	{key: "mqtt.tlsKey", value: &QC.MqttTLSKey},
+	{key: "mqtt.websocket", value: &QC.MqttWebSocketAddr, check: checkHostPort},
+	{key: "sparkplug.broker", value: &QC.SparkplugBroker},
+	{key: "sparkplug.group", value: &QC.SparkplugGroup, check: checkSparkplugGroup},
+	{key: "sparkplug.credential", value: &QC.SparkplugCredential},
+	{key: "sparkplug.ca", value: &QC.SparkplugCA},
+	{key: "sparkplug.interval", reloadable: true, value: &QC.SparkplugInterval, check: checkPositive},
+	{key: "opcua.server", value: &QC.OpcuaServerURL, check: checkOpcuaURL},
+	{key: "opcua.interval", reloadable: true, value: &QC.OpcuaInterval, check: checkPositive},
+	{key: "opcua.anonymous", value: &QC.OpcuaAnonymous},
+	{key: "opcua.securityNone", value: &QC.OpcuaSecurityNone},
+	{key: "trap.server", flag: "ts", value: &QC.TrapServerAddr, check: checkHostPort},
+	{key: "syslog.server", flag: "ss", value: &QC.SyslogServerAddr, check: checkHostPort},
+	{key: "syslog.remote", flag: "rs", reloadable: true, value: &QC.RemoteSyslogServerAddr, check: checkHostPort},
+	{key: "syslog.localPath", flag: "so", reloadable: true, value: &QC.SyslogLocalPath},
+	{key: "syslog.fileSize", flag: "sf", reloadable: true, value: &QC.SyslogFileSize, check: checkPositive},
+	{key: "syslog.compress", flag: "sc", reloadable: true, value: &QC.SyslogCompress},
+	{key: "syslog.keepLocal", flag: "sk", reloadable: true, value: &QC.SyslogKeepLocal},
+	{key: "syslog.retentionDays", reloadable: true, value: &QC.SyslogRetentionDays, check: checkNotNegative},
+	{key: "syslog.retentionBudget", reloadable: true, value: &QC.SyslogRetentionBudget},
+	{key: "snmp.port", reloadable: true, value: &QC.SnmpOptions.Port},
+	{key: "snmp.community", reloadable: true, value: &QC.SnmpOptions.Community, secret: true},
+	{key: "snmp.version", reloadable: true, value: &QC.SnmpOptions.Version},
+	{key: "snmp.timeout", reloadable: true, value: &QC.SnmpOptions.Timeout, check: checkPositive},
+}
+
+var settings struct {
+	sync.Mutex
+	file     string
+	flags    map[string]bool
+	defaults map[string]interface{}
+	sources  map[string]string
+	profile  map[string]interface{}
+	hash     string                 // of the profile
+	saved    map[string]interface{} // by commands
+}
+
+// settingValues guards the QC fields of the settings, which reloads
+// change while the services read them.
+var settingValues sync.RWMutex
+
+// ReadSetting returns the value of the setting in the QC field p.
+func ReadSetting[T any](p *T) T {
+	settingValues.RLock()
+	defer settingValues.RUnlock()
+	return *p
+}
+
+// WriteSetting sets the setting in the QC field p to v.
+func WriteSetting[T any](p *T, v T) {
+	settingValues.Lock()
+	defer settingValues.Unlock()
+	*p = v
+}
+
+func checkPort(v interface{}) error {
+	if p := v.(int); p < 1 || p > 65535 {
+		return fmt.Errorf("port %d out of range", p)
+	}
+	return nil
+}
+
+func checkPositive(v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		if v > 0 {
+			return nil
+		}
+	case uint:
+		if v > 0 {
+			return nil
+		}
+	case time.Duration:
+		if v > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not positive", v)
+}
+
+func checkNotNegative(v interface{}) error {
+	if v.(int) < 0 {
+		return fmt.Errorf("%v is negative", v)
+	}
+	return nil
+}
+
+func checkHostPort(v interface{}) error {
+	s := v.(string)
+	if s == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port in %s", s)
+	}
+	return nil
+}
+
+func checkTopicPrefix(v interface{}) error {
+	s := v.(string)
+	if s == "" || strings.ContainsAny(s, "+#") || strings.HasPrefix(s, "$") {
+		return fmt.Errorf("invalid topic prefix %q", s)
+	}
+	return nil
+}
+
+func checkOpcuaURL(v interface{}) error {
+	s := v.(string)
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "opc.tcp" || u.Port() == "" {
+		return fmt.Errorf("invalid opcua url %q, expect opc.tcp://host:port", s)
+	}
+	return nil
+}
+
+func checkSparkplugGroup(v interface{}) error {
+	s := v.(string)
+	if s == "" || strings.ContainsAny(s, "/+#") {
+		return fmt.Errorf("invalid sparkplug group %q", s)
+	}
+	return nil
+}
+
+// settingEnv returns the environment variable of the setting key,
+// syslog.localPath is MNMS_SYSLOG_LOCAL_PATH.
+func settingEnv(key string) string {
+	var b strings.Builder
+	b.WriteString("MNMS_")
+	prev := rune(0)
+	for _, r := range key {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func findSettingDef(key string) *settingDef {
+	for i := range settingDefs {
+		if settingDefs[i].key == key {
+			return &settingDefs[i]
+		}
+	}
+	return nil
+}
+
+// parse converts s to the type of the setting.
+func (def *settingDef) parse(s string) (interface{}, error) {
+	var v interface{}
+	var err error
+	switch def.value.(type) {
+	case *string:
+		v = s
+	case *int:
+		v, err = strconv.Atoi(s)
+	case *uint:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 0)
+		v = uint(n)
+	case *uint16:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 16)
+		v = uint16(n)
+	case *bool:
+		v, err = strconv.ParseBool(s)
+	case *time.Duration:
+		// plain numbers are seconds
+		if n, e := strconv.Atoi(s); e == nil {
+			v = time.Duration(n) * time.Second
+		} else {
+			v, err = time.ParseDuration(s)
+		}
+	case *gosnmp.SnmpVersion:
+		switch s {
+		case "1":
+			v = gosnmp.Version1
+		case "2c":
+			v = gosnmp.Version2c
+		case "3":
+			v = gosnmp.Version3
+		default:
+			err = errors.New("accept 1|2c|3")
+		}
+	default:
+		err = errors.New("unsupported type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setting %s: invalid value %q: %v", def.key, s, err)
+	}
+	if def.check != nil {
+		err = def.check(v)
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %v", def.key, err)
+		}
+	}
+	return v, nil
+}
+
+func (def *settingDef) get() interface{} {
+	settingValues.RLock()
+	defer settingValues.RUnlock()
+	switch p := def.value.(type) {
+	case *string:
+		return *p
+	case *int:
+		return *p
+	case *uint:
+		return *p
+	case *uint16:
+		return *p
+	case *bool:
+		return *p
+	case *time.Duration:
+		return *p
+	case *gosnmp.SnmpVersion:
+		return *p
+	}
+	return nil
+}
+
+func (def *settingDef) set(v interface{}) {
+	settingValues.Lock()
+	defer settingValues.Unlock()
+	switch p := def.value.(type) {
+	case *string:
+		*p = v.(string)
+	case *int:
+		*p = v.(int)
+	case *uint:
+		*p = v.(uint)
+	case *uint16:
+		*p = v.(uint16)
+	case *bool:
+		*p = v.(bool)
+	case *time.Duration:
+		*p = v.(time.Duration)
+	case *gosnmp.SnmpVersion:
+		*p = v.(gosnmp.SnmpVersion)
+	}
+}
+
+// formatSetting returns v as it is written in the settings file.
+func formatSetting(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case gosnmp.SnmpVersion:
+		return v.String()
+	}
+	return v
+}
+
+// flattenSettings flattens the sections of the settings file m into
+// keys separated by ".".
+func flattenSettings(prefix string, m map[string]interface{}, ret map[string]string) error {
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			err := flattenSettings(key, v, ret)
+			if err != nil {
+				return err
+			}
+		case []interface{}:
+			return fmt.Errorf("setting %s: lists are not supported", key)
+		case nil:
+			return fmt.Errorf("setting %s: missing value", key)
+		default:
+			ret[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// ParseSettings parses and validates the settings file content data.
+func ParseSettings(data []byte) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	err := yaml.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	flat := map[string]string{}
+	err = flattenSettings("", m, flat)
+	if err != nil {
+		return nil, err
+	}
+	version := SettingsVersion
+	if s, ok := flat["version"]; ok {
+		version, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid settings version %q", s)
+		}
+		delete(flat, "version")
+	}
+	if version != SettingsVersion {
+		return nil, fmt.Errorf("unsupported settings version %d, expect %d", version, SettingsVersion)
+	}
+	ret := map[string]interface{}{}
+	for k, s := range flat {
+		def := findSettingDef(k)
+		if def == nil {
+			return nil, fmt.Errorf("unknown setting %s", k)
+		}
+		ret[k], err = def.parse(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func defaultSettingsFile() string {
+	mnmsDir, err := CheckMNMSFolder()
+	if err != nil {
+		return DefaultSettingsFile
+	}
+	return path.Join(mnmsDir, DefaultSettingsFile)
+}
+
+// readSettings returns the settings of the settings file and the
+// environment with their sources.
+func readSettings(file string) (map[string]interface{}, map[string]string, error) {
+	values := map[string]interface{}{}
+	sources := map[string]string{}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil && !(os.IsNotExist(err) && file == defaultSettingsFile()) {
+			return nil, nil, err
+		}
+		if err == nil {
+			values, err = ParseSettings(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", file, err)
+			}
+			for k := range values {
+				sources[k] = SettingFile
+			}
+		}
+	}
+	for k, v := range settings.profile {
+		values[k] = v
+		sources[k] = SettingProfile
+	}
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		s, ok := os.LookupEnv(settingEnv(def.key))
+		if !ok {
+			continue
+		}
+		v, err := def.parse(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", settingEnv(def.key), err)
+		}
+		values[def.key] = v
+		sources[def.key] = SettingEnv
+	}
+	return values, sources, nil
+}
+
+// LoadSettings applies the settings file and the environment to the
+// settings not given by the mnmsctl flags in flags. An empty file is
+// the MNMS_CONFIG environment variable or mnms.yaml in the mnms folder,
+// which may not exist.
+func LoadSettings(file string, flags map[string]bool) error {
+	settings.Lock()
+	defer settings.Unlock()
+	if file == "" {
+		file = os.Getenv("MNMS_CONFIG")
+	}
+	if file == "" {
+		file = defaultSettingsFile()
+	}
+	settings.profile, settings.hash = nil, ""
+	values, sources, err := readSettings(file)
+	if err != nil {
+		return err
+	}
+	// the profile from root is kept by node name
+	name := QC.Name
+	if v, ok := values["name"]; ok && !flags["n"] {
+		name = v.(string)
+	}
+	settings.profile, settings.hash, err = loadProfile(name)
+	if err != nil {
+		q.Q(err)
+	}
+	if len(settings.profile) > 0 {
+		values, sources, err = readSettings(file)
+		if err != nil {
+			return err
+		}
+	}
+	settings.file = file
+	settings.flags = flags
+	settings.defaults = map[string]interface{}{}
+	settings.sources = map[string]string{}
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		if def.flag != "" && flags[def.flag] {
+			settings.sources[def.key] = SettingFlag
+			continue
+		}
+		settings.defaults[def.key] = def.get()
+		settings.sources[def.key] = SettingDefault
+		if v, ok := values[def.key]; ok {
+			def.set(v)
+			settings.sources[def.key] = sources[def.key]
+		} else if v, ok := settings.saved[def.key]; ok {
+			def.set(v)
+			settings.sources[def.key] = SettingSaved
+		} else if def.follows != "" {
+			def.set(findSettingDef(def.follows).get())
+		}
+	}
+	q.Q("settings loaded", file)
+	return nil
+}
+
+// ReloadSettings reads the settings file and the environment again and
+// applies the changed settings that can change while running. It
+// returns the applied settings and the changed settings that need a
+// restart.
+func ReloadSettings() ([]string, []string, error) {
+	settings.Lock()
+	defer settings.Unlock()
+	return reloadSettings()
+}
+
+func reloadSettings() ([]string, []string, error) {
+	if settings.defaults == nil {
+		return nil, nil, errors.New("settings not loaded")
+	}
+	values, sources, err := readSettings(settings.file)
+	if err != nil {
+		return nil, nil, err
+	}
+	applied := []string{}
+	restart := []string{}
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		if settings.sources[def.key] == SettingFlag {
+			continue
+		}
+		v, ok := values[def.key]
+		source := sources[def.key]
+		if saved, found := settings.saved[def.key]; !ok && found {
+			v, source = saved, SettingSaved
+		} else if !ok {
+			v = settings.defaults[def.key]
+			if def.follows != "" {
+				v = findSettingDef(def.follows).get()
+			}
+			source = SettingDefault
+		}
+		if v == def.get() {
+			settings.sources[def.key] = source
+			continue
+		}
+		if !def.reloadable {
+			restart = append(restart, def.key)
+			continue
+		}
+		if strings.HasPrefix(def.key, "syslog.") {
+			// the syslog settings are read by the syslog goroutines
+			QC.SyslogMutex.Lock()
+			def.set(v)
+			if def.key == "syslog.remote" && QC.RemoteSyslogServer != nil {
+				// reconnect to the new remote syslog server
+				QC.RemoteSyslogServer.Close()
+				QC.RemoteSyslogServer = nil
+			}
+			QC.SyslogMutex.Unlock()
+		} else {
+			def.set(v)
+		}
+		settings.sources[def.key] = source
+		applied = append(applied, def.key)
+	}
+	q.Q("settings reloaded", applied, restart)
+	return applied, restart, nil
+}
+
+// setSavedSettings applies the settings of values changed by a command
+// or kept by the service. It fails when one of them is given by a flag,
+// the environment, the profile or the settings file, which come first.
+func setSavedSettings(values map[string]interface{}) error {
+	settings.Lock()
+	defer settings.Unlock()
+	for key := range values {
+		if findSettingDef(key) == nil {
+			return fmt.Errorf("unknown setting %s", key)
+		}
+		switch source := settings.sources[key]; source {
+		case "", SettingDefault, SettingSaved:
+		default:
+			return fmt.Errorf("setting %s is set by %s", key, source)
+		}
+	}
+	if settings.saved == nil {
+		settings.saved = map[string]interface{}{}
+	}
+	if settings.sources == nil {
+		settings.sources = map[string]string{}
+	}
+	for key, v := range values {
+		findSettingDef(key).set(v)
+		settings.saved[key] = v
+		settings.sources[key] = SettingSaved
+	}
+	return nil
+}
+
+// GetSettings returns the effective settings with their sources, secret
+// values are masked.
+func GetSettings() []Setting {
+	return effectiveSettings(func(string) string { return secretMask })
+}
+
+// RegisteredSettings returns the effective settings clients report to
+// root, secret values are replaced by their hash, so that root can
+// compare them with the profile.
+func RegisteredSettings() []Setting {
+	return effectiveSettings(settingHash)
+}
+
+// settingHash returns the hash of the secret setting value v.
+func settingHash(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// effectiveSettings returns the effective settings with their sources,
+// secret values are replaced by secret.
+func effectiveSettings(secret func(string) string) []Setting {
+	settings.Lock()
+	defer settings.Unlock()
+	ret := make([]Setting, 0, len(settingDefs))
+	for i := range settingDefs {
+		def := &settingDefs[i]
+		source := settings.sources[def.key]
+		if source == "" {
+			source = SettingDefault
+		}
+		value := formatSetting(def.get())
+		if v, ok := value.(string); ok && def.secret && v != "" {
+			value = secret(v)
+		}
+		ret = append(ret, Setting{
+			Key:        def.key,
+			Value:      value,
+			Source:     source,
+			Flag:       def.flag,
+			Env:        settingEnv(def.key),
+			Reloadable: def.reloadable,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// Reload settings file.
+//
+// Usage : config reload
+//
+//	reads the settings file and the environment again and applies the
+//	settings that can change while running. The result lists the
+//	applied settings and the changed settings that need a restart.
+//
+// Example :
+//
+//	config reload
+//	@client1 config reload
+func ConfigReloadCmd(cmdinfo *CmdInfo) *CmdInfo {
+	applied, restart, err := ReloadSettings()
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	b, err := json.Marshal(map[string][]string{"applied": applied, "restart": restart})
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Result = string(b)
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
+
+// HandleSettings returns the effective settings of this mnms service.
+//
+// GET /api/v1/settings
+//
+//	Example return: {"file": "/opt/mnms/mnms.yaml", "version": 1, "settings": [{"key": "intervals.gwd", "value": 120, "source": "file", "flag": "ig", "env": "MNMS_INTERVALS_GWD", "reloadable": true}, ...]}
+func HandleSettings(w http.ResponseWriter, r *http.Request) {
+	settings.Lock()
+	file := settings.file
+	settings.Unlock()
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"file":     file,
+		"version":  SettingsVersion,
+		"settings": GetSettings(),
+	})
+	if err != nil {
+		q.Q(err)
+	}
+}
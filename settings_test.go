@@ -0,0 +1,187 @@
+package mnms
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// restoreSettings restores the settings changed by a test
+func restoreSettings(t *testing.T) {
+	saved := make([]interface{}, len(settingDefs))
+	for i := range settingDefs {
+		saved[i] = settingDefs[i].get()
+	}
+	t.Cleanup(func() {
+		for i := range settingDefs {
+			settingDefs[i].set(saved[i])
+		}
+		settings.Lock()
+		settings.file, settings.flags, settings.defaults, settings.sources = "", nil, nil, nil
+		settings.profile, settings.hash, settings.saved = nil, "", nil
+		settings.Unlock()
+	})
+}
+
+// TestParseSettings tests validating the settings file
+func TestParseSettings(t *testing.T) {
+	values, err := ParseSettings([]byte("version: 1\nport: 28000\nsyslog:\n  localPath: /var/log/mnms.log\n  compress: false\nsnmp:\n  version: 3\n  timeout: 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["port"] != 28000 || values["syslog.localPath"] != "/var/log/mnms.log" ||
+		values["syslog.compress"] != false || values["snmp.timeout"] != 5*time.Second {
+		t.Fatal("unexpected settings", values)
+	}
+	for _, data := range []string{
+		"version: 2\n",
+		"prot: 28000\n",
+		"port: 99999\n",
+		"intervals:\n  gwd: 0\n",
+		"syslog:\n  remote: 10.0.0.1\n",
+		"snmp:\n  version: 4\n",
+		"syslog:\n  - remote\n",
+		"port: [",
+	} {
+		if _, err = ParseSettings([]byte(data)); err == nil {
+			t.Errorf("expect %q to fail", data)
+		}
+	}
+	if env := settingEnv("syslog.localPath"); env != "MNMS_SYSLOG_LOCAL_PATH" {
+		t.Error("unexpected env", env)
+	}
+}
+
+// TestLoadSettings tests the sources of settings and reloading
+func TestLoadSettings(t *testing.T) {
+	restoreSettings(t)
+	file := path.Join(t.TempDir(), "mnms.yaml")
+	write := func(data string) {
+		err := os.WriteFile(file, []byte(data), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("name: fromfile\nport: 28000\nintervals:\n  gwd: 120\n  command: 7\n")
+	t.Setenv("MNMS_INTERVALS_GWD", "90")
+	QC.Port = 29000
+	err := LoadSettings(file, map[string]bool{"p": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if QC.Name != "fromfile" || QC.Port != 29000 || QC.GwdInterval != 90 || QC.CmdInterval != 7 {
+		t.Fatal("unexpected settings", QC.Name, QC.Port, QC.GwdInterval, QC.CmdInterval)
+	}
+	sources := map[string]string{}
+	for _, s := range GetSettings() {
+		sources[s.Key] = s.Source
+	}
+	if sources["name"] != SettingFile || sources["port"] != SettingFlag ||
+		sources["intervals.gwd"] != SettingEnv || sources["intervals.register"] != SettingDefault {
+		t.Fatal("unexpected sources", sources)
+	}
+
+	write("name: renamed\nport: 28001\nintervals:\n  gwd: 120\n")
+	cmdinfo := ConfigReloadCmd(&CmdInfo{Command: "config reload"})
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	var result struct {
+		Applied []string `json:"applied"`
+		Restart []string `json:"restart"`
+	}
+	err = json.Unmarshal([]byte(cmdinfo.Result), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "intervals.command" ||
+		len(result.Restart) != 1 || result.Restart[0] != "name" {
+		t.Fatal("unexpected reload", cmdinfo.Result)
+	}
+	if QC.CmdInterval != 5 || QC.Name != "fromfile" || QC.Port != 29000 {
+		t.Fatal("expect command interval back to default only", QC.CmdInterval, QC.Name, QC.Port)
+	}
+
+	// mqtt.northbound follows mqtt.auth unless it is set
+	if QC.MqttNorthbound {
+		t.Fatal("expect northbound off without auth")
+	}
+	write("mqtt:\n  auth: true\n")
+	if _, _, err = ReloadSettings(); err != nil || !QC.MqttAuth || !QC.MqttNorthbound {
+		t.Fatal("expect northbound on with auth", QC.MqttAuth, QC.MqttNorthbound, err)
+	}
+	write("mqtt:\n  auth: true\n  northbound: false\n")
+	if _, _, err = ReloadSettings(); err != nil || QC.MqttNorthbound {
+		t.Fatal("expect northbound off when set", err)
+	}
+
+	write("port: 0\n")
+	if _, _, err = ReloadSettings(); err == nil {
+		t.Fatal("expect invalid settings to fail")
+	}
+	if err = LoadSettings(path.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Fatal("expect missing settings file to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	HandleSettings(rec, httptest.NewRequest("GET", "/api/v1/settings", nil))
+	var ret struct {
+		File     string    `json:"file"`
+		Settings []Setting `json:"settings"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &ret)
+	if err != nil || ret.File != file || len(ret.Settings) != len(settingDefs) {
+		t.Fatal("unexpected settings response", rec.Body.String(), err)
+	}
+}
+
+// TestSavedSettings tests secret settings and the precedence of settings
+// kept by commands
+func TestSavedSettings(t *testing.T) {
+	restoreSettings(t)
+	file := path.Join(t.TempDir(), "mnms.yaml")
+	write := func(data string) {
+		err := os.WriteFile(file, []byte(data), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("snmp:\n  community: private\n")
+	err := LoadSettings(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting := func(key string) Setting {
+		for _, s := range GetSettings() {
+			if s.Key == key {
+				return s
+			}
+		}
+		t.Fatal("no setting", key)
+		return Setting{}
+	}
+	if s := setting("snmp.community"); s.Value != secretMask || s.Source != SettingFile {
+		t.Fatal("expect masked community", s)
+	}
+
+	err = setSavedSettings(map[string]interface{}{"syslog.retentionDays": 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ReloadSettings(); err != nil || QC.SyslogRetentionDays != 30 {
+		t.Fatal("expect saved retention to survive a reload", QC.SyslogRetentionDays, err)
+	}
+	if s := setting("syslog.retentionDays"); s.Value != 30 || s.Source != SettingSaved {
+		t.Fatal("expect saved retention", s)
+	}
+	write("syslog:\n  retentionDays: 10\n")
+	if _, _, err = ReloadSettings(); err != nil || QC.SyslogRetentionDays != 10 {
+		t.Fatal("expect the settings file to come first", QC.SyslogRetentionDays, err)
+	}
+	if err = setSavedSettings(map[string]interface{}{"syslog.retentionDays": 30}); err == nil {
+		t.Fatal("expect saving a setting of the settings file to fail")
+	}
+}
@@ -153,7 +153,7 @@ func probeSnmp(ipaddr string) error {
 	var err error
 	var community string
 	devInfo, err := FindDevWithIP(ipaddr)
-	community = QC.SnmpOptions.Community
+	community = ReadSetting(&QC.SnmpOptions.Community)
 	if err == nil {
 
 		if len(devInfo.ReadCommunity) > 0 {
@@ -162,10 +162,10 @@ func probeSnmp(ipaddr string) error {
 	}
 	params := &gosnmp.GoSNMP{
 		Target:                  ipaddr,
-		Port:                    QC.SnmpOptions.Port,
+		Port:                    ReadSetting(&QC.SnmpOptions.Port),
 		Community:               community,
-		Version:                 QC.SnmpOptions.Version,
-		Timeout:                 QC.SnmpOptions.Timeout,
+		Version:                 ReadSetting(&QC.SnmpOptions.Version),
+		Timeout:                 ReadSetting(&QC.SnmpOptions.Timeout),
 		UseUnconnectedUDPSocket: true,
 	}
 
@@ -320,7 +320,7 @@ func SnmpGetObjectID(path string) (string, error) {
 func SnmpGet(address string, oids []string) (result *gosnmp.SnmpPacket, err error) {
 	var community string
 	devInfo, err := FindDevWithIP(address)
-	community = QC.SnmpOptions.Community
+	community = ReadSetting(&QC.SnmpOptions.Community)
 	if err == nil {
 
 		if len(devInfo.ReadCommunity) > 0 {
@@ -329,10 +329,10 @@ func SnmpGet(address string, oids []string) (result *gosnmp.SnmpPacket, err erro
 	}
 	params := &gosnmp.GoSNMP{
 		Target:                  address,
-		Port:                    QC.SnmpOptions.Port,
+		Port:                    ReadSetting(&QC.SnmpOptions.Port),
 		Community:               community,
-		Version:                 QC.SnmpOptions.Version,
-		Timeout:                 QC.SnmpOptions.Timeout,
+		Version:                 ReadSetting(&QC.SnmpOptions.Version),
+		Timeout:                 ReadSetting(&QC.SnmpOptions.Timeout),
 		UseUnconnectedUDPSocket: true,
 	}
 
@@ -357,7 +357,7 @@ func SnmpGet(address string, oids []string) (result *gosnmp.SnmpPacket, err erro
 func SnmpWalk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 	var community string
 	devInfo, err := FindDevWithIP(address)
-	community = QC.SnmpOptions.Community
+	community = ReadSetting(&QC.SnmpOptions.Community)
 	if err == nil {
 
 		if len(devInfo.ReadCommunity) > 0 {
@@ -366,10 +366,10 @@ func SnmpWalk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 	}
 	params := &gosnmp.GoSNMP{
 		Target:                  address,
-		Port:                    QC.SnmpOptions.Port,
+		Port:                    ReadSetting(&QC.SnmpOptions.Port),
 		Community:               community,
-		Version:                 QC.SnmpOptions.Version,
-		Timeout:                 QC.SnmpOptions.Timeout,
+		Version:                 ReadSetting(&QC.SnmpOptions.Version),
+		Timeout:                 ReadSetting(&QC.SnmpOptions.Timeout),
 		UseUnconnectedUDPSocket: true,
 	}
 
@@ -393,7 +393,7 @@ func SnmpWalk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 func SnmpBulk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 	var community string
 	devInfo, err := FindDevWithIP(address)
-	community = QC.SnmpOptions.Community
+	community = ReadSetting(&QC.SnmpOptions.Community)
 	if err == nil {
 
 		if len(devInfo.ReadCommunity) > 0 {
@@ -402,10 +402,10 @@ func SnmpBulk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 	}
 	params := &gosnmp.GoSNMP{
 		Target:                  address,
-		Port:                    QC.SnmpOptions.Port,
+		Port:                    ReadSetting(&QC.SnmpOptions.Port),
 		Community:               community,
-		Version:                 QC.SnmpOptions.Version,
-		Timeout:                 QC.SnmpOptions.Timeout,
+		Version:                 ReadSetting(&QC.SnmpOptions.Version),
+		Timeout:                 ReadSetting(&QC.SnmpOptions.Timeout),
 		UseUnconnectedUDPSocket: true,
 	}
 
@@ -429,7 +429,7 @@ func SnmpBulk(address string, oid string) (result []gosnmp.SnmpPDU, err error) {
 func SnmpSet(address, oid string, value string, valuetype string) (result *gosnmp.SnmpPacket, err error) {
 	var community string
 	devInfo, err := FindDevWithIP(address)
-	community = QC.SnmpOptions.Community
+	community = ReadSetting(&QC.SnmpOptions.Community)
 	if err == nil {
 
 		if len(devInfo.WriteCommunity) > 0 {
@@ -438,10 +438,10 @@ func SnmpSet(address, oid string, value string, valuetype string) (result *gosnm
 	}
 	params := &gosnmp.GoSNMP{
 		Target:                  address,
-		Port:                    QC.SnmpOptions.Port,
+		Port:                    ReadSetting(&QC.SnmpOptions.Port),
 		Community:               community,
-		Version:                 QC.SnmpOptions.Version,
-		Timeout:                 QC.SnmpOptions.Timeout,
+		Version:                 ReadSetting(&QC.SnmpOptions.Version),
+		Timeout:                 ReadSetting(&QC.SnmpOptions.Timeout),
 		UseUnconnectedUDPSocket: true,
 	}
 
@@ -521,6 +521,11 @@ func PDUToString(pdu gosnmp.SnmpPDU) string {
 //
 // Example: snmp communities admin default 00-60-E9-27-E3-39
 //
+// Usage: snmp communities @cred:[credential] [mac]
+// Read device's SNMP communities with a credential of the credential vault.
+//
+// Example: snmp communities @cred:plant1 00-60-E9-27-E3-39
+//
 // Usage: snmp update community [mac] [read community] [write community]
 // Update device's SNMP communities manually.
 //
@@ -594,21 +599,25 @@ func SnmpCmd(cmdinfo *CmdInfo) *CmdInfo {
 	if ws[1] == "communities" {
 		// read communities and write to DevInfo
 		// snmp communities {user} {password} {mac}
-
-		if len(ws) < 5 {
+		// snmp communities @cred:{credential} {mac}
+		n := loginArgs(ws, 2)
+		if len(ws) < 3+n {
 			cmdinfo.Status = "error: invalid snmp communities command"
 			return cmdinfo
 		}
 		// find device
-		devID := ws[4]
-		user := ws[2]
-		password := ws[3]
-		q.Q(devID, user, password)
+		devID := ws[2+n]
+		q.Q(devID)
 		dev, err := FindDev(devID)
 		if err != nil {
 			cmdinfo.Status = fmt.Sprintf("error: %v", err)
 			return cmdinfo
 		}
+		user, password, _, err := deviceLogin(ws[2:], dev.Mac)
+		if err != nil {
+			cmdinfo.Status = fmt.Sprintf("error: %v", err)
+			return cmdinfo
+		}
 		// get communities
 		r, rw, err := GetSNMPCommunity(user, password, dev.IPAddress)
 		if err != nil {
@@ -844,6 +853,15 @@ func (h snmpHandler) OnTrap(addr net.Addr, trap snmplib.Trap) {
 	if QC.IsRoot {
 		// TODO save data to to q
 		q.Q("trapserver :", string(prettyPrint))
+		msg := WebSocketMessage{
+			Kind:    "trap",
+			Topic:   WebSocketTopicTraps,
+			Level:   LOG_ALERT,
+			Message: string(prettyPrint),
+			Data:    trap,
+		}
+		PublishWebSocketMessage(msg)
+		publishMqttEvent(msg)
 	} else {
 		err := SendSyslog(LOG_ALERT, "trapserver", string(prettyPrint))
 		if err != nil {
@@ -872,3 +890,84 @@ func StartTrapServer() {
 	}
 	server.ListenAndServe(snmpHandler{})
 }
+
+// PortStats are the link state and counters of a device port.
+type PortStats struct {
+	Link      bool   `json:"link"`
+	InOctets  uint32 `json:"inOctets"`
+	OutOctets uint32 `json:"outOctets"`
+}
+
+// PollPortStats walks the interface table of dev, keyed by port index.
+// It is a variable for tests.
+var PollPortStats = func(dev DevInfo) map[string]PortStats {
+	ports := map[string]PortStats{}
+	if dev.IPAddress == "" {
+		return ports
+	}
+	for _, oid := range []string{
+		".1.3.6.1.2.1.2.2.1.8",  // ifOperStatus
+		".1.3.6.1.2.1.2.2.1.10", // ifInOctets
+		".1.3.6.1.2.1.2.2.1.16", // ifOutOctets
+	} {
+		pdus, err := SnmpWalk(dev.IPAddress, oid)
+		if err != nil {
+			q.Q(err)
+			return ports
+		}
+		for _, pdu := range pdus {
+			port := pdu.Name[strings.LastIndex(pdu.Name, ".")+1:]
+			v := gosnmp.ToBigInt(pdu.Value).Uint64()
+			stats := ports[port]
+			switch oid {
+			case ".1.3.6.1.2.1.2.2.1.8":
+				stats.Link = v == 1
+			case ".1.3.6.1.2.1.2.2.1.10":
+				stats.InOctets = uint32(v)
+			default:
+				stats.OutOctets = uint32(v)
+			}
+			ports[port] = stats
+		}
+	}
+	return ports
+}
+
+// portStatsKept is how long port stats of devices not polled again are
+// kept.
+const portStatsKept = time.Hour
+
+type polledPortStats struct {
+	ports  map[string]PortStats
+	polled time.Time
+}
+
+// portStats are the port stats polled last by device mac, the opcua
+// address space and sparkplug share them instead of each walking the
+// devices.
+var portStats = struct {
+	sync.Mutex
+	devices map[string]polledPortStats
+}{devices: make(map[string]polledPortStats)}
+
+// devicePortStats returns the port stats of dev polled within maxAge,
+// dev is polled when they are older.
+func devicePortStats(dev DevInfo, maxAge time.Duration) map[string]PortStats {
+	now := time.Now()
+	portStats.Lock()
+	p, ok := portStats.devices[dev.Mac]
+	portStats.Unlock()
+	if ok && now.Sub(p.polled) < maxAge {
+		return p.ports
+	}
+	ports := PollPortStats(dev)
+	portStats.Lock()
+	defer portStats.Unlock()
+	for mac, p := range portStats.devices {
+		if now.Sub(p.polled) > portStatsKept {
+			delete(portStats.devices, mac)
+		}
+	}
+	portStats.devices[dev.Mac] = polledPortStats{ports: ports, polled: now}
+	return ports
+}
@@ -0,0 +1,529 @@
+package mnms
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	"github.com/qeof/q"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+	Eclipse Sparkplug B edge node.
+
+	When sparkplug.broker is set the service is a Sparkplug B edge node
+	named like the service, in group sparkplug.group, and each device it
+	scanned is a Sparkplug device named by its mac address:
+
+		spBv1.0/<group>/NBIRTH/<node>          node birth, bdSeq and Node Control/Rebirth
+		spBv1.0/<group>/NDEATH/<node>          last will of the node connection
+		spBv1.0/<group>/DBIRTH/<node>/<mac>    device properties, status and port metrics
+		spBv1.0/<group>/DDATA/<node>/<mac>     changed metrics, polled every sparkplug.interval
+		spBv1.0/<group>/DDEATH/<node>/<mac>    device went offline
+		spBv1.0/<group>/NCMD/<node>            Node Control/Rebirth true publishes all births again
+
+	Payloads are Sparkplug B protobuf, encoded here without generated
+	code. Sequence numbers run from 0 at NBIRTH to 255 and wrap.
+*/
+
+const sparkplugNamespace = "spBv1.0"
+
+// sparkplug b metric data types
+const (
+	sparkplugInt32   = 3
+	sparkplugInt64   = 4
+	sparkplugUInt32  = 7
+	sparkplugUInt64  = 8
+	sparkplugFloat   = 9
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+	sparkplugString  = 12
+)
+
+// sparkplugConnection is the name of the mqtt connection of the node.
+const sparkplugConnection = "sparkplug"
+
+const sparkplugRebirth = "Node Control/Rebirth"
+
+// SparkplugMetric is a metric of a sparkplug payload. Value is bool,
+// string, int32, int64, uint32, uint64, float32 or float64.
+type SparkplugMetric struct {
+	Name      string
+	Timestamp uint64
+	Datatype  uint32
+	Value     any
+}
+
+// SparkplugPayload is a sparkplug b payload.
+type SparkplugPayload struct {
+	Timestamp uint64
+	Metrics   []SparkplugMetric
+	Seq       uint64
+}
+
+// sparkplugDatatype returns the data type of metric value v.
+func sparkplugDatatype(v any) uint32 {
+	switch v.(type) {
+	case bool:
+		return sparkplugBoolean
+	case int32:
+		return sparkplugInt32
+	case int64:
+		return sparkplugInt64
+	case uint32:
+		return sparkplugUInt32
+	case uint64:
+		return sparkplugUInt64
+	case float32:
+		return sparkplugFloat
+	case float64:
+		return sparkplugDouble
+	default:
+		return sparkplugString
+	}
+}
+
+func appendSparkplugMetric(b []byte, m SparkplugMetric) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.Name)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.Timestamp)
+	datatype := m.Datatype
+	if datatype == 0 {
+		datatype = sparkplugDatatype(m.Value)
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(datatype))
+	switch v := m.Value.(type) {
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(v)))
+	case uint32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case int64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float32:
+		b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case nil:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	default:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, fmt.Sprint(v))
+	}
+	return b
+}
+
+// Marshal encodes the payload in protobuf.
+func (p *SparkplugPayload) Marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for _, m := range p.Metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendSparkplugMetric(nil, m))
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Seq)
+	return b
+}
+
+// consumeSparkplugFields calls f with the fields of the protobuf message
+// b, the varint value or the bytes of each field.
+func consumeSparkplugFields(b []byte, f func(num protowire.Number, v uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var bytes []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		err := f(num, v, bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSparkplugPayload decodes a protobuf sparkplug b payload.
+func ParseSparkplugPayload(b []byte) (*SparkplugPayload, error) {
+	p := &SparkplugPayload{}
+	err := consumeSparkplugFields(b, func(num protowire.Number, v uint64, bytes []byte) error {
+		switch num {
+		case 1:
+			p.Timestamp = v
+		case 3:
+			p.Seq = v
+		case 2:
+			var m SparkplugMetric
+			err := consumeSparkplugFields(bytes, func(num protowire.Number, v uint64, bytes []byte) error {
+				switch num {
+				case 1:
+					m.Name = string(bytes)
+				case 3:
+					m.Timestamp = v
+				case 4:
+					m.Datatype = uint32(v)
+				case 10:
+					m.Value = uint32(v)
+				case 11:
+					m.Value = v
+				case 12:
+					m.Value = math.Float32frombits(uint32(v))
+				case 13:
+					m.Value = math.Float64frombits(v)
+				case 14:
+					m.Value = protowire.DecodeBool(v)
+				case 15:
+					m.Value = string(bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			switch m.Datatype {
+			case sparkplugInt32:
+				if v, ok := m.Value.(uint32); ok {
+					m.Value = int32(v)
+				}
+			case sparkplugInt64:
+				if v, ok := m.Value.(uint64); ok {
+					m.Value = int64(v)
+				}
+			}
+			p.Metrics = append(p.Metrics, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// sparkplugDevice is the state of a device of the node.
+type sparkplugDevice struct {
+	born    bool
+	metrics map[string]any
+}
+
+var sparkplug struct {
+	sync.Mutex
+	client  MQTTClient.Client
+	bdSeq   uint64
+	seq     uint64
+	devices map[string]*sparkplugDevice
+}
+
+// sparkplugTopic returns the topic of message type of the node, or of
+// device mac of the node.
+func sparkplugTopic(msgType, mac string) string {
+	topic := strings.Join([]string{sparkplugNamespace, QC.SparkplugGroup, msgType, QC.Name}, "/")
+	if mac != "" {
+		topic += "/" + mac
+	}
+	return topic
+}
+
+// sparkplugPublish publishes metrics with the next sequence number.
+// Births start the sequence at 0. The caller holds the lock.
+func sparkplugPublish(msgType, mac string, metrics []SparkplugMetric) error {
+	client := sparkplug.client
+	if client == nil || !client.IsConnectionOpen() {
+		return errors.New("sparkplug node is not connected")
+	}
+	if msgType == "NBIRTH" {
+		sparkplug.seq = 0
+	} else {
+		sparkplug.seq = (sparkplug.seq + 1) % 256
+	}
+	now := uint64(time.Now().UnixMilli())
+	for i := range metrics {
+		if metrics[i].Timestamp == 0 {
+			metrics[i].Timestamp = now
+		}
+	}
+	payload := SparkplugPayload{Timestamp: now, Metrics: metrics, Seq: sparkplug.seq}
+	token := client.Publish(sparkplugTopic(msgType, mac), 0, false, payload.Marshal())
+	if !token.WaitTimeout(clientTimeout * time.Second) {
+		return errors.New("sparkplug publish timeout")
+	}
+	return token.Error()
+}
+
+// sparkplugMetrics sorts the metrics of m by name.
+func sparkplugMetrics(m map[string]any) []SparkplugMetric {
+	metrics := make([]SparkplugMetric, 0, len(m))
+	for k, v := range m {
+		metrics = append(metrics, SparkplugMetric{Name: k, Value: v})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// sparkplugDeviceMetrics are the metrics of dev.
+func sparkplugDeviceMetrics(dev DevInfo, online bool) map[string]any {
+	m := map[string]any{
+		"Properties/Model":    dev.ModelName,
+		"Properties/IP":       dev.IPAddress,
+		"Properties/MAC":      dev.Mac,
+		"Properties/Hostname": dev.Hostname,
+		"Properties/Kernel":   dev.Kernel,
+		"Properties/AP":       dev.Ap,
+		"Status/Online":       online,
+	}
+	if online {
+		maxAge := time.Duration(sparkplugInterval()) * time.Second
+		for port, stats := range devicePortStats(dev, maxAge) {
+			m["Ports/"+port+"/Link"] = stats.Link
+			m["Ports/"+port+"/InOctets"] = stats.InOctets
+			m["Ports/"+port+"/OutOctets"] = stats.OutOctets
+		}
+	}
+	return m
+}
+
+// sparkplugNodeBirth publishes the node birth. The caller holds the lock.
+func sparkplugNodeBirth() error {
+	for _, d := range sparkplug.devices {
+		d.born = false
+	}
+	return sparkplugPublish("NBIRTH", "", []SparkplugMetric{
+		{Name: "bdSeq", Value: sparkplug.bdSeq},
+		{Name: sparkplugRebirth, Value: false},
+		{Name: "Properties/Name", Value: QC.Name},
+	})
+}
+
+// sparkplugOwnDevices returns the devices scanned by this service.
+func sparkplugOwnDevices() []DevInfo {
+	QC.DevMutex.Lock()
+	defer QC.DevMutex.Unlock()
+	devs := []DevInfo{}
+	for _, dev := range QC.DevData {
+		if dev.Mac != specialMac && (dev.ScannedBy == "" || dev.ScannedBy == QC.Name) {
+			devs = append(devs, dev)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Mac < devs[j].Mac })
+	return devs
+}
+
+// SparkplugUpdate publishes the births, deaths and changed metrics of
+// the devices.
+func SparkplugUpdate() error {
+	devs := sparkplugOwnDevices()
+	now := time.Now()
+	metrics := make(map[string]map[string]any, len(devs))
+	for _, dev := range devs {
+		online := deviceStatus(dev, now) == mqttStatusOnline
+		metrics[dev.Mac] = sparkplugDeviceMetrics(dev, online)
+	}
+	sparkplug.Lock()
+	defer sparkplug.Unlock()
+	for _, dev := range devs {
+		m := metrics[dev.Mac]
+		d := sparkplug.devices[dev.Mac]
+		if d == nil {
+			d = &sparkplugDevice{}
+			sparkplug.devices[dev.Mac] = d
+		}
+		online := m["Status/Online"] == true
+		var err error
+		switch {
+		case !online && d.born:
+			err = sparkplugPublish("DDEATH", dev.Mac, nil)
+			d.born = false
+		case !online:
+		case !d.born:
+			err = sparkplugPublish("DBIRTH", dev.Mac, sparkplugMetrics(m))
+			d.born = err == nil
+		default:
+			changed := map[string]any{}
+			for k, v := range m {
+				if old, ok := d.metrics[k]; !ok || old != v {
+					changed[k] = v
+				}
+			}
+			if len(changed) > 0 {
+				err = sparkplugPublish("DDATA", dev.Mac, sparkplugMetrics(changed))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		d.metrics = m
+	}
+	return nil
+}
+
+// sparkplugCommand handles node commands, a rebirth request publishes
+// all births again.
+func sparkplugCommand(_ MQTTClient.Client, msg MQTTClient.Message) {
+	p, err := ParseSparkplugPayload(msg.Payload())
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	for _, m := range p.Metrics {
+		if m.Name != sparkplugRebirth || m.Value != true {
+			continue
+		}
+		q.Q("sparkplug rebirth")
+		// polling the devices takes a while, keep the message handler free
+		go func() {
+			sparkplug.Lock()
+			err := sparkplugNodeBirth()
+			sparkplug.Unlock()
+			if err == nil {
+				err = SparkplugUpdate()
+			}
+			if err != nil {
+				q.Q(err)
+			}
+		}()
+		return
+	}
+}
+
+// sparkplugConnected publishes the births of a new connection.
+func sparkplugConnected(client MQTTClient.Client) {
+	token := client.Subscribe(sparkplugTopic("NCMD", ""), 1, sparkplugCommand)
+	if token.WaitTimeout(clientTimeout*time.Second) && token.Error() != nil {
+		q.Q(token.Error())
+	}
+	sparkplug.Lock()
+	sparkplug.client = client
+	err := sparkplugNodeBirth()
+	sparkplug.Unlock()
+	if err == nil {
+		err = SparkplugUpdate()
+	}
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// sparkplugProfile is the connect profile of the node, with the node
+// death as last will.
+func sparkplugProfile() (MqttConnectProfile, error) {
+	broker, err := parseMqttBroker(QC.SparkplugBroker)
+	if err != nil {
+		return MqttConnectProfile{}, err
+	}
+	death := SparkplugPayload{
+		Timestamp: uint64(time.Now().UnixMilli()),
+		Metrics:   []SparkplugMetric{{Name: "bdSeq", Value: sparkplug.bdSeq}},
+	}
+	return MqttConnectProfile{
+		Name:         sparkplugConnection,
+		Broker:       broker,
+		ClientID:     QC.Name + ":" + sparkplugConnection,
+		Credential:   QC.SparkplugCredential,
+		CleanSession: true,
+		CAFile:       QC.SparkplugCA,
+		Will: &MqttWill{
+			Topic:   sparkplugTopic("NDEATH", ""),
+			Payload: string(death.Marshal()),
+			QoS:     1,
+		},
+	}, nil
+}
+
+// startSparkplug connects the sparkplug edge node. Each connection has
+// the next bdSeq in its birth and will, the client reconnects itself
+// since paho keeps the will of the first connection.
+func startSparkplug() error {
+	sparkplug.Lock()
+	sparkplug.devices = make(map[string]*sparkplugDevice)
+	sparkplug.bdSeq = (sparkplug.bdSeq + 1) % 256
+	p, err := sparkplugProfile()
+	sparkplug.Unlock()
+	if err != nil {
+		return err
+	}
+	return connectMqtt(p, sparkplugConnected, sparkplugLost)
+}
+
+// sparkplugLost connects the node again after the broker published the
+// death of the lost connection.
+func sparkplugLost() {
+	for {
+		err := startSparkplug()
+		if err == nil {
+			return
+		}
+		q.Q(err)
+		time.Sleep(clientTimeout * time.Second)
+	}
+}
+
+// sparkplugInterval returns sparkplug.interval, 60 seconds when unset.
+func sparkplugInterval() int {
+	interval := ReadSetting(&QC.SparkplugInterval)
+	if interval <= 0 {
+		interval = 60
+	}
+	return interval
+}
+
+// RunSparkplug connects the sparkplug edge node and publishes device
+// data every sparkplug.interval seconds.
+func RunSparkplug() error {
+	err := startSparkplug()
+	if err != nil {
+		return err
+	}
+	for {
+		time.Sleep(time.Duration(sparkplugInterval()) * time.Second)
+		sparkplug.Lock()
+		connected := sparkplug.client != nil && sparkplug.client.IsConnectionOpen()
+		sparkplug.Unlock()
+		if !connected {
+			continue
+		}
+		err = SparkplugUpdate()
+		if err != nil {
+			q.Q(err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package mnms
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	MQTTClient "github.com/eclipse/paho.mqtt.golang"
+	MQTTBroker "github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+// TestSparkplugPayload tests encoding and decoding sparkplug payloads
+func TestSparkplugPayload(t *testing.T) {
+	p := SparkplugPayload{Timestamp: 1700000000000, Seq: 255, Metrics: []SparkplugMetric{
+		{Name: "bdSeq", Timestamp: 1700000000000, Value: uint64(7)},
+		{Name: "Ports/1/Link", Value: true},
+		{Name: "Ports/1/InOctets", Value: uint32(4000000000)},
+		{Name: "Temperature", Value: 41.5},
+		{Name: "Offset", Value: int32(-3)},
+		{Name: "Properties/Model", Value: "EHG7508"},
+	}}
+	got, err := ParseSparkplugPayload(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Timestamp != p.Timestamp || got.Seq != p.Seq || len(got.Metrics) != len(p.Metrics) {
+		t.Fatal("unexpected payload", got)
+	}
+	for i, m := range got.Metrics {
+		if m.Name != p.Metrics[i].Name || m.Value != p.Metrics[i].Value ||
+			m.Datatype != sparkplugDatatype(p.Metrics[i].Value) {
+			t.Errorf("unexpected metric %+v", m)
+		}
+	}
+	if _, err = ParseSparkplugPayload([]byte{0x12, 0x05, 0x0a}); err == nil {
+		t.Fatal("expect truncated payload to fail")
+	}
+}
+
+// TestSparkplug tests node and device births, data, deaths and rebirth
+func TestSparkplug(t *testing.T) {
+	restoreSettings(t)
+	QC.Name = "client1"
+	poll := PollPortStats
+	defer func() {
+		PollPortStats = poll
+	}()
+	inOctets := uint32(100)
+	PollPortStats = func(dev DevInfo) map[string]PortStats {
+		return map[string]PortStats{"1": {Link: true, InOctets: inOctets}}
+	}
+	forgetPortStats()
+	defer forgetPortStats()
+
+	const mac = "00-60-E9-18-3C-3C"
+	// only the test device, devices of other tests would take sequence numbers
+	QC.DevMutex.Lock()
+	devData := QC.DevData
+	QC.DevData = map[string]DevInfo{mac: {Mac: mac, IPAddress: "10.0.50.1", ModelName: "EHG7508", ScannedBy: "client1",
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10)}}
+	QC.DevMutex.Unlock()
+	defer func() {
+		QC.DevMutex.Lock()
+		QC.DevData = devData
+		QC.DevMutex.Unlock()
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	broker := MQTTBroker.NewServer(nil)
+	err = broker.AddListener(listeners.NewTCP("sparkplug", addr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = broker.Serve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan MQTTClient.Message, 100)
+	opts := MQTTClient.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("host")
+	client := MQTTClient.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(100)
+	token := client.Subscribe("spBv1.0/#", 0, func(_ MQTTClient.Client, msg MQTTClient.Message) {
+		received <- msg
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect := func(topic string, seq uint64) map[string]any {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-received:
+				if msg.Topic() != topic {
+					continue
+				}
+				p, err := ParseSparkplugPayload(msg.Payload())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Seq != seq {
+					t.Fatalf("expect %s seq %d, got %d", topic, seq, p.Seq)
+				}
+				metrics := map[string]any{}
+				for _, m := range p.Metrics {
+					metrics[m.Name] = m.Value
+				}
+				return metrics
+			case <-timeout:
+				t.Fatal("no message on", topic)
+			}
+		}
+	}
+
+	QC.SparkplugBroker = addr
+	QC.SparkplugGroup = "plant"
+	err = startSparkplug()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = MqttDisconnect(sparkplugConnection)
+	}()
+	m := expect("spBv1.0/plant/NBIRTH/client1", 0)
+	bdSeq, ok := m["bdSeq"].(uint64)
+	if !ok || m[sparkplugRebirth] != false {
+		t.Fatal("unexpected node birth", m)
+	}
+	m = expect("spBv1.0/plant/DBIRTH/client1/"+mac, 1)
+	if m["Properties/Model"] != "EHG7508" || m["Status/Online"] != true || m["Ports/1/InOctets"] != uint32(100) {
+		t.Fatal("unexpected device birth", m)
+	}
+
+	inOctets = 200
+	forgetPortStats()
+	err = SparkplugUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m = expect("spBv1.0/plant/DDATA/client1/"+mac, 2); len(m) != 1 || m["Ports/1/InOctets"] != uint32(200) {
+		t.Fatal("expect changed metrics only", m)
+	}
+
+	rebirth := SparkplugPayload{Metrics: []SparkplugMetric{{Name: sparkplugRebirth, Value: true}}}
+	if token = client.Publish("spBv1.0/plant/NCMD/client1", 1, false, rebirth.Marshal()); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	expect("spBv1.0/plant/NBIRTH/client1", 0)
+	expect("spBv1.0/plant/DBIRTH/client1/"+mac, 1)
+
+	QC.DevMutex.Lock()
+	dev := QC.DevData[mac]
+	dev.ArpMissed = 2
+	QC.DevData[mac] = dev
+	QC.DevMutex.Unlock()
+	err = SparkplugUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("spBv1.0/plant/DDEATH/client1/"+mac, 2)
+
+	// another client taking the client id drops the node, the broker sends
+	// its death and the node comes back with the next bdSeq
+	opts = MQTTClient.NewClientOptions().AddBroker("tcp://" + addr).SetClientID(QC.Name + ":" + sparkplugConnection)
+	opts.SetAutoReconnect(false)
+	other := MQTTClient.NewClient(opts)
+	if token := other.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer other.Disconnect(100)
+	if m = expect("spBv1.0/plant/NDEATH/client1", 0); m["bdSeq"] != bdSeq {
+		t.Fatal("expect death with the bdSeq of the birth", m, bdSeq)
+	}
+	if m = expect("spBv1.0/plant/NBIRTH/client1", 0); m["bdSeq"] != (bdSeq+1)%256 {
+		t.Fatal("expect birth with the next bdSeq", m, bdSeq)
+	}
+}
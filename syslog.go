@@ -1,7 +1,6 @@
 package mnms
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/influxdata/go-syslog/v3"
@@ -125,11 +125,13 @@ func StartSyslogServer() {
 			q.Q(err)
 		}
 		q.Q("syslog input", raddr, mlen)
+		forwardSyslog(string(buf[:mlen]), raddr)
 		err = syslogInput(mlen, buf)
-		if err != nil {
-			// Implement saving and rotating logs locally. Currently
-			// if there is no remote syslog server specified we drop the logs.
-			if QC.IsRoot {
+		// Implement saving and rotating logs locally. Currently
+		// if there is no remote syslog server specified we drop the logs.
+		// Clients keep a local copy as well when asked to.
+		if err != nil || ReadSetting(&QC.SyslogKeepLocal) {
+			if QC.IsRoot || ReadSetting(&QC.SyslogKeepLocal) {
 				_, _, err := parsingDataofSyslog(string(buf[:mlen]))
 				if err != nil {
 					f, b, err := SyslogParsePriority(string(buf[:mlen]))
@@ -139,9 +141,9 @@ func StartSyslogServer() {
 					p := fmt.Sprintf("<%v>", (f*8)+b)
 					m := strings.ReplaceAll(string(buf[:mlen]), p, "")
 					message := fmt.Sprintf("%v%v %v %v", p, time.Now().Format("Jan 02 15:04:05"), raddr.String(), m)
-					SaveLog(message)
+					saveLogFrom(raddr, message)
 				} else {
-					SaveLog(string(buf[:mlen]))
+					saveLogFrom(raddr, string(buf[:mlen]))
 				}
 			}
 		}
@@ -149,13 +151,21 @@ func StartSyslogServer() {
 }
 
 func InitRemoteSyslog() error {
-	if QC.RemoteSyslogServerAddr == "" {
+	QC.SyslogMutex.Lock()
+	defer QC.SyslogMutex.Unlock()
+	return initRemoteSyslog()
+}
+
+// initRemoteSyslog connects to the remote syslog server, the caller
+// holds QC.SyslogMutex.
+func initRemoteSyslog() error {
+	if ReadSetting(&QC.RemoteSyslogServerAddr) == "" {
 		return fmt.Errorf("%v", "Missing remote syslog server address")
 	}
 	if QC.RemoteSyslogServer != nil {
 		QC.RemoteSyslogServer.Close()
 	}
-	udpsock, err := net.Dial("udp4", QC.RemoteSyslogServerAddr)
+	udpsock, err := net.Dial("udp4", ReadSetting(&QC.RemoteSyslogServerAddr))
 	if err != nil {
 		q.Q(err)
 		return err
@@ -192,9 +202,11 @@ func syslogInput(mlen int, buf []byte) error {
 		return err
 	}
 	SendSocketMessage(severity, bufStr)
+	QC.SyslogMutex.Lock()
+	defer QC.SyslogMutex.Unlock()
 	if QC.RemoteSyslogServer == nil {
 		// First time, initialize client to remote syslog service
-		if err := InitRemoteSyslog(); err != nil {
+		if err := initRemoteSyslog(); err != nil {
 			q.Q(err)
 			return err
 		}
@@ -203,7 +215,7 @@ func syslogInput(mlen int, buf []byte) error {
 	if err != nil {
 		q.Q(err)
 		// upon failure, re-establish remote client and attemp to write again
-		if err := InitRemoteSyslog(); err != nil {
+		if err := initRemoteSyslog(); err != nil {
 			return err
 		}
 		_, err := QC.RemoteSyslogServer.Write(buf[:mlen])
@@ -226,15 +238,19 @@ func SendSyslog(priority int, tag string, msg string) error {
 		name = QC.Name
 	}
 	syslogmsg := fmt.Sprintf("<%d>%s %s %s: %s", priority, timestamp, name, tag, msg)
-	if QC.RemoteSyslogServerAddr == "" {
+	forwardSyslog(syslogmsg, nil)
+	QC.SyslogMutex.Lock()
+	if ReadSetting(&QC.RemoteSyslogServerAddr) == "" {
+		QC.SyslogMutex.Unlock()
 		q.Q("Missing remote syslog server address, can't send syslog")
 		rootSaveLog(syslogmsg)
 		return fmt.Errorf("%v", "Missing remote syslog server address")
 	}
 	// reuse udp socket instead of open/close per message
 	if QC.RemoteSyslogServer == nil {
-		udpSock, err := net.Dial("udp4", QC.RemoteSyslogServerAddr)
+		udpSock, err := net.Dial("udp4", ReadSetting(&QC.RemoteSyslogServerAddr))
 		if err != nil {
+			QC.SyslogMutex.Unlock()
 			rootSaveLog(syslogmsg)
 
 			return err
@@ -244,6 +260,7 @@ func SendSyslog(priority int, tag string, msg string) error {
 	}
 
 	_, err := QC.RemoteSyslogServer.Write([]byte(syslogmsg))
+	QC.SyslogMutex.Unlock()
 	if err != nil {
 		q.Q(err)
 		rootSaveLog(syslogmsg)
@@ -268,38 +285,156 @@ func rootSaveLog(syslogmsg string) {
 	}
 }
 
+// SyslogState is the syslog configuration made by commands, kept in
+// syslog.json of the mnms folder so that it survives restarts.
+type SyslogState struct {
+	Rules     []SyslogExtractRule   `json:"rules"`
+	Forwards  []SyslogForwardTarget `json:"forwards,omitempty"`
+	Retention *SyslogRetention      `json:"retention,omitempty"`
+}
+
+var syslogStateMutex sync.Mutex
+
+func syslogStatePath() string {
+	mnmsDir, err := CheckMNMSFolder()
+	if err != nil {
+		mnmsDir = "."
+	}
+	return path.Join(mnmsDir, "syslog.json")
+}
+
+func readSyslogState() (*SyslogState, error) {
+	var state SyslogState
+	data, err := os.ReadFile(syslogStatePath())
+	if os.IsNotExist(err) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveSyslogState changes the saved syslog configuration with update.
+func saveSyslogState(update func(*SyslogState)) error {
+	syslogStateMutex.Lock()
+	defer syslogStateMutex.Unlock()
+	state, err := readSyslogState()
+	if err != nil {
+		return err
+	}
+	update(state)
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(syslogStatePath(), data, 0o644)
+}
+
+// LoadSyslogState applies the saved syslog configuration. The saved
+// retention applies unless the settings give it, call it after
+// LoadSettings.
+func LoadSyslogState() error {
+	syslogStateMutex.Lock()
+	state, err := readSyslogState()
+	syslogStateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if state.Retention != nil {
+		err = setSavedSettings(map[string]interface{}{
+			"syslog.retentionDays":   state.Retention.Days,
+			"syslog.retentionBudget": state.Retention.Budget,
+		})
+		if err != nil {
+			q.Q("saved syslog retention not applied", err)
+		}
+	}
+	if state.Rules != nil {
+		// saved rules replace the defaults, also when some were deleted
+		err = setSyslogRules(state.Rules)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range state.Forwards {
+		err = AddSyslogForwardTarget(&state.Forwards[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var Logger *lumberjack.Logger
 
+// syslogLocalPath returns the path of the local syslog file.
+func syslogLocalPath() string {
+	QC.SyslogMutex.Lock()
+	defer QC.SyslogMutex.Unlock()
+	return ReadSetting(&QC.SyslogLocalPath)
+}
+
 func initLogger() *lumberjack.Logger {
-	filename := path.Join(QC.SyslogLocalPath)
+	filename := path.Join(ReadSetting(&QC.SyslogLocalPath))
 	Logger := &lumberjack.Logger{
 		Filename:   filename,
-		MaxSize:    int(QC.SyslogFileSize),
+		MaxSize:    int(ReadSetting(&QC.SyslogFileSize)),
 		MaxBackups: 10,
-		Compress:   QC.SyslogCompress,
+		MaxAge:     ReadSetting(&QC.SyslogRetentionDays),
+		Compress:   ReadSetting(&QC.SyslogCompress),
 		LocalTime:  true,
 	}
+	if ReadSetting(&QC.SyslogRetentionDays) > 0 || ReadSetting(&QC.SyslogRetentionBudget) > 0 {
+		// backups are pruned by the retention policy instead
+		Logger.MaxBackups = 0
+	}
 	return Logger
 }
 
+var syslogLineRegexp = regexp.MustCompile(`\r?\n`)
+
+// syslogLine returns data as it is saved, on a single line.
+func syslogLine(data string) string {
+	return syslogLineRegexp.ReplaceAllString(data, " ")
+}
+
+// saveLogFrom saves syslog received from raddr to file, with its source
+// address in the sidecar file.
+func saveLogFrom(raddr net.Addr, data string) {
+	err := saveSyslogSource(syslogLocalPath(), raddr, data)
+	if err != nil {
+		q.Q(err)
+	}
+	SaveLog(data)
+}
+
 // Save syslog to file
 func SaveLog(data string) {
 	// mkdir()
+	startSyslogRetention()
+	QC.SyslogMutex.Lock()
+	defer QC.SyslogMutex.Unlock()
 	if Logger == nil {
 		Logger = initLogger()
 	} else {
-		if Logger.Filename != (path.Join(QC.SyslogLocalPath)) || Logger.Compress != QC.SyslogCompress || Logger.MaxSize != int(QC.SyslogFileSize) {
+		// the retention budget changes MaxBackups
+		l := initLogger()
+		if Logger.Filename != l.Filename || Logger.Compress != l.Compress || Logger.MaxSize != l.MaxSize ||
+			Logger.MaxAge != l.MaxAge || Logger.MaxBackups != l.MaxBackups {
 			err := Logger.Close()
 			if err != nil {
 				q.Q(err)
 			}
-			Logger = initLogger()
+			Logger = l
 			q.Q("SaveLog,change local syslog paramter:", Logger)
 		}
 	}
-	re := regexp.MustCompile(`\r?\n`)
-	data = re.ReplaceAllString(data, " ")
-	_, err := Logger.Write([]byte(data))
+	_, err := Logger.Write([]byte(syslogLine(data)))
 	if err != nil {
 		q.Q(err)
 		//remind user if file error
@@ -334,7 +469,9 @@ func SyslogSetPathCmd(cmdinfo *CmdInfo) *CmdInfo {
 	}
 	var path string
 	Unpack(ws[4:], &path)
-	QC.SyslogLocalPath = path
+	QC.SyslogMutex.Lock()
+	WriteSetting(&QC.SyslogLocalPath, path)
+	QC.SyslogMutex.Unlock()
 	cmdinfo.Status = "ok"
 	return cmdinfo
 }
@@ -364,7 +501,9 @@ func SyslogSetMaxSizeCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	QC.SyslogFileSize = uint(s)
+	QC.SyslogMutex.Lock()
+	WriteSetting(&QC.SyslogFileSize, uint(s))
+	QC.SyslogMutex.Unlock()
 	cmdinfo.Status = "ok"
 	return cmdinfo
 }
@@ -394,14 +533,16 @@ func SyslogSetCompressCmd(cmdinfo *CmdInfo) *CmdInfo {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	QC.SyslogCompress = boolValue
+	QC.SyslogMutex.Lock()
+	WriteSetting(&QC.SyslogCompress, boolValue)
+	QC.SyslogMutex.Unlock()
 	cmdinfo.Status = "ok"
 	return cmdinfo
 }
 
 const foramt = "2006/01/02 15:04:05"
 
-// Read local syslog.
+// Read local syslog, including rotated backups.
 //
 // Usage : config local syslog read [start date] [start time] [end date] [end time] [max line]
 //
@@ -457,35 +598,30 @@ func ReadSyslogCmd(cmdinfo *CmdInfo) *CmdInfo {
 		}
 	}
 
-	readFile, err := os.Open(QC.SyslogLocalPath)
+	query := SyslogQuery{Ascending: true, Limit: maxline}
+	if filtertime {
+		_, err := compareTime(start, end, start)
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		query.Start, _ = parseSyslogTime(start)
+		query.End, _ = parseSyslogTime(end)
+	}
+	idx, err := GetSyslogIndex()
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	result, err := idx.Search(query)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
 		return cmdinfo
 	}
-	fileScanner := bufio.NewScanner(readFile)
-	fileScanner.Split(bufio.ScanLines)
-
 	logs := []syslog.Base{}
-	for fileScanner.Scan() {
-		b, t, err := parsingDataofSyslog(fileScanner.Text())
-		if err != nil {
-			continue
-		}
-		if filtertime {
-			r, _ := compareTime(start, end, t.Format(foramt))
-			if r {
-				logs = append(logs, b)
-			}
-		} else {
-			logs = append(logs, b)
-		}
-		if maxline != 0 {
-			if len(logs) >= maxline {
-				break
-			}
-		}
+	for _, rec := range result.Records {
+		logs = append(logs, rec.base)
 	}
-	_ = readFile.Close()
 	b, err := json.Marshal(&logs)
 	if err != nil {
 		cmdinfo.Status = "error: " + err.Error()
@@ -546,14 +682,42 @@ func compareTime(start, end, target string) (bool, error) {
 }
 
 func SendSocketMessage(severity int, bufStr string) {
-	if severity < 6 {
-		ix := strings.Index(bufStr, ">")
-		wsMessage := WebSocketMessage{
-			Kind:    "mnms_syslog",
+	ix := strings.Index(bufStr, ">")
+	wsMessage := WebSocketMessage{
+		Kind:    "mnms_syslog",
+		Topic:   WebSocketTopicSyslog,
+		Level:   severity,
+		Message: strings.TrimSpace(bufStr[ix+1:]),
+	}
+	PublishWebSocketMessage(wsMessage)
+	publishMqttEvent(wsMessage)
+	q.Q("forward to ws", wsMessage)
+
+	// traps and firmware progress reach root as syslog
+	b, _, err := parsingDataofSyslog(bufStr)
+	if err != nil || b.Appname == nil || b.Message == nil {
+		return
+	}
+	switch *b.Appname {
+	case "trapserver":
+		msg := WebSocketMessage{
+			Kind:    "trap",
+			Topic:   WebSocketTopicTraps,
+			Level:   severity,
+			Message: *b.Message,
+		}
+		PublishWebSocketMessage(msg)
+		publishMqttEvent(msg)
+	case "firmware":
+		mac, _, _ := strings.Cut(*b.Message, " ")
+		msg := WebSocketMessage{
+			Kind:    "firmware",
+			Topic:   WebSocketTopicFirmware,
 			Level:   severity,
-			Message: strings.TrimSpace(bufStr[ix+1:]),
+			Mac:     mac,
+			Message: *b.Message,
 		}
-		QC.WebSocketMessageBroadcast <- wsMessage
-		q.Q("forward to ws", wsMessage)
+		PublishWebSocketMessage(msg)
+		publishMqttEvent(msg)
 	}
 }
@@ -0,0 +1,452 @@
+package mnms
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Syslog enrichment correlates a syslog message with the device that
+	sent it and extracts structured fields from the message text.
+
+	The device is resolved from the source address the message was
+	received from, or failing that from the hostname field which Atop
+	devices fill with their IP address or configured hostname. Saved
+	messages are kept as received, their source addresses are kept in a
+	sidecar file next to the local syslog file, syslog_mnms.log.sources,
+	one hash of a line and its source address per line.
+
+	Extraction rules are either regular expressions with named groups,
+	whose groups become fields, or key=value rules, which collect all
+	key=value pairs of matching messages.
+*/
+
+// SyslogExtractRule extracts structured fields from matching messages.
+type SyslogExtractRule struct {
+	Name    string            `json:"name"`
+	Kind    string            `json:"kind"` // regex or kv
+	Pattern string            `json:"pattern"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	re      *regexp.Regexp
+}
+
+var defaultSyslogRules = []SyslogExtractRule{
+	{
+		Name:    "linkstate",
+		Kind:    "regex",
+		Pattern: `(?i)port\s*(?P<port>[\w/.-]+)\s*(?:link\s*)?(?:is\s*|changed\s*to\s*)?(?P<state>up|down)\b`,
+		Fields:  map[string]string{"event": "link"},
+	},
+	{
+		Name:    "loginfail",
+		Kind:    "regex",
+		Pattern: `(?i)(?:login|logon|authentication)\s*fail(?:ed|ure)?(?:.*?\buser(?:name)?\s*[:=]?\s*(?P<user>[^\s,;]+))?(?:.*?\bfrom\s*(?P<ip>\d+\.\d+\.\d+\.\d+))?`,
+		Fields:  map[string]string{"event": "loginfail"},
+	},
+	{
+		Name:    "keyvalue",
+		Kind:    "kv",
+		Pattern: `\w+=\S+`,
+	},
+}
+
+var kvPairRegexp = regexp.MustCompile(`([A-Za-z_][\w.-]*)=("[^"]*"|[^\s,;]+)`)
+
+var syslogRules = struct {
+	sync.Mutex
+	rules   []SyslogExtractRule
+	version int
+}{}
+
+func init() {
+	for _, r := range defaultSyslogRules {
+		err := AddSyslogRule(r)
+		if err != nil {
+			q.Q(err)
+		}
+	}
+}
+
+// AddSyslogRule adds or replaces the extraction rule with the same name.
+func AddSyslogRule(rule SyslogExtractRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule name required")
+	}
+	if rule.Kind != "regex" && rule.Kind != "kv" {
+		return fmt.Errorf("invalid rule kind %v, must be regex or kv", rule.Kind)
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rule.re = re
+	syslogRules.Lock()
+	defer syslogRules.Unlock()
+	syslogRules.version++
+	for i, r := range syslogRules.rules {
+		if r.Name == rule.Name {
+			syslogRules.rules[i] = rule
+			return nil
+		}
+	}
+	syslogRules.rules = append(syslogRules.rules, rule)
+	return nil
+}
+
+// setSyslogRules replaces the extraction rules with rules.
+func setSyslogRules(rules []SyslogExtractRule) error {
+	compiled := make([]SyslogExtractRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		rule.re = re
+		compiled = append(compiled, rule)
+	}
+	syslogRules.Lock()
+	defer syslogRules.Unlock()
+	syslogRules.rules = compiled
+	syslogRules.version++
+	return nil
+}
+
+// saveSyslogRules keeps the extraction rules in the syslog state.
+func saveSyslogRules() error {
+	rules := GetSyslogRules()
+	return saveSyslogState(func(state *SyslogState) {
+		state.Rules = rules
+	})
+}
+
+// DeleteSyslogRule deletes the extraction rule with the name.
+func DeleteSyslogRule(name string) error {
+	syslogRules.Lock()
+	defer syslogRules.Unlock()
+	for i, r := range syslogRules.rules {
+		if r.Name == name {
+			syslogRules.rules = append(syslogRules.rules[:i], syslogRules.rules[i+1:]...)
+			syslogRules.version++
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %s not exist", name)
+}
+
+// GetSyslogRules returns a copy of the extraction rules.
+func GetSyslogRules() []SyslogExtractRule {
+	syslogRules.Lock()
+	defer syslogRules.Unlock()
+	rules := make([]SyslogExtractRule, len(syslogRules.rules))
+	copy(rules, syslogRules.rules)
+	return rules
+}
+
+func syslogRulesVersion() int {
+	syslogRules.Lock()
+	defer syslogRules.Unlock()
+	return syslogRules.version
+}
+
+// ExtractSyslogFields applies the extraction rules to msg and returns the
+// extracted fields and the names of the rules that matched.
+func ExtractSyslogFields(msg string) (map[string]string, []string) {
+	var fields map[string]string
+	matched := []string{}
+	set := func(k, v string) {
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[k] = v
+	}
+	for _, rule := range GetSyslogRules() {
+		switch rule.Kind {
+		case "regex":
+			m := rule.re.FindStringSubmatch(msg)
+			if m == nil {
+				continue
+			}
+			for i, name := range rule.re.SubexpNames() {
+				if name != "" && m[i] != "" {
+					set(name, m[i])
+				}
+			}
+		case "kv":
+			if !rule.re.MatchString(msg) {
+				continue
+			}
+			for _, kv := range kvPairRegexp.FindAllStringSubmatch(msg, -1) {
+				set(kv[1], strings.Trim(kv[2], `"`))
+			}
+		}
+		for k, v := range rule.Fields {
+			set(k, v)
+		}
+		matched = append(matched, rule.Name)
+	}
+	return fields, matched
+}
+
+// syslogSourcesMax is the number of source addresses kept in the
+// sidecar file, the older half is dropped when there are more.
+const syslogSourcesMax = 100000
+
+// syslogSources are the source addresses of the lines of the local
+// syslog file at path, by hash of the line.
+var syslogSources = struct {
+	sync.Mutex
+	path   string
+	byLine map[string]string
+	order  []string
+}{}
+
+func syslogSourcesPath(path string) string {
+	return path + ".sources"
+}
+
+// syslogLineHash returns the key of a saved line in the sidecar file.
+func syslogLineHash(line string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(line))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// loadSyslogSources reads the sidecar file of the syslog file at path
+// when it is not the one loaded, the caller holds syslogSources.
+func loadSyslogSources(path string) {
+	if syslogSources.byLine != nil && syslogSources.path == path {
+		return
+	}
+	syslogSources.path = path
+	syslogSources.byLine = make(map[string]string)
+	syslogSources.order = nil
+	f, err := os.Open(syslogSourcesPath(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			q.Q(err)
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, source, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if _, ok := syslogSources.byLine[key]; !ok {
+			syslogSources.order = append(syslogSources.order, key)
+		}
+		syslogSources.byLine[key] = source
+	}
+	if err := scanner.Err(); err != nil {
+		q.Q(err)
+	}
+}
+
+// writeSyslogSources writes the sidecar file again with the newer half
+// of the source addresses, the caller holds syslogSources.
+func writeSyslogSources() error {
+	drop := syslogSources.order[:len(syslogSources.order)/2]
+	for _, key := range drop {
+		delete(syslogSources.byLine, key)
+	}
+	syslogSources.order = append([]string(nil), syslogSources.order[len(drop):]...)
+	var b strings.Builder
+	for _, key := range syslogSources.order {
+		b.WriteString(key + " " + syslogSources.byLine[key] + "\n")
+	}
+	tmp := syslogSourcesPath(syslogSources.path) + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, syslogSourcesPath(syslogSources.path))
+}
+
+// saveSyslogSource keeps the host of raddr as the source address of line
+// saved to the local syslog file at path.
+func saveSyslogSource(path string, raddr net.Addr, line string) error {
+	if raddr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(raddr.String())
+	if err != nil {
+		host = raddr.String()
+	}
+	key := syslogLineHash(syslogLine(line))
+	syslogSources.Lock()
+	defer syslogSources.Unlock()
+	loadSyslogSources(path)
+	if syslogSources.byLine[key] == host {
+		return nil
+	}
+	if _, ok := syslogSources.byLine[key]; !ok {
+		syslogSources.order = append(syslogSources.order, key)
+	}
+	syslogSources.byLine[key] = host
+	if len(syslogSources.order) > syslogSourcesMax {
+		return writeSyslogSources()
+	}
+	f, err := os.OpenFile(syslogSourcesPath(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(key + " " + host + "\n")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syslogSource returns the source address of line of the local syslog
+// file at path, if it is known.
+func syslogSource(path, line string) string {
+	syslogSources.Lock()
+	defer syslogSources.Unlock()
+	loadSyslogSources(path)
+	return syslogSources.byLine[syslogLineHash(line)]
+}
+
+// findDevForSyslog resolves the device that sent a message, by source
+// address first and by hostname as IP address or device hostname next.
+func findDevForSyslog(sourceIP, hostname string) *DevInfo {
+	QC.DevMutex.Lock()
+	defer QC.DevMutex.Unlock()
+	for _, ip := range []string{sourceIP, hostname} {
+		if ip == "" {
+			continue
+		}
+		for _, dev := range QC.DevData {
+			if dev.IPAddress == ip {
+				return &dev
+			}
+		}
+	}
+	if hostname == "" {
+		return nil
+	}
+	for _, dev := range QC.DevData {
+		if strings.EqualFold(dev.Hostname, hostname) || strings.EqualFold(dev.Mac, hostname) {
+			return &dev
+		}
+	}
+	return nil
+}
+
+// EnrichSyslogRecord fills in the device and extracted fields of r.
+func EnrichSyslogRecord(r *SyslogRecord, sourceIP string) {
+	if sourceIP != "" {
+		r.SourceIP = sourceIP
+	}
+	dev := findDevForSyslog(r.SourceIP, r.Hostname)
+	if dev != nil {
+		r.DevMac = dev.Mac
+		r.DevModel = dev.ModelName
+		r.DevHostname = dev.Hostname
+		if r.SourceIP == "" {
+			r.SourceIP = dev.IPAddress
+		}
+	}
+	r.Fields, r.Rules = ExtractSyslogFields(r.Message)
+}
+
+// ParseSyslogMessage parses a RFC3164 or RFC5424 message received from
+// raddr into an enriched record.
+func ParseSyslogMessage(message string, raddr net.Addr) (*SyslogRecord, error) {
+	b, t, err := parsingDataofSyslog(message)
+	if err != nil {
+		return nil, err
+	}
+	r := &SyslogRecord{Timestamp: t, base: b}
+	r.fillFromBase()
+	sourceIP := ""
+	if raddr != nil {
+		sourceIP, _, err = net.SplitHostPort(raddr.String())
+		if err != nil {
+			sourceIP = raddr.String()
+		}
+	}
+	EnrichSyslogRecord(r, sourceIP)
+	return r, nil
+}
+
+// Configure syslog field extraction rules.
+//
+// Usage : config local syslog rule add [name] [kind] [pattern]
+//
+//	[name]        : rule name
+//	[kind]        : regex or kv
+//	[pattern]     : regular expression, named groups become fields;
+//	                for kv rules key=value pairs of matching messages become fields
+//
+// Usage : config local syslog rule delete [name]
+//
+// Usage : config local syslog rule list
+//
+//	rules are kept in syslog.json and loaded again on restart
+//
+// Example :
+//
+//	config local syslog rule add fan regex fan (?P<fan>\d+) (?P<fanstate>failed|ok)
+//	config local syslog rule delete fan
+//	config local syslog rule list
+func SyslogRuleCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	if len(ws) < 5 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	switch ws[4] {
+	case "add":
+		if len(ws) < 8 {
+			cmdinfo.Status = "error: invalid command"
+			return cmdinfo
+		}
+		rule := SyslogExtractRule{Name: ws[5], Kind: ws[6], Pattern: strings.Join(ws[7:], " ")}
+		err := AddSyslogRule(rule)
+		if err == nil {
+			err = saveSyslogRules()
+		}
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+	case "delete":
+		if len(ws) < 6 {
+			cmdinfo.Status = "error: invalid command"
+			return cmdinfo
+		}
+		err := DeleteSyslogRule(ws[5])
+		if err == nil {
+			err = saveSyslogRules()
+		}
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+	case "list":
+		b, err := json.Marshal(GetSyslogRules())
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Result = string(b)
+	default:
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
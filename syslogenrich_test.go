@@ -0,0 +1,152 @@
+package mnms
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestExtractSyslogFields tests the default Atop extraction rules
+func TestExtractSyslogFields(t *testing.T) {
+	fields, rules := ExtractSyslogFields("Port 3 link down")
+	if fields["event"] != "link" || fields["port"] != "3" || fields["state"] != "down" {
+		t.Fatal("unexpected link fields", fields, rules)
+	}
+	fields, _ = ExtractSyslogFields("Login failed, user: admin from 10.0.50.8")
+	if fields["event"] != "loginfail" || fields["user"] != "admin" || fields["ip"] != "10.0.50.8" {
+		t.Fatal("unexpected login fields", fields)
+	}
+	fields, _ = ExtractSyslogFields(`cpu=93 mem=41 name="core switch"`)
+	if fields["cpu"] != "93" || fields["mem"] != "41" || fields["name"] != "core switch" {
+		t.Fatal("unexpected key value fields", fields)
+	}
+	fields, rules = ExtractSyslogFields("nothing to see here")
+	if len(fields) != 0 || len(rules) != 0 {
+		t.Fatal("expect no fields", fields, rules)
+	}
+}
+
+// TestSyslogRuleCmd tests adding, deleting and saving extraction rules
+func TestSyslogRuleCmd(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+	cmdinfo := &CmdInfo{Command: `config local syslog rule add fan regex fan (?P<fan>\d+) (?P<fanstate>failed|ok)`}
+	SyslogRuleCmd(cmdinfo)
+	if cmdinfo.Status != "ok" {
+		t.Fatal("add rule failed", cmdinfo.Status)
+	}
+	defer func() {
+		_ = DeleteSyslogRule("fan")
+	}()
+	fields, _ := ExtractSyslogFields("fan 2 failed")
+	if fields["fan"] != "2" || fields["fanstate"] != "failed" {
+		t.Fatal("unexpected fan fields", fields)
+	}
+	// saved rules are loaded again after a restart
+	err = setSyslogRules(defaultSyslogRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadSyslogState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields, _ = ExtractSyslogFields("fan 2 failed"); fields["fan"] != "2" {
+		t.Fatal("expect saved fan rule to be loaded", fields)
+	}
+	cmdinfo = &CmdInfo{Command: `config local syslog rule add bad regex (`}
+	SyslogRuleCmd(cmdinfo)
+	if cmdinfo.Status == "ok" {
+		t.Fatal("expect invalid regex to fail")
+	}
+	cmdinfo = &CmdInfo{Command: "config local syslog rule add bad json .*"}
+	SyslogRuleCmd(cmdinfo)
+	if cmdinfo.Status == "ok" {
+		t.Fatal("expect invalid kind to fail")
+	}
+	cmdinfo = &CmdInfo{Command: "config local syslog rule delete fan"}
+	SyslogRuleCmd(cmdinfo)
+	if cmdinfo.Status != "ok" {
+		t.Fatal("delete rule failed", cmdinfo.Status)
+	}
+}
+
+// TestSyslogDeviceCorrelation resolves devices by source address and hostname
+func TestSyslogDeviceCorrelation(t *testing.T) {
+	devs := []DevInfo{
+		{Mac: "00-60-E9-00-00-01", ModelName: "EHG7508", IPAddress: "10.9.9.1", Hostname: "core"},
+		{Mac: "00-60-E9-00-00-02", ModelName: "EH7506", IPAddress: "10.9.9.2", Hostname: "edge"},
+	}
+	QC.DevMutex.Lock()
+	for _, d := range devs {
+		QC.DevData[d.Mac] = d
+	}
+	QC.DevMutex.Unlock()
+	defer func() {
+		QC.DevMutex.Lock()
+		for _, d := range devs {
+			delete(QC.DevData, d.Mac)
+		}
+		QC.DevMutex.Unlock()
+	}()
+
+	raddr := &net.UDPAddr{IP: net.ParseIP("10.9.9.1"), Port: 514}
+	r, err := ParseSyslogMessage("<131>Feb 22 09:00:00 somehost portd: port 2 link down", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DevMac != "00-60-E9-00-00-01" || r.DevModel != "EHG7508" || r.Fields["port"] != "2" {
+		t.Fatal("unexpected enrichment by source address", r)
+	}
+
+	// index lines whose hostname is a device hostname or which were saved
+	// with their source address
+	dir := t.TempDir()
+	path := filepath.Join(dir, "syslog_mnms.log")
+	sourced := "<134>Feb 22 08:00:00 switchx portd: port 1 link up"
+	unknown := "<134>Feb 22 08:00:00 switchx portd: port 2 link up"
+	err = saveSyslogSource(path, raddr, sourced)
+	if err == nil {
+		err = saveSyslogSource(path, &net.UDPAddr{IP: net.ParseIP("10.9.9.3"), Port: 514}, unknown)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(
+		"<134>Feb 22 08:00:00 edge portd: port 1 link up\n"+sourced+"\n"+unknown+"\n"+
+			"<131>Feb 22 09:00:00 10.9.9.2 portd: port 4 link down\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sidecar file is read again
+	syslogSources.Lock()
+	syslogSources.byLine = nil
+	syslogSources.Unlock()
+	idx := NewSyslogIndex(path)
+	err = idx.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := idx.Search(SyslogQuery{Devices: []string{"00-60-e9-00-00-02"}})
+	if res.Total != 2 {
+		t.Fatal("expect 2 records of edge, got", res.Total)
+	}
+	res, _ = idx.Search(SyslogQuery{Devices: []string{"00-60-E9-00-00-01"}})
+	if res.Total != 1 || res.Records[0].SourceIP != "10.9.9.1" {
+		t.Fatal("expect 1 record from saved source, got", res.Records)
+	}
+	res, _ = idx.Search(SyslogQuery{Fields: map[string]string{"event": "link", "state": "DOWN"}})
+	if res.Total != 1 || res.Records[0].Fields["port"] != "4" {
+		t.Fatal("unexpected field query result", res.Records)
+	}
+}
@@ -0,0 +1,589 @@
+package mnms
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Syslog forwarding sends received and locally generated syslog
+	messages to named forwarding targets, in addition to the remote
+	syslog server given by -rs.
+
+	Each target selects messages by severity threshold, facility,
+	host, device and message regex, and sends them over UDP, TCP or
+	TLS as RFC3164, RFC5424 or JSON. Stream protocols send one message
+	per line.
+
+	Messages which can not be delivered are appended to an on-disk
+	buffer next to the local syslog file and retried in order until the
+	target is reachable again.
+*/
+
+const (
+	syslogForwardQueueSize     = 1024
+	syslogForwardRetryInterval = 5 * time.Second
+	syslogForwardMaxBufferSize = 16 * 1024 * 1024
+	syslogForwardDialTimeout   = 3 * time.Second
+)
+
+// SyslogForwardTarget is a named syslog forwarding destination.
+type SyslogForwardTarget struct {
+	Name       string   `json:"name"`
+	Protocol   string   `json:"protocol"` // udp, tcp or tls
+	Address    string   `json:"address"`
+	Format     string   `json:"format"`   // rfc3164, rfc5424 or json
+	Severity   int      `json:"severity"` // forward severity <= threshold
+	Facilities []int    `json:"facilities,omitempty"`
+	Hosts      []string `json:"hosts,omitempty"`
+	Devices    []string `json:"devices,omitempty"`
+	Match      string   `json:"match,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"` // skip tls verification
+	Sent       int      `json:"sent"`
+	Buffered   int      `json:"buffered"`
+	Dropped    int      `json:"dropped"`
+
+	re       *regexp.Regexp
+	queue    chan []byte
+	stop     chan struct{}
+	done     chan struct{}
+	conn     net.Conn
+	bufMutex *sync.Mutex
+	statMu   sync.Mutex
+}
+
+var syslogForwarders = struct {
+	sync.Mutex
+	targets map[string]*SyslogForwardTarget
+	buffers map[string]*sync.Mutex // by target name, kept across replaced targets
+}{targets: make(map[string]*SyslogForwardTarget), buffers: make(map[string]*sync.Mutex)}
+
+var newlineRegexp = regexp.MustCompile(`\r?\n`)
+
+// syslogForwardNameRegexp restricts target names, which are part of the
+// buffer file names.
+var syslogForwardNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// AddSyslogForwardTarget adds or replaces the forwarding target with the
+// same name and starts forwarding to it.
+func AddSyslogForwardTarget(t *SyslogForwardTarget) error {
+	if t.Name == "" {
+		return fmt.Errorf("target name required")
+	}
+	if !syslogForwardNameRegexp.MatchString(t.Name) {
+		return fmt.Errorf("invalid target name %q, must be letters, digits, _ and -", t.Name)
+	}
+	switch t.Protocol {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("invalid protocol %v, must be udp, tcp or tls", t.Protocol)
+	}
+	switch t.Format {
+	case "rfc3164", "rfc5424", "json":
+	default:
+		return fmt.Errorf("invalid format %v, must be rfc3164, rfc5424 or json", t.Format)
+	}
+	if _, _, err := net.SplitHostPort(t.Address); err != nil {
+		return err
+	}
+	if t.Severity < LOG_EMERG || t.Severity > LOG_DEBUG {
+		return fmt.Errorf("invalid severity %v", t.Severity)
+	}
+	if t.Match != "" {
+		re, err := regexp.Compile(t.Match)
+		if err != nil {
+			return err
+		}
+		t.re = re
+	}
+	t.queue = make(chan []byte, syslogForwardQueueSize)
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	syslogForwarders.Lock()
+	old := syslogForwarders.targets[t.Name]
+	syslogForwarders.targets[t.Name] = t
+	if syslogForwarders.buffers[t.Name] == nil {
+		syslogForwarders.buffers[t.Name] = &sync.Mutex{}
+	}
+	t.bufMutex = syslogForwarders.buffers[t.Name]
+	syslogForwarders.Unlock()
+	if old != nil {
+		// the old target is done with the buffer before the new one
+		// flushes it
+		close(old.stop)
+		<-old.done
+	}
+	go t.run()
+	return nil
+}
+
+// DeleteSyslogForwardTarget stops forwarding to the target with the name.
+// Undelivered messages stay in its buffer until a target with the same
+// name is added again.
+func DeleteSyslogForwardTarget(name string) error {
+	syslogForwarders.Lock()
+	t, ok := syslogForwarders.targets[name]
+	delete(syslogForwarders.targets, name)
+	syslogForwarders.Unlock()
+	if !ok {
+		return fmt.Errorf("target %s not exist", name)
+	}
+	close(t.stop)
+	<-t.done
+	return nil
+}
+
+// GetSyslogForwardTargets returns copies of the forwarding targets.
+func GetSyslogForwardTargets() []SyslogForwardTarget {
+	syslogForwarders.Lock()
+	defer syslogForwarders.Unlock()
+	targets := []SyslogForwardTarget{}
+	for _, t := range syslogForwarders.targets {
+		t.statMu.Lock()
+		targets = append(targets, SyslogForwardTarget{
+			Name:       t.Name,
+			Protocol:   t.Protocol,
+			Address:    t.Address,
+			Format:     t.Format,
+			Severity:   t.Severity,
+			Facilities: t.Facilities,
+			Hosts:      t.Hosts,
+			Devices:    t.Devices,
+			Match:      t.Match,
+			Insecure:   t.Insecure,
+			Sent:       t.Sent,
+			Buffered:   t.Buffered,
+			Dropped:    t.Dropped,
+		})
+		t.statMu.Unlock()
+	}
+	return targets
+}
+
+// saveSyslogForwardTargets keeps the forwarding targets in the syslog
+// state, without their counters.
+func saveSyslogForwardTargets() error {
+	targets := GetSyslogForwardTargets()
+	for i := range targets {
+		targets[i].Sent, targets[i].Buffered, targets[i].Dropped = 0, 0, 0
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return saveSyslogState(func(state *SyslogState) {
+		state.Forwards = targets
+	})
+}
+
+// forwardSyslog hands a received or locally generated message to all
+// forwarding targets whose filters it passes.
+func forwardSyslog(message string, raddr net.Addr) {
+	syslogForwarders.Lock()
+	targets := make([]*SyslogForwardTarget, 0, len(syslogForwarders.targets))
+	for _, t := range syslogForwarders.targets {
+		targets = append(targets, t)
+	}
+	syslogForwarders.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	r := forwardRecord(message, raddr)
+	if r == nil {
+		return
+	}
+	for _, t := range targets {
+		if !t.accept(r) {
+			continue
+		}
+		payload, err := formatSyslogRecord(r, t.Format)
+		if err != nil {
+			q.Q(err)
+			continue
+		}
+		select {
+		case t.queue <- payload:
+		default:
+			// the sender is behind, keep the message on disk
+			t.buffer(payload)
+		}
+	}
+}
+
+// forwardRecord parses message into an enriched record. Messages which
+// only carry a priority are forwarded with the sender as hostname.
+func forwardRecord(message string, raddr net.Addr) *SyslogRecord {
+	r, err := ParseSyslogMessage(message, raddr)
+	if err == nil {
+		return r
+	}
+	facility, severity, err := SyslogParsePriority(message)
+	if err != nil {
+		q.Q(err)
+		return nil
+	}
+	r = &SyslogRecord{
+		Timestamp: time.Now(),
+		Facility:  facility,
+		Severity:  severity,
+		Message:   message[strings.Index(message, ">")+1:],
+	}
+	sourceIP := ""
+	if raddr != nil {
+		sourceIP, _, err = net.SplitHostPort(raddr.String())
+		if err != nil {
+			sourceIP = raddr.String()
+		}
+	}
+	r.Hostname = sourceIP
+	EnrichSyslogRecord(r, sourceIP)
+	return r
+}
+
+func (t *SyslogForwardTarget) accept(r *SyslogRecord) bool {
+	if r.Severity > t.Severity {
+		return false
+	}
+	if len(t.Facilities) > 0 && !containsInt(t.Facilities, r.Facility) {
+		return false
+	}
+	if len(t.Hosts) > 0 && !containsFold(t.Hosts, r.Hostname) &&
+		!containsFold(t.Hosts, r.SourceIP) && !containsFold(t.Hosts, r.DevHostname) {
+		return false
+	}
+	if len(t.Devices) > 0 && !containsFold(t.Devices, r.DevMac) {
+		return false
+	}
+	if t.re != nil && !t.re.MatchString(r.Message) {
+		return false
+	}
+	return true
+}
+
+func nilDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatSyslogRecord renders r in format as a single line.
+func formatSyslogRecord(r *SyslogRecord, format string) ([]byte, error) {
+	priority := r.Facility*8 + r.Severity
+	procid, msgid := "", ""
+	if r.base.ProcID != nil {
+		procid = *r.base.ProcID
+	}
+	if r.base.MsgID != nil {
+		msgid = *r.base.MsgID
+	}
+	var line string
+	switch format {
+	case "rfc3164":
+		tag := r.Appname
+		if tag != "" && procid != "" {
+			tag = fmt.Sprintf("%s[%s]", tag, procid)
+		}
+		if tag != "" {
+			tag += ": "
+		}
+		line = fmt.Sprintf("<%d>%s %s %s%s", priority, r.Timestamp.Format(time.Stamp),
+			nilDash(r.Hostname), tag, r.Message)
+	case "rfc5424":
+		line = fmt.Sprintf("<%d>1 %s %s %s %s %s - %s", priority, r.Timestamp.Format(time.RFC3339Nano),
+			nilDash(r.Hostname), nilDash(r.Appname), nilDash(procid), nilDash(msgid), r.Message)
+	case "json":
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("invalid format %v", format)
+	}
+	return []byte(newlineRegexp.ReplaceAllString(line, " ")), nil
+}
+
+// bufferPath is the on-disk buffer of undelivered messages.
+func (t *SyslogForwardTarget) bufferPath() string {
+	return path.Join(path.Dir(syslogLocalPath()), fmt.Sprintf("syslog_forward_%s.buf", t.Name))
+}
+
+func (t *SyslogForwardTarget) buffer(payload []byte) {
+	t.bufMutex.Lock()
+	defer t.bufMutex.Unlock()
+	fn := t.bufferPath()
+	if fi, err := os.Stat(fn); err == nil && fi.Size()+int64(len(payload)) > syslogForwardMaxBufferSize {
+		t.statMu.Lock()
+		t.Dropped++
+		t.statMu.Unlock()
+		return
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		q.Q(err)
+		t.statMu.Lock()
+		t.Dropped++
+		t.statMu.Unlock()
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(payload, '\n'))
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	t.statMu.Lock()
+	t.Buffered++
+	t.statMu.Unlock()
+}
+
+func (t *SyslogForwardTarget) hasBuffered() bool {
+	t.bufMutex.Lock()
+	defer t.bufMutex.Unlock()
+	fi, err := os.Stat(t.bufferPath())
+	return err == nil && fi.Size() > 0
+}
+
+// flush sends buffered messages in order and keeps what could not be sent.
+func (t *SyslogForwardTarget) flush() error {
+	t.bufMutex.Lock()
+	defer t.bufMutex.Unlock()
+	fn := t.bufferPath()
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := [][]byte{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), syslogForwardMaxBufferSize)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for i, line := range lines {
+		err = t.send(line)
+		if err != nil {
+			rest := []byte{}
+			for _, l := range lines[i:] {
+				rest = append(rest, l...)
+				rest = append(rest, '\n')
+			}
+			werr := os.WriteFile(fn, rest, 0o644)
+			if werr != nil {
+				q.Q(werr)
+			}
+			return err
+		}
+	}
+	return os.Remove(fn)
+}
+
+func (t *SyslogForwardTarget) dial() (net.Conn, error) {
+	switch t.Protocol {
+	case "tls":
+		dialer := &net.Dialer{Timeout: syslogForwardDialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", t.Address, &tls.Config{InsecureSkipVerify: t.Insecure})
+	case "tcp":
+		return net.DialTimeout("tcp", t.Address, syslogForwardDialTimeout)
+	default:
+		return net.Dial("udp", t.Address)
+	}
+}
+
+// send writes one message to the target, connecting when needed.
+func (t *SyslogForwardTarget) send(payload []byte) error {
+	if t.conn == nil {
+		conn, err := t.dial()
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+	if t.Protocol != "udp" {
+		payload = append(payload, '\n')
+	}
+	_ = t.conn.SetWriteDeadline(time.Now().Add(syslogForwardDialTimeout))
+	_, err := t.conn.Write(payload)
+	if err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	t.statMu.Lock()
+	t.Sent++
+	t.statMu.Unlock()
+	return nil
+}
+
+func (t *SyslogForwardTarget) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(syslogForwardRetryInterval)
+	defer ticker.Stop()
+	defer func() {
+		if t.conn != nil {
+			t.conn.Close()
+		}
+	}()
+	// retry what a previous target of the same name left behind
+	if err := t.flush(); err != nil {
+		q.Q(err)
+	}
+	for {
+		select {
+		case <-t.stop:
+			return
+		case payload := <-t.queue:
+			// keep order behind buffered messages
+			if t.hasBuffered() {
+				t.buffer(payload)
+				continue
+			}
+			if err := t.send(payload); err != nil {
+				q.Q(t.Name, err)
+				t.buffer(payload)
+			}
+		case <-ticker.C:
+			if err := t.flush(); err != nil {
+				q.Q(t.Name, err)
+			}
+		}
+	}
+}
+
+func parseSyslogForwardOptions(t *SyslogForwardTarget, opts []string) error {
+	for i, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid option %v", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "severity":
+			t.Severity, err = strconv.Atoi(kv[1])
+		case "facility":
+			t.Facilities, err = splitIntList(kv[1])
+		case "host":
+			t.Hosts = splitList(kv[1])
+		case "device":
+			t.Devices = splitList(kv[1])
+		case "insecure":
+			t.Insecure, err = strconv.ParseBool(kv[1])
+		case "match":
+			// the regex runs to the end of the command
+			t.Match = strings.Join(append([]string{kv[1]}, opts[i+1:]...), " ")
+			return nil
+		default:
+			return fmt.Errorf("invalid option %v", opt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Configure syslog forwarding targets.
+//
+// Usage : config local syslog forward add [name] [protocol] [address] [format] [options]
+//
+//	[name]        : target name, letters, digits, _ and -
+//	[protocol]    : udp, tcp or tls
+//	[address]     : target address as host:port
+//	[format]      : rfc3164, rfc5424 or json
+//	[options]     : severity=[0-7] forward messages at or above this severity, default 7
+//	                facility=[list] comma separated facility numbers
+//	                host=[list] comma separated hostnames or source addresses
+//	                device=[list] comma separated device mac addresses
+//	                insecure=true skip tls certificate verification
+//	                match=[regex] message regex, must be the last option
+//
+// Usage : config local syslog forward delete [name]
+//
+// Usage : config local syslog forward list
+//
+//	targets are kept in syslog.json and started again on restart
+//
+// Example :
+//
+//	config local syslog forward add siem tls 10.0.50.2:6514 json severity=4
+//	config local syslog forward add auth udp 10.0.50.3:514 rfc5424 facility=4,10 match=login fail
+//	config local syslog forward delete siem
+//	config local syslog forward list
+func SyslogForwardCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	if len(ws) < 5 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	switch ws[4] {
+	case "add":
+		if len(ws) < 9 {
+			cmdinfo.Status = "error: invalid command"
+			return cmdinfo
+		}
+		t := &SyslogForwardTarget{
+			Name:     ws[5],
+			Protocol: ws[6],
+			Address:  ws[7],
+			Format:   ws[8],
+			Severity: LOG_DEBUG,
+		}
+		err := parseSyslogForwardOptions(t, ws[9:])
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		err = AddSyslogForwardTarget(t)
+		if err == nil {
+			err = saveSyslogForwardTargets()
+		}
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+	case "delete":
+		if len(ws) < 6 {
+			cmdinfo.Status = "error: invalid command"
+			return cmdinfo
+		}
+		err := DeleteSyslogForwardTarget(ws[5])
+		if err == nil {
+			err = saveSyslogForwardTargets()
+		}
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+	case "list":
+		b, err := json.Marshal(GetSyslogForwardTargets())
+		if err != nil {
+			cmdinfo.Status = "error: " + err.Error()
+			return cmdinfo
+		}
+		cmdinfo.Result = string(b)
+	default:
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
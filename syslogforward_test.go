@@ -0,0 +1,157 @@
+package mnms
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSyslogForwardFilter tests target filters and output formats
+func TestSyslogForwardFilter(t *testing.T) {
+	target := &SyslogForwardTarget{Severity: LOG_WARNING, Facilities: []int{16}, Hosts: []string{"switch1"}}
+	err := parseSyslogForwardOptions(target, []string{"match=link", "down"})
+	if err != nil || target.Match != "link down" {
+		t.Fatal("unexpected match option", target.Match, err)
+	}
+	target.Match = "link"
+	target.Format, target.Protocol, target.Address = "json", "udp", "127.0.0.1:514"
+	for _, name := range []string{"../filter", "a/b", "-x", "a b"} {
+		target.Name = name
+		if AddSyslogForwardTarget(target) == nil {
+			t.Fatal("expect invalid target name to fail", name)
+		}
+	}
+	target.Name = "filter"
+	err = AddSyslogForwardTarget(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteSyslogForwardTarget("filter")
+	}()
+
+	r := forwardRecord("<131>Feb 22 09:00:00 switch1 portd[12]: port 2 link down", nil)
+	if !target.accept(r) {
+		t.Fatal("expect record to be accepted", r)
+	}
+	for _, msg := range []string{
+		"<134>Feb 22 09:00:00 switch1 portd: port 2 link up",
+		"<11>Feb 22 09:00:00 switch1 portd: port 2 link down",
+		"<131>Feb 22 09:00:00 switch2 portd: port 2 link down",
+		"<131>Feb 22 09:00:00 switch1 portd: power down",
+	} {
+		if target.accept(forwardRecord(msg, nil)) {
+			t.Fatal("expect record to be filtered", msg)
+		}
+	}
+
+	b, _ := formatSyslogRecord(r, "rfc3164")
+	if !strings.HasPrefix(string(b), "<131>Feb 22 09:00:00 switch1 portd[12]: port 2 link down") {
+		t.Fatal("unexpected rfc3164", string(b))
+	}
+	b, _ = formatSyslogRecord(r, "rfc5424")
+	if !strings.HasPrefix(string(b), "<131>1 ") || !strings.HasSuffix(string(b), " switch1 portd 12 - - port 2 link down") {
+		t.Fatal("unexpected rfc5424", string(b))
+	}
+	b, _ = formatSyslogRecord(r, "json")
+	var rec SyslogRecord
+	err = json.Unmarshal(b, &rec)
+	if err != nil || rec.Hostname != "switch1" || rec.Fields["port"] != "2" {
+		t.Fatal("unexpected json", string(b), err)
+	}
+
+	cmdinfo := &CmdInfo{Command: "config local syslog forward add bad sctp 127.0.0.1:514 json"}
+	SyslogForwardCmd(cmdinfo)
+	if cmdinfo.Status == "ok" {
+		t.Fatal("expect invalid protocol to fail")
+	}
+}
+
+// TestSyslogForwardBuffer tests that messages to an unreachable target are
+// buffered and delivered in order once it is reachable, also by the
+// target started again from the saved state
+func TestSyslogForwardBuffer(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+	oldPath := QC.SyslogLocalPath
+	QC.SyslogLocalPath = filepath.Join(t.TempDir(), "syslog_mnms.log")
+	defer func() {
+		QC.SyslogLocalPath = oldPath
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cmdinfo := &CmdInfo{Command: "config local syslog forward add buf tcp " + addr + " rfc3164"}
+	SyslogForwardCmd(cmdinfo)
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	defer func() {
+		_ = DeleteSyslogForwardTarget("buf")
+	}()
+	forwardSyslog("<134>Feb 22 08:00:00 switch1 portd: first", nil)
+	forwardSyslog("<134>Feb 22 08:01:00 switch1 portd: second", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		targets := GetSyslogForwardTargets()
+		if len(targets) == 1 && targets[0].Buffered == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expect 2 buffered messages", targets)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	err = DeleteSyslogForwardTarget("buf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadSyslogState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := GetSyslogForwardTargets(); len(targets) != 1 || targets[0].Name != "buf" || targets[0].Address != addr {
+		t.Fatal("expect saved target to be started", targets)
+	}
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("can not listen again on", addr, err)
+	}
+	defer ln.Close()
+	_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(3 * syslogForwardRetryInterval))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(syslogForwardRetryInterval))
+	scanner := bufio.NewScanner(conn)
+	for _, want := range []string{"first", "second"} {
+		if !scanner.Scan() {
+			t.Fatal("expect buffered message", want, scanner.Err())
+		}
+		if !strings.HasSuffix(scanner.Text(), want) {
+			t.Fatal("unexpected order", scanner.Text(), want)
+		}
+	}
+}
@@ -0,0 +1,760 @@
+package mnms
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/influxdata/go-syslog/v3"
+	"github.com/qeof/q"
+)
+
+/*
+	The syslog index keeps every line of the local syslog file and its
+	rotated backups (plain or gzip'd by lumberjack) parsed in memory, with
+	posting lists by host, app name, severity, facility and message token.
+
+	Rotated backups never change, so they are indexed once. The current
+	file is indexed incrementally from the last offset seen; if it was
+	rotated away underneath us, its records are dropped and it is indexed
+	again from the start (the old content shows up as a new backup).
+*/
+
+// SyslogRecord is a single parsed and indexed syslog line.
+type SyslogRecord struct {
+	ID          uint64            `json:"id"`
+	Segment     string            `json:"segment"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Hostname    string            `json:"hostname"`
+	Appname     string            `json:"appname"`
+	Facility    int               `json:"facility"`
+	Severity    int               `json:"severity"`
+	Message     string            `json:"message"`
+	SourceIP    string            `json:"sourceip,omitempty"`
+	DevMac      string            `json:"devmac,omitempty"`
+	DevModel    string            `json:"devmodel,omitempty"`
+	DevHostname string            `json:"devhostname,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Rules       []string          `json:"rules,omitempty"`
+	base        syslog.Base
+}
+
+// SyslogQuery selects records from the syslog index. Zero values mean
+// no filtering on that field.
+type SyslogQuery struct {
+	Start      time.Time
+	End        time.Time
+	Hosts      []string
+	Apps       []string
+	Severities []int
+	Facilities []int
+	Devices    []string
+	Fields     map[string]string
+	Text       string
+	Limit      int
+	Cursor     string
+	Ascending  bool
+}
+
+// SyslogQueryResult is one page of records matching a query.
+type SyslogQueryResult struct {
+	Records []SyslogRecord `json:"records"`
+	Total   int            `json:"total"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// SyslogBucket counts the records falling in one time bucket.
+type SyslogBucket struct {
+	Start    time.Time   `json:"start"`
+	Total    int         `json:"total"`
+	Severity map[int]int `json:"severity"`
+}
+
+type syslogSegment struct {
+	file    string
+	info    os.FileInfo
+	offset  int64
+	records []*SyslogRecord
+}
+
+// SyslogIndex indexes a lumberjack syslog file and its rotated backups.
+type SyslogIndex struct {
+	mutex      sync.Mutex
+	path       string
+	rules      int
+	nextID     uint64
+	segments   map[string]*syslogSegment
+	byHost     map[string][]*SyslogRecord
+	byApp      map[string][]*SyslogRecord
+	bySeverity map[int][]*SyslogRecord
+	byFacility map[int][]*SyslogRecord
+	byDevice   map[string][]*SyslogRecord
+	byField    map[string][]*SyslogRecord
+	byToken    map[string][]*SyslogRecord
+	all        []*SyslogRecord
+}
+
+// NewSyslogIndex creates an empty index for the syslog file at path.
+func NewSyslogIndex(path string) *SyslogIndex {
+	idx := &SyslogIndex{path: path, rules: syslogRulesVersion(), segments: make(map[string]*syslogSegment)}
+	idx.resetPostings()
+	return idx
+}
+
+var syslogIndex *SyslogIndex
+var syslogIndexMutex sync.Mutex
+
+// GetSyslogIndex returns the index of the local syslog file, brought
+// up to date with what is on disk. The index is rebuilt when extraction
+// rules change.
+func GetSyslogIndex() (*SyslogIndex, error) {
+	path := syslogLocalPath()
+	syslogIndexMutex.Lock()
+	if syslogIndex == nil || syslogIndex.path != path ||
+		syslogIndex.rules != syslogRulesVersion() {
+		syslogIndex = NewSyslogIndex(path)
+	}
+	idx := syslogIndex
+	syslogIndexMutex.Unlock()
+	err := idx.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *SyslogIndex) resetPostings() {
+	idx.byHost = make(map[string][]*SyslogRecord)
+	idx.byApp = make(map[string][]*SyslogRecord)
+	idx.bySeverity = make(map[int][]*SyslogRecord)
+	idx.byFacility = make(map[int][]*SyslogRecord)
+	idx.byDevice = make(map[string][]*SyslogRecord)
+	idx.byField = make(map[string][]*SyslogRecord)
+	idx.byToken = make(map[string][]*SyslogRecord)
+	idx.all = nil
+}
+
+func (idx *SyslogIndex) rebuildPostings() {
+	idx.resetPostings()
+	for _, seg := range idx.segments {
+		for _, r := range seg.records {
+			idx.addPostings(r)
+		}
+	}
+}
+
+func (idx *SyslogIndex) addPostings(r *SyslogRecord) {
+	idx.all = append(idx.all, r)
+	idx.byHost[strings.ToLower(r.Hostname)] = append(idx.byHost[strings.ToLower(r.Hostname)], r)
+	idx.byApp[strings.ToLower(r.Appname)] = append(idx.byApp[strings.ToLower(r.Appname)], r)
+	idx.bySeverity[r.Severity] = append(idx.bySeverity[r.Severity], r)
+	idx.byFacility[r.Facility] = append(idx.byFacility[r.Facility], r)
+	if r.DevMac != "" {
+		idx.byDevice[strings.ToUpper(r.DevMac)] = append(idx.byDevice[strings.ToUpper(r.DevMac)], r)
+	}
+	for k, v := range r.Fields {
+		key := k + "=" + strings.ToLower(v)
+		idx.byField[key] = append(idx.byField[key], r)
+	}
+	for _, t := range syslogTokens(r.Hostname + " " + r.Appname + " " + r.Message) {
+		idx.byToken[t] = append(idx.byToken[t], r)
+	}
+}
+
+// syslogTokens splits text into unique lower case words for full-text search.
+func syslogTokens(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	seen := make(map[string]bool, len(words))
+	tokens := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// syslogBackupFiles lists the rotated backups lumberjack keeps next to path,
+// oldest first.
+func syslogBackupFiles(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "-"
+	files, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := filepath.Glob(prefix + "*" + ext + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, gz...)
+	sort.Strings(files)
+	return files, nil
+}
+
+// Refresh indexes new backups and new lines of the current file, and
+// forgets backups removed from disk.
+func (idx *SyslogIndex) Refresh() error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	backups, err := syslogBackupFiles(idx.path)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{idx.path: true}
+	removed := false
+	for _, file := range backups {
+		key := strings.TrimSuffix(file, ".gz")
+		seen[key] = true
+		if seg, ok := idx.segments[key]; ok {
+			// lumberjack compresses backups after rotating, same content
+			seg.file = file
+			continue
+		}
+		seg := &syslogSegment{file: file}
+		err := idx.readSegment(seg)
+		if err != nil {
+			q.Q(err)
+			continue
+		}
+		idx.segments[key] = seg
+	}
+	for key := range idx.segments {
+		if !seen[key] {
+			delete(idx.segments, key)
+			removed = true
+		}
+	}
+
+	fi, err := os.Stat(idx.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if _, ok := idx.segments[idx.path]; ok {
+			delete(idx.segments, idx.path)
+			removed = true
+		}
+	} else {
+		seg, ok := idx.segments[idx.path]
+		if ok && (!os.SameFile(seg.info, fi) || fi.Size() < seg.offset) {
+			// rotated or truncated, index again from the start
+			delete(idx.segments, idx.path)
+			removed = true
+			ok = false
+		}
+		if !ok {
+			seg = &syslogSegment{file: idx.path}
+			idx.segments[idx.path] = seg
+		}
+		seg.info = fi
+		if removed {
+			idx.rebuildPostings()
+			removed = false
+		}
+		if fi.Size() > seg.offset {
+			err = idx.readSegment(seg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if removed {
+		idx.rebuildPostings()
+	}
+	return nil
+}
+
+// readSegment indexes complete lines of seg starting at seg.offset.
+func (idx *SyslogIndex) readSegment(seg *syslogSegment) error {
+	f, err := os.Open(seg.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var reader io.Reader = f
+	if strings.HasSuffix(seg.file, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		reader = gr
+	} else if seg.offset > 0 {
+		_, err = f.Seek(seg.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	br := bufio.NewReader(reader)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			// a partial line of the current file is picked up by the
+			// next refresh, backups are complete
+			if seg.file != idx.path && line != "" {
+				idx.addLine(seg, strings.TrimRight(line, "\r"))
+			}
+			return nil
+		}
+		seg.offset += int64(len(line))
+		idx.addLine(seg, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (idx *SyslogIndex) addLine(seg *syslogSegment, line string) {
+	if line == "" {
+		return
+	}
+	b, t, err := parsingDataofSyslog(line)
+	if err != nil {
+		return
+	}
+	idx.nextID++
+	r := &SyslogRecord{ID: idx.nextID, Segment: filepath.Base(seg.file), Timestamp: t, base: b}
+	r.fillFromBase()
+	EnrichSyslogRecord(r, syslogSource(idx.path, line))
+	seg.records = append(seg.records, r)
+	idx.addPostings(r)
+}
+
+func (r *SyslogRecord) fillFromBase() {
+	b := r.base
+	if b.Hostname != nil {
+		r.Hostname = *b.Hostname
+	}
+	if b.Appname != nil {
+		r.Appname = *b.Appname
+	}
+	if b.Facility != nil {
+		r.Facility = int(*b.Facility)
+	}
+	if b.Severity != nil {
+		r.Severity = int(*b.Severity)
+	}
+	if b.Message != nil {
+		r.Message = *b.Message
+	}
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the shortest posting list able to answer the query.
+func (idx *SyslogIndex) candidates(query *SyslogQuery, tokens []string) []*SyslogRecord {
+	best := idx.all
+	consider := func(list []*SyslogRecord) {
+		if len(list) < len(best) {
+			best = list
+		}
+	}
+	union := func(lists ...[]*SyslogRecord) []*SyslogRecord {
+		if len(lists) == 1 {
+			return lists[0]
+		}
+		out := []*SyslogRecord{}
+		for _, l := range lists {
+			out = append(out, l...)
+		}
+		return out
+	}
+	if len(query.Hosts) > 0 {
+		lists := [][]*SyslogRecord{}
+		for _, h := range query.Hosts {
+			lists = append(lists, idx.byHost[strings.ToLower(h)])
+		}
+		consider(union(lists...))
+	}
+	if len(query.Apps) > 0 {
+		lists := [][]*SyslogRecord{}
+		for _, a := range query.Apps {
+			lists = append(lists, idx.byApp[strings.ToLower(a)])
+		}
+		consider(union(lists...))
+	}
+	if len(query.Severities) > 0 {
+		lists := [][]*SyslogRecord{}
+		for _, s := range query.Severities {
+			lists = append(lists, idx.bySeverity[s])
+		}
+		consider(union(lists...))
+	}
+	if len(query.Facilities) > 0 {
+		lists := [][]*SyslogRecord{}
+		for _, f := range query.Facilities {
+			lists = append(lists, idx.byFacility[f])
+		}
+		consider(union(lists...))
+	}
+	if len(query.Devices) > 0 {
+		lists := [][]*SyslogRecord{}
+		for _, d := range query.Devices {
+			lists = append(lists, idx.byDevice[strings.ToUpper(d)])
+		}
+		consider(union(lists...))
+	}
+	for k, v := range query.Fields {
+		consider(idx.byField[k+"="+strings.ToLower(v)])
+	}
+	for _, t := range tokens {
+		consider(idx.byToken[t])
+	}
+	return best
+}
+
+func (query *SyslogQuery) match(r *SyslogRecord, tokens []string) bool {
+	if !query.Start.IsZero() && r.Timestamp.Before(query.Start) {
+		return false
+	}
+	if !query.End.IsZero() && r.Timestamp.After(query.End) {
+		return false
+	}
+	if len(query.Hosts) > 0 && !containsFold(query.Hosts, r.Hostname) {
+		return false
+	}
+	if len(query.Apps) > 0 && !containsFold(query.Apps, r.Appname) {
+		return false
+	}
+	if len(query.Severities) > 0 && !containsInt(query.Severities, r.Severity) {
+		return false
+	}
+	if len(query.Facilities) > 0 && !containsInt(query.Facilities, r.Facility) {
+		return false
+	}
+	if len(query.Devices) > 0 && !containsFold(query.Devices, r.DevMac) {
+		return false
+	}
+	for k, v := range query.Fields {
+		if !strings.EqualFold(r.Fields[k], v) {
+			return false
+		}
+	}
+	if len(tokens) > 0 {
+		have := syslogTokens(r.Hostname + " " + r.Appname + " " + r.Message)
+		for _, t := range tokens {
+			found := false
+			for _, h := range have {
+				if h == t {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matching returns all records matching query, sorted by time and id.
+func (idx *SyslogIndex) matching(query *SyslogQuery) []*SyslogRecord {
+	tokens := syslogTokens(query.Text)
+	idx.mutex.Lock()
+	candidates := idx.candidates(query, tokens)
+	seen := make(map[uint64]bool, len(candidates))
+	matched := []*SyslogRecord{}
+	for _, r := range candidates {
+		if seen[r.ID] {
+			continue
+		}
+		seen[r.ID] = true
+		if query.match(r, tokens) {
+			matched = append(matched, r)
+		}
+	}
+	idx.mutex.Unlock()
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			if query.Ascending {
+				return a.Timestamp.Before(b.Timestamp)
+			}
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if query.Ascending {
+			return a.ID < b.ID
+		}
+		return a.ID > b.ID
+	})
+	return matched
+}
+
+func encodeSyslogCursor(r *SyslogRecord) string {
+	c := fmt.Sprintf("%d.%d", r.Timestamp.UnixNano(), r.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+func decodeSyslogCursor(cursor string) (int64, uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	ws := strings.Split(string(b), ".")
+	if len(ws) != 2 {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	ts, err := strconv.ParseInt(ws[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseUint(ws[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cursor")
+	}
+	return ts, id, nil
+}
+
+// Search returns a page of records matching query. The Next cursor of
+// the result continues where the page ended.
+func (idx *SyslogIndex) Search(query SyslogQuery) (*SyslogQueryResult, error) {
+	matched := idx.matching(&query)
+	start := 0
+	if query.Cursor != "" {
+		ts, id, err := decodeSyslogCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		// first record strictly after the cursor in sort order
+		start = sort.Search(len(matched), func(i int) bool {
+			r := matched[i]
+			t := r.Timestamp.UnixNano()
+			if t != ts {
+				if query.Ascending {
+					return t > ts
+				}
+				return t < ts
+			}
+			if query.Ascending {
+				return r.ID > id
+			}
+			return r.ID < id
+		})
+	}
+	end := len(matched)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+	result := &SyslogQueryResult{Records: []SyslogRecord{}, Total: len(matched)}
+	for _, r := range matched[start:end] {
+		result.Records = append(result.Records, *r)
+	}
+	if end < len(matched) && end > start {
+		result.Next = encodeSyslogCursor(matched[end-1])
+	}
+	return result, nil
+}
+
+// Counts returns the number of matching records per time bucket, with a
+// per severity breakdown, oldest bucket first.
+func (idx *SyslogIndex) Counts(query SyslogQuery, bucket time.Duration) ([]SyslogBucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("invalid bucket size %v", bucket)
+	}
+	query.Ascending = true
+	matched := idx.matching(&query)
+	buckets := []SyslogBucket{}
+	for _, r := range matched {
+		start := r.Timestamp.Truncate(bucket)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			buckets = append(buckets, SyslogBucket{Start: start, Severity: make(map[int]int)})
+		}
+		b := &buckets[len(buckets)-1]
+		b.Total++
+		b.Severity[r.Severity]++
+	}
+	return buckets, nil
+}
+
+// parseSyslogTime accepts the "2006/01/02 15:04:05" format used by the
+// syslog commands as well as RFC3339.
+func parseSyslogTime(s string) (time.Time, error) {
+	t, err := time.Parse(foramt, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func splitIntList(s string) ([]int, error) {
+	list := []int{}
+	for _, v := range splitList(s) {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// syslogQueryFromRequest builds a query from the url parameters shared by
+// the syslog search and count apis.
+func syslogQueryFromRequest(r *http.Request) (SyslogQuery, error) {
+	var query SyslogQuery
+	var err error
+	params := r.URL.Query()
+	if s := params.Get("start"); s != "" {
+		query.Start, err = parseSyslogTime(s)
+		if err != nil {
+			return query, fmt.Errorf("invalid start time %v", s)
+		}
+	}
+	if s := params.Get("end"); s != "" {
+		query.End, err = parseSyslogTime(s)
+		if err != nil {
+			return query, fmt.Errorf("invalid end time %v", s)
+		}
+	}
+	query.Hosts = splitList(params.Get("host"))
+	query.Apps = splitList(params.Get("app"))
+	query.Severities, err = splitIntList(params.Get("severity"))
+	if err != nil {
+		return query, fmt.Errorf("invalid severity %v", params.Get("severity"))
+	}
+	query.Facilities, err = splitIntList(params.Get("facility"))
+	if err != nil {
+		return query, fmt.Errorf("invalid facility %v", params.Get("facility"))
+	}
+	query.Devices = splitList(params.Get("mac"))
+	for _, kv := range splitList(params.Get("field")) {
+		ws := strings.SplitN(kv, ":", 2)
+		if len(ws) != 2 {
+			return query, fmt.Errorf("invalid field %v, must be name:value", kv)
+		}
+		if query.Fields == nil {
+			query.Fields = make(map[string]string)
+		}
+		query.Fields[ws[0]] = ws[1]
+	}
+	query.Text = params.Get("q")
+	query.Cursor = params.Get("cursor")
+	query.Ascending = params.Get("order") == "asc"
+	query.Limit = 100
+	if s := params.Get("limit"); s != "" {
+		query.Limit, err = strconv.Atoi(s)
+		if err != nil || query.Limit < 0 {
+			return query, fmt.Errorf("invalid limit %v", s)
+		}
+	}
+	return query, nil
+}
+
+// HandleSyslogSearch searches the indexed local syslogs
+//
+// GET /api/v1/syslogs/search
+//
+//	Example parameter:
+//	  ?start=2023/02/21 22:06:00&end=2023/02/23 22:08:00&host=switch1,switch2
+//	  &app=RunCmd&severity=1,2,3&facility=16&mac=00-60-E9-18-3C-3C
+//	  &field=event:link,state:down&q=link down&limit=50&cursor=...&order=asc
+//
+//	Response: {"records": [...], "total": 120, "next": "cursor of next page"}
+func HandleSyslogSearch(w http.ResponseWriter, r *http.Request) {
+	query, err := syslogQueryFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	idx, err := GetSyslogIndex()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	result, err := idx.Search(query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleSyslogCounts counts indexed local syslogs per time bucket
+//
+// GET /api/v1/syslogs/counts
+//
+//	Takes the same filter parameters as /api/v1/syslogs/search plus
+//	bucket, a duration such as 5m or 1h (default 1h).
+//
+//	Response: {"bucket": "1h0m0s", "buckets": [{"start": "...", "total": 3, "severity": {"3": 1, "5": 2}}]}
+func HandleSyslogCounts(w http.ResponseWriter, r *http.Request) {
+	query, err := syslogQueryFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	bucket := time.Hour
+	if s := r.URL.Query().Get("bucket"); s != "" {
+		bucket, err = time.ParseDuration(s)
+		if err != nil || bucket <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid bucket " + s})
+			return
+		}
+	}
+	idx, err := GetSyslogIndex()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	buckets, err := idx.Counts(query, bucket)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	res := map[string]interface{}{"bucket": bucket.String(), "buckets": buckets}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		q.Q(err)
+	}
+}
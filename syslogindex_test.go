@@ -0,0 +1,193 @@
+package mnms
+
+import (
+	"compress/gzip"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeGzipFile(t *testing.T, name, content string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	_, err = gw.Write([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyslogIndexSearch indexes the current file and rotated backups
+func TestSyslogIndexSearch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "syslog_mnms.log")
+	writeGzipFile(t, filepath.Join(dir, "syslog_mnms-2023-02-20T10-00-00.000.log.gz"),
+		"<131>Feb 20 09:00:00 switch1 portd: port 1 link down\n"+
+			"<134>Feb 20 09:30:00 switch1 portd: port 1 link up\n")
+	err := os.WriteFile(filepath.Join(dir, "syslog_mnms-2023-02-21T10-00-00.000.log"),
+		[]byte("<36>Feb 21 08:00:00 switch2 login: login failed for admin\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(
+		"<134>Feb 22 08:00:00 switch2 portd: port 3 link up\n"+
+			"not a syslog line\n"+
+			"<131>Feb 22 09:00:00 switch1 portd: port 2 link down\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := NewSyslogIndex(path)
+	err = idx.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Search(SyslogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 5 {
+		t.Fatal("expect 5 records, got", res.Total)
+	}
+	if res.Records[0].Message != "port 2 link down" {
+		t.Fatal("expect newest record first, got", res.Records[0].Message)
+	}
+
+	res, _ = idx.Search(SyslogQuery{Text: "Link DOWN"})
+	if res.Total != 2 {
+		t.Fatal("expect 2 link down records, got", res.Total)
+	}
+	res, _ = idx.Search(SyslogQuery{Hosts: []string{"switch2"}, Apps: []string{"portd"}})
+	if res.Total != 1 || res.Records[0].Message != "port 3 link up" {
+		t.Fatal("unexpected host/app filter result", res.Records)
+	}
+	res, _ = idx.Search(SyslogQuery{Severities: []int{LOG_ERR}})
+	if res.Total != 2 {
+		t.Fatal("expect 2 error records, got", res.Total)
+	}
+	res, _ = idx.Search(SyslogQuery{Facilities: []int{LOG_AUTH >> 3}})
+	if res.Total != 1 || res.Records[0].Appname != "login" {
+		t.Fatal("unexpected facility filter result", res.Records)
+	}
+	year := time.Now().Year()
+	res, _ = idx.Search(SyslogQuery{
+		Start: time.Date(year, 2, 21, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(year, 2, 22, 8, 0, 0, 0, time.UTC),
+	})
+	if res.Total != 2 {
+		t.Fatal("expect 2 records in time range, got", res.Total)
+	}
+
+	// page through everything two at a time
+	seen := 0
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		res, err = idx.Search(SyslogQuery{Limit: 2, Cursor: cursor, Ascending: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen += len(res.Records)
+		if res.Next == "" {
+			break
+		}
+		cursor = res.Next
+	}
+	if seen != 5 {
+		t.Fatal("expect to page through 5 records, got", seen)
+	}
+	_, err = idx.Search(SyslogQuery{Cursor: "bogus"})
+	if err == nil {
+		t.Fatal("expect invalid cursor error")
+	}
+
+	buckets, err := idx.Counts(SyslogQuery{}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 || buckets[0].Total != 2 || buckets[2].Severity[LOG_ERR] != 1 {
+		t.Fatal("unexpected buckets", buckets)
+	}
+}
+
+// TestSyslogIndexRotation checks appends and rotation of the current file
+func TestSyslogIndexRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "syslog_mnms.log")
+	err := os.WriteFile(path, []byte("<134>Feb 22 08:00:00 switch1 portd: first\n<134>Feb 22 08:01:00 switch1 portd: partial"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := NewSyslogIndex(path)
+	err = idx.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := idx.Search(SyslogQuery{})
+	if res.Total != 1 {
+		t.Fatal("expect partial line to be skipped, got", res.Total)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(" line\n")
+	f.Close()
+	_ = idx.Refresh()
+	res, _ = idx.Search(SyslogQuery{Text: "partial"})
+	if res.Total != 1 {
+		t.Fatal("expect appended line to be indexed, got", res.Total)
+	}
+
+	// rotate like lumberjack does
+	err = os.Rename(path, filepath.Join(dir, "syslog_mnms-2023-02-22T10-00-00.000.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("<134>Feb 22 11:00:00 switch1 portd: after rotation\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = idx.Refresh()
+	res, _ = idx.Search(SyslogQuery{})
+	if res.Total != 3 {
+		t.Fatal("expect 3 records after rotation, got", res.Total)
+	}
+	_ = os.Remove(filepath.Join(dir, "syslog_mnms-2023-02-22T10-00-00.000.log"))
+	_ = idx.Refresh()
+	res, _ = idx.Search(SyslogQuery{Text: "first"})
+	if res.Total != 0 {
+		t.Fatal("expect removed backup to be forgotten, got", res.Total)
+	}
+}
+
+// TestHandleSyslogSearch tests query parameter parsing of the syslog apis
+func TestHandleSyslogSearch(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/v1/syslogs/search?start=2023/02/21%2022:06:00&host=a,b&severity=1,2&q=link&limit=5", nil)
+	query, err := syslogQueryFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Hosts) != 2 || len(query.Severities) != 2 || query.Limit != 5 || query.Text != "link" || query.Start.IsZero() {
+		t.Fatal("unexpected query", query)
+	}
+	req = httptest.NewRequest("GET", "/api/v1/syslogs/search?severity=x", nil)
+	_, err = syslogQueryFromRequest(req)
+	if err == nil {
+		t.Fatal("expect invalid severity error")
+	}
+	req = httptest.NewRequest("GET", "/api/v1/syslogs/counts?bucket=0s", nil)
+	w := httptest.NewRecorder()
+	HandleSyslogCounts(w, req)
+	if w.Code != 400 {
+		t.Fatal("expect bad request for invalid bucket, got", w.Code)
+	}
+}
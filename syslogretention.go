@@ -0,0 +1,416 @@
+package mnms
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	Syslog retention prunes rotated syslog backups by age and by a total
+	disk budget shared by the current file and its backups, oldest first.
+	Lumberjack only rotates by size, the policy is applied periodically
+	and whenever it changes.
+
+	Archived segments can be listed and exported through the api. A
+	client keeping local syslog files (-sk) serves the same apis, and
+	root relays requests carrying client=name to it.
+*/
+
+const syslogRetentionInterval = time.Minute
+
+var syslogRetentionOnce sync.Once
+
+// SyslogSegmentInfo describes a syslog file, current or archived.
+type SyslogSegmentInfo struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modtime"`
+	Start      time.Time `json:"start,omitempty"`
+	End        time.Time `json:"end,omitempty"`
+	Records    int       `json:"records"`
+	Compressed bool      `json:"compressed"`
+	Current    bool      `json:"current"`
+}
+
+// SyslogRetention is the retention policy set by command.
+type SyslogRetention struct {
+	Days   int  `json:"days"`
+	Budget uint `json:"budget"`
+}
+
+// startSyslogRetention applies the retention policy periodically.
+func startSyslogRetention() {
+	syslogRetentionOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(syslogRetentionInterval)
+				_, err := EnforceSyslogRetention(syslogLocalPath())
+				if err != nil {
+					q.Q(err)
+				}
+			}
+		}()
+	})
+}
+
+// EnforceSyslogRetention removes backups of the syslog file at path
+// older than the retention age, then the oldest backups until the
+// files fit the disk budget. It returns the removed files.
+func EnforceSyslogRetention(path string) ([]string, error) {
+	QC.SyslogMutex.Lock()
+	days := ReadSetting(&QC.SyslogRetentionDays)
+	budget := int64(ReadSetting(&QC.SyslogRetentionBudget)) * 1024 * 1024
+	QC.SyslogMutex.Unlock()
+	if days <= 0 && budget <= 0 {
+		return nil, nil
+	}
+	backups, err := syslogBackupFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		file string
+		info os.FileInfo
+	}
+	files := []backup{}
+	total := int64(0)
+	for _, file := range backups {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		files = append(files, backup{file, fi})
+		total += fi.Size()
+	}
+	// lumberjack timestamps in backup names may be local or utc, order by
+	// modification time
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].info.ModTime().Before(files[j].info.ModTime())
+	})
+	if fi, err := os.Stat(path); err == nil {
+		total += fi.Size()
+	}
+	removed := []string{}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	for _, b := range files {
+		expired := days > 0 && b.info.ModTime().Before(cutoff)
+		over := budget > 0 && total > budget
+		if !expired && !over {
+			continue
+		}
+		err := os.Remove(b.file)
+		if err != nil {
+			q.Q(err)
+			continue
+		}
+		total -= b.info.Size()
+		removed = append(removed, b.file)
+	}
+	if len(removed) > 0 {
+		q.Q("syslog retention removed", removed)
+	}
+	return removed, nil
+}
+
+// Segments describes the indexed syslog files, oldest first.
+func (idx *SyslogIndex) Segments() []SyslogSegmentInfo {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	infos := []SyslogSegmentInfo{}
+	for key, seg := range idx.segments {
+		info := SyslogSegmentInfo{
+			Name:       filepath.Base(seg.file),
+			Records:    len(seg.records),
+			Compressed: strings.HasSuffix(seg.file, ".gz"),
+			Current:    key == idx.path,
+		}
+		if fi, err := os.Stat(seg.file); err == nil {
+			info.Size = fi.Size()
+			info.ModTime = fi.ModTime()
+		}
+		for _, r := range seg.records {
+			if info.Start.IsZero() || r.Timestamp.Before(info.Start) {
+				info.Start = r.Timestamp
+			}
+			if r.Timestamp.After(info.End) {
+				info.End = r.Timestamp
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Current != infos[j].Current {
+			return infos[j].Current
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Configure local syslog retention.
+//
+// Usage : config local syslog retention [days] [budget]
+//
+//	[days]        : remove archived syslog files older than days, 0 keeps them
+//	[budget]      : total megabytes of syslog files to keep, 0 is unlimited
+//
+//	the policy is kept in syslog.json and applied again on restart,
+//	it can not be changed when the settings give it
+//
+// Example :
+//
+//	config local syslog retention 30 500
+//	config local syslog retention 0 0
+func SyslogRetentionCmd(cmdinfo *CmdInfo) *CmdInfo {
+	cmd := cmdinfo.Command
+	ws := strings.Split(cmd, " ")
+	if len(ws) != 6 {
+		cmdinfo.Status = "error: invalid command"
+		return cmdinfo
+	}
+	days, err := strconv.Atoi(ws[4])
+	if err != nil || days < 0 {
+		cmdinfo.Status = "error: invalid days " + ws[4]
+		return cmdinfo
+	}
+	budget, err := strconv.ParseUint(ws[5], 10, 32)
+	if err != nil {
+		cmdinfo.Status = "error: invalid budget " + ws[5]
+		return cmdinfo
+	}
+	// the settings file takes precedence over the saved retention
+	err = setSavedSettings(map[string]interface{}{
+		"syslog.retentionDays":   days,
+		"syslog.retentionBudget": uint(budget),
+	})
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	err = saveSyslogState(func(state *SyslogState) {
+		state.Retention = &SyslogRetention{Days: days, Budget: uint(budget)}
+	})
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	startSyslogRetention()
+	removed, err := EnforceSyslogRetention(syslogLocalPath())
+	if err != nil {
+		cmdinfo.Status = "error: " + err.Error()
+		return cmdinfo
+	}
+	cmdinfo.Result = fmt.Sprintf("removed %d files", len(removed))
+	cmdinfo.Status = "ok"
+	return cmdinfo
+}
+
+// relaySyslogClient relays a syslog api request to the named client and
+// copies its response.
+func relaySyslogClient(w http.ResponseWriter, r *http.Request, name string) {
+	QC.ClientMutex.Lock()
+	ci, ok := QC.Clients[name]
+	QC.ClientMutex.Unlock()
+	if !ok || ci.Port == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "unknown client " + name})
+		return
+	}
+	params := r.URL.Query()
+	params.Del("client")
+	var lastErr error
+	for _, ip := range ci.IPAddresses {
+		url := fmt.Sprintf("http://%s:%d%s?%s", ip, ci.Port, r.URL.Path, params.Encode())
+		resp, err := GetWithToken(url, QC.AdminToken)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+		for _, h := range []string{"Content-Type", "Content-Disposition"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			q.Q(err)
+		}
+		return
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("client %s has no address", name)
+	}
+	RespondWithError(w, lastErr)
+}
+
+// HandleSyslogArchive lists local syslog files
+//
+// GET /api/v1/syslogs/archive
+//
+//	Example parameter: ?client=client1 to list the files of a client
+//
+//	Response: [{"name": "syslog_mnms-2023-02-21T10-00-00.000.log.gz", "size": 1024,
+//	           "modtime": "...", "start": "...", "end": "...", "records": 12,
+//	           "compressed": true, "current": false}]
+func HandleSyslogArchive(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("client"); name != "" && name != QC.Name {
+		relaySyslogClient(w, r, name)
+		return
+	}
+	idx, err := GetSyslogIndex()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(idx.Segments())
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// syslogExportFlushRecords is the number of exported records sent to
+// the client at a time.
+const syslogExportFlushRecords = 1000
+
+var syslogCSVHeader = []string{"timestamp", "hostname", "appname", "facility", "severity",
+	"sourceip", "devmac", "message"}
+
+// syslogCSVFields returns the extracted field names of records, sorted,
+// one csv column each after the fixed columns.
+func syslogCSVFields(records []*SyslogRecord) []string {
+	seen := map[string]bool{}
+	fields := []string{}
+	for _, rec := range records {
+		for k := range rec.Fields {
+			if !seen[k] {
+				seen[k] = true
+				fields = append(fields, k)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// HandleSyslogExport exports local syslogs as gzip compressed NDJSON or CSV
+//
+// GET /api/v1/syslogs/export
+//
+//	Takes the filter parameters of /api/v1/syslogs/search, without paging,
+//	plus format, ndjson (default) or csv, and client to export the syslogs
+//	of a client.
+//
+//	Example parameter: ?start=2023/02/21 22:06:00&end=2023/02/23 22:08:00&format=csv
+//
+//	Response: syslog-export.ndjson.gz or syslog-export.csv.gz, oldest first.
+//	CSV exports have a field.<name> column for each extracted field.
+func HandleSyslogExport(w http.ResponseWriter, r *http.Request) {
+	if name := r.URL.Query().Get("client"); name != "" && name != QC.Name {
+		relaySyslogClient(w, r, name)
+		return
+	}
+	query, err := syslogQueryFromRequest(r)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if err == nil && format != "ndjson" && format != "csv" {
+		err = fmt.Errorf("invalid format %v, must be ndjson or csv", format)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	query.Ascending = true
+	idx, err := GetSyslogIndex()
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	// records are written as they are encoded, not copied into a page
+	records := idx.matching(&query)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="syslog-export.%s.gz"`, format))
+	gw := gzip.NewWriter(w)
+	defer func() {
+		err := gw.Close()
+		if err != nil {
+			q.Q(err)
+		}
+	}()
+	flusher, _ := w.(http.Flusher)
+	flush := func(i int) error {
+		if flusher == nil || (i+1)%syslogExportFlushRecords != 0 {
+			return nil
+		}
+		err := gw.Flush()
+		flusher.Flush()
+		return err
+	}
+	if format == "csv" {
+		cw := csv.NewWriter(gw)
+		fields := syslogCSVFields(records)
+		header := append([]string{}, syslogCSVHeader...)
+		for _, k := range fields {
+			header = append(header, "field."+k)
+		}
+		_ = cw.Write(header)
+		for i, rec := range records {
+			row := []string{
+				rec.Timestamp.Format(time.RFC3339),
+				rec.Hostname,
+				rec.Appname,
+				strconv.Itoa(rec.Facility),
+				strconv.Itoa(rec.Severity),
+				rec.SourceIP,
+				rec.DevMac,
+				rec.Message,
+			}
+			for _, k := range fields {
+				row = append(row, rec.Fields[k])
+			}
+			_ = cw.Write(row)
+			if (i+1)%syslogExportFlushRecords == 0 {
+				cw.Flush()
+			}
+			err = flush(i)
+			if err != nil {
+				q.Q(err)
+				return
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			q.Q(err)
+		}
+		return
+	}
+	enc := json.NewEncoder(gw)
+	for i, rec := range records {
+		err = enc.Encode(rec)
+		if err == nil {
+			err = flush(i)
+		}
+		if err != nil {
+			q.Q(err)
+			return
+		}
+	}
+}
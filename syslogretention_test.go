@@ -0,0 +1,202 @@
+package mnms
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSyslogRetention prunes backups by age and disk budget and keeps the
+// policy set by command
+func TestSyslogRetention(t *testing.T) {
+	oldDays, oldBudget, oldPath := QC.SyslogRetentionDays, QC.SyslogRetentionBudget, QC.SyslogLocalPath
+	defer func() {
+		QC.SyslogRetentionDays, QC.SyslogRetentionBudget, QC.SyslogLocalPath = oldDays, oldBudget, oldPath
+	}()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+	path := filepath.Join(dir, "syslog_mnms.log")
+	mb := strings.Repeat("x", 1024*1024)
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"syslog_mnms-2023-01-01T00-00-00.000.log.gz", 40 * 24 * time.Hour},
+		{"syslog_mnms-2023-02-01T00-00-00.000.log", 10 * 24 * time.Hour},
+		{"syslog_mnms-2023-02-05T00-00-00.000.log", 5 * 24 * time.Hour},
+		{"syslog_mnms-2023-02-09T00-00-00.000.log", 24 * time.Hour},
+	}
+	for _, f := range files {
+		fn := filepath.Join(dir, f.name)
+		if err := os.WriteFile(fn, []byte(mb), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(mb), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	QC.SyslogRetentionDays, QC.SyslogRetentionBudget = 0, 0
+	removed, _ := EnforceSyslogRetention(path)
+	if len(removed) != 0 {
+		t.Fatal("expect no retention without policy", removed)
+	}
+	QC.SyslogRetentionDays = 30
+	removed, _ = EnforceSyslogRetention(path)
+	if len(removed) != 1 || !strings.HasSuffix(removed[0], files[0].name) {
+		t.Fatal("expect expired backup to be removed", removed)
+	}
+	QC.SyslogRetentionBudget = 2
+	removed, _ = EnforceSyslogRetention(path)
+	if len(removed) != 2 || !strings.HasSuffix(removed[0], files[1].name) {
+		t.Fatal("expect oldest backups to be removed", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, files[3].name)); err != nil {
+		t.Fatal("expect newest backup to be kept", err)
+	}
+
+	cmdinfo := &CmdInfo{Command: "config local syslog retention x 5"}
+	SyslogRetentionCmd(cmdinfo)
+	if cmdinfo.Status == "ok" {
+		t.Fatal("expect invalid days to fail")
+	}
+	QC.SyslogLocalPath = path
+	cmdinfo = &CmdInfo{Command: "config local syslog retention 7 100"}
+	SyslogRetentionCmd(cmdinfo)
+	if cmdinfo.Status != "ok" {
+		t.Fatal(cmdinfo.Status)
+	}
+	QC.SyslogRetentionDays, QC.SyslogRetentionBudget = 0, 0
+	err = LoadSyslogState()
+	if err != nil || QC.SyslogRetentionDays != 7 || QC.SyslogRetentionBudget != 100 {
+		t.Fatal("expect saved retention to be applied", QC.SyslogRetentionDays, QC.SyslogRetentionBudget, err)
+	}
+
+	// the logger keeps no backups of its own once a budget is set
+	defer func() {
+		QC.SyslogMutex.Lock()
+		if Logger != nil {
+			_ = Logger.Close()
+			Logger = nil
+		}
+		QC.SyslogMutex.Unlock()
+	}()
+	QC.SyslogRetentionDays, QC.SyslogRetentionBudget = 0, 0
+	SaveLog("<134>Feb 22 08:00:00 switch1 portd: port 1 link up")
+	if Logger.MaxBackups == 0 {
+		t.Fatal("expect logger to keep backups without retention")
+	}
+	QC.SyslogRetentionBudget = 100
+	SaveLog("<134>Feb 22 08:00:01 switch1 portd: port 1 link down")
+	if Logger.MaxBackups != 0 {
+		t.Fatal("expect logger to leave backups to the budget", Logger.MaxBackups)
+	}
+}
+
+// TestHandleSyslogExport exports syslogs as gzip ndjson and csv
+func TestHandleSyslogExport(t *testing.T) {
+	oldPath := QC.SyslogLocalPath
+	defer func() {
+		QC.SyslogLocalPath = oldPath
+	}()
+	dir := t.TempDir()
+	QC.SyslogLocalPath = filepath.Join(dir, "syslog_mnms.log")
+	writeGzipFile(t, filepath.Join(dir, "syslog_mnms-2023-02-20T10-00-00.000.log.gz"),
+		"<131>Feb 20 09:00:00 switch1 portd: port 1 link down\n")
+	err := os.WriteFile(QC.SyslogLocalPath, []byte(
+		"<134>Feb 22 08:00:00 switch2 portd: port 3 link up\n"+
+			"<131>Feb 22 09:00:00 switch1 portd: port \"2\", link down\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleSyslogArchive(w, httptest.NewRequest("GET", "/api/v1/syslogs/archive", nil))
+	segments := []SyslogSegmentInfo{}
+	err = json.Unmarshal(w.Body.Bytes(), &segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || !segments[0].Compressed || !segments[1].Current || segments[1].Records != 2 {
+		t.Fatal("unexpected segments", segments)
+	}
+
+	w = httptest.NewRecorder()
+	HandleSyslogExport(w, httptest.NewRequest("GET", "/api/v1/syslogs/export?host=switch1", nil))
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(gr)
+	lines := []SyslogRecord{}
+	for scanner.Scan() {
+		var rec SyslogRecord
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, rec)
+	}
+	if len(lines) != 2 || lines[0].Message != "port 1 link down" {
+		t.Fatal("unexpected ndjson export", lines)
+	}
+
+	w = httptest.NewRecorder()
+	start := fmt.Sprintf("%d-02-21T00:00:00Z", time.Now().Year())
+	HandleSyslogExport(w, httptest.NewRequest("GET", "/api/v1/syslogs/export?format=csv&start="+start, nil))
+	if w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatal("unexpected content type", w.Header())
+	}
+	gr, err = gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(gr).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "timestamp" || rows[2][7] != `port "2", link down` {
+		t.Fatal("unexpected csv export", rows)
+	}
+	// extracted fields follow as field.<name> columns
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[h] = i
+	}
+	if i, ok := col["field.port"]; !ok || rows[1][i] != "3" || rows[1][col["field.state"]] != "up" {
+		t.Fatal("expect extracted fields in csv export", rows)
+	}
+
+	w = httptest.NewRecorder()
+	HandleSyslogExport(w, httptest.NewRequest("GET", "/api/v1/syslogs/export?format=xml", nil))
+	if w.Code != 400 {
+		t.Fatal("expect bad request for invalid format, got", w.Code)
+	}
+	w = httptest.NewRecorder()
+	HandleSyslogExport(w, httptest.NewRequest("GET", "/api/v1/syslogs/export?client=nosuchclient", nil))
+	if w.Code != 404 {
+		t.Fatal("expect not found for unknown client, got", w.Code)
+	}
+}
@@ -105,7 +105,7 @@ func TopologyPollingWithTimer(pollingInterval int) {
 				q.Q("error in parsing timestamp")
 				continue
 			}
-			if currTime-lastTime <= int64(QC.GwdInterval) {
+			if currTime-lastTime <= int64(ReadSetting(&QC.GwdInterval)) {
 				targetes = append(targetes, TopoDevice{IpAddress: dev.IPAddress, MacAddress: dev.Mac, ModelName: dev.ModelName})
 			}
 		}
@@ -378,21 +378,35 @@ func PublishTopology(topologyData Topology) error {
 }
 
 func InsertTopology(topoKeys string, topoDesc Topology) bool {
+	changed := false
 	QC.DevMutex.Lock()
 	_, ok := QC.TopologyData[topoKeys]
 	if ok {
 		if !topoDesc.Equal(QC.TopologyData[topoKeys]) {
 			QC.TopologyData[topoKeys] = topoDesc
+			changed = true
 			// topologies vary all the time due to snmp polling, so we don't send syslog here
 		}
 	} else {
 		QC.TopologyData[topoKeys] = topoDesc
+		changed = true
 		err := SendSyslog(LOG_ALERT, "InsertTopo", "new topology from: "+topoKeys)
 		if err != nil {
 			q.Q(err)
 		}
 	}
 	QC.DevMutex.Unlock()
+	if changed {
+		publishMqttTopology(topoKeys, topoDesc)
+		PublishWebSocketMessage(WebSocketMessage{
+			Kind:    "topology",
+			Topic:   WebSocketTopicTopology,
+			Level:   LOG_INFO,
+			Mac:     topoKeys,
+			Message: topoKeys,
+			Data:    topoDesc,
+		})
+	}
 
 	return true
 }
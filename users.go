@@ -10,31 +10,15 @@ import (
 	"sync"
 	"time"
 
-	"github.com/dlclark/regexp2"
 	"github.com/pquerna/otp/totp"
 
 	"github.com/qeof/q"
 )
 
-// validUserPassword returns true if the password is valid for the user.
+// validUserPassword returns nil if the password is valid for the user.
 func validUserPassword(user, password string) error {
-	// get mnms config
-	config, err := GetMNMSConfig()
-	if err != nil {
-		q.Q(err)
-		return err
-	}
-	// find user
-	for _, u := range config.Users {
-		if u.Name == user {
-
-			if u.Password != password {
-				return errors.New("password not match")
-			}
-			return nil
-		}
-	}
-	return fmt.Errorf("user %s not found", user)
+	_, err := authenticateUser(user, password)
+	return err
 }
 
 func GenerateRetrievePasswordToken(user, pass string) (string, error) {
@@ -87,10 +71,7 @@ func ValidateUserPassword(user, password string) bool {
 	for _, u := range c.Users {
 		if u.Name == user {
 			// check password
-
-			if u.Password == password {
-				return true
-			}
+			return verifyPassword(u.Password, password)
 		}
 	}
 	return false
@@ -117,170 +98,208 @@ func GetUserConfig(user string) (*UserConfig, error) {
 	// check user exist
 	for _, u := range c.Users {
 		if u.Name == user {
+			u.passwordHashed = true
 			return &u, nil
 		}
 	}
 	q.Q("user not exist", user)
 	return nil, errors.New("user not exist")
 }
+
+// checkUsersPassword checks pw against the password policy.
 func checkUsersPassword(pw string) error {
-	// check password with regex: /^(?=.\d)(?=.[A-Z])(?=.[a-z])(?=.[a-zA-Z!#@$%&? "])[a-zA-Z0-9!#$@%&?]{8,20}$/
-	regex := regexp2.MustCompile(`(?=.*[A-Z])(?=.*[a-z])(?=.*\d)(?=.*[@$!%*#?&])[A-Za-z\d@$!%*#?&]{8,20}$`, 0)
-	if isMatch, _ := regex.MatchString(pw); isMatch {
-		return nil
-	}
-	return errors.New("password must have 8-20 characters, at least one uppercase one lowercase one digit one special character")
+	return GetPasswordPolicy().Check(pw)
 }
 
 // AddUserConfig add user to mnms config
 func AddUserConfig(user, role, password, email string) error {
-	// get mnms config
-	c, err := GetMNMSConfig()
+	err := checkUsersPassword(password)
 	if err != nil {
 		q.Q(err)
 		return err
 	}
-
-	err = checkUsersPassword(password)
+	hash, err := hashPassword(password)
 	if err != nil {
 		q.Q(err)
 		return err
 	}
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		_, err := findRole(c, role)
+		if err != nil {
+			q.Q(err)
+			return err
+		}
 
-	// check email exist
-	for _, u := range c.Users {
-		if u.Email == email {
-			q.Q("email exist", email)
-			return fmt.Errorf("email %s exist", email)
+		// check email exist
+		for _, u := range c.Users {
+			if u.Email == email {
+				q.Q("email exist", email)
+				return fmt.Errorf("email %s exist", email)
+			}
 		}
-	}
 
-	// check user exist
-	for _, u := range c.Users {
-		if u.Name == user {
-			q.Q("user exist", user)
-			return fmt.Errorf("user %s exist", user)
+		// check user exist
+		for _, u := range c.Users {
+			if u.Name == user {
+				q.Q("user exist", user)
+				return fmt.Errorf("user %s exist", user)
+			}
 		}
-	}
-	// add user
-	c.Users = append(c.Users, UserConfig{
-		Name:     user,
-		Role:     role,
-		Email:    email,
-		Password: password,
+		// add user
+		c.Users = append(c.Users, UserConfig{
+			Name:            user,
+			Role:            role,
+			Email:           email,
+			Password:        hash,
+			PasswordChanged: time.Now().Unix(),
+		})
+		return nil
 	})
-	err = WriteMNMSConfig(c)
-	if err != nil {
-		q.Q(err)
-		return err
-	}
-	return nil
 }
 
 // DeleteUserConfig delete user from mnms config
 func DeleteUserConfig(user string) error {
-	// get mnms config
-	c, err := GetMNMSConfig()
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		// check user exist
+		for i, u := range c.Users {
+			if u.Name == user {
+				c.Users = append(c.Users[:i], c.Users[i+1:]...)
+				for j := range c.APIKeys {
+					if c.APIKeys[j].User == user && c.APIKeys[j].Revoked == 0 {
+						c.APIKeys[j].Revoked = time.Now().Unix()
+					}
+				}
+				return nil
+			}
+		}
+		q.Q("user not exist", user)
+		return fmt.Errorf("user %s not exist", user)
+	})
 	if err != nil {
-		q.Q(err)
 		return err
 	}
-	// check user exist
-	for i, u := range c.Users {
-		if u.Name == user {
-			c.Users = append(c.Users[:i], c.Users[i+1:]...)
-			err = WriteMNMSConfig(c)
-			if err != nil {
-				q.Q(err)
-				return err
+	RevokeUserSessions(user)
+	return nil
+}
+
+// modifyUser applies f to the stored user and writes the config when f
+// succeeds.
+func modifyUser(user string, f func(u *UserConfig) error) error {
+	return updateMNMSConfig(func(c *MNMSConfig) error {
+		for i := range c.Users {
+			if c.Users[i].Name == user {
+				return f(&c.Users[i])
 			}
-			return nil
 		}
-	}
-	q.Q("user not exist", user)
-	return fmt.Errorf("user %s not exist", user)
+		return fmt.Errorf("user %s not exist", user)
+	})
 }
 
-// MergeUserConfig merge user config
+// MergeUserConfig merge user config. The password is hashed unless it
+// is marked as a hash by GetUserConfig.
 func MergeUserConfig(user UserConfig) error {
-	// get mnms config
-	c, err := GetMNMSConfig()
+	roleChanged := false
+	err := updateMNMSConfig(func(c *MNMSConfig) error {
+		var err error
+		// check user exist
+		for i, u := range c.Users {
+			if u.Name == user.Name {
+				// merge user if not empty
+
+				if user.Email != "" {
+					c.Users[i].Email = user.Email
+				}
+				if user.Password != "" && user.Password != c.Users[i].Password {
+					if user.passwordHashed {
+						c.Users[i].Password = user.Password
+					} else {
+						c.Users[i].Password, err = hashPassword(user.Password)
+						if err != nil {
+							q.Q(err)
+							return err
+						}
+					}
+					c.Users[i].PasswordChanged = time.Now().Unix()
+				}
+				roleChanged = user.Role != "" && user.Role != c.Users[i].Role
+				if user.Role != "" {
+					c.Users[i].Role = user.Role
+				}
+
+				c.Users[i].Enable2FA = user.Enable2FA
+				if user.Secret != "" {
+					c.Users[i].Secret = user.Secret
+				}
+				return nil
+			}
+		}
+		q.Q("user not exist", user.Name)
+		return fmt.Errorf("user %s not exist", user.Name)
+	})
 	if err != nil {
 		q.Q(err)
 		return err
 	}
-	// check user exist
-	for i, u := range c.Users {
-		if u.Name == user.Name {
-			// merge user if not empty
-
-			if user.Email != "" {
-				c.Users[i].Email = user.Email
-			}
-			if user.Password != "" {
-				c.Users[i].Password = user.Password
-			}
-			if user.Role != "" {
-				c.Users[i].Role = user.Role
-			}
-
-			c.Users[i].Enable2FA = user.Enable2FA
-			if user.Secret != "" {
-				c.Users[i].Secret = user.Secret
-			}
-			err = WriteMNMSConfig(c)
-			if err != nil {
-				q.Q(err)
-				return err
-			}
-			return nil
-		}
+	if roleChanged {
+		RevokeUserSessions(user.Name)
 	}
-	q.Q("user not exist", user.Name)
-	return fmt.Errorf("user %s not exist", user.Name)
+	return nil
 }
 
 // UpdateUserConfig add user to mnms config
 func UpdateUserConfig(user, role, password, email string) error {
-	// get mnms config
-	c, err := GetMNMSConfig()
+	err := checkUsersPassword(password)
 	if err != nil {
 		q.Q(err)
 		return err
 	}
-
-	err = checkUsersPassword(password)
+	hash, err := hashPassword(password)
 	if err != nil {
 		q.Q(err)
 		return err
 	}
-	// check email exist
-	for _, u := range c.Users {
-		if u.Email == email {
-			if u.Name == user {
-				continue
-			}
-			q.Q("email exist", email)
-			return fmt.Errorf("email %s exist", email)
-		}
-	}
-
-	// check user exist
-	for i, u := range c.Users {
-		if u.Name == user {
-			c.Users[i].Role = role
-			c.Users[i].Password = password
-			c.Users[i].Email = email
-			err = WriteMNMSConfig(c)
+	roleChanged := false
+	err = updateMNMSConfig(func(c *MNMSConfig) error {
+		if role != "" {
+			_, err := findRole(c, role)
 			if err != nil {
 				q.Q(err)
 				return err
 			}
-			return nil
 		}
+		// check email exist
+		for _, u := range c.Users {
+			if u.Email == email {
+				if u.Name == user {
+					continue
+				}
+				q.Q("email exist", email)
+				return fmt.Errorf("email %s exist", email)
+			}
+		}
+
+		// check user exist
+		for i, u := range c.Users {
+			if u.Name == user {
+				c.Users[i].Role = role
+				c.Users[i].Password = hash
+				c.Users[i].PasswordChanged = time.Now().Unix()
+				c.Users[i].Email = email
+				roleChanged = u.Role != role
+				return nil
+			}
+		}
+		q.Q("user not exist", user)
+		return fmt.Errorf("user %s not exist", user)
+	})
+	if err != nil {
+		return err
 	}
-	q.Q("user not exist", user)
-	return fmt.Errorf("user %s not exist", user)
+	// tokens issued under the old role must not outlive it
+	if roleChanged {
+		RevokeUserSessions(user)
+	}
+	return nil
 }
 
 // the mnms config mutex for writing file avoid race condition
@@ -298,11 +317,40 @@ type UserConfig struct {
 	Password  string `json:"password"`
 	Enable2FA bool   `json:"enable2FA"`
 	Secret    string `json:"secret"`
+	// PasswordChanged is the unix time the password was last set
+	PasswordChanged int64 `json:"passwordChanged,omitempty"`
+	FailedLogins    int   `json:"failedLogins,omitempty"`
+	LockedUntil     int64 `json:"lockedUntil,omitempty"`
+	// Service accounts log in with API keys only
+	Service bool `json:"service,omitempty"`
+	// Provider is ldap or oidc for users of an identity provider
+	Provider string `json:"provider,omitempty"`
+	// WebAuthn are the security keys of the user
+	WebAuthn []WebAuthnCredential `json:"webauthn,omitempty"`
+	// RecoveryCodes are hashes of unused 2fa recovery codes
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	// passwordHashed marks Password as the stored hash, as returned by
+	// GetUserConfig, it is never taken from a request
+	passwordHashed bool
 }
 
 // MNMSConfig is the configuration for the MNMS.
 type MNMSConfig struct {
-	Users []UserConfig `json:"users"`
+	Users          []UserConfig    `json:"users"`
+	PasswordPolicy *PasswordPolicy `json:"passwordPolicy,omitempty"`
+	Roles          []RoleConfig    `json:"roles,omitempty"`
+	DeviceGroups   []DeviceGroup   `json:"deviceGroups,omitempty"`
+	APIKeys        []APIKey        `json:"apiKeys,omitempty"`
+	LDAP           *LDAPConfig     `json:"ldap,omitempty"`
+	OIDC           *OIDCConfig     `json:"oidc,omitempty"`
+	Credentials    []Credential    `json:"credentials,omitempty"`
+	Profiles       []ClientProfile `json:"profiles,omitempty"`
+	MqttAccounts   []MqttAccount   `json:"mqttAccounts,omitempty"`
+	MqttACLs       []MqttACL       `json:"mqttAcls,omitempty"`
+	MqttRules      []MqttRule      `json:"mqttRules,omitempty"`
+
+	OpcuaBridgeServers []OpcuaBridgeServer `json:"opcuaBridgeServers,omitempty"`
+	OpcuaTags          []OpcuaTag          `json:"opcuaTags,omitempty"`
 }
 
 // GetMNMSConfig returns the MNMS configuration
@@ -335,10 +383,42 @@ func GetMNMSConfig() (*MNMSConfig, error) {
 	return &config, err
 }
 
-// WriteMNMSConfig writes the MNMS configuration
+// WriteMNMSConfig writes the MNMS configuration. Use updateMNMSConfig to
+// change the stored configuration.
 func WriteMNMSConfig(c *MNMSConfig) error {
 	mnmsconfigMutex.Lock()
 	defer mnmsconfigMutex.Unlock()
+	return writeMNMSConfig(c)
+}
+
+// errMNMSConfigUnchanged is returned by the function passed to
+// updateMNMSConfig when nothing needs to be written.
+var errMNMSConfigUnchanged = errors.New("config unchanged")
+
+// updateMNMSConfig reads the MNMS configuration, applies f and writes it
+// back when f succeeds. The config mutex is held all along, so changes
+// made at the same time are not lost. f must not write the config itself.
+func updateMNMSConfig(f func(c *MNMSConfig) error) error {
+	mnmsconfigMutex.Lock()
+	defer mnmsconfigMutex.Unlock()
+	c, err := GetMNMSConfig()
+	if err != nil {
+		q.Q(err)
+		return err
+	}
+	err = f(c)
+	if errors.Is(err, errMNMSConfigUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeMNMSConfig(c)
+}
+
+// writeMNMSConfig writes the MNMS configuration, the caller holds the
+// config mutex.
+func writeMNMSConfig(c *MNMSConfig) error {
 	configFullPath, err := checkMNMSConfigPath()
 	if err != nil {
 		q.Q(err)
@@ -365,8 +445,15 @@ func WriteMNMSConfig(c *MNMSConfig) error {
 		return err
 	}
 
-	// write encryptedConfig to configFullPath
-	err = ioutil.WriteFile(configFullPath, encryptedConfig, 0644)
+	// write encryptedConfig to configFullPath, readers do not take the
+	// mutex so the file is replaced at once
+	tmp := configFullPath + ".tmp"
+	err = ioutil.WriteFile(tmp, encryptedConfig, 0644)
+	if err != nil {
+		q.Q(err)
+		return err
+	}
+	err = os.Rename(tmp, configFullPath)
 	if err != nil {
 		q.Q(err)
 		return err
@@ -410,32 +497,49 @@ var AdminDefaultPassword = "default"
 type LoginSession struct {
 	User      UserConfig
 	ExpiresAt time.Time
+	// Challenge is the pending security key challenge
+	Challenge string
+	// Failures counts the second factors which did not verify
+	Failures int
 }
 
+// maxLoginSessionFailures is the number of failed second factors after
+// which a login session ends.
+const maxLoginSessionFailures = 5
+
 var loginsSssionStore = struct {
 	sync.RWMutex
 	m map[string]LoginSession
 }{m: make(map[string]LoginSession)}
 
 // createLoginSession create a login session
-func createLoginSession(user UserConfig) string {
-	sessionID := fmt.Sprintf("%s-%d", user.Name, time.Now().UnixNano())
+func createLoginSession(user UserConfig) (string, error) {
+	sessionID, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
 	// create session
+	now := time.Now()
 	session := LoginSession{
 		User:      user,
-		ExpiresAt: time.Now().Add(5 * time.Minute),
+		ExpiresAt: now.Add(5 * time.Minute),
 	}
 
 	loginsSssionStore.Lock()
 	defer loginsSssionStore.Unlock()
+	for k, v := range loginsSssionStore.m {
+		if v.ExpiresAt.Before(now) {
+			delete(loginsSssionStore.m, k)
+		}
+	}
 	loginsSssionStore.m[sessionID] = session
-	return sessionID
+	return sessionID, nil
 }
 
 // getLoginSession get a login session
 func getLoginSession(sessionID string) (*UserConfig, error) {
-	loginsSssionStore.RLock()
-	defer loginsSssionStore.RUnlock()
+	loginsSssionStore.Lock()
+	defer loginsSssionStore.Unlock()
 	session, ok := loginsSssionStore.m[sessionID]
 	if !ok {
 		return nil, fmt.Errorf("session not exist")
@@ -447,6 +551,60 @@ func getLoginSession(sessionID string) (*UserConfig, error) {
 	return &session.User, nil
 }
 
+// takeLoginSessionChallenge returns the security key challenge of a
+// login session and clears it, so that a challenge is answered once.
+func takeLoginSessionChallenge(sessionID string) string {
+	loginsSssionStore.Lock()
+	defer loginsSssionStore.Unlock()
+	session, ok := loginsSssionStore.m[sessionID]
+	if !ok {
+		return ""
+	}
+	challenge := session.Challenge
+	session.Challenge = ""
+	loginsSssionStore.m[sessionID] = session
+	return challenge
+}
+
+// setLoginSessionChallenge sets the security key challenge of a login
+// session.
+func setLoginSessionChallenge(sessionID, challenge string) error {
+	loginsSssionStore.Lock()
+	defer loginsSssionStore.Unlock()
+	session, ok := loginsSssionStore.m[sessionID]
+	if !ok {
+		return fmt.Errorf("session not exist")
+	}
+	session.Challenge = challenge
+	loginsSssionStore.m[sessionID] = session
+	return nil
+}
+
+// loginSessionFailed counts a failed second factor of a login session and
+// ends the session after maxLoginSessionFailures.
+func loginSessionFailed(sessionID string) {
+	loginsSssionStore.Lock()
+	defer loginsSssionStore.Unlock()
+	session, ok := loginsSssionStore.m[sessionID]
+	if !ok {
+		return
+	}
+	session.Failures++
+	if session.Failures >= maxLoginSessionFailures {
+		q.Q("login session ended after failures", session.User.Name)
+		delete(loginsSssionStore.m, sessionID)
+		return
+	}
+	loginsSssionStore.m[sessionID] = session
+}
+
+// deleteLoginSession ends a login session once the second factor passed.
+func deleteLoginSession(sessionID string) {
+	loginsSssionStore.Lock()
+	defer loginsSssionStore.Unlock()
+	delete(loginsSssionStore.m, sessionID)
+}
+
 // InitDefaultMNMSConfigIfNotExist generate default users, if already there, do nothing
 func InitDefaultMNMSConfigIfNotExist() error {
 	_, err := GetMNMSConfig()
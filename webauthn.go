@@ -0,0 +1,745 @@
+package mnms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qeof/q"
+)
+
+/*
+	WebAuthn (FIDO2) security keys as second factor.
+
+	A logged in user registers a security key with the browser,
+
+		GET  /api/v1/2fa/webauthn/register  creation options
+		POST /api/v1/2fa/webauthn/register  the created credential
+
+	and after the password step of a login signs a challenge with it,
+
+		POST /api/v1/2fa/webauthn/login     request options of a login session
+		POST /api/v1/2fa/validate           the assertion
+
+	Credentials are scoped to the relying party id, the host name of the
+	web UI. Browsers do not accept IP addresses as relying party id, the
+	web UI has to be opened by name. Attestation is not requested, keys
+	are trusted on registration like TOTP secrets.
+*/
+
+const webAuthnTimeout = 5 * time.Minute
+
+// COSE algorithms of supported credentials
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// authenticator data flags
+const (
+	authDataUserPresent  = 0x01
+	authDataAttestedData = 0x40
+)
+
+// WebAuthnCredential is a registered security key.
+type WebAuthnCredential struct {
+	ID        string `json:"id"` // base64url credential id
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"` // base64url COSE key
+	RPID      string `json:"rpID"`
+	SignCount uint32 `json:"signCount"`
+	Created   int64  `json:"created"`
+	LastUsed  int64  `json:"lastUsed,omitempty"`
+}
+
+// webAuthnAttestation is a credential returned by
+// navigator.credentials.create, binary fields base64url encoded.
+type webAuthnAttestation struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// webAuthnAssertion is a credential returned by navigator.credentials.get.
+type webAuthnAssertion struct {
+	ID       string `json:"id"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webAuthnChallenge struct {
+	challenge string
+	rpID      string
+	expires   time.Time
+}
+
+var (
+	webAuthnRegistrationsMutex sync.Mutex
+	webAuthnRegistrations      = map[string]webAuthnChallenge{}
+)
+
+var b64url = base64.RawURLEncoding
+
+// decodeB64URL decodes base64url with or without padding.
+func decodeB64URL(s string) ([]byte, error) {
+	return b64url.DecodeString(strings.TrimRight(s, "="))
+}
+
+// cborDecode decodes the CBOR item at the start of b and returns it with
+// its length. Maps decode to map[interface{}]interface{} with int64 or
+// string keys, floats and undefined decode to nil. Indefinite lengths
+// are not used by authenticators and not supported.
+func cborDecode(b []byte, depth int) (interface{}, int, error) {
+	if depth > 16 {
+		return nil, 0, errors.New("cbor: nested too deep")
+	}
+	if len(b) == 0 {
+		return nil, 0, errors.New("cbor: unexpected end")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < 1+size {
+			return nil, 0, errors.New("cbor: unexpected end")
+		}
+		for _, c := range b[1 : 1+size] {
+			arg = arg<<8 | uint64(c)
+		}
+		n += size
+	default:
+		return nil, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+	switch major {
+	case 0:
+		return int64(arg), n, nil
+	case 1:
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(b)-n) {
+			return nil, 0, errors.New("cbor: unexpected end")
+		}
+		v := b[n : n+int(arg)]
+		if major == 3 {
+			return string(v), n + int(arg), nil
+		}
+		return v, n + int(arg), nil
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, 0, errors.New("cbor: unexpected end")
+		}
+		arr := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, m, err := cborDecode(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, v)
+			n += m
+		}
+		return arr, n, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, 0, errors.New("cbor: unexpected end")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, kn, err := cborDecode(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += kn
+			v, vn, err := cborDecode(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += vn
+			switch k.(type) {
+			case int64, string:
+				m[k] = v
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key")
+			}
+		}
+		return m, n, nil
+	case 6:
+		// tags are ignored
+		v, m, err := cborDecode(b[n:], depth+1)
+		return v, n + m, err
+	default:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		}
+		return nil, n, nil
+	}
+}
+
+// authenticatorData is the parsed authenticator data of a ceremony.
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // COSE key of attested credential data
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&authDataAttestedData == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("attested credential data too short")
+	}
+	ad.credentialID = rest[:idLen]
+	_, n, err := cborDecode(rest[idLen:], 0)
+	if err != nil {
+		return nil, err
+	}
+	ad.publicKey = rest[idLen : idLen+n]
+	return ad, nil
+}
+
+func coseInt(m map[interface{}]interface{}, k int64) int64 {
+	v, _ := m[k].(int64)
+	return v
+}
+
+func coseBytes(m map[interface{}]interface{}, k int64) []byte {
+	v, _ := m[k].([]byte)
+	return v
+}
+
+// parseCOSEKey returns the public key and COSE algorithm of a COSE key.
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	v, _, err := cborDecode(b, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("cose key is not a map")
+	}
+	alg := coseInt(m, 3)
+	switch alg {
+	case coseAlgES256:
+		x, y := coseBytes(m, -2), coseBytes(m, -3)
+		if coseInt(m, 1) != 2 || coseInt(m, -1) != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid ES256 cose key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("invalid ES256 cose key")
+		}
+		return pub, alg, nil
+	case coseAlgRS256:
+		n, e := coseBytes(m, -1), coseBytes(m, -2)
+		if coseInt(m, 1) != 3 || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RS256 cose key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	case coseAlgEdDSA:
+		x := coseBytes(m, -2)
+		if coseInt(m, 1) != 1 || coseInt(m, -1) != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid EdDSA cose key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported cose algorithm %d", alg)
+}
+
+func verifyCOSESignature(coseKey, data, sig []byte) error {
+	pub, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgRS256:
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+	default:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), data, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+}
+
+// webAuthnRPID returns the relying party id of the web UI making r, the
+// host name of its origin.
+func webAuthnRPID(r *http.Request) string {
+	host := r.Host
+	if o, err := url.Parse(r.Header.Get("Origin")); err == nil && o.Host != "" {
+		host = o.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// checkClientData checks the client data of a ceremony of type typ
+// against challenge and rpID and returns its hash.
+func checkClientData(clientData []byte, typ, challenge, rpID string) ([]byte, error) {
+	var cd webAuthnClientData
+	err := json.Unmarshal(clientData, &cd)
+	if err != nil {
+		return nil, err
+	}
+	if cd.Type != typ {
+		return nil, fmt.Errorf("client data type %s, expect %s", cd.Type, typ)
+	}
+	if cd.Challenge != challenge {
+		return nil, errors.New("challenge mismatch")
+	}
+	o, err := url.Parse(cd.Origin)
+	if err != nil {
+		return nil, err
+	}
+	host := o.Hostname()
+	if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+		return nil, fmt.Errorf("origin %s not of relying party %s", cd.Origin, rpID)
+	}
+	h := sha256.Sum256(clientData)
+	return h[:], nil
+}
+
+// newWebAuthnChallenge returns a random base64url challenge.
+func newWebAuthnChallenge() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return b64url.EncodeToString(b), nil
+}
+
+// beginWebAuthnRegistration returns the creation options for a new
+// security key of user.
+func beginWebAuthnRegistration(user *UserConfig, rpID string) (map[string]any, error) {
+	if rpID == "" || net.ParseIP(rpID) != nil {
+		return nil, fmt.Errorf("security keys need the web UI opened by host name, not %q", rpID)
+	}
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	webAuthnRegistrationsMutex.Lock()
+	for k, v := range webAuthnRegistrations {
+		if now.After(v.expires) {
+			delete(webAuthnRegistrations, k)
+		}
+	}
+	webAuthnRegistrations[user.Name] = webAuthnChallenge{challenge: challenge, rpID: rpID, expires: now.Add(webAuthnTimeout)}
+	webAuthnRegistrationsMutex.Unlock()
+
+	exclude := []map[string]string{}
+	for _, c := range user.WebAuthn {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": c.ID})
+	}
+	return map[string]any{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": rpID, "name": IssuerOf2FA},
+		"user": map[string]string{
+			"id":          b64url.EncodeToString([]byte(user.Name)),
+			"name":        user.Name,
+			"displayName": user.Name,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":            webAuthnTimeout.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]string{
+			"userVerification": "discouraged",
+		},
+	}, nil
+}
+
+// finishWebAuthnRegistration verifies a created credential of user and
+// returns it for storing.
+func finishWebAuthnRegistration(user string, att *webAuthnAttestation) (*WebAuthnCredential, error) {
+	webAuthnRegistrationsMutex.Lock()
+	reg, ok := webAuthnRegistrations[user]
+	delete(webAuthnRegistrations, user)
+	webAuthnRegistrationsMutex.Unlock()
+	if !ok || time.Now().After(reg.expires) {
+		return nil, errors.New("no pending security key registration")
+	}
+	clientData, err := decodeB64URL(att.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	_, err = checkClientData(clientData, "webauthn.create", reg.challenge, reg.rpID)
+	if err != nil {
+		return nil, err
+	}
+	attObj, err := decodeB64URL(att.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := cborDecode(attObj, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid attestation object")
+	}
+	raw, _ := m["authData"].([]byte)
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	rpHash := sha256.Sum256([]byte(reg.rpID))
+	if string(ad.rpIDHash) != string(rpHash[:]) {
+		return nil, errors.New("relying party id hash mismatch")
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return nil, errors.New("user not present")
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("no attested credential data")
+	}
+	_, _, err = parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	name := att.Name
+	if name == "" {
+		name = "security key"
+	}
+	return &WebAuthnCredential{
+		ID:        b64url.EncodeToString(ad.credentialID),
+		Name:      name,
+		PublicKey: b64url.EncodeToString(ad.publicKey),
+		RPID:      reg.rpID,
+		SignCount: ad.signCount,
+		Created:   time.Now().Unix(),
+	}, nil
+}
+
+// beginWebAuthnLogin returns the request options for the second factor
+// of a login session, for the security keys registered with the relying
+// party rpID of the web UI.
+func beginWebAuthnLogin(sessionID, rpID string) (map[string]any, error) {
+	user, err := getLoginSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	allow := []map[string]string{}
+	for _, c := range user.WebAuthn {
+		if c.RPID == rpID {
+			allow = append(allow, map[string]string{"type": "public-key", "id": c.ID})
+		}
+	}
+	if len(allow) == 0 {
+		return nil, fmt.Errorf("user %s has no security key for %s", user.Name, rpID)
+	}
+	challenge, err := newWebAuthnChallenge()
+	if err != nil {
+		return nil, err
+	}
+	err = setLoginSessionChallenge(sessionID, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"challenge":        challenge,
+		"rpId":             rpID,
+		"allowCredentials": allow,
+		"timeout":          webAuthnTimeout.Milliseconds(),
+		"userVerification": "discouraged",
+	}, nil
+}
+
+// verifyWebAuthnAssertion checks an assertion of user against challenge
+// and updates the sign count of the credential used. The sign count is
+// checked and stored in one config transaction, so a replayed assertion
+// fails.
+func verifyWebAuthnAssertion(user, challenge string, as *webAuthnAssertion) error {
+	if challenge == "" {
+		return errors.New("no security key challenge, request login options first")
+	}
+	return modifyUser(user, func(u *UserConfig) error {
+		var cred *WebAuthnCredential
+		for i := range u.WebAuthn {
+			if u.WebAuthn[i].ID == strings.TrimRight(as.ID, "=") {
+				cred = &u.WebAuthn[i]
+			}
+		}
+		if cred == nil {
+			return errors.New("unknown security key")
+		}
+		clientData, err := decodeB64URL(as.Response.ClientDataJSON)
+		if err != nil {
+			return err
+		}
+		clientHash, err := checkClientData(clientData, "webauthn.get", challenge, cred.RPID)
+		if err != nil {
+			return err
+		}
+		raw, err := decodeB64URL(as.Response.AuthenticatorData)
+		if err != nil {
+			return err
+		}
+		ad, err := parseAuthenticatorData(raw)
+		if err != nil {
+			return err
+		}
+		rpHash := sha256.Sum256([]byte(cred.RPID))
+		if string(ad.rpIDHash) != string(rpHash[:]) {
+			return errors.New("relying party id hash mismatch")
+		}
+		if ad.flags&authDataUserPresent == 0 {
+			return errors.New("user not present")
+		}
+		sig, err := decodeB64URL(as.Response.Signature)
+		if err != nil {
+			return err
+		}
+		coseKey, err := decodeB64URL(cred.PublicKey)
+		if err != nil {
+			return err
+		}
+		err = verifyCOSESignature(coseKey, append(raw, clientHash...), sig)
+		if err != nil {
+			return err
+		}
+		// a counter that does not grow points to a cloned key
+		if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+			return fmt.Errorf("security key %s sign count went back, possibly cloned", cred.Name)
+		}
+		cred.SignCount = ad.signCount
+		cred.LastUsed = time.Now().Unix()
+		return nil
+	})
+}
+
+// HandleWebAuthnRegister registers security keys of the logged in user
+//
+// GET /api/v1/2fa/webauthn/register
+//
+//	returns PublicKeyCredentialCreationOptions for navigator.credentials.create,
+//	binary fields base64url encoded
+//
+// POST /api/v1/2fa/webauthn/register
+//
+//	Example parameter: {"name": "yubikey", "id": "AbC...",
+//	                    "response": {"clientDataJSON": "eyJ...", "attestationObject": "o2N..."}}
+//	Example return: {"id": "AbC...", "name": "yubikey", "recoveryCodes": ["4f2a1-9be07", ...]}
+//
+//	recovery codes are returned when the key turns on 2fa
+func HandleWebAuthnRegister(w http.ResponseWriter, r *http.Request) {
+	self := userFromContext(r.Context())
+	if self == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "GET" {
+		opts, err := beginWebAuthnRegistration(self, webAuthnRPID(r))
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		err = json.NewEncoder(w).Encode(opts)
+		if err != nil {
+			q.Q(err)
+		}
+		return
+	}
+	var att webAuthnAttestation
+	err := json.NewDecoder(r.Body).Decode(&att)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	setAuditDetail(r, "register security key %s of user %s", att.Name, self.Name)
+	cred, err := finishWebAuthnRegistration(self.Name, &att)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	var codes []string
+	err = modifyUser(self.Name, func(u *UserConfig) error {
+		if len(u.RecoveryCodes) == 0 {
+			var hashes []string
+			var err error
+			codes, hashes, err = generateRecoveryCodes()
+			if err != nil {
+				return err
+			}
+			u.RecoveryCodes = hashes
+		}
+		u.WebAuthn = append(u.WebAuthn, *cred)
+		u.Enable2FA = true
+		return nil
+	})
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	res := map[string]any{"id": cred.ID, "name": cred.Name}
+	if codes != nil {
+		res["recoveryCodes"] = codes
+	}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleWebAuthnCredentials lists and removes security keys. Users
+// manage their own keys, users with users:write permission those of
+// all users.
+//
+// GET /api/v1/2fa/webauthn?user=[user]
+//
+//	Example return: [{"id": "AbC...", "name": "yubikey", "rpID": "mnms.example.com",
+//	                  "signCount": 12, "created": 1686000000, "lastUsed": 1686000600}]
+//
+// DELETE /api/v1/2fa/webauthn
+//
+//	Example parameter: {"user": "user1", "id": "AbC..."}
+func HandleWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	self := userFromContext(r.Context())
+	if self == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		User string `json:"user"`
+		ID   string `json:"id"`
+	}
+	body.User = r.URL.Query().Get("user")
+	if r.Method == "DELETE" {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+		defer r.Body.Close()
+	}
+	if body.User == "" {
+		body.User = self.Name
+	}
+	if !checkManageUser(w, r, body.User) {
+		return
+	}
+	if r.Method == "DELETE" {
+		setAuditDetail(r, "remove security key %s of user %s", body.ID, body.User)
+		err := modifyUser(body.User, func(u *UserConfig) error {
+			for i, c := range u.WebAuthn {
+				if c.ID == body.ID {
+					u.WebAuthn = append(u.WebAuthn[:i], u.WebAuthn[i+1:]...)
+					disable2FAIfNoFactor(u)
+					return nil
+				}
+			}
+			return fmt.Errorf("security key %s not exist", body.ID)
+		})
+		if err != nil {
+			RespondWithError(w, err)
+			return
+		}
+	}
+	u, err := GetUserConfig(body.User)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	creds := u.WebAuthn
+	if creds == nil {
+		creds = []WebAuthnCredential{}
+	}
+	err = json.NewEncoder(w).Encode(creds)
+	if err != nil {
+		q.Q(err)
+	}
+}
+
+// HandleWebAuthnLogin returns the security key challenge of a login
+//
+// POST /api/v1/2fa/webauthn/login
+//
+//	Example parameter: {"sessionID": "9c1e...d2"}
+//	returns PublicKeyCredentialRequestOptions for navigator.credentials.get
+func HandleWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SessionID string `json:"sessionID"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	defer r.Body.Close()
+	opts, err := beginWebAuthnLogin(body.SessionID, webAuthnRPID(r))
+	if err != nil {
+		RespondWithError(w, err)
+		return
+	}
+	err = json.NewEncoder(w).Encode(opts)
+	if err != nil {
+		q.Q(err)
+	}
+}
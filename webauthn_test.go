@@ -0,0 +1,283 @@
+package mnms
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// cborEncode encodes the values used by authenticators.
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		b := head(5, uint64(len(v)))
+		for k, e := range v {
+			b = append(b, cborEncode(k)...)
+			b = append(b, cborEncode(e)...)
+		}
+		return b
+	}
+	panic("cbor: unsupported type")
+}
+
+// testAuthenticator is a software security key.
+type testAuthenticator struct {
+	key   *ecdsa.PrivateKey
+	id    []byte
+	count uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{key: key, id: []byte("test-credential-1")}
+}
+
+func (a *testAuthenticator) authData(rpID string, attested bool) []byte {
+	rpHash := sha256.Sum256([]byte(rpID))
+	b := append([]byte{}, rpHash[:]...)
+	flags := byte(authDataUserPresent)
+	if attested {
+		flags |= authDataAttestedData
+	}
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.count)
+	if attested {
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.id)>>8), byte(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, cborEncode(map[any]any{
+			1: 2, 3: coseAlgES256, -1: 1,
+			-2: a.key.X.FillBytes(make([]byte, 32)),
+			-3: a.key.Y.FillBytes(make([]byte, 32)),
+		})...)
+	}
+	return b
+}
+
+func clientDataJSON(typ, challenge, origin string) string {
+	b, _ := json.Marshal(webAuthnClientData{Type: typ, Challenge: challenge, Origin: origin})
+	return b64url.EncodeToString(b)
+}
+
+func (a *testAuthenticator) create(rpID, challenge, origin string) webAuthnAttestation {
+	var att webAuthnAttestation
+	att.ID = b64url.EncodeToString(a.id)
+	att.Name = "test key"
+	att.Response.ClientDataJSON = clientDataJSON("webauthn.create", challenge, origin)
+	att.Response.AttestationObject = b64url.EncodeToString(cborEncode(map[any]any{
+		"fmt": "none", "attStmt": map[any]any{}, "authData": a.authData(rpID, true),
+	}))
+	return att
+}
+
+func (a *testAuthenticator) get(t *testing.T, rpID, challenge, origin string) *webAuthnAssertion {
+	a.count++
+	var as webAuthnAssertion
+	as.ID = b64url.EncodeToString(a.id)
+	as.Response.ClientDataJSON = clientDataJSON("webauthn.get", challenge, origin)
+	authData := a.authData(rpID, false)
+	cd, _ := decodeB64URL(as.Response.ClientDataJSON)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.Response.AuthenticatorData = b64url.EncodeToString(authData)
+	as.Response.Signature = b64url.EncodeToString(sig)
+	return &as
+}
+
+// TestCBORDecode tests decoding and rejecting truncated input
+func TestCBORDecode(t *testing.T) {
+	b := cborEncode(map[any]any{"a": []byte{1, 2}, -3: 500, 1: "x"})
+	v, n, err := cborDecode(b, 0)
+	if err != nil || n != len(b) {
+		t.Fatal(err, n)
+	}
+	m := v.(map[interface{}]interface{})
+	if m[int64(-3)] != int64(500) || m[int64(1)] != "x" || string(m["a"].([]byte)) != "\x01\x02" {
+		t.Fatal("unexpected decode", m)
+	}
+	for i := 0; i < len(b); i++ {
+		if _, _, err = cborDecode(b[:i], 0); err == nil {
+			t.Fatal("expect truncated input to fail at", i)
+		}
+	}
+}
+
+// TestWebAuthn tests registering a security key and logging in with it
+func TestWebAuthn(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	cleanSessions(t)
+	defer cleanSessions(t)
+
+	const rpID, origin = "mnms.example.com", "https://mnms.example.com"
+	err = AddUserConfig("op1", MNMSUserRole, "Op1Pass#2023", "op1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := GetToken("op1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// webRPID is the host name the web UI is opened by
+	webRPID := rpID
+	register := jwtauth.Verifier(jwtTokenAuth)(requirePermission("")(http.HandlerFunc(HandleWebAuthnRegister)))
+	call := func(h http.Handler, method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/2fa/webauthn/register", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Origin", "https://"+webRPID)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := call(register, "GET", "")
+	var opts struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &opts)
+	if err != nil || opts.RP.ID != rpID {
+		t.Fatal("expect creation options", rec.Body.String(), err)
+	}
+	key := newTestAuthenticator(t)
+	att, _ := json.Marshal(key.create(rpID, opts.Challenge, origin))
+	rec = call(register, "POST", string(att))
+	var reg struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &reg)
+	if err != nil || len(reg.RecoveryCodes) != recoveryCodeCount {
+		t.Fatal("expect registration with recovery codes", rec.Code, rec.Body.String())
+	}
+	u, err := GetUserConfig("op1")
+	if err != nil || !u.Enable2FA || len(u.WebAuthn) != 1 {
+		t.Fatal("expect 2fa with a security key", u, err)
+	}
+
+	begin := func() (string, string) {
+		sessionID, err := createLoginSession(*u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/2fa/webauthn/login",
+			strings.NewReader(`{"sessionID":"`+sessionID+`"}`))
+		req.Header.Set("Origin", "https://"+webRPID)
+		rec := httptest.NewRecorder()
+		HandleWebAuthnLogin(rec, req)
+		var opts struct {
+			Challenge        string `json:"challenge"`
+			RPID             string `json:"rpId"`
+			AllowCredentials []struct {
+				ID string `json:"id"`
+			} `json:"allowCredentials"`
+		}
+		err = json.Unmarshal(rec.Body.Bytes(), &opts)
+		if err != nil || opts.RPID != webRPID || len(opts.AllowCredentials) != 1 {
+			t.Fatal("expect request options", rec.Body.String(), err)
+		}
+		return sessionID, opts.Challenge
+	}
+	validate := func(sessionID string, as *webAuthnAssertion) int {
+		body, _ := json.Marshal(map[string]any{"sessionID": sessionID, "assertion": as})
+		rec := httptest.NewRecorder()
+		HandleValidate2FA(rec, httptest.NewRequest("POST", "/api/v1/2fa/validate", strings.NewReader(string(body))))
+		return rec.Code
+	}
+	login := func(as func(challenge string) *webAuthnAssertion) int {
+		sessionID, challenge := begin()
+		return validate(sessionID, as(challenge))
+	}
+	if code := login(func(c string) *webAuthnAssertion { return key.get(t, rpID, c, origin) }); code != http.StatusOK {
+		t.Fatal("expect security key login, got", code)
+	}
+	if code := login(func(c string) *webAuthnAssertion { return key.get(t, rpID, c, "https://evil.example.org") }); code != http.StatusUnauthorized {
+		t.Fatal("expect foreign origin to fail, got", code)
+	}
+	if code := login(func(c string) *webAuthnAssertion { return key.get(t, rpID, "wrong", origin) }); code != http.StatusUnauthorized {
+		t.Fatal("expect wrong challenge to fail, got", code)
+	}
+	// an assertion sent twice at the same time is accepted once
+	sessionID, challenge := begin()
+	as := key.get(t, rpID, challenge, origin)
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			codes <- validate(sessionID, as)
+		}()
+	}
+	if c1, c2 := <-codes, <-codes; c1+c2 != http.StatusOK+http.StatusUnauthorized {
+		t.Fatal("expect one login with the assertion, got", c1, c2)
+	}
+	key.count = 0
+	if code := login(func(c string) *webAuthnAssertion { return key.get(t, rpID, c, origin) }); code != http.StatusUnauthorized {
+		t.Fatal("expect sign count going back to fail, got", code)
+	}
+	other := newTestAuthenticator(t)
+	if code := login(func(c string) *webAuthnAssertion { return other.get(t, rpID, c, origin) }); code != http.StatusUnauthorized {
+		t.Fatal("expect key with another private key to fail, got", code)
+	}
+
+	// a key registered by another host name of the web UI logs in there
+	const rpID2, origin2 = "nms.example.org", "https://nms.example.org"
+	webRPID = rpID2
+	rec = call(register, "GET", "")
+	err = json.Unmarshal(rec.Body.Bytes(), &opts)
+	if err != nil || opts.RP.ID != rpID2 {
+		t.Fatal("expect creation options", rec.Body.String(), err)
+	}
+	att, _ = json.Marshal(other.create(rpID2, opts.Challenge, origin2))
+	if rec = call(register, "POST", string(att)); rec.Code != http.StatusOK {
+		t.Fatal("expect second key registered, got", rec.Code, rec.Body.String())
+	}
+	u, err = GetUserConfig("op1")
+	if err != nil || len(u.WebAuthn) != 2 {
+		t.Fatal("expect two security keys", u, err)
+	}
+	if code := login(func(c string) *webAuthnAssertion { return other.get(t, rpID2, c, origin2) }); code != http.StatusOK {
+		t.Fatal("expect login with the key of the second host name, got", code)
+	}
+}
@@ -1,68 +1,398 @@
 package mnms
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/qeof/q"
 )
 
+/*
+	The websocket hub publishes events to browser clients by topic.
+
+	A client authenticates with its JWT, as token query parameter or
+	Authorization header, and manages subscriptions by sending
+	WebSocketRequest messages, e.g.
+
+		{"action": "subscribe", "topic": "devices", "filter": {"macs": ["00-60-E9-18-3C-3C"]}}
+		{"action": "unsubscribe", "topic": "devices"}
+
+	New connections are subscribed to syslog messages of severity
+	notice and above.
+
+	The commands topic needs commands:read permission, passwords in
+	the commands are replaced by ***.
+
+	Each connection has its own buffered writer. When the buffer of a
+	slow client is full messages to it are dropped, or the connection is
+	closed when it was opened with slow=disconnect.
+*/
+
+const (
+	WebSocketTopicSyslog   = "syslog"
+	WebSocketTopicTraps    = "traps"
+	WebSocketTopicDevices  = "devices"
+	WebSocketTopicCommands = "commands"
+	WebSocketTopicTopology = "topology"
+	WebSocketTopicFirmware = "firmware"
+	WebSocketTopicMqtt     = "mqtt"
+	WebSocketTopicOpcua    = "opcua"
+)
+
+// webSocketTopicPerms are the permissions needed to subscribe to topics
+// beyond being logged in.
+var webSocketTopicPerms = map[string]string{
+	WebSocketTopicCommands: PermCommandsRead,
+}
+
+var webSocketTopics = []string{WebSocketTopicSyslog, WebSocketTopicTraps, WebSocketTopicDevices,
+	WebSocketTopicCommands, WebSocketTopicTopology, WebSocketTopicFirmware, WebSocketTopicMqtt, WebSocketTopicOpcua}
+
+const (
+	wsSendBuffer   = 256
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = wsPongTimeout * 9 / 10
+	wsMaxRequest   = 4096
+)
+
 type WebSocketMessage struct {
 	Kind    string `json:"kind"`
 	Level   int    `json:"level"`
 	Message string `json:"message"`
+	Topic   string `json:"topic,omitempty"`
+	Mac     string `json:"mac,omitempty"`
+	Data    any    `json:"data,omitempty"`
 }
 
+// WebSocketFilter selects the messages of a subscribed topic a client
+// receives. Empty fields do not filter.
+type WebSocketFilter struct {
+	Level *int     `json:"level,omitempty"` // highest severity number
+	Macs  []string `json:"macs,omitempty"`
+	Kinds []string `json:"kinds,omitempty"`
+	Match string   `json:"match,omitempty"` // regular expression on message
+	re    *regexp.Regexp
+}
+
+// WebSocketRequest is sent by websocket clients to manage subscriptions.
+type WebSocketRequest struct {
+	Action string          `json:"action"` // subscribe or unsubscribe
+	Topic  string          `json:"topic"`
+	Filter WebSocketFilter `json:"filter"`
+}
+
+type wsClient struct {
+	conn           *websocket.Conn
+	user           string
+	key            *APIKey // api key the client logged in with, if any
+	send           chan []byte
+	done           chan struct{}
+	closeOnce      sync.Once
+	disconnectSlow bool
+	mutex          sync.Mutex
+	subs           map[string]*WebSocketFilter
+	dropped        int
+}
+
+type wsHub struct {
+	sync.Mutex
+	clients map[*wsClient]bool
+}
+
+var webSocketHub = &wsHub{clients: make(map[*wsClient]bool)}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
-func WebSocketStartWriteMessage() {
+func (f *WebSocketFilter) compile() error {
+	if f.Match == "" {
+		f.re = nil
+		return nil
+	}
+	re, err := regexp.Compile(f.Match)
+	if err != nil {
+		return err
+	}
+	f.re = re
+	return nil
+}
 
-	for message := range QC.WebSocketMessageBroadcast {
-		q.Q("got msg from WebSocketMessageBroadcast", len(QC.WebSocketClient))
-		for client := range QC.WebSocketClient {
-			if err := client.WriteJSON(message); err != nil {
-				q.Q("error: websocket", err)
-				continue
+func (f *WebSocketFilter) accept(msg *WebSocketMessage) bool {
+	if f.Level != nil && msg.Level > *f.Level {
+		return false
+	}
+	if len(f.Macs) > 0 && !containsFold(f.Macs, msg.Mac) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !containsFold(f.Kinds, msg.Kind) {
+		return false
+	}
+	if f.re != nil && !f.re.MatchString(msg.Message) {
+		return false
+	}
+	return true
+}
+
+func (c *wsClient) wants(msg *WebSocketMessage) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	f, ok := c.subs[msg.Topic]
+	return ok && f.accept(msg)
+}
+
+// enqueue hands b to the writer of c without blocking the publisher.
+func (c *wsClient) enqueue(b []byte) {
+	select {
+	case c.send <- b:
+	default:
+		if c.disconnectSlow {
+			q.Q("websocket slow client disconnected", c.user)
+			c.close()
+			return
+		}
+		c.mutex.Lock()
+		c.dropped++
+		c.mutex.Unlock()
+	}
+}
+
+func (c *wsClient) reply(kind, topic, message string) {
+	b, err := json.Marshal(WebSocketMessage{Kind: kind, Topic: topic, Message: message})
+	if err != nil {
+		q.Q(err)
+		return
+	}
+	c.enqueue(b)
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) subscribe(req WebSocketRequest) error {
+	found := false
+	for _, t := range webSocketTopics {
+		if t == req.Topic {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("invalid topic %v", req.Topic)
+	}
+	if perm, ok := webSocketTopicPerms[req.Topic]; ok && !c.allows(perm) {
+		return fmt.Errorf("topic %v needs %v permission", req.Topic, perm)
+	}
+	filter := req.Filter
+	err := filter.compile()
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.subs[req.Topic] = &filter
+	c.mutex.Unlock()
+	return nil
+}
+
+// allows reports whether the user of c, and its api key, have perm.
+func (c *wsClient) allows(perm string) bool {
+	u, err := GetUserConfig(c.user)
+	if err != nil {
+		return false
+	}
+	role, err := GetRole(u.Role)
+	if err != nil || !role.Allows(perm) {
+		return false
+	}
+	return c.key == nil || c.key.Allows(perm)
+}
+
+func (c *wsClient) unsubscribe(topic string) {
+	c.mutex.Lock()
+	delete(c.subs, topic)
+	c.mutex.Unlock()
+}
+
+func (h *wsHub) add(c *wsClient) {
+	h.Lock()
+	h.clients[c] = true
+	h.Unlock()
+}
+
+func (h *wsHub) remove(c *wsClient) {
+	h.Lock()
+	delete(h.clients, c)
+	h.Unlock()
+}
+
+// PublishWebSocketMessage sends msg to the websocket clients subscribed
+// to its topic, syslog when the topic is empty. It never blocks.
+func PublishWebSocketMessage(msg WebSocketMessage) {
+	if msg.Topic == "" {
+		msg.Topic = WebSocketTopicSyslog
+	}
+	webSocketHub.Lock()
+	clients := make([]*wsClient, 0, len(webSocketHub.clients))
+	for c := range webSocketHub.clients {
+		clients = append(clients, c)
+	}
+	webSocketHub.Unlock()
+	var b []byte
+	for _, c := range clients {
+		if !c.wants(&msg) {
+			continue
+		}
+		if b == nil {
+			var err error
+			b, err = json.Marshal(msg)
+			if err != nil {
+				q.Q(err)
+				return
 			}
-			q.Q("websocket write to client", message)
 		}
+		c.enqueue(b)
 	}
 }
 
+// WebSocketStartWriteMessage publishes messages sent to
+// QC.WebSocketMessageBroadcast.
+func WebSocketStartWriteMessage() {
+	for message := range QC.WebSocketMessageBroadcast {
+		PublishWebSocketMessage(message)
+	}
+}
+
+// webSocketUser verifies the JWT or api key of a websocket request and
+// returns the user name it was issued to and the api key.
+func webSocketUser(r *http.Request) (string, *APIKey, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return "", nil, fmt.Errorf("no token")
+	}
+	if strings.HasPrefix(token, APIKeyPrefix) {
+		u, key, err := authenticateAPIKey(token)
+		if err != nil {
+			return "", nil, err
+		}
+		return u.Name, key, nil
+	}
+	t, err := JWTVerifyToken(jwtTokenAuth, token)
+	if err != nil {
+		return "", nil, err
+	}
+	err = checkTokenSession(t)
+	if err != nil {
+		return "", nil, err
+	}
+	user, _ := t.Get("user")
+	name, _ := user.(string)
+	return name, nil, nil
+}
+
+// WsEndpoint serves the websocket event bus
+//
+// GET /api/v1/ws?token=[jwt]&slow=[drop|disconnect]
 func WsEndpoint(w http.ResponseWriter, r *http.Request) {
+	user, key, err := webSocketUser(r)
+	if err != nil {
+		q.Q(err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		q.Q(err)
+		return
+	}
+	level := LOG_NOTICE
+	c := &wsClient{
+		conn:           ws,
+		user:           user,
+		key:            key,
+		send:           make(chan []byte, wsSendBuffer),
+		done:           make(chan struct{}),
+		disconnectSlow: r.URL.Query().Get("slow") == "disconnect",
+		subs:           map[string]*WebSocketFilter{WebSocketTopicSyslog: {Level: &level}},
 	}
-	QC.WebSocketClient[ws] = true
-	q.Q("Client Connected")
+	webSocketHub.add(c)
+	q.Q("Client Connected", user)
 	defer func() {
-		delete(QC.WebSocketClient, ws)
-		ws.Close()
-		q.Q("Closed!")
+		webSocketHub.remove(c)
+		c.close()
+		q.Q("Closed!", user)
 	}()
-	webSocketReader(ws)
+	go webSocketWriter(c)
+	webSocketReader(c)
 }
 
-func webSocketReader(conn *websocket.Conn) {
+func webSocketWriter(c *wsClient) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
 	for {
-		var message WebSocketMessage
-		err := conn.ReadJSON(&message)
-		if !errors.Is(err, nil) {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err := c.conn.WriteMessage(websocket.TextMessage, b)
+			if err != nil {
+				q.Q("error: websocket", err)
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				q.Q("error: websocket ping", err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func webSocketReader(c *wsClient) {
+	c.conn.SetReadLimit(wsMaxRequest)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	for {
+		var req WebSocketRequest
+		err := c.conn.ReadJSON(&req)
+		if err != nil {
 			q.Q("error occurred: ", err)
-			err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("error: ReadJSON %v", err)))
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		switch req.Action {
+		case "subscribe":
+			err = c.subscribe(req)
 			if err != nil {
-				q.Q("error while sending error message to ws client", err)
+				c.reply("error", req.Topic, err.Error())
+				continue
 			}
-			delete(QC.WebSocketClient, conn)
-			break
+			c.reply("subscribed", req.Topic, "")
+		case "unsubscribe":
+			c.unsubscribe(req.Topic)
+			c.reply("unsubscribed", req.Topic, "")
+		default:
+			q.Q(req)
 		}
-		q.Q(message)
 	}
 }
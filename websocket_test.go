@@ -0,0 +1,158 @@
+package mnms
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWebSocket(t *testing.T, url string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+}
+
+func readWebSocketMessage(t *testing.T, conn *websocket.Conn) WebSocketMessage {
+	t.Helper()
+	var msg WebSocketMessage
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	err := conn.ReadJSON(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// TestWebSocketHub tests authentication, subscriptions and filters
+func TestWebSocketHub(t *testing.T) {
+	_ = cleanMNMSConfig()
+	err := InitDefaultMNMSConfigIfNotExist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cleanMNMSConfig()
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(WsEndpoint))
+	defer srv.Close()
+
+	_, resp, err := dialWebSocket(t, srv.URL+"?token=bogus")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("expect unauthorized without a valid token", err)
+	}
+
+	token, err := GetToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := dialWebSocket(t, srv.URL+"?token="+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(WebSocketRequest{Action: "subscribe", Topic: "nosuchtopic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWebSocketMessage(t, conn); msg.Kind != "error" {
+		t.Fatal("expect error for invalid topic", msg)
+	}
+	err = conn.WriteJSON(WebSocketRequest{
+		Action: "subscribe",
+		Topic:  WebSocketTopicDevices,
+		Filter: WebSocketFilter{Macs: []string{"00-60-e9-00-00-02"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := readWebSocketMessage(t, conn); msg.Kind != "subscribed" {
+		t.Fatal("expect subscribed", msg)
+	}
+
+	publishDevice("new", DevInfo{Mac: "00-60-E9-00-00-01"})
+	SendSocketMessage(LOG_INFO, "<134>Feb 22 08:00:00 switch1 portd: filtered by default level")
+	publishDevice("new", DevInfo{Mac: "00-60-E9-00-00-02"})
+	SendSocketMessage(LOG_ERR, "<131>Feb 22 08:00:00 switch1 portd: port 1 link down")
+
+	msg := readWebSocketMessage(t, conn)
+	if msg.Topic != WebSocketTopicDevices || msg.Mac != "00-60-E9-00-00-02" {
+		t.Fatal("expect filtered device message", msg)
+	}
+	msg = readWebSocketMessage(t, conn)
+	if msg.Kind != "mnms_syslog" || !strings.Contains(msg.Message, "link down") {
+		t.Fatal("expect syslog message", msg)
+	}
+
+	// commands are sent without passwords
+	err = conn.WriteJSON(WebSocketRequest{Action: "subscribe", Topic: WebSocketTopicCommands})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg = readWebSocketMessage(t, conn); msg.Kind != "subscribed" {
+		t.Fatal("expect subscribed", msg)
+	}
+	const secret = "switch 00-60-E9-00-00-02 admin default show ip"
+	publishCmd(secret, CmdInfo{Command: secret, Status: "ok"})
+	msg = readWebSocketMessage(t, conn)
+	if msg.Topic != WebSocketTopicCommands || msg.Message != "switch 00-60-E9-00-00-02 admin *** show ip" ||
+		strings.Contains(fmt.Sprint(msg.Data), "default") {
+		t.Fatal("expect redacted command", msg)
+	}
+
+	// the commands topic needs commands:read
+	err = AddServiceAccount("wsviewer", MNMSAdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secretKey, err := CreateAPIKey("wsviewer", "devices", []string{PermDevicesRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, _, err := dialWebSocket(t, srv.URL+"?token="+secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	err = viewer.WriteJSON(WebSocketRequest{Action: "subscribe", Topic: WebSocketTopicCommands})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg = readWebSocketMessage(t, viewer); msg.Kind != "error" {
+		t.Fatal("expect commands refused to a key without commands:read", msg)
+	}
+}
+
+// TestWebSocketSlowClient tests dropping and disconnecting slow clients
+func TestWebSocketSlowClient(t *testing.T) {
+	c := &wsClient{send: make(chan []byte, 1), done: make(chan struct{})}
+	c.enqueue([]byte("1"))
+	c.enqueue([]byte("2"))
+	if c.dropped != 1 {
+		t.Fatal("expect one dropped message, got", c.dropped)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := &wsClient{conn: conn, send: make(chan []byte), done: make(chan struct{}), disconnectSlow: true}
+		c.enqueue([]byte("{}"))
+		select {
+		case <-c.done:
+		default:
+			t.Error("expect slow client to be disconnected")
+		}
+	}))
+	defer srv.Close()
+	conn, _, err := dialWebSocket(t, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}